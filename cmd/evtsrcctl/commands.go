@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/rs/zerolog/log"
+)
+
+// run executes a single command against the opened database.
+func run(command string, args []string, conn *sql.DB) error {
+	switch command {
+	case "rotate-key":
+		return rotateKey(conn)
+	case "reencrypt":
+		return reencrypt(conn)
+	case "compress":
+		return compress(conn)
+	case "train-dictionary":
+		if len(args) != 1 {
+			return fmt.Errorf("train-dictionary needs the aggregate type")
+		}
+		return trainDictionary(conn, args[0])
+	case "backup":
+		if len(args) != 1 {
+			return fmt.Errorf("backup needs the target directory")
+		}
+		return backup(conn, args[0])
+	case "export":
+		return export(conn, args)
+	case "import":
+		return importEvents(conn, args)
+	case "create-api-key":
+		return createAPIKey(conn, args)
+	case "revoke-api-key":
+		if len(args) != 1 {
+			return fmt.Errorf("revoke-api-key needs the id of the key")
+		}
+		return revokeAPIKey(conn, args[0])
+	case "verify":
+		if len(args) > 1 {
+			return fmt.Errorf("verify takes at most one aggregate id")
+		}
+		return verify(conn, args)
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+// runOnFiles executes a command that works on the files of the store without opening it.
+func runOnFiles(command string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%s needs the backup directory", command)
+	}
+	switch command {
+	case "validate":
+		return validate(args[0])
+	case "restore":
+		return restore(args[0])
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+func rotateKey(conn *sql.DB) error {
+	master, err := store.LoadMasterKeys()
+	if err != nil {
+		return err
+	}
+	err = store.RotateDataKey(conn, master)
+	if err != nil {
+		return err
+	}
+	log.Info().Msg("Rotated data key")
+	return nil
+}
+
+func reencrypt(conn *sql.DB) error {
+	master, err := store.LoadMasterKeys()
+	if err != nil {
+		return err
+	}
+	count, err := store.ReencryptEvents(conn, master)
+	if err != nil {
+		return err
+	}
+	log.Info().Int64("events", count).Msg("Re-encrypted events")
+	return nil
+}
+
+func compress(conn *sql.DB) error {
+	master, err := store.LoadMasterKeys()
+	if err != nil {
+		return err
+	}
+	count, err := store.CompressEvents(conn, master)
+	if err != nil {
+		return err
+	}
+	log.Info().Int64("events", count).Msg("Compressed events")
+	return nil
+}
+
+func trainDictionary(conn *sql.DB, aggregateType string) error {
+	repository := store.NewEventRepository(conn)
+	if repository == nil {
+		return fmt.Errorf("unsuccessfull initalization of event repository")
+	}
+	defer repository.Close()
+	err := repository.TrainCompressionDictionary(aggregateType)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("aggregateType", aggregateType).Msg("Trained compression dictionary")
+	return nil
+}
+
+func backup(conn *sql.DB, target string) error {
+	backup, err := store.Backup(conn, target)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("path", backup.Path).Int64("size", backup.SizeBytes).Int("segments", backup.Segments).Msg("Backed up store")
+	return nil
+}
+
+func validate(path string) error {
+	master, err := store.LoadMasterKeys()
+	if err != nil {
+		return err
+	}
+	err = store.ValidateBackup(path, master)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("path", path).Msg("Backup is valid")
+	return nil
+}
+
+func restore(path string) error {
+	master, err := store.LoadMasterKeys()
+	if err != nil {
+		return err
+	}
+	err = store.Restore(path, master)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("path", path).Msg("Restored backup, the replaced files are kept with the suffix .pre-restore")
+	return nil
+}
+
+func export(conn *sql.DB, args []string) error {
+	var filter models.ExportFilter
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.StringVar(&filter.AggregateId, "aggregate-id", "", "only export the events of this aggregate")
+	flags.StringVar(&filter.AggregateType, "aggregate-type", "", "only export the events of this aggregate type")
+	flags.StringVar(&filter.After, "after", "", "only export the events after the event with this id")
+	flags.StringVar(&filter.Until, "until", "", "only export the events up to and including the event with this id")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("export takes at most one file")
+	}
+	out := io.Writer(os.Stdout)
+	if flags.NArg() == 1 {
+		file, err := os.Create(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	repository := store.NewEventRepository(conn)
+	if repository == nil {
+		return fmt.Errorf("unsuccessfull initalization of event repository")
+	}
+	defer repository.Close()
+	count, err := repository.ExportEvents(filter, out)
+	if err != nil {
+		return err
+	}
+	log.Info().Int64("events", count).Msg("Exported events")
+	return nil
+}
+
+func importEvents(conn *sql.DB, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("import takes at most one file")
+	}
+	in := io.Reader(os.Stdin)
+	if len(args) == 1 && args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	repository := store.NewEventRepository(conn)
+	if repository == nil {
+		return fmt.Errorf("unsuccessfull initalization of event repository")
+	}
+	defer repository.Close()
+	count, err := repository.ImportEvents(in)
+	if err != nil {
+		return err
+	}
+	log.Info().Int64("events", count).Msg("Imported events")
+	return nil
+}
+
+// verifyPageSize is the number of aggregates listed at once when verifying all of them.
+const verifyPageSize = 100
+
+func verify(conn *sql.DB, args []string) error {
+	repository := store.NewEventRepository(conn)
+	if repository == nil {
+		return fmt.Errorf("unsuccessfull initalization of event repository")
+	}
+	defer repository.Close()
+	aggregateIds := args
+	broken := 0
+	verified := 0
+	after := ""
+	for {
+		if len(args) == 0 {
+			aggregates, err := repository.ListAggregates("", after, verifyPageSize)
+			if err != nil {
+				return err
+			}
+			aggregateIds = aggregateIds[:0]
+			for _, aggregate := range aggregates {
+				aggregateIds = append(aggregateIds, aggregate.Id)
+			}
+		}
+		for _, aggregateId := range aggregateIds {
+			verification, err := repository.VerifyAggregate(aggregateId)
+			if err != nil {
+				return err
+			}
+			verified++
+			if !verification.Valid {
+				broken++
+				link := verification.BrokenLink
+				log.Error().Str("aggregateId", aggregateId).Str("eventId", link.EventId).Int64("version", link.Version).Msg("Broken hash chain: " + link.Reason)
+			}
+		}
+		if len(args) > 0 || len(aggregateIds) < verifyPageSize {
+			break
+		}
+		after = aggregateIds[len(aggregateIds)-1]
+	}
+	if broken > 0 {
+		return fmt.Errorf("%d of %d aggregates have a broken hash chain", broken, verified)
+	}
+	log.Info().Int("aggregates", verified).Msg("Verified hash chains")
+	return nil
+}
+
+func createAPIKey(conn *sql.DB, args []string) error {
+	flags := flag.NewFlagSet("create-api-key", flag.ContinueOnError)
+	roles := flags.String("roles", "", "comma separated roles of the key")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("create-api-key needs the subject of the key")
+	}
+	var keyRoles []string
+	if len(*roles) > 0 {
+		keyRoles = strings.Split(*roles, ",")
+	}
+	issued, err := store.NewAPIKeys(conn).CreateKey(flags.Arg(0), keyRoles)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("id", issued.Id).Str("subject", issued.Subject).Msg("Created API key")
+	// the key is printed on its own so it can be captured, it cannot be shown again
+	fmt.Println(issued.Key)
+	return nil
+}
+
+func revokeAPIKey(conn *sql.DB, id string) error {
+	_, err := store.NewAPIKeys(conn).RevokeKey(id)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("id", id).Msg("Revoked API key")
+	return nil
+}
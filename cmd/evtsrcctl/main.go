@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const usage = `Usage: evtsrcctl [-db path] <command>
+
+Offline maintenance of the event store. The server must not run while a command
+is executed, except for backup and the API key commands.
+
+Commands:
+  rotate-key   rewrap the data keys with the current master key and start using a new data key
+  reencrypt    rotate the data key and re-encrypt all events with it
+  compress     compress the data of all events that are not compressed yet
+  train-dictionary <aggregateType>
+               train the compression dictionary of an aggregate type on its recent events
+  backup <dir> write a consistent backup of the database and segment files to a new directory
+  validate <dir>
+               check that a backup can be restored with the configured master keys
+  restore <dir>
+               validate a backup and replace the database and segment files with it
+  export [-aggregate-id id] [-aggregate-type type] [-after eventId] [-until eventId] [file]
+               write events as newline-delimited JSON to a file or stdout
+  import [file]
+               append the events of an export read from a file or stdin
+  verify [aggregateId]
+               walk the hash chain of an aggregate, or of every aggregate, and report broken links
+  create-api-key [-roles role,...] <subject>
+               create an API key for the HTTP API and print it; it is not shown again.
+               The admin role may do everything, other roles only what access rules grant
+  revoke-api-key <id>
+               revoke an API key
+`
+
+func main() {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	dbFile := flag.String("db", store.GetDbFileLocation(), "location of the database file")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	store.SetDbFileLocation(*dbFile)
+	// restoring replaces the database file, so it must not be opened before
+	if flag.Arg(0) == "restore" || flag.Arg(0) == "validate" {
+		err := runOnFiles(flag.Arg(0), flag.Args()[1:])
+		if err != nil {
+			log.Error().Err(err).Msg("Command failed")
+			os.Exit(1)
+		}
+		return
+	}
+	db := store.DatabaseConnection{}
+	db.SetUp()
+	conn, err := db.GetDbConnection()
+	if err != nil {
+		log.Error().Err(err).Msg("Unsuccessfull initalization of db")
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	err = run(flag.Arg(0), flag.Args()[1:], conn)
+	if err != nil {
+		log.Error().Err(err).Msg("Command failed")
+		os.Exit(1)
+	}
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"os"
+	"time"
 
+	"github.com/L4B0MB4/EVTSRC/pkg/auth"
+	"github.com/L4B0MB4/EVTSRC/pkg/grpcserver"
 	"github.com/L4B0MB4/EVTSRC/pkg/httphandler"
 	"github.com/L4B0MB4/EVTSRC/pkg/httphandler/controller"
 	"github.com/L4B0MB4/EVTSRC/pkg/store"
 	"github.com/L4B0MB4/EVTSRC/pkg/tcp/server"
+	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
 )
 
 func main() {
@@ -22,6 +27,20 @@ func main() {
 	}
 	log.Debug().Msg("Db Connection was successful")
 	repository := store.NewEventRepository(conn)
+	if repository == nil {
+		log.Error().Msg("Unsuccessfull initalization of event repository")
+		return
+	}
+	defer repository.Close()
+	repository.StartRetention(store.RetentionInterval)
+	if archiveAfter := os.Getenv(store.ArchiveAfterEnv); len(archiveAfter) > 0 {
+		olderThan, err := time.ParseDuration(archiveAfter)
+		if err != nil {
+			log.Error().Err(err).Msg("Invalid archive age")
+			return
+		}
+		repository.StartArchiving(store.ArchiveInterval, olderThan)
+	}
 
 	tcpServer, err := server.NewTcpEventServer()
 	if err != nil {
@@ -30,8 +49,31 @@ func main() {
 	}
 	go tcpServer.Start()
 
+	authenticators, err := auth.FromEnv(repository.APIKeys())
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid authentication settings")
+		return
+	}
+	middleware := []gin.HandlerFunc{}
+	grpcOptions := []grpc.ServerOption{}
+	if authenticators != nil {
+		middleware = append(middleware, auth.Middleware(authenticators...))
+		grpcOptions = append(grpcOptions,
+			grpc.UnaryInterceptor(auth.UnaryInterceptor(authenticators...)),
+			grpc.StreamInterceptor(auth.StreamInterceptor(authenticators...)))
+	} else {
+		log.Warn().Msg("Authentication is disabled, every client reaching the HTTP or gRPC API has full access")
+	}
+
+	grpcServer := grpcserver.NewEventStoreServer(repository, tcpServer, grpcOptions...)
+	go grpcServer.Start()
+	defer grpcServer.Stop()
+
 	c := controller.NewEventController(repository, tcpServer)
-	h := httphandler.NewHttpHandler(c)
+	a := controller.NewAggregateController(repository)
+	s := controller.NewSchemaController(repository.Schemas())
+	ad := controller.NewAdminController(repository)
+	h := httphandler.NewHttpHandler(c, a, s, ad, middleware...)
 
 	h.Start()
 }
@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+)
+
+// APIKeyHeader carries the API key of a request.
+const APIKeyHeader = "X-Api-Key"
+
+// APIKeyAuthenticator authenticates requests with the API keys of the store.
+type APIKeyAuthenticator struct {
+	keys *store.APIKeys
+}
+
+// NewAPIKeyAuthenticator creates a new APIKeyAuthenticator.
+func NewAPIKeyAuthenticator(keys *store.APIKeys) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{keys: keys}
+}
+
+// Authenticate authenticates the key in the APIKeyHeader header.
+func (a *APIKeyAuthenticator) Authenticate(header http.Header) (*models.Principal, error) {
+	key := strings.TrimSpace(header.Get(APIKeyHeader))
+	if len(key) == 0 {
+		return nil, nil
+	}
+	return a.keys.Authenticate(key)
+}
@@ -0,0 +1,98 @@
+// Package auth authenticates the requests of the HTTP and gRPC APIs.
+// Authenticators turn the credentials of a request into a models.Principal;
+// Middleware and the interceptors reject requests none of them accepts.
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// RequiredEnv set to true makes the server require authentication on every route.
+	RequiredEnv = "EVTSRC_AUTH_REQUIRED"
+	// JWTKeySetFileEnv names a JSON Web Key Set file whose keys bearer tokens are
+	// verified with. Without it only API keys are accepted.
+	JWTKeySetFileEnv = "EVTSRC_JWT_KEY_SET_FILE"
+	// JWTIssuerEnv and JWTAudienceEnv, if set, have to match the iss and aud claims of bearer tokens.
+	JWTIssuerEnv   = "EVTSRC_JWT_ISSUER"
+	JWTAudienceEnv = "EVTSRC_JWT_AUDIENCE"
+)
+
+// principalKey is the key of the principal in the gin context.
+const principalKey = "evtsrc.principal"
+
+// Authenticator authenticates the credentials in the headers of a request.
+type Authenticator interface {
+	// Authenticate returns the principal of the credentials in the header, nil if
+	// the header carries no credentials the authenticator handles, or an
+	// UnauthenticatedError if the credentials are not valid.
+	Authenticate(header http.Header) (*models.Principal, error)
+}
+
+// Middleware authenticates every request with the first authenticator that finds
+// credentials in it and stores the principal for PrincipalFrom. Requests without
+// valid credentials are rejected with 401.
+func Middleware(authenticators ...Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, authenticator := range authenticators {
+			principal, err := authenticator.Authenticate(c.Request.Header)
+			if err != nil {
+				var unauthenticated *customerrors.UnauthenticatedError
+				if !errors.As(err, &unauthenticated) {
+					c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+					return
+				}
+				c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials", "reason": unauthenticated.Reason})
+				return
+			}
+			if principal != nil {
+				c.Set(principalKey, principal)
+				c.Next()
+				return
+			}
+		}
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+	}
+}
+
+// PrincipalFrom returns the principal a request was authenticated as, nil if
+// the request passed no authentication middleware.
+func PrincipalFrom(c *gin.Context) *models.Principal {
+	value, ok := c.Get(principalKey)
+	if !ok {
+		return nil
+	}
+	principal, _ := value.(*models.Principal)
+	return principal
+}
+
+// FromEnv returns the authenticators configured by RequiredEnv and the JWT
+// settings, accepting the API keys of the store and, if a key set is configured,
+// bearer tokens. It returns nil if authentication is not required.
+func FromEnv(apiKeys *store.APIKeys) ([]Authenticator, error) {
+	required, _ := strconv.ParseBool(os.Getenv(RequiredEnv))
+	if !required {
+		return nil, nil
+	}
+	authenticators := []Authenticator{NewAPIKeyAuthenticator(apiKeys)}
+	if path := os.Getenv(JWTKeySetFileEnv); len(path) > 0 {
+		keys, err := LoadKeySet(path)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, NewJWTAuthenticator(keys, os.Getenv(JWTIssuerEnv), os.Getenv(JWTAudienceEnv)))
+		log.Debug().Int("keys", keys.Len()).Msg("Accepting bearer tokens")
+	}
+	return authenticators, nil
+}
@@ -0,0 +1,179 @@
+package auth_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/auth"
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// staticAuthenticator accepts a single header value.
+type staticAuthenticator struct {
+	value string
+}
+
+func (s staticAuthenticator) Authenticate(header http.Header) (*models.Principal, error) {
+	value := header.Get("X-Test")
+	if len(value) == 0 {
+		return nil, nil
+	}
+	if value != s.value {
+		return nil, &customerrors.UnauthenticatedError{Reason: "wrong value"}
+	}
+	return &models.Principal{Subject: value, Method: "test"}, nil
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(auth.Middleware(staticAuthenticator{"a"}, staticAuthenticator{"b"}))
+	router.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, auth.PrincipalFrom(c).Subject)
+	})
+	request := func(value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if len(value) > 0 {
+			req.Header.Set("X-Test", value)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	resp := request("a")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "a", resp.Body.String())
+	// the first authenticator finding credentials decides
+	resp = request("b")
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Contains(t, resp.Body.String(), "wrong value")
+	resp = request("")
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Equal(t, "Bearer", resp.Header().Get("WWW-Authenticate"))
+}
+
+func TestUnaryInterceptor(t *testing.T) {
+	interceptor := auth.UnaryInterceptor(staticAuthenticator{"a"})
+	call := func(md metadata.MD) (any, error) {
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		return interceptor(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req any) (any, error) {
+			return auth.PrincipalFromContext(ctx).Subject, nil
+		})
+	}
+
+	subject, err := call(metadata.Pairs("x-test", "a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", subject)
+	_, err = call(metadata.Pairs("x-test", "b"))
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Contains(t, err.Error(), "wrong value")
+	_, err = call(metadata.MD{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Nil(t, auth.PrincipalFromContext(context.Background()))
+}
+
+func bearer(token string) http.Header {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	return header
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	encode := base64.RawURLEncoding.EncodeToString
+	keySet, err := auth.ParseKeySet([]byte(fmt.Sprintf(`{"keys":[
+		{"kty":"RSA","kid":"rsa","alg":"RS256","n":"%s","e":"%s"},
+		{"kty":"EC","kid":"ec","crv":"P-256","x":"%s","y":"%s"},
+		{"kty":"oct","kid":"hmac","k":"%s"},
+		{"kty":"RSA","kid":"encryption","use":"enc","n":"%s","e":"%s"}
+	]}`, encode(rsaKey.N.Bytes()), encode([]byte{1, 0, 1}), encode(ecKey.X.Bytes()), encode(ecKey.Y.Bytes()), encode(secret), encode(rsaKey.N.Bytes()), encode([]byte{1, 0, 1}))))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, keySet.Len())
+	authenticator := auth.NewJWTAuthenticator(keySet, "idp", "evtsrc")
+
+	sign := func(method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return signed
+	}
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{"sub": "billing", "iss": "idp", "aud": "evtsrc", "exp": time.Now().Add(time.Hour).Unix(), "roles": []string{"billing-writer"}}
+	}
+
+	principal, err := authenticator.Authenticate(bearer(sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims())))
+	assert.NoError(t, err)
+	assert.Equal(t, &models.Principal{Subject: "billing", Method: "jwt", Roles: []string{"billing-writer"}}, principal)
+	_, err = authenticator.Authenticate(bearer(sign(jwt.SigningMethodES256, "ec", ecKey, claims())))
+	assert.NoError(t, err)
+	_, err = authenticator.Authenticate(bearer(sign(jwt.SigningMethodHS256, "hmac", secret, claims())))
+	assert.NoError(t, err)
+
+	principal, err = authenticator.Authenticate(http.Header{})
+	assert.NoError(t, err)
+	assert.Nil(t, principal)
+
+	rejected := map[string]string{
+		"garbage":          "not-a-token",
+		"unknown kid":      sign(jwt.SigningMethodHS256, "other", secret, claims()),
+		"alg of key":       sign(jwt.SigningMethodRS512, "rsa", rsaKey, claims()),
+		"hmac with rsa":    sign(jwt.SigningMethodHS256, "rsa", rsaKey.N.Bytes(), claims()),
+		"encryption key":   sign(jwt.SigningMethodRS256, "encryption", rsaKey, claims()),
+		"no kid ambiguity": sign(jwt.SigningMethodHS256, "", secret, claims()),
+	}
+	for _, modify := range []struct {
+		name  string
+		claim string
+		value any
+	}{{"expired", "exp", time.Now().Add(-time.Hour).Unix()}, {"issuer", "iss", "other"}, {"audience", "aud", "other"}, {"subject", "sub", ""}} {
+		modified := claims()
+		modified[modify.claim] = modify.value
+		rejected[modify.name] = sign(jwt.SigningMethodHS256, "hmac", secret, modified)
+	}
+	withoutExpiry := claims()
+	delete(withoutExpiry, "exp")
+	rejected["no expiry"] = sign(jwt.SigningMethodHS256, "hmac", secret, withoutExpiry)
+	for name, token := range rejected {
+		_, err = authenticator.Authenticate(bearer(token))
+		assert.IsType(t, &customerrors.UnauthenticatedError{}, err, name)
+	}
+}
+
+func TestParseKeySetRejectsInvalidKeys(t *testing.T) {
+	for _, keySet := range []string{
+		`not json`,
+		`{"keys":[]}`,
+		`{"keys":[{"kty":"oct","k":"c2hvcnQ"}]}`,
+		`{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`,
+		`{"keys":[{"kty":"OKP","crv":"X25519","x":"AQ"}]}`,
+		`{"keys":[{"kty":"oct","alg":"RS256","k":"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY"}]}`,
+		`{"keys":[{"kty":"oct","k":"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY"},{"kty":"oct","k":"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY"}]}`,
+		`{"keys":[{"kty":"unknown"}]}`,
+	} {
+		_, err := auth.ParseKeySet([]byte(keySet))
+		assert.Error(t, err, keySet)
+	}
+}
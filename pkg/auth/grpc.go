@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// principalContextKey is the key of the principal in the context of a gRPC call.
+type principalContextKey struct{}
+
+// UnaryInterceptor authenticates every unary gRPC call like Middleware does HTTP
+// requests. The credentials are read from the metadata of the call, which carries
+// the same headers, e.g. x-api-key or authorization. Calls without valid
+// credentials fail with codes.Unauthenticated.
+func UnaryInterceptor(authenticators ...Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := authenticateCall(ctx, authenticators)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor authenticates every streaming gRPC call, see UnaryInterceptor.
+func StreamInterceptor(authenticators ...Authenticator) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticateCall(stream.Context(), authenticators)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// authenticatedStream is a server stream whose context holds the principal.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticateCall returns the context of a call with the principal of its credentials.
+func authenticateCall(ctx context.Context, authenticators []Authenticator) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := http.Header{}
+	for key, values := range md {
+		header[http.CanonicalHeaderKey(key)] = values
+	}
+	for _, authenticator := range authenticators {
+		principal, err := authenticator.Authenticate(header)
+		if err != nil {
+			var unauthenticated *customerrors.UnauthenticatedError
+			if !errors.As(err, &unauthenticated) {
+				return nil, status.Error(codes.Internal, "unkown error occured")
+			}
+			return nil, status.Error(codes.Unauthenticated, "invalid credentials: "+unauthenticated.Reason)
+		}
+		if principal != nil {
+			return context.WithValue(ctx, principalContextKey{}, principal), nil
+		}
+	}
+	return nil, status.Error(codes.Unauthenticated, "authentication required")
+}
+
+// PrincipalFromContext returns the principal a gRPC call was authenticated as,
+// nil if the call passed no authentication interceptor.
+func PrincipalFromContext(ctx context.Context) *models.Principal {
+	principal, _ := ctx.Value(principalContextKey{}).(*models.Principal)
+	return principal
+}
@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtLeeway is the clock skew tolerated when checking the time claims of a token.
+const jwtLeeway = 30 * time.Second
+
+// KeySet holds the public keys, and HMAC secrets, bearer tokens are verified with.
+type KeySet struct {
+	keys map[string]verificationKey
+}
+
+// verificationKey is a key of a KeySet with the algorithms it may verify.
+type verificationKey struct {
+	key        any
+	algorithms []string
+}
+
+// jsonWebKey holds the members of a JSON Web Key used by the supported key types.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// LoadKeySet reads a JSON Web Key Set file, see ParseKeySet.
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read key set: %w", err)
+	}
+	return ParseKeySet(data)
+}
+
+// ParseKeySet parses a JSON Web Key Set with RSA, EC (P-256, P-384, P-521),
+// Ed25519 and symmetric keys. Keys for another use than signatures are skipped.
+func ParseKeySet(data []byte) (*KeySet, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("key set is not valid JSON: %w", err)
+	}
+	keys := &KeySet{keys: map[string]verificationKey{}}
+	for i, jwk := range set.Keys {
+		if len(jwk.Use) > 0 && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.verificationKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d of the key set: %w", i, err)
+		}
+		if _, ok := keys.keys[jwk.Kid]; ok {
+			return nil, fmt.Errorf("key id %q is used twice in the key set", jwk.Kid)
+		}
+		keys.keys[jwk.Kid] = key
+	}
+	if len(keys.keys) == 0 {
+		return nil, errors.New("key set has no signature keys")
+	}
+	return keys, nil
+}
+
+// Len returns the number of keys in the set.
+func (k *KeySet) Len() int {
+	return len(k.keys)
+}
+
+func (jwk jsonWebKey) verificationKey() (verificationKey, error) {
+	var key verificationKey
+	switch jwk.Kty {
+	case "RSA":
+		n, errN := decodeBigInt(jwk.N)
+		e, errE := decodeBigInt(jwk.E)
+		if errN != nil || errE != nil || !e.IsInt64() {
+			return key, errors.New("invalid RSA key")
+		}
+		key.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		key.algorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+	case "EC":
+		curves := map[string]struct {
+			curve     elliptic.Curve
+			algorithm string
+		}{"P-256": {elliptic.P256(), "ES256"}, "P-384": {elliptic.P384(), "ES384"}, "P-521": {elliptic.P521(), "ES512"}}
+		curve, ok := curves[jwk.Crv]
+		x, errX := decodeBigInt(jwk.X)
+		y, errY := decodeBigInt(jwk.Y)
+		if !ok || errX != nil || errY != nil || !curve.curve.IsOnCurve(x, y) {
+			return key, errors.New("invalid EC key")
+		}
+		key.key = &ecdsa.PublicKey{Curve: curve.curve, X: x, Y: y}
+		key.algorithms = []string{curve.algorithm}
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if jwk.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return key, errors.New("invalid Ed25519 key")
+		}
+		key.key = ed25519.PublicKey(x)
+		key.algorithms = []string{"EdDSA"}
+	case "oct":
+		k, err := base64.RawURLEncoding.DecodeString(jwk.K)
+		if err != nil || len(k) < 32 {
+			return key, errors.New("symmetric key has to have at least 32 bytes")
+		}
+		key.key = k
+		key.algorithms = []string{"HS256", "HS384", "HS512"}
+	default:
+		return key, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+	if len(jwk.Alg) > 0 {
+		if !slices.Contains(key.algorithms, jwk.Alg) {
+			return key, fmt.Errorf("algorithm %s does not fit the key type", jwk.Alg)
+		}
+		key.algorithms = []string{jwk.Alg}
+	}
+	return key, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid number")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// lookup returns the key for the kid header of a token. A token without kid is
+// accepted if the set has a single key.
+func (k *KeySet) lookup(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok && len(kid) == 0 && len(k.keys) == 1 {
+		for _, key = range k.keys {
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, errors.New("token is signed with an unknown key")
+	}
+	if !slices.Contains(key.algorithms, token.Method.Alg()) {
+		return nil, errors.New("token algorithm does not fit the key")
+	}
+	return key.key, nil
+}
+
+// JWTAuthenticator authenticates bearer tokens signed with a key of a KeySet.
+// Tokens have to carry exp and sub claims; the roles claim lists the roles of
+// the caller.
+type JWTAuthenticator struct {
+	keys    *KeySet
+	options []jwt.ParserOption
+}
+
+// jwtClaims are the claims read from bearer tokens.
+type jwtClaims struct {
+	jwt.RegisteredClaims
+	Roles []string `json:"roles,omitempty"`
+}
+
+// NewJWTAuthenticator creates a new JWTAuthenticator. Empty issuer and audience
+// are not checked.
+func NewJWTAuthenticator(keys *KeySet, issuer string, audience string) *JWTAuthenticator {
+	algorithms := []string{}
+	for _, key := range keys.keys {
+		algorithms = append(algorithms, key.algorithms...)
+	}
+	options := []jwt.ParserOption{jwt.WithValidMethods(algorithms), jwt.WithExpirationRequired(), jwt.WithLeeway(jwtLeeway)}
+	if len(issuer) > 0 {
+		options = append(options, jwt.WithIssuer(issuer))
+	}
+	if len(audience) > 0 {
+		options = append(options, jwt.WithAudience(audience))
+	}
+	return &JWTAuthenticator{keys: keys, options: options}
+}
+
+// Authenticate authenticates the bearer token in the Authorization header.
+func (a *JWTAuthenticator) Authenticate(header http.Header) (*models.Principal, error) {
+	scheme, token, found := strings.Cut(header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return nil, nil
+	}
+	var claims jwtClaims
+	_, err := jwt.ParseWithClaims(strings.TrimSpace(token), &claims, a.keys.lookup, a.options...)
+	if err != nil {
+		return nil, &customerrors.UnauthenticatedError{Reason: err.Error()}
+	}
+	if len(claims.Subject) == 0 {
+		return nil, &customerrors.UnauthenticatedError{Reason: "token has no subject"}
+	}
+	return &models.Principal{Subject: claims.Subject, Method: "jwt", Roles: claims.Roles}, nil
+}
@@ -2,21 +2,36 @@ package client
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"slices"
+	"strconv"
+	"time"
 
+	"github.com/L4B0MB4/EVTSRC/pkg/codec"
 	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/upcaster"
 	"github.com/rs/zerolog/log"
 )
 
+// errNotFound is returned by getJSON if the server responds with 404.
+var errNotFound = errors.New("not found")
+
 // EventSourcingHttpClient is a client for interacting with the event sourcing HTTP API.
 type EventSourcingHttpClient struct {
 	httpClient *http.Client
 	url        string
+	upcasters  *upcaster.Registry
+	encoding   string
+	// signingKeyId and signingKey sign the appended events if set, see SignWith
+	signingKeyId string
+	signingKey   ed25519.PrivateKey
 }
 
 // stripOldEvents filters out old events from a list of change-tracked events.
@@ -26,11 +41,18 @@ func stripOldEvents(events []models.ChangeTrackedEvent) []models.Event {
 
 		if e.IsNew {
 			ev := models.Event{
+				Id:            e.Id,
 				Version:       e.Version,
 				Name:          e.Name,
 				Data:          e.Data,
 				AggregateId:   e.AggregateId,
 				AggregateType: e.AggregateType,
+				Tags:          e.Tags,
+				SchemaVersion: e.SchemaVersion,
+				ContentType:   e.ContentType,
+				Subject:       e.Subject,
+				SigningKeyId:  e.SigningKeyId,
+				Signature:     e.Signature,
 			}
 			newEvents = append(newEvents, ev)
 
@@ -48,13 +70,124 @@ func NewEventSourcingHttpClient(urlStr string) (*EventSourcingHttpClient, error)
 	}
 	baseUrl := fmt.Sprintf("%s://%s", path.Scheme, path.Host)
 
-	httpClient := http.Client{}
+	httpClient := http.Client{Transport: &credentialTransport{base: http.DefaultTransport}}
 	return &EventSourcingHttpClient{
 		httpClient: &httpClient,
 		url:        baseUrl,
+		upcasters:  upcaster.NewRegistry(),
+		encoding:   codec.JSON,
 	}, nil
 }
 
+// UseEncoding selects the media type events are sent and received in:
+// codec.JSON, codec.Protobuf or codec.MessagePack.
+func (client *EventSourcingHttpClient) UseEncoding(mediaType string) error {
+	encoding, ok := codec.MediaType(mediaType)
+	if !ok {
+		return fmt.Errorf("unsupported encoding %s", mediaType)
+	}
+	client.encoding = encoding
+	return nil
+}
+
+// UseAPIKey makes the client authenticate every request with an API key created
+// by the store.
+func (client *EventSourcingHttpClient) UseAPIKey(key string) {
+	client.useCredentials(func(req *http.Request) error {
+		req.Header.Set("X-Api-Key", key)
+		return nil
+	})
+}
+
+// UseBearerToken makes the client authenticate every request with a fixed JWT.
+func (client *EventSourcingHttpClient) UseBearerToken(token string) {
+	client.UseTokenSource(func() (string, error) {
+		return token, nil
+	})
+}
+
+// UseTokenSource makes the client authenticate every request with a JWT returned
+// by source, which is called before each request and may refresh the token.
+func (client *EventSourcingHttpClient) UseTokenSource(source func() (string, error)) {
+	client.useCredentials(func(req *http.Request) error {
+		token, err := source()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	})
+}
+
+func (client *EventSourcingHttpClient) useCredentials(apply func(req *http.Request) error) {
+	transport, ok := client.httpClient.Transport.(*credentialTransport)
+	if !ok {
+		transport = &credentialTransport{base: client.httpClient.Transport}
+		client.httpClient.Transport = transport
+	}
+	transport.apply = apply
+}
+
+// credentialTransport adds the credentials of the client to every request.
+type credentialTransport struct {
+	base  http.RoundTripper
+	apply func(req *http.Request) error
+}
+
+func (t *credentialTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t.apply == nil {
+		return base.RoundTrip(req)
+	}
+	// a RoundTripper must not modify the request it was given
+	authenticated := req.Clone(req.Context())
+	err := t.apply(authenticated)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		log.Info().Err(err).Msg("could not get credentials")
+		return nil, err
+	}
+	resp, err := base.RoundTrip(authenticated)
+	if err == nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		log.Info().Int("status", resp.StatusCode).Msg("request was not authorized")
+	}
+	return resp, err
+}
+
+// SignWith makes the client sign every appended event that is not signed yet
+// with the private key of the registered producer key keyId.
+func (client *EventSourcingHttpClient) SignWith(keyId string, key ed25519.PrivateKey) {
+	client.signingKeyId = keyId
+	client.signingKey = key
+}
+
+// sign returns the events for a given aggregate ID, signed if the client has a signing key.
+func (client *EventSourcingHttpClient) sign(aggregateId string, events []models.Event) []models.Event {
+	if client.signingKey == nil {
+		return events
+	}
+	signed := make([]models.Event, len(events))
+	for i, event := range events {
+		if len(event.Signature) == 0 {
+			event.AggregateId = aggregateId
+			event.Sign(client.signingKeyId, client.signingKey)
+		}
+		signed[i] = event
+	}
+	return signed
+}
+
+// Upcasters returns the registry applied to all events read by the client.
+// Upcasting happens in clients only, the server returns events as stored.
+func (client *EventSourcingHttpClient) Upcasters() *upcaster.Registry {
+	return client.upcasters
+}
+
 // AddEvents adds events to a given aggregate ID with validation.
 func (client *EventSourcingHttpClient) AddEvents(aggregateId string, events []models.ChangeTrackedEvent) error {
 	if len(aggregateId) <= 0 {
@@ -76,9 +209,24 @@ func (client *EventSourcingHttpClient) AddEvents(aggregateId string, events []mo
 
 // AddEventsWithoutValidation adds events to a given aggregate ID without validation.
 func (client *EventSourcingHttpClient) AddEventsWithoutValidation(aggregateId string, events []models.ChangeTrackedEvent) error {
+	return client.postEvents(aggregateId, events, "")
+}
+
+// AddEventsWithIdempotencyKey adds events to a given aggregate ID without validation.
+// Retrying with the same key and events after a failed or timed out request is
+// safe: a batch that was already committed is not added a second time.
+func (client *EventSourcingHttpClient) AddEventsWithIdempotencyKey(aggregateId string, idempotencyKey string, events []models.ChangeTrackedEvent) error {
+	if len(idempotencyKey) == 0 {
+		return fmt.Errorf("idempotencyKey empty")
+	}
+	return client.postEvents(aggregateId, events, idempotencyKey)
+}
 
-	newEvents := stripOldEvents(events)
-	bodyBytes, err := json.Marshal(newEvents)
+// postEvents sends the new events to a given aggregate ID.
+func (client *EventSourcingHttpClient) postEvents(aggregateId string, events []models.ChangeTrackedEvent, idempotencyKey string) error {
+
+	newEvents := client.sign(aggregateId, stripOldEvents(events))
+	bodyBytes, err := codec.Marshal(client.encoding, newEvents)
 	if err != nil {
 		log.Info().Err(err).Msg("could not marshal events")
 		return err
@@ -89,48 +237,160 @@ func (client *EventSourcingHttpClient) AddEventsWithoutValidation(aggregateId st
 		log.Info().Err(err).Msg("could not use url")
 		return err
 	}
+	req, err := http.NewRequest(http.MethodPost, addEventsUrl, buf)
+	if err != nil {
+		log.Info().Err(err).Msg("could not create request")
+		return err
+	}
+	req.Header.Set("Content-Type", client.encoding)
+	if len(idempotencyKey) > 0 {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
 
-	resp, err := client.httpClient.Post(addEventsUrl, "application/json", buf)
+	resp, err := client.httpClient.Do(req)
 
 	if err != nil {
 		log.Info().Err(err).Msg("error during the request")
 		return err
 	}
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		log.Info().Err(err).Msg("got non 2XX header")
-		return fmt.Errorf("unsuccessful request")
-	}
-	return nil
+	defer resp.Body.Close()
+	return errorFromResponse(resp)
 }
 
-// GetEventsOrdered retrieves events for a given aggregate ID in order.
-func (client *EventSourcingHttpClient) GetEventsOrdered(aggregateId string) (*EventsIterator, error) {
+// AppendTransaction adds events to several aggregates at once. Either all events
+// are added or, if any aggregate is not at its expected version, none of them.
+func (client *EventSourcingHttpClient) AppendTransaction(appends []models.StreamAppend) error {
+	return client.AppendTransactionIf(appends, nil)
+}
 
-	getEventsUrl, err := url.JoinPath(client.url, fmt.Sprintf("/aggregates/%s/events", aggregateId))
+// AppendTransactionIf works like AppendTransaction, but additionally fails with an
+// AppendConditionFailedError if events matching the condition were written after
+// the condition's position.
+func (client *EventSourcingHttpClient) AppendTransactionIf(appends []models.StreamAppend, condition *models.AppendCondition) error {
+	if len(appends) == 0 {
+		return fmt.Errorf("appends empty")
+	}
+	for _, streamAppend := range appends {
+		if len(streamAppend.AggregateId) == 0 {
+			return fmt.Errorf("aggregateId empty")
+		}
+	}
+	signed := make([]models.StreamAppend, len(appends))
+	for i, streamAppend := range appends {
+		streamAppend.Events = client.sign(streamAppend.AggregateId, streamAppend.Events)
+		signed[i] = streamAppend
+	}
+	bodyBytes, err := codec.Marshal(client.encoding, models.AppendTransaction{Appends: signed, Condition: condition})
+	if err != nil {
+		log.Info().Err(err).Msg("could not marshal transaction")
+		return err
+	}
+	transactionUrl, err := url.JoinPath(client.url, "/transactions")
 	if err != nil {
 		log.Info().Err(err).Msg("could not use url")
-		return nil, err
+		return err
 	}
 
-	resp, err := client.httpClient.Get(getEventsUrl)
+	resp, err := client.httpClient.Post(transactionUrl, client.encoding, bytes.NewBuffer(bodyBytes))
 	if err != nil {
 		log.Info().Err(err).Msg("error during the request")
-		return nil, err
+		return err
 	}
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		log.Info().Err(err).Msg("got non 2XX header")
-		return nil, fmt.Errorf("unsuccessful request")
+	defer resp.Body.Close()
+	return errorFromResponse(resp)
+}
+
+// errorFromResponse turns the response of an append into the error it reports,
+// nil if the append succeeded.
+func errorFromResponse(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return readConflict(resp)
+	case resp.StatusCode == http.StatusUnprocessableEntity:
+		return readUnprocessable(resp)
+	case resp.StatusCode == http.StatusGone:
+		return readDeleted(resp)
+	case resp.StatusCode == http.StatusForbidden:
+		return &customerrors.AccessDeniedError{}
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		log.Info().Msg("got non 2XX header")
+		return fmt.Errorf("unsuccessful request")
+	}
+	return nil
+}
+
+// readConflict turns a 409 response into a WrongExpectedVersionError, an
+// AppendConditionFailedError, a SubjectKeyDestroyedError or an EventIdConflictError.
+func readConflict(resp *http.Response) error {
+	var body struct {
+		AggregateId     string `json:"aggregateId"`
+		ExpectedVersion *int64 `json:"expectedVersion"`
+		CurrentVersion  *int64 `json:"currentVersion"`
+		ConditionFailed bool   `json:"conditionFailed"`
+		Subject         string `json:"subject"`
+	}
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil || json.Unmarshal(buf, &body) != nil {
+		return &customerrors.EventIdConflictError{}
+	}
+	if body.ConditionFailed {
+		return &customerrors.AppendConditionFailedError{}
+	}
+	if len(body.Subject) > 0 {
+		return &customerrors.SubjectKeyDestroyedError{Subject: body.Subject}
+	}
+	if body.ExpectedVersion != nil && body.CurrentVersion != nil {
+		return &customerrors.WrongExpectedVersionError{
+			AggregateId:     body.AggregateId,
+			ExpectedVersion: *body.ExpectedVersion,
+			CurrentVersion:  *body.CurrentVersion,
+		}
+	}
+	return &customerrors.EventIdConflictError{}
+}
+
+// readUnprocessable turns a 422 response into an InvalidSignatureError or a SchemaValidationError.
+func readUnprocessable(resp *http.Response) error {
+	var body struct {
+		Violations   []models.SchemaViolation `json:"violations"`
+		EventIndex   int                      `json:"eventIndex"`
+		SigningKeyId string                   `json:"signingKeyId"`
+		Reason       string                   `json:"reason"`
+	}
+	buf, err := io.ReadAll(resp.Body)
+	if err == nil {
+		json.Unmarshal(buf, &body)
+	}
+	if len(body.Reason) > 0 {
+		return &customerrors.InvalidSignatureError{EventIndex: body.EventIndex, SigningKeyId: body.SigningKeyId, Reason: body.Reason}
+	}
+	return &customerrors.SchemaValidationError{Violations: body.Violations}
+}
+
+// readDeleted turns a 410 response into an AggregateDeletedError.
+func readDeleted(resp *http.Response) error {
+	var body struct {
+		AggregateId string              `json:"aggregateId"`
+		Deleted     models.DeletionMode `json:"deleted"`
 	}
-	var events []models.Event
 	buf, err := io.ReadAll(resp.Body)
+	if err == nil {
+		json.Unmarshal(buf, &body)
+	}
+	return &customerrors.AggregateDeletedError{AggregateId: body.AggregateId, Mode: body.Deleted}
+}
+
+// GetEventsOrdered retrieves events for a given aggregate ID in order.
+func (client *EventSourcingHttpClient) GetEventsOrdered(aggregateId string) (*EventsIterator, error) {
+
+	getEventsUrl, err := url.JoinPath(client.url, fmt.Sprintf("/aggregates/%s/events", aggregateId))
 	if err != nil {
-		log.Info().Err(err).Msg("error during reading response body")
+		log.Info().Err(err).Msg("could not use url")
 		return nil, err
 	}
-	err = json.Unmarshal(buf, &events)
 
+	events, err := client.getEvents(getEventsUrl)
 	if err != nil {
-		log.Info().Err(err).Msg("error during unmarshalling body")
 		return nil, err
 	}
 
@@ -148,7 +408,9 @@ func (client *EventSourcingHttpClient) GetEventsOrdered(aggregateId string) (*Ev
 	return eventsIterator, nil
 }
 
-// GetEventsSince retrieves events since a given event ID with a limit.
+// GetEventsSince retrieves events since a given event ID with a limit. Removed
+// events stay valid cursors. It returns an EventNotFoundError if the event never
+// existed.
 func (client *EventSourcingHttpClient) GetEventsSince(eventId string, limit int) ([]models.Event, error) {
 	if len(eventId) == 0 {
 		eventId = "0"
@@ -170,27 +432,1136 @@ func (client *EventSourcingHttpClient) GetEventsSince(eventId string, limit int)
 	query.Set("limit", fmt.Sprintf("%d", limit))
 	getEventsSinceUrl = fmt.Sprintf("%s?%s", getEventsSinceUrl, query.Encode())
 
-	resp, err := client.httpClient.Get(getEventsSinceUrl)
+	return client.getEvents(getEventsSinceUrl)
+}
+
+// GetEventsBackward retrieves the newest events of a given aggregate ID, newest first.
+func (client *EventSourcingHttpClient) GetEventsBackward(aggregateId string, limit int) ([]models.Event, error) {
+	if len(aggregateId) <= 0 {
+		return nil, fmt.Errorf("aggregateId empty")
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid limit value")
+	}
+	getEventsUrl, err := url.JoinPath(client.url, "/aggregates", url.PathEscape(aggregateId), "events")
 	if err != nil {
-		log.Info().Err(err).Msg("error during the request")
+		log.Info().Err(err).Msg("could not use url")
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("direction", string(models.Backward))
+	query.Set("limit", fmt.Sprintf("%d", limit))
+	getEventsUrl = fmt.Sprintf("%s?%s", getEventsUrl, query.Encode())
+
+	return client.getEvents(getEventsUrl)
+}
+
+// GetEventsBefore retrieves events written before a given event ID, newest first,
+// with a limit. An empty event ID reads from the newest event of the store.
+func (client *EventSourcingHttpClient) GetEventsBefore(eventId string, limit int) ([]models.Event, error) {
+	if len(eventId) == 0 {
+		eventId = "0"
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid limit value")
+	}
+	if limit > 100 {
+		limit = 100
+	}
+	getEventsBeforeUrl, err := url.JoinPath(client.url, "/events", url.PathEscape(eventId), "before")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
 		return nil, err
 	}
+	query := url.Values{}
+	query.Set("limit", fmt.Sprintf("%d", limit))
+	getEventsBeforeUrl = fmt.Sprintf("%s?%s", getEventsBeforeUrl, query.Encode())
+
+	return client.getEvents(getEventsBeforeUrl)
+}
+
+// ListAggregates retrieves up to limit aggregates ordered by id, starting after afterId.
+// An empty aggregateType lists aggregates of all types.
+func (client *EventSourcingHttpClient) ListAggregates(aggregateType string, afterId string, limit int) ([]models.AggregateSummary, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid limit value")
+	}
+	if limit > 100 {
+		limit = 100
+	}
+	listAggregatesUrl, err := url.JoinPath(client.url, "/aggregates")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("limit", fmt.Sprintf("%d", limit))
+	if len(aggregateType) > 0 {
+		query.Set("type", aggregateType)
+	}
+	if len(afterId) > 0 {
+		query.Set("after", afterId)
+	}
+	listAggregatesUrl = fmt.Sprintf("%s?%s", listAggregatesUrl, query.Encode())
+
+	var aggregates []models.AggregateSummary
+	err = client.getJSON(listAggregatesUrl, &aggregates)
+	if err != nil {
+		return nil, err
+	}
+	return aggregates, nil
+}
+
+// GetAggregate retrieves the summary of a given aggregate ID.
+// It returns an AggregateNotFoundError if the aggregate does not exist.
+func (client *EventSourcingHttpClient) GetAggregate(aggregateId string) (*models.AggregateSummary, error) {
+	if len(aggregateId) <= 0 {
+		return nil, fmt.Errorf("aggregateId empty")
+	}
+	getAggregateUrl, err := url.JoinPath(client.url, "/aggregates", url.PathEscape(aggregateId))
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return nil, err
+	}
+	var aggregate models.AggregateSummary
+	err = client.getJSON(getAggregateUrl, &aggregate)
+	if errors.Is(err, errNotFound) {
+		return nil, &customerrors.AggregateNotFoundError{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &aggregate, nil
+}
+
+// VerifyAggregate lets the store walk the hash chain of a given aggregate ID. A
+// broken chain is reported by the result, not as an error.
+func (client *EventSourcingHttpClient) VerifyAggregate(aggregateId string) (*models.ChainVerification, error) {
+	if len(aggregateId) <= 0 {
+		return nil, fmt.Errorf("aggregateId empty")
+	}
+	verifyUrl, err := url.JoinPath(client.url, "/aggregates", url.PathEscape(aggregateId), "verify")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return nil, err
+	}
+	var verification models.ChainVerification
+	err = client.getJSON(verifyUrl, &verification)
+	if errors.Is(err, errNotFound) {
+		return nil, &customerrors.AggregateNotFoundError{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &verification, nil
+}
+
+// GetCurrentVersion retrieves the current version of a given aggregate ID without
+// transferring its events. It returns 0 if the aggregate does not exist yet and an
+// AggregateDeletedError if it was deleted.
+func (client *EventSourcingHttpClient) GetCurrentVersion(aggregateId string) (int64, error) {
+	if len(aggregateId) <= 0 {
+		return 0, fmt.Errorf("aggregateId empty")
+	}
+	headAggregateUrl, err := url.JoinPath(client.url, "/aggregates", url.PathEscape(aggregateId))
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return 0, err
+	}
+	resp, err := client.httpClient.Head(headAggregateUrl)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if resp.StatusCode == http.StatusGone {
+		return 0, &customerrors.AggregateDeletedError{AggregateId: aggregateId}
+	}
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		log.Info().Err(err).Msg("got non 2XX header")
-		return nil, fmt.Errorf("unsuccessful request")
+		log.Info().Msg("got non 2XX header")
+		return 0, fmt.Errorf("unsuccessful request")
 	}
+	version, err := strconv.ParseInt(resp.Header.Get("X-Aggregate-Version"), 10, 64)
+	if err != nil {
+		log.Info().Err(err).Msg("error during parsing version header")
+		return 0, err
+	}
+	return version, nil
+}
 
-	var events []models.Event
-	buf, err := io.ReadAll(resp.Body)
+// GetStats retrieves global statistics of the event store.
+func (client *EventSourcingHttpClient) GetStats() (*models.EventStoreStats, error) {
+	getStatsUrl, err := url.JoinPath(client.url, "/stats")
 	if err != nil {
-		log.Info().Err(err).Msg("error during reading response body")
+		log.Info().Err(err).Msg("could not use url")
 		return nil, err
 	}
-	err = json.Unmarshal(buf, &events)
+	var stats models.EventStoreStats
+	err = client.getJSON(getStatsUrl, &stats)
 	if err != nil {
-		log.Info().Err(err).Msg("error during unmarshalling body")
 		return nil, err
 	}
+	return &stats, nil
+}
 
-	return events, nil
+// DeleteAggregate deletes a given aggregate ID. A soft deletion keeps its events,
+// a hard deletion removes them and leaves a tombstone event in the global feed.
+// It returns an AggregateNotFoundError if the aggregate does not exist.
+func (client *EventSourcingHttpClient) DeleteAggregate(aggregateId string, mode models.DeletionMode) error {
+	if len(aggregateId) <= 0 {
+		return fmt.Errorf("aggregateId empty")
+	}
+	deleteAggregateUrl, err := url.JoinPath(client.url, "/admin/aggregates", url.PathEscape(aggregateId))
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return err
+	}
+	query := url.Values{}
+	query.Set("mode", string(mode))
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s?%s", deleteAggregateUrl, query.Encode()), nil)
+	if err != nil {
+		log.Info().Err(err).Msg("could not create request")
+		return err
+	}
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &customerrors.AggregateNotFoundError{}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return fmt.Errorf("unsuccessful request")
+	}
+	return nil
+}
+
+// DestroySubjectKey destroys the encryption key of a subject. The data of its
+// events is returned as nil afterwards, backups taken before still contain the
+// key. It returns a SubjectNotFoundError if the subject has no key.
+func (client *EventSourcingHttpClient) DestroySubjectKey(subject string) error {
+	if len(subject) <= 0 {
+		return fmt.Errorf("subject empty")
+	}
+	destroyKeyUrl, err := url.JoinPath(client.url, "/admin/subjects", url.PathEscape(subject), "key")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return err
+	}
+	req, err := http.NewRequest(http.MethodDelete, destroyKeyUrl, nil)
+	if err != nil {
+		log.Info().Err(err).Msg("could not create request")
+		return err
+	}
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &customerrors.SubjectNotFoundError{}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return fmt.Errorf("unsuccessful request")
+	}
+	return nil
+}
+
+// SetCompressionDictionary stores a zstd dictionary that new events of the aggregate
+// type are compressed with. It returns an InvalidDictionaryError if the store
+// cannot use the dictionary.
+func (client *EventSourcingHttpClient) SetCompressionDictionary(aggregateType string, dictionary []byte) error {
+	return client.postDictionary(http.MethodPut, aggregateType, "dictionary", dictionary)
+}
+
+// TrainCompressionDictionary lets the store train a zstd dictionary on the recent
+// events of the aggregate type. It returns an InvalidDictionaryError if there
+// are not enough events to train on.
+func (client *EventSourcingHttpClient) TrainCompressionDictionary(aggregateType string) error {
+	return client.postDictionary(http.MethodPost, aggregateType, "dictionary/train", nil)
+}
+
+func (client *EventSourcingHttpClient) postDictionary(method string, aggregateType string, path string, body []byte) error {
+	if len(aggregateType) <= 0 {
+		return fmt.Errorf("aggregateType empty")
+	}
+	dictionaryUrl, err := url.JoinPath(client.url, "/admin/compression", url.PathEscape(aggregateType), path)
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return err
+	}
+	req, err := http.NewRequest(method, dictionaryUrl, bytes.NewBuffer(body))
+	if err != nil {
+		log.Info().Err(err).Msg("could not create request")
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		buf, err := io.ReadAll(resp.Body)
+		if err == nil {
+			json.Unmarshal(buf, &body)
+		}
+		return &customerrors.InvalidDictionaryError{Reason: body.Reason}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return fmt.Errorf("unsuccessful request")
+	}
+	return nil
+}
+
+// RegisterSchema registers the JSON Schema the data of events with the given
+// aggregate type, name and schema version has to satisfy. An existing schema is
+// replaced.
+func (client *EventSourcingHttpClient) RegisterSchema(aggregateType string, name string, version int, schema []byte) error {
+	schemaUrl, err := client.schemaUrl(aggregateType, name, version)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, schemaUrl, bytes.NewBuffer(schema))
+	if err != nil {
+		log.Info().Err(err).Msg("could not create request")
+		return err
+	}
+	req.Header.Set("Content-Type", "application/schema+json")
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		buf, err := io.ReadAll(resp.Body)
+		if err == nil {
+			json.Unmarshal(buf, &body)
+		}
+		return &customerrors.InvalidSchemaError{Reason: body.Reason}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return fmt.Errorf("unsuccessful request")
+	}
+	return nil
+}
+
+// GetSchema retrieves the schema for events with the given aggregate type, name
+// and schema version. It returns a SchemaNotFoundError if there is none.
+func (client *EventSourcingHttpClient) GetSchema(aggregateType string, name string, version int) (*models.EventSchema, error) {
+	schemaUrl, err := client.schemaUrl(aggregateType, name, version)
+	if err != nil {
+		return nil, err
+	}
+	var schema models.EventSchema
+	err = client.getJSON(schemaUrl, &schema)
+	if errors.Is(err, errNotFound) {
+		return nil, &customerrors.SchemaNotFoundError{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// ListSchemas retrieves all registered schemas.
+func (client *EventSourcingHttpClient) ListSchemas() ([]models.EventSchema, error) {
+	listSchemasUrl, err := url.JoinPath(client.url, "/schemas")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return nil, err
+	}
+	schemas := []models.EventSchema{}
+	err = client.getJSON(listSchemasUrl, &schemas)
+	if err != nil {
+		return nil, err
+	}
+	return schemas, nil
+}
+
+// DeleteSchema removes the schema for events with the given aggregate type, name
+// and schema version. It returns a SchemaNotFoundError if there is none.
+func (client *EventSourcingHttpClient) DeleteSchema(aggregateType string, name string, version int) error {
+	schemaUrl, err := client.schemaUrl(aggregateType, name, version)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodDelete, schemaUrl, nil)
+	if err != nil {
+		log.Info().Err(err).Msg("could not create request")
+		return err
+	}
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &customerrors.SchemaNotFoundError{}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return fmt.Errorf("unsuccessful request")
+	}
+	return nil
+}
+
+// SetRetentionPolicy stores the retention policy of its aggregate type, replacing an existing one.
+func (client *EventSourcingHttpClient) SetRetentionPolicy(policy models.RetentionPolicy) error {
+	policyUrl, err := client.retentionPolicyUrl(policy.AggregateType)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(policy)
+	if err != nil {
+		log.Info().Err(err).Msg("could not marshal retention policy")
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, policyUrl, bytes.NewBuffer(body))
+	if err != nil {
+		log.Info().Err(err).Msg("could not create request")
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return fmt.Errorf("unsuccessful request")
+	}
+	return nil
+}
+
+// GetRetentionPolicy retrieves the retention policy of an aggregate type. It returns
+// a RetentionPolicyNotFoundError if there is none.
+func (client *EventSourcingHttpClient) GetRetentionPolicy(aggregateType string) (*models.RetentionPolicy, error) {
+	policyUrl, err := client.retentionPolicyUrl(aggregateType)
+	if err != nil {
+		return nil, err
+	}
+	var policy models.RetentionPolicy
+	err = client.getJSON(policyUrl, &policy)
+	if errors.Is(err, errNotFound) {
+		return nil, &customerrors.RetentionPolicyNotFoundError{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// ListRetentionPolicies retrieves all retention policies ordered by aggregate type.
+func (client *EventSourcingHttpClient) ListRetentionPolicies() ([]models.RetentionPolicy, error) {
+	listUrl, err := url.JoinPath(client.url, "/admin/retention/policies")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return nil, err
+	}
+	policies := []models.RetentionPolicy{}
+	err = client.getJSON(listUrl, &policies)
+	if err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// DeleteRetentionPolicy removes the retention policy of an aggregate type. It
+// returns a RetentionPolicyNotFoundError if there is none.
+func (client *EventSourcingHttpClient) DeleteRetentionPolicy(aggregateType string) error {
+	policyUrl, err := client.retentionPolicyUrl(aggregateType)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodDelete, policyUrl, nil)
+	if err != nil {
+		log.Info().Err(err).Msg("could not create request")
+		return err
+	}
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &customerrors.RetentionPolicyNotFoundError{}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return fmt.Errorf("unsuccessful request")
+	}
+	return nil
+}
+
+// ApplyRetention lets the store apply the retention policies right away and
+// returns the number of removed events.
+func (client *EventSourcingHttpClient) ApplyRetention() (int64, error) {
+	runUrl, err := url.JoinPath(client.url, "/admin/retention/run")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return 0, err
+	}
+	resp, err := client.httpClient.Post(runUrl, "application/json", nil)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return 0, fmt.Errorf("unsuccessful request")
+	}
+	var body struct {
+		Removed int64 `json:"removed"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		log.Info().Err(err).Msg("error during unmarshalling body")
+		return 0, err
+	}
+	return body.Removed, nil
+}
+
+// ArchiveEvents lets the store move the data of events older than olderThan to
+// segment files right away and returns the number of archived events.
+func (client *EventSourcingHttpClient) ArchiveEvents(olderThan time.Duration) (int64, error) {
+	archiveUrl, err := url.JoinPath(client.url, "/admin/archive/run")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return 0, err
+	}
+	resp, err := client.httpClient.Post(archiveUrl+"?olderThan="+url.QueryEscape(olderThan.String()), "application/json", nil)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return 0, fmt.Errorf("unsuccessful request")
+	}
+	var body struct {
+		Archived int64 `json:"archived"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		log.Info().Err(err).Msg("error during unmarshalling body")
+		return 0, err
+	}
+	return body.Archived, nil
+}
+
+// ListArchiveSegments retrieves the segment files holding the data of archived events.
+func (client *EventSourcingHttpClient) ListArchiveSegments() ([]models.ArchiveSegment, error) {
+	listUrl, err := url.JoinPath(client.url, "/admin/archive/segments")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return nil, err
+	}
+	segments := []models.ArchiveSegment{}
+	err = client.getJSON(listUrl, &segments)
+	if err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+// retentionPolicyUrl builds the url of the retention policy of an aggregate type.
+func (client *EventSourcingHttpClient) retentionPolicyUrl(aggregateType string) (string, error) {
+	if len(aggregateType) == 0 {
+		return "", fmt.Errorf("aggregateType empty")
+	}
+	policyUrl, err := url.JoinPath(client.url, "/admin/retention/policies", url.PathEscape(aggregateType))
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return "", err
+	}
+	return policyUrl, nil
+}
+
+// schemaUrl builds the url of the schema for an aggregate type and event name.
+func (client *EventSourcingHttpClient) schemaUrl(aggregateType string, name string, version int) (string, error) {
+	if len(aggregateType) == 0 || len(name) == 0 {
+		return "", fmt.Errorf("aggregateType or name empty")
+	}
+	schemaUrl, err := url.JoinPath(client.url, "/schemas", url.PathEscape(aggregateType), url.PathEscape(name))
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return "", err
+	}
+	return schemaUrl + "?version=" + strconv.Itoa(max(version, 1)), nil
+}
+
+// getEvents sends a GET request for events in the selected encoding and upcasts them.
+func (client *EventSourcingHttpClient) getEvents(requestUrl string) ([]models.Event, error) {
+	req, err := http.NewRequest(http.MethodGet, requestUrl, nil)
+	if err != nil {
+		log.Info().Err(err).Msg("could not create request")
+		return nil, err
+	}
+	req.Header.Set("Accept", client.encoding)
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return nil, readDeleted(resp)
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return nil, &customerrors.AccessDeniedError{}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &customerrors.EventNotFoundError{}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return nil, fmt.Errorf("unsuccessful request")
+	}
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Info().Err(err).Msg("error during reading response body")
+		return nil, err
+	}
+	mediaType, ok := codec.MediaType(resp.Header.Get("Content-Type"))
+	if !ok {
+		return nil, fmt.Errorf("unsupported response content type")
+	}
+	var events []models.Event
+	err = codec.Unmarshal(mediaType, buf, &events)
+	if err != nil {
+		log.Info().Err(err).Msg("error during unmarshalling body")
+		return nil, err
+	}
+	err = client.upcasters.UpcastAll(events)
+	if err != nil {
+		log.Info().Err(err).Msg("error during upcasting events")
+		return nil, err
+	}
+	return events, nil
+}
+
+// getJSON sends a GET request and unmarshals the JSON response body into target.
+// It returns an AccessDeniedError if the server responds with 403.
+func (client *EventSourcingHttpClient) getJSON(requestUrl string, target any) error {
+	resp, err := client.httpClient.Get(requestUrl)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return &customerrors.AccessDeniedError{}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return fmt.Errorf("unsuccessful request")
+	}
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Info().Err(err).Msg("error during reading response body")
+		return err
+	}
+	err = json.Unmarshal(buf, target)
+	if err != nil {
+		log.Info().Err(err).Msg("error during unmarshalling body")
+		return err
+	}
+	return nil
+}
+
+// Backup lets the store write an online backup to the directory target, a relative
+// path within the backup directory of the server. It returns a
+// BackupTargetExistsError if target exists.
+func (client *EventSourcingHttpClient) Backup(target string) (*models.Backup, error) {
+	backupUrl, err := url.JoinPath(client.url, "/admin/backup")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return nil, err
+	}
+	body, err := json.Marshal(models.BackupRequest{Target: target})
+	if err != nil {
+		log.Info().Err(err).Msg("could not marshal backup request")
+		return nil, err
+	}
+	resp, err := client.httpClient.Post(backupUrl, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return nil, &customerrors.BackupTargetExistsError{}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return nil, fmt.Errorf("unsuccessful request")
+	}
+	var backup models.Backup
+	err = json.NewDecoder(resp.Body).Decode(&backup)
+	if err != nil {
+		log.Info().Err(err).Msg("error during unmarshalling body")
+		return nil, err
+	}
+	return &backup, nil
+}
+
+// ExportEvents writes the events matching the filter to w as newline-delimited
+// JSON. It returns an EventNotFoundError if the position range is bounded by an unknown event.
+func (client *EventSourcingHttpClient) ExportEvents(filter models.ExportFilter, w io.Writer) error {
+	exportUrl, err := url.JoinPath(client.url, "/admin/export")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return err
+	}
+	query := url.Values{}
+	if len(filter.AggregateId) > 0 {
+		query.Set("aggregateId", filter.AggregateId)
+	}
+	if len(filter.AggregateType) > 0 {
+		query.Set("aggregateType", filter.AggregateType)
+	}
+	if len(filter.After) > 0 {
+		query.Set("after", filter.After)
+	}
+	if len(filter.Until) > 0 {
+		query.Set("until", filter.Until)
+	}
+	resp, err := client.httpClient.Get(fmt.Sprintf("%s?%s", exportUrl, query.Encode()))
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &customerrors.EventNotFoundError{}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return fmt.Errorf("unsuccessful request")
+	}
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		log.Info().Err(err).Msg("error reading the export")
+		return err
+	}
+	return nil
+}
+
+// ImportEvents imports newline-delimited JSON as written by ExportEvents and returns
+// the number of imported events. It returns an ImportError if a line was rejected.
+func (client *EventSourcingHttpClient) ImportEvents(r io.Reader) (int64, error) {
+	importUrl, err := url.JoinPath(client.url, "/admin/import")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return 0, err
+	}
+	resp, err := client.httpClient.Post(importUrl, models.NDJSONContentType, r)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Imported int64  `json:"imported"`
+		Reason   string `json:"reason"`
+		Line     int    `json:"line"`
+	}
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusConflict {
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		if err != nil || body.Line == 0 {
+			log.Info().Msg("got non 2XX header")
+			return 0, fmt.Errorf("unsuccessful request")
+		}
+		return body.Imported, &customerrors.ImportError{Line: body.Line, Imported: body.Imported, Reason: body.Reason}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return 0, fmt.Errorf("unsuccessful request")
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		log.Info().Err(err).Msg("error during unmarshalling body")
+		return 0, err
+	}
+	return body.Imported, nil
+}
+
+// RegisterProducerKey registers the ed25519 public key of a producer. Registering
+// the same key again succeeds. It returns a ProducerKeyConflictError if a different
+// key is registered with the id.
+func (client *EventSourcingHttpClient) RegisterProducerKey(key models.ProducerKey) (*models.ProducerKey, error) {
+	keyUrl, err := client.producerKeyUrl(key.Id)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(key)
+	if err != nil {
+		log.Info().Err(err).Msg("could not marshal producer key")
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPut, keyUrl, bytes.NewBuffer(body))
+	if err != nil {
+		log.Info().Err(err).Msg("could not create request")
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return client.doProducerKeyRequest(req)
+}
+
+// GetProducerKey retrieves a producer key. It returns a ProducerKeyNotFoundError
+// if there is none.
+func (client *EventSourcingHttpClient) GetProducerKey(keyId string) (*models.ProducerKey, error) {
+	keyUrl, err := client.producerKeyUrl(keyId)
+	if err != nil {
+		return nil, err
+	}
+	var key models.ProducerKey
+	err = client.getJSON(keyUrl, &key)
+	if errors.Is(err, errNotFound) {
+		return nil, &customerrors.ProducerKeyNotFoundError{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// ListProducerKeys retrieves all producer keys, including revoked ones.
+func (client *EventSourcingHttpClient) ListProducerKeys() ([]models.ProducerKey, error) {
+	listUrl, err := url.JoinPath(client.url, "/admin/keys")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return nil, err
+	}
+	keys := []models.ProducerKey{}
+	err = client.getJSON(listUrl, &keys)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RevokeProducerKey revokes a producer key, so events signed with it are rejected.
+// It returns a ProducerKeyNotFoundError if there is no such key.
+func (client *EventSourcingHttpClient) RevokeProducerKey(keyId string) (*models.ProducerKey, error) {
+	keyUrl, err := client.producerKeyUrl(keyId)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, keyUrl+"/revoke", nil)
+	if err != nil {
+		log.Info().Err(err).Msg("could not create request")
+		return nil, err
+	}
+	return client.doProducerKeyRequest(req)
+}
+
+// VerifySignature checks the signature of an event read from the store against
+// the registered key it names and returns that key. It returns an
+// InvalidSignatureError if the event is unsigned or the signature does not match.
+func (client *EventSourcingHttpClient) VerifySignature(event models.Event) (*models.ProducerKey, error) {
+	if len(event.SigningKeyId) == 0 || len(event.Signature) == 0 {
+		return nil, &customerrors.InvalidSignatureError{Reason: "event is not signed"}
+	}
+	key, err := client.GetProducerKey(event.SigningKeyId)
+	if err != nil {
+		return nil, err
+	}
+	if !event.VerifySignature(key.PublicKey) {
+		return nil, &customerrors.InvalidSignatureError{SigningKeyId: event.SigningKeyId, Reason: "signature does not match the event"}
+	}
+	return key, nil
+}
+
+func (client *EventSourcingHttpClient) producerKeyUrl(keyId string) (string, error) {
+	if len(keyId) == 0 {
+		return "", fmt.Errorf("keyId empty")
+	}
+	keyUrl, err := url.JoinPath(client.url, "/admin/keys", url.PathEscape(keyId))
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return "", err
+	}
+	return keyUrl, nil
+}
+
+func (client *EventSourcingHttpClient) doProducerKeyRequest(req *http.Request) (*models.ProducerKey, error) {
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &customerrors.ProducerKeyNotFoundError{}
+	}
+	if resp.StatusCode == http.StatusConflict {
+		return nil, &customerrors.ProducerKeyConflictError{}
+	}
+	if resp.StatusCode == http.StatusBadRequest {
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return nil, &customerrors.InvalidProducerKeyError{Reason: body.Reason}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return nil, fmt.Errorf("unsuccessful request")
+	}
+	var key models.ProducerKey
+	err = json.NewDecoder(resp.Body).Decode(&key)
+	if err != nil {
+		log.Info().Err(err).Msg("error during unmarshalling body")
+		return nil, err
+	}
+	return &key, nil
+}
+
+// CreateAPIKey creates an API key for a subject. The returned key cannot be retrieved again.
+func (client *EventSourcingHttpClient) CreateAPIKey(request models.APIKeyRequest) (*models.IssuedAPIKey, error) {
+	createUrl, err := url.JoinPath(client.url, "/admin/api-keys")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return nil, err
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		log.Info().Err(err).Msg("could not marshal API key request")
+		return nil, err
+	}
+	resp, err := client.httpClient.Post(createUrl, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return nil, fmt.Errorf("unsuccessful request")
+	}
+	var issued models.IssuedAPIKey
+	err = json.NewDecoder(resp.Body).Decode(&issued)
+	if err != nil {
+		log.Info().Err(err).Msg("error during unmarshalling body")
+		return nil, err
+	}
+	return &issued, nil
+}
+
+// GetAPIKey retrieves an API key without its secret. It returns an
+// APIKeyNotFoundError if there is none.
+func (client *EventSourcingHttpClient) GetAPIKey(keyId string) (*models.APIKey, error) {
+	keyUrl, err := client.apiKeyUrl(keyId)
+	if err != nil {
+		return nil, err
+	}
+	var key models.APIKey
+	err = client.getJSON(keyUrl, &key)
+	if errors.Is(err, errNotFound) {
+		return nil, &customerrors.APIKeyNotFoundError{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// ListAPIKeys retrieves all API keys, including revoked ones, without their secrets.
+func (client *EventSourcingHttpClient) ListAPIKeys() ([]models.APIKey, error) {
+	listUrl, err := url.JoinPath(client.url, "/admin/api-keys")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return nil, err
+	}
+	keys := []models.APIKey{}
+	err = client.getJSON(listUrl, &keys)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey revokes an API key, so requests with it are rejected. It returns
+// an APIKeyNotFoundError if there is no such key.
+func (client *EventSourcingHttpClient) RevokeAPIKey(keyId string) (*models.APIKey, error) {
+	keyUrl, err := client.apiKeyUrl(keyId)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.httpClient.Post(keyUrl+"/revoke", "application/json", nil)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &customerrors.APIKeyNotFoundError{}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return nil, fmt.Errorf("unsuccessful request")
+	}
+	var key models.APIKey
+	err = json.NewDecoder(resp.Body).Decode(&key)
+	if err != nil {
+		log.Info().Err(err).Msg("error during unmarshalling body")
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (client *EventSourcingHttpClient) apiKeyUrl(keyId string) (string, error) {
+	if len(keyId) == 0 {
+		return "", fmt.Errorf("keyId empty")
+	}
+	keyUrl, err := url.JoinPath(client.url, "/admin/api-keys", url.PathEscape(keyId))
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return "", err
+	}
+	return keyUrl, nil
+}
+
+// SetAccessRule stores an access rule, replacing an existing one with the same id.
+// It returns an InvalidAccessRuleError if the server rejects the rule.
+func (client *EventSourcingHttpClient) SetAccessRule(rule models.AccessRule) error {
+	ruleUrl, err := client.accessRuleUrl(rule.Id)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(rule)
+	if err != nil {
+		log.Info().Err(err).Msg("could not marshal access rule")
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, ruleUrl, bytes.NewBuffer(body))
+	if err != nil {
+		log.Info().Err(err).Msg("could not create request")
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return &customerrors.InvalidAccessRuleError{Reason: body.Reason}
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return &customerrors.AccessDeniedError{}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return fmt.Errorf("unsuccessful request")
+	}
+	return nil
+}
+
+// GetAccessRule retrieves an access rule. It returns an AccessRuleNotFoundError if there is none.
+func (client *EventSourcingHttpClient) GetAccessRule(ruleId string) (*models.AccessRule, error) {
+	ruleUrl, err := client.accessRuleUrl(ruleId)
+	if err != nil {
+		return nil, err
+	}
+	var rule models.AccessRule
+	err = client.getJSON(ruleUrl, &rule)
+	if errors.Is(err, errNotFound) {
+		return nil, &customerrors.AccessRuleNotFoundError{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// ListAccessRules retrieves all access rules ordered by id.
+func (client *EventSourcingHttpClient) ListAccessRules() ([]models.AccessRule, error) {
+	listUrl, err := url.JoinPath(client.url, "/admin/access-rules")
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return nil, err
+	}
+	rules := []models.AccessRule{}
+	err = client.getJSON(listUrl, &rules)
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// DeleteAccessRule removes an access rule. It returns an AccessRuleNotFoundError if there is none.
+func (client *EventSourcingHttpClient) DeleteAccessRule(ruleId string) error {
+	ruleUrl, err := client.accessRuleUrl(ruleId)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodDelete, ruleUrl, nil)
+	if err != nil {
+		log.Info().Err(err).Msg("could not create request")
+		return err
+	}
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		log.Info().Err(err).Msg("error during the request")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &customerrors.AccessRuleNotFoundError{}
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return &customerrors.AccessDeniedError{}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Info().Msg("got non 2XX header")
+		return fmt.Errorf("unsuccessful request")
+	}
+	return nil
+}
+
+func (client *EventSourcingHttpClient) accessRuleUrl(ruleId string) (string, error) {
+	if len(ruleId) == 0 {
+		return "", fmt.Errorf("ruleId empty")
+	}
+	ruleUrl, err := url.JoinPath(client.url, "/admin/access-rules", url.PathEscape(ruleId))
+	if err != nil {
+		log.Info().Err(err).Msg("could not use url")
+		return "", err
+	}
+	return ruleUrl, nil
 }
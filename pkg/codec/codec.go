@@ -0,0 +1,133 @@
+// Package codec encodes events and append transactions as JSON, Protobuf or
+// MessagePack, selected by media type.
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/eventpb"
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Supported media types.
+const (
+	JSON        = "application/json"
+	Protobuf    = "application/x-protobuf"
+	MessagePack = "application/msgpack"
+)
+
+// aliases maps further media types in use to the supported ones.
+var aliases = map[string]string{
+	JSON:                      JSON,
+	Protobuf:                  Protobuf,
+	"application/protobuf":    Protobuf,
+	MessagePack:               MessagePack,
+	"application/x-msgpack":   MessagePack,
+	"application/vnd.msgpack": MessagePack,
+}
+
+// MediaType returns the supported media type of a Content-Type header. An empty
+// header is treated as JSON. It returns false if the media type is not supported.
+func MediaType(contentType string) (string, bool) {
+	if len(strings.TrimSpace(contentType)) == 0 {
+		return JSON, true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	supported, ok := aliases[mediaType]
+	return supported, ok
+}
+
+// Negotiate returns the supported media type of an Accept header with the
+// highest q-value, the first one listed among equal q-values. Wildcards, an empty
+// header and a header without supported types select JSON.
+func Negotiate(accept string) string {
+	selected, best := JSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q <= best {
+			continue
+		}
+		if mediaType == "*/*" || mediaType == "application/*" {
+			selected, best = JSON, q
+		} else if supported, ok := aliases[mediaType]; ok {
+			selected, best = supported, q
+		}
+	}
+	return selected
+}
+
+// Marshal encodes a []models.Event or a models.AppendTransaction.
+func Marshal(mediaType string, v any) ([]byte, error) {
+	switch mediaType {
+	case JSON:
+		return json.Marshal(v)
+	case MessagePack:
+		var buf bytes.Buffer
+		encoder := msgpack.NewEncoder(&buf)
+		encoder.SetCustomStructTag("json")
+		err := encoder.Encode(v)
+		return buf.Bytes(), err
+	case Protobuf:
+		switch value := v.(type) {
+		case []models.Event:
+			return proto.Marshal(eventpb.FromEvents(value))
+		case models.AppendTransaction:
+			return proto.Marshal(eventpb.FromAppendTransaction(value))
+		case *models.AppendTransaction:
+			return proto.Marshal(eventpb.FromAppendTransaction(*value))
+		}
+		return nil, fmt.Errorf("cannot encode %T as protobuf", v)
+	}
+	return nil, fmt.Errorf("unsupported media type %s", mediaType)
+}
+
+// Unmarshal decodes into a *[]models.Event or a *models.AppendTransaction.
+func Unmarshal(mediaType string, data []byte, v any) error {
+	switch mediaType {
+	case JSON:
+		return json.Unmarshal(data, v)
+	case MessagePack:
+		decoder := msgpack.NewDecoder(bytes.NewReader(data))
+		decoder.SetCustomStructTag("json")
+		return decoder.Decode(v)
+	case Protobuf:
+		switch value := v.(type) {
+		case *[]models.Event:
+			var batch eventpb.EventBatch
+			if err := proto.Unmarshal(data, &batch); err != nil {
+				return err
+			}
+			*value = batch.ToModels()
+			return nil
+		case *models.AppendTransaction:
+			var transaction eventpb.AppendTransaction
+			if err := proto.Unmarshal(data, &transaction); err != nil {
+				return err
+			}
+			*value = transaction.ToModel()
+			return nil
+		}
+		return fmt.Errorf("cannot decode protobuf into %T", v)
+	}
+	return fmt.Errorf("unsupported media type %s", mediaType)
+}
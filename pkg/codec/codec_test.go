@@ -0,0 +1,57 @@
+package codec_test
+
+import (
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/codec"
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+var events = []models.Event{
+	{Id: "a", Version: 1, Name: "created", Data: []byte{0, 1, 2}, AggregateId: "agg", AggregateType: "t", Tags: []string{"x"}},
+	{Id: "b", Version: 2, Name: "renamed", Data: []byte(`{"a":1}`), AggregateId: "agg", AggregateType: "t", SchemaVersion: 2, ContentType: models.JSONContentType},
+}
+
+func TestEventsRoundTrip(t *testing.T) {
+	for _, mediaType := range []string{codec.JSON, codec.Protobuf, codec.MessagePack} {
+		body, err := codec.Marshal(mediaType, events)
+		assert.NoError(t, err, mediaType)
+		var decoded []models.Event
+		assert.NoError(t, codec.Unmarshal(mediaType, body, &decoded), mediaType)
+		assert.Equal(t, events, decoded, mediaType)
+	}
+}
+
+func TestAppendTransactionRoundTrip(t *testing.T) {
+	transaction := models.AppendTransaction{
+		Appends: []models.StreamAppend{{AggregateId: "agg", ExpectedVersion: models.NoStream, Events: events}},
+		Condition: &models.AppendCondition{
+			FailIfEventsMatch: []models.EventQuery{{Names: []string{"created"}, Tags: []string{"x"}}},
+			After:             "a",
+		},
+	}
+	for _, mediaType := range []string{codec.JSON, codec.Protobuf, codec.MessagePack} {
+		body, err := codec.Marshal(mediaType, transaction)
+		assert.NoError(t, err, mediaType)
+		var decoded models.AppendTransaction
+		assert.NoError(t, codec.Unmarshal(mediaType, body, &decoded), mediaType)
+		assert.Equal(t, transaction, decoded, mediaType)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	assert.Equal(t, codec.JSON, codec.Negotiate(""))
+	assert.Equal(t, codec.JSON, codec.Negotiate("*/*"))
+	assert.Equal(t, codec.Protobuf, codec.Negotiate("application/x-protobuf, application/json;q=0.5"))
+	assert.Equal(t, codec.MessagePack, codec.Negotiate("text/html, application/x-msgpack"))
+	assert.Equal(t, codec.Protobuf, codec.Negotiate("application/json;q=0.1, application/x-protobuf"))
+	assert.Equal(t, codec.MessagePack, codec.Negotiate("*/*;q=0.2, application/msgpack;q=0.8, application/x-protobuf;q=0.5"))
+	assert.Equal(t, codec.JSON, codec.Negotiate("application/x-protobuf;q=0, text/html"))
+
+	mediaType, ok := codec.MediaType("application/json; charset=utf-8")
+	assert.True(t, ok)
+	assert.Equal(t, codec.JSON, mediaType)
+	_, ok = codec.MediaType("text/xml")
+	assert.False(t, ok)
+}
@@ -0,0 +1,136 @@
+// Package eventpb contains the Protobuf messages of the event store API and
+// conversions from and to the models package.
+package eventpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative events.proto event_store.proto
+
+import "github.com/L4B0MB4/EVTSRC/pkg/models"
+
+// FromEvent converts a models.Event to its Protobuf message.
+func FromEvent(event models.Event) *Event {
+	return &Event{
+		Id:            event.Id,
+		Version:       event.Version,
+		Name:          event.Name,
+		Data:          event.Data,
+		AggregateId:   event.AggregateId,
+		AggregateType: event.AggregateType,
+		Tags:          event.Tags,
+		SchemaVersion: int32(event.SchemaVersion),
+		ContentType:   event.ContentType,
+		Subject:       event.Subject,
+		Hash:          event.Hash,
+		SigningKeyId:  event.SigningKeyId,
+		Signature:     event.Signature,
+	}
+}
+
+// ToModel converts the message to a models.Event.
+func (e *Event) ToModel() models.Event {
+	return models.Event{
+		Id:            e.GetId(),
+		Version:       e.GetVersion(),
+		Name:          e.GetName(),
+		Data:          e.GetData(),
+		AggregateId:   e.GetAggregateId(),
+		AggregateType: e.GetAggregateType(),
+		Tags:          e.GetTags(),
+		SchemaVersion: int(e.GetSchemaVersion()),
+		ContentType:   e.GetContentType(),
+		Subject:       e.GetSubject(),
+		Hash:          e.GetHash(),
+		SigningKeyId:  e.GetSigningKeyId(),
+		Signature:     e.GetSignature(),
+	}
+}
+
+// FromEvents converts a list of events to an EventBatch.
+func FromEvents(events []models.Event) *EventBatch {
+	batch := &EventBatch{Events: make([]*Event, 0, len(events))}
+	for _, event := range events {
+		batch.Events = append(batch.Events, FromEvent(event))
+	}
+	return batch
+}
+
+// ToModels converts the events of the batch to models.Events.
+func (b *EventBatch) ToModels() []models.Event {
+	return toModels(b.GetEvents())
+}
+
+func toModels(messages []*Event) []models.Event {
+	events := make([]models.Event, 0, len(messages))
+	for _, message := range messages {
+		events = append(events, message.ToModel())
+	}
+	return events
+}
+
+// FromAppendCondition converts a models.AppendCondition to its Protobuf message.
+// A nil condition is converted to nil.
+func FromAppendCondition(condition *models.AppendCondition) *AppendCondition {
+	if condition == nil {
+		return nil
+	}
+	message := &AppendCondition{After: condition.After}
+	for _, query := range condition.FailIfEventsMatch {
+		message.FailIfEventsMatch = append(message.FailIfEventsMatch, &EventQuery{
+			Names:          query.Names,
+			AggregateTypes: query.AggregateTypes,
+			Tags:           query.Tags,
+		})
+	}
+	return message
+}
+
+// ToModel converts the message to a models.AppendCondition. A nil message is converted to nil.
+func (c *AppendCondition) ToModel() *models.AppendCondition {
+	if c == nil {
+		return nil
+	}
+	condition := &models.AppendCondition{After: c.GetAfter(), FailIfEventsMatch: []models.EventQuery{}}
+	for _, query := range c.GetFailIfEventsMatch() {
+		condition.FailIfEventsMatch = append(condition.FailIfEventsMatch, models.EventQuery{
+			Names:          query.GetNames(),
+			AggregateTypes: query.GetAggregateTypes(),
+			Tags:           query.GetTags(),
+		})
+	}
+	return condition
+}
+
+// FromStreamAppend converts a models.StreamAppend to its Protobuf message.
+func FromStreamAppend(streamAppend models.StreamAppend) *StreamAppend {
+	return &StreamAppend{
+		AggregateId:     streamAppend.AggregateId,
+		ExpectedVersion: streamAppend.ExpectedVersion,
+		Events:          FromEvents(streamAppend.Events).Events,
+	}
+}
+
+// ToModel converts the message to a models.StreamAppend.
+func (s *StreamAppend) ToModel() models.StreamAppend {
+	return models.StreamAppend{
+		AggregateId:     s.GetAggregateId(),
+		ExpectedVersion: s.GetExpectedVersion(),
+		Events:          toModels(s.GetEvents()),
+	}
+}
+
+// FromAppendTransaction converts a models.AppendTransaction to its Protobuf message.
+func FromAppendTransaction(transaction models.AppendTransaction) *AppendTransaction {
+	message := &AppendTransaction{Condition: FromAppendCondition(transaction.Condition)}
+	for _, streamAppend := range transaction.Appends {
+		message.Appends = append(message.Appends, FromStreamAppend(streamAppend))
+	}
+	return message
+}
+
+// ToModel converts the message to a models.AppendTransaction.
+func (t *AppendTransaction) ToModel() models.AppendTransaction {
+	transaction := models.AppendTransaction{Condition: t.GetCondition().ToModel()}
+	for _, streamAppend := range t.GetAppends() {
+		transaction.Appends = append(transaction.Appends, streamAppend.ToModel())
+	}
+	return transaction
+}
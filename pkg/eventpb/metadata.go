@@ -0,0 +1,5 @@
+package eventpb
+
+// CurrentVersionTrailer is the trailer carrying the current version of an
+// aggregate when an append fails because it is not at the expected version.
+const CurrentVersionTrailer = "current-version"
@@ -0,0 +1,186 @@
+// Package grpcclient is a client for the gRPC API of the event store.
+package grpcclient
+
+import (
+	"context"
+	"io"
+	"strconv"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/eventpb"
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// EventStoreGrpcClient is a client for interacting with the event store gRPC API.
+type EventStoreGrpcClient struct {
+	conn   *grpc.ClientConn
+	client eventpb.EventStoreClient
+	// credentials are added to the metadata of every call
+	credentials metadata.MD
+}
+
+// NewEventStoreGrpcClient creates a new EventStoreGrpcClient for the target, e.g.
+// "localhost:5530". Without options the connection is not encrypted.
+func NewEventStoreGrpcClient(target string, opts ...grpc.DialOption) (*EventStoreGrpcClient, error) {
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		log.Info().Err(err).Msg("could not create grpc client")
+		return nil, err
+	}
+	return &EventStoreGrpcClient{
+		conn:   conn,
+		client: eventpb.NewEventStoreClient(conn),
+	}, nil
+}
+
+// UseAPIKey makes the client authenticate every call with an API key.
+func (c *EventStoreGrpcClient) UseAPIKey(key string) {
+	c.credentials = metadata.Pairs("x-api-key", key)
+}
+
+// UseBearerToken makes the client authenticate every call with a fixed JWT.
+func (c *EventStoreGrpcClient) UseBearerToken(token string) {
+	c.credentials = metadata.Pairs("authorization", "Bearer "+token)
+}
+
+// withCredentials returns ctx with the credentials of the client added to the outgoing metadata.
+func (c *EventStoreGrpcClient) withCredentials(ctx context.Context) context.Context {
+	for key, values := range c.credentials {
+		for _, value := range values {
+			ctx = metadata.AppendToOutgoingContext(ctx, key, value)
+		}
+	}
+	return ctx
+}
+
+// Close closes the connection.
+func (c *EventStoreGrpcClient) Close() error {
+	return c.conn.Close()
+}
+
+// Append adds events to an aggregate if it is at the expected version
+// (models.AnyVersion skips the check, models.NoStream expects a new aggregate).
+// It returns the version of the aggregate after the append.
+func (c *EventStoreGrpcClient) Append(ctx context.Context, aggregateId string, expectedVersion int64, events []models.Event) (int64, error) {
+	return c.AppendWithIdempotencyKey(ctx, aggregateId, expectedVersion, "", events)
+}
+
+// AppendWithIdempotencyKey works like Append, but derives the ids of events
+// without one from the idempotency key so that retries are not written twice.
+func (c *EventStoreGrpcClient) AppendWithIdempotencyKey(ctx context.Context, aggregateId string, expectedVersion int64, idempotencyKey string, events []models.Event) (int64, error) {
+	var trailer metadata.MD
+	resp, err := c.client.Append(c.withCredentials(ctx), &eventpb.AppendRequest{
+		AggregateId:     aggregateId,
+		ExpectedVersion: expectedVersion,
+		Events:          eventpb.FromEvents(events).Events,
+		IdempotencyKey:  idempotencyKey,
+	}, grpc.Trailer(&trailer))
+	if err != nil {
+		return 0, appendError(err, aggregateId, expectedVersion, trailer)
+	}
+	return resp.GetVersion(), nil
+}
+
+// appendError turns the status of a failed append into the errors of the HTTP client.
+func appendError(err error, aggregateId string, expectedVersion int64, trailer metadata.MD) error {
+	switch status.Code(err) {
+	case codes.FailedPrecondition:
+		wrongVersion := &customerrors.WrongExpectedVersionError{AggregateId: aggregateId, ExpectedVersion: expectedVersion}
+		if values := trailer.Get(eventpb.CurrentVersionTrailer); len(values) > 0 {
+			wrongVersion.CurrentVersion, _ = strconv.ParseInt(values[0], 10, 64)
+		}
+		return wrongVersion
+	case codes.AlreadyExists:
+		return &customerrors.DuplicateVersionError{}
+	case codes.Aborted:
+		return &customerrors.EventIdConflictError{}
+	case codes.NotFound:
+		return &customerrors.AggregateDeletedError{AggregateId: aggregateId}
+	case codes.Unauthenticated:
+		return &customerrors.UnauthenticatedError{Reason: status.Convert(err).Message()}
+	}
+	return err
+}
+
+// ReadAggregate streams the events of an aggregate with a version between
+// fromVersion and toVersion, both inclusive. A toVersion <= 0 reads up to the
+// newest event and a limit <= 0 reads all events of the range.
+func (c *EventStoreGrpcClient) ReadAggregate(ctx context.Context, aggregateId string, fromVersion int64, toVersion int64, direction models.ReadDirection, limit int) (*EventStream, error) {
+	stream, err := c.client.ReadAggregate(c.withCredentials(ctx), &eventpb.ReadAggregateRequest{
+		AggregateId: aggregateId,
+		FromVersion: fromVersion,
+		ToVersion:   toVersion,
+		Backward:    direction == models.Backward,
+		Limit:       int32(limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &EventStream{stream: stream}, nil
+}
+
+// ReadAll streams the events of all aggregates written after the event with the
+// given id. An empty id starts at the beginning and a limit <= 0 reads all events.
+func (c *EventStoreGrpcClient) ReadAll(ctx context.Context, afterEventId string, limit int) (*EventStream, error) {
+	stream, err := c.client.ReadAll(c.withCredentials(ctx), &eventpb.ReadAllRequest{
+		AfterEventId: afterEventId,
+		Limit:        int32(limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &EventStream{stream: stream}, nil
+}
+
+// Subscribe streams the events written after the event with the given id and
+// keeps streaming new events until ctx is cancelled. Aggregate types restrict
+// the subscription to events of these types.
+func (c *EventStoreGrpcClient) Subscribe(ctx context.Context, afterEventId string, aggregateTypes ...string) (*EventStream, error) {
+	stream, err := c.client.Subscribe(c.withCredentials(ctx), &eventpb.SubscribeRequest{
+		AfterEventId:   afterEventId,
+		AggregateTypes: aggregateTypes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &EventStream{stream: stream}, nil
+}
+
+// EventStream receives the events of a streaming call.
+type EventStream struct {
+	stream grpc.ServerStreamingClient[eventpb.Event]
+}
+
+// Recv returns the next event. It returns io.EOF once the stream is complete.
+func (s *EventStream) Recv() (*models.Event, error) {
+	message, err := s.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	event := message.ToModel()
+	return &event, nil
+}
+
+// Collect receives all remaining events of the stream.
+func (s *EventStream) Collect() ([]models.Event, error) {
+	events := []models.Event{}
+	for {
+		message, err := s.stream.Recv()
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, message.ToModel())
+	}
+}
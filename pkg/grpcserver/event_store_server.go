@@ -0,0 +1,344 @@
+// Package grpcserver serves the gRPC API of the event store on top of the
+// same repository as the HTTP API.
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/auth"
+	"github.com/L4B0MB4/EVTSRC/pkg/eventpb"
+	"github.com/L4B0MB4/EVTSRC/pkg/helper"
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/L4B0MB4/EVTSRC/pkg/tcp/server"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// ListenAddress is the address the gRPC API listens on.
+	ListenAddress = "0.0.0.0:5530"
+	// pageSize is the number of events read from the repository at once.
+	pageSize = 100
+)
+
+// EventStoreServer implements the EventStore gRPC service.
+type EventStoreServer struct {
+	eventpb.UnimplementedEventStoreServer
+	repo       *store.EventRepository
+	tcpServer  *server.TcpEventServer
+	grpcServer *grpc.Server
+}
+
+// NewEventStoreServer creates a new EventStoreServer. Appends are announced to
+// the consumers of the tcp server like appends over HTTP; tcpServer may be nil.
+// The options configure the gRPC server, e.g. the interceptors authenticating calls.
+func NewEventStoreServer(repo *store.EventRepository, tcpServer *server.TcpEventServer, opts ...grpc.ServerOption) *EventStoreServer {
+	s := &EventStoreServer{
+		repo:       repo,
+		tcpServer:  tcpServer,
+		grpcServer: grpc.NewServer(opts...),
+	}
+	eventpb.RegisterEventStoreServer(s.grpcServer, s)
+	return s
+}
+
+// Start listens on ListenAddress and serves requests until Stop is called.
+func (s *EventStoreServer) Start() error {
+	listener, err := net.Listen("tcp", ListenAddress)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to listen for gRPC")
+		return err
+	}
+	return s.grpcServer.Serve(listener)
+}
+
+// Stop closes the listener and all open streams.
+func (s *EventStoreServer) Stop() {
+	s.grpcServer.Stop()
+}
+
+// Append adds events to an aggregate if it is at the expected version.
+// Events without an id get one derived from the idempotency key, if given.
+// The caller needs Append on the aggregate and the types of the events.
+func (s *EventStoreServer) Append(ctx context.Context, req *eventpb.AppendRequest) (*eventpb.AppendResponse, error) {
+	aggregateId := req.GetAggregateId()
+	if len(strings.TrimSpace(aggregateId)) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "aggregate id cant be empty")
+	}
+	if len(req.GetEvents()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "events cant be empty")
+	}
+	events := make([]models.Event, 0, len(req.GetEvents()))
+	for i, message := range req.GetEvents() {
+		event := message.ToModel()
+		event.AggregateId = aggregateId
+		if len(event.Id) == 0 && len(req.GetIdempotencyKey()) > 0 {
+			event.Id = helper.IdempotentEventId(req.GetIdempotencyKey(), aggregateId, i)
+		}
+		if err := validateEvent(event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	for _, event := range events {
+		if err := s.authorize(ctx, models.Append, event.AggregateType, aggregateId); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.authorizeAggregate(ctx, models.Append, aggregateId, events[0].AggregateType); err != nil {
+		return nil, err
+	}
+
+	err := s.repo.AppendToAggregates([]models.StreamAppend{{
+		AggregateId:     aggregateId,
+		ExpectedVersion: req.GetExpectedVersion(),
+		Events:          events,
+	}})
+	if err != nil {
+		return nil, appendError(ctx, err)
+	}
+	if s.tcpServer != nil {
+		s.tcpServer.SendEvent("NewEvent")
+	}
+	version := events[0].Version
+	for _, event := range events {
+		version = max(version, event.Version)
+	}
+	return &eventpb.AppendResponse{Version: version}, nil
+}
+
+// authorize checks that the caller may perform the operation on an aggregate.
+func (s *EventStoreServer) authorize(ctx context.Context, operation models.Operation, aggregateType string, aggregateId string) error {
+	allowed, err := s.repo.AccessRules().Allows(auth.PrincipalFromContext(ctx), operation, aggregateType, aggregateId)
+	if err != nil {
+		log.Info().Err(err).Msg("Error checking access rules")
+		return status.Error(codes.Internal, "unkown error occured")
+	}
+	if !allowed {
+		return status.Error(codes.PermissionDenied, "access denied")
+	}
+	return nil
+}
+
+// authorizeAggregate checks that the caller may perform the operation on a stored
+// aggregate, by the type the aggregate was created with. An unknown aggregate is
+// checked with the given type.
+func (s *EventStoreServer) authorizeAggregate(ctx context.Context, operation models.Operation, aggregateId string, aggregateType string) error {
+	aggregate, err := s.repo.GetAggregate(aggregateId)
+	var notFound *customerrors.AggregateNotFoundError
+	if err != nil && !errors.As(err, &notFound) {
+		return status.Error(codes.Internal, "unkown error occured")
+	}
+	if err == nil {
+		aggregateType = aggregate.Type
+	}
+	return s.authorize(ctx, operation, aggregateType, aggregateId)
+}
+
+// readFeed reads the events after the cursor of the aggregates the caller may
+// both read and subscribe to, like the feeds of the HTTP API.
+func (s *EventStoreServer) readFeed(ctx context.Context, cursor string, limit int) ([]models.Event, error) {
+	scopes, all, err := s.repo.AccessRules().Scopes(auth.PrincipalFromContext(ctx), models.Read, models.Subscribe)
+	if err != nil {
+		log.Info().Err(err).Msg("Error checking access rules")
+		return nil, status.Error(codes.Internal, "unkown error occured")
+	}
+	var events []models.Event
+	if all {
+		events, err = s.repo.GetEventsSinceEvent(cursor, limit)
+	} else {
+		events, err = s.repo.GetScopedEventsSinceEvent(cursor, limit, scopes)
+	}
+	if err != nil {
+		return nil, feedError(err)
+	}
+	return events, nil
+}
+
+// validateEvent checks the fields the HTTP API requires as well.
+func validateEvent(event models.Event) error {
+	if event.Version <= 0 || len(event.Name) == 0 || len(event.AggregateType) == 0 || len(event.Data) == 0 {
+		return status.Error(codes.InvalidArgument, "events need a version, name, aggregate type and data")
+	}
+	if len(event.Id) > 0 {
+		if _, err := uuid.Parse(event.Id); err != nil {
+			return status.Error(codes.InvalidArgument, "event id has to be a uuid")
+		}
+	}
+	return nil
+}
+
+// appendError turns an error of the repository into a gRPC status.
+func appendError(ctx context.Context, err error) error {
+	var wrongVersion *customerrors.WrongExpectedVersionError
+	if errors.As(err, &wrongVersion) {
+		grpc.SetTrailer(ctx, metadata.Pairs(eventpb.CurrentVersionTrailer, strconv.FormatInt(wrongVersion.CurrentVersion, 10)))
+		return status.Error(codes.FailedPrecondition, wrongVersion.Error())
+	}
+	var deleted *customerrors.AggregateDeletedError
+	if errors.As(err, &deleted) {
+		return status.Error(codes.NotFound, deleted.Error())
+	}
+	var destroyed *customerrors.SubjectKeyDestroyedError
+	if errors.As(err, &destroyed) {
+		return status.Error(codes.PermissionDenied, destroyed.Error())
+	}
+	var duplicate *customerrors.DuplicateVersionError
+	if errors.As(err, &duplicate) {
+		return status.Error(codes.AlreadyExists, duplicate.Error())
+	}
+	var idConflict *customerrors.EventIdConflictError
+	if errors.As(err, &idConflict) {
+		return status.Error(codes.Aborted, idConflict.Error())
+	}
+	var schemaViolation *customerrors.SchemaValidationError
+	if errors.As(err, &schemaViolation) {
+		messages := []string{}
+		for _, violation := range schemaViolation.Violations {
+			messages = append(messages, violation.Name+violation.InstanceLocation+": "+violation.Message)
+		}
+		return status.Error(codes.InvalidArgument, schemaViolation.Error()+": "+strings.Join(messages, "; "))
+	}
+	var invalidSignature *customerrors.InvalidSignatureError
+	if errors.As(err, &invalidSignature) {
+		return status.Error(codes.InvalidArgument, invalidSignature.Error())
+	}
+	return status.Error(codes.Internal, "unkown error occured")
+}
+
+// ReadAggregate streams the events of an aggregate within a version range in
+// pages. The caller needs Read on the aggregate.
+func (s *EventStoreServer) ReadAggregate(req *eventpb.ReadAggregateRequest, stream grpc.ServerStreamingServer[eventpb.Event]) error {
+	if len(strings.TrimSpace(req.GetAggregateId())) == 0 {
+		return status.Error(codes.InvalidArgument, "aggregate id cant be empty")
+	}
+	if err := s.authorizeAggregate(stream.Context(), models.Read, req.GetAggregateId(), ""); err != nil {
+		return err
+	}
+	direction := models.Forward
+	if req.GetBackward() {
+		direction = models.Backward
+	}
+	from, to := req.GetFromVersion(), req.GetToVersion()
+	remaining := int(req.GetLimit())
+	for {
+		limit := pageSize
+		if remaining > 0 {
+			limit = min(limit, remaining)
+		}
+		events, err := s.repo.ReadEventRange(req.GetAggregateId(), from, to, direction, limit)
+		var deleted *customerrors.AggregateDeletedError
+		if errors.As(err, &deleted) {
+			return status.Error(codes.NotFound, deleted.Error())
+		}
+		if err != nil {
+			return status.Error(codes.Internal, "could not read events")
+		}
+		if err = s.send(stream, events); err != nil {
+			return err
+		}
+		if remaining > 0 {
+			remaining -= len(events)
+		}
+		if len(events) < limit || req.GetLimit() > 0 && remaining <= 0 {
+			return nil
+		}
+		last := events[len(events)-1].Version
+		if direction == models.Forward {
+			from = last + 1
+		} else if to = last - 1; to < max(from, 1) {
+			return nil
+		}
+	}
+}
+
+// ReadAll streams the events of all aggregates written after a cursor in pages,
+// skipping aggregates the caller may not both read and subscribe to.
+func (s *EventStoreServer) ReadAll(req *eventpb.ReadAllRequest, stream grpc.ServerStreamingServer[eventpb.Event]) error {
+	cursor := req.GetAfterEventId()
+	remaining := int(req.GetLimit())
+	for {
+		limit := pageSize
+		if remaining > 0 {
+			limit = min(limit, remaining)
+		}
+		events, err := s.readFeed(stream.Context(), cursor, limit)
+		if err != nil {
+			return err
+		}
+		if err = s.send(stream, events); err != nil {
+			return err
+		}
+		if remaining > 0 {
+			remaining -= len(events)
+		}
+		if len(events) < limit || req.GetLimit() > 0 && remaining <= 0 {
+			return nil
+		}
+		cursor = events[len(events)-1].Id
+	}
+}
+
+// Subscribe catches up from the cursor and then streams events as they are
+// committed, until the client cancels. Like ReadAll it skips aggregates the
+// caller may not both read and subscribe to.
+func (s *EventStoreServer) Subscribe(req *eventpb.SubscribeRequest, stream grpc.ServerStreamingServer[eventpb.Event]) error {
+	cursor := req.GetAfterEventId()
+	for {
+		committed := s.repo.NextCommit()
+		events, err := s.readFeed(stream.Context(), cursor, pageSize)
+		if err != nil {
+			return err
+		}
+		read := len(events)
+		if read > 0 {
+			cursor = events[read-1].Id
+		}
+		if len(req.GetAggregateTypes()) > 0 {
+			events = slices.DeleteFunc(events, func(event models.Event) bool {
+				return !slices.Contains(req.GetAggregateTypes(), event.AggregateType)
+			})
+		}
+		if err = s.send(stream, events); err != nil {
+			return err
+		}
+		if read == pageSize {
+			continue
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-committed:
+		}
+	}
+}
+
+// feedError returns the status of an error returned while reading the global feed.
+func feedError(err error) error {
+	var notFound *customerrors.EventNotFoundError
+	if errors.As(err, &notFound) {
+		return status.Error(codes.NotFound, "cursor event does not exist")
+	}
+	return status.Error(codes.Internal, "could not read events")
+}
+
+// send writes the events to the stream.
+func (s *EventStoreServer) send(stream grpc.ServerStreamingServer[eventpb.Event], events []models.Event) error {
+	for _, event := range events {
+		if err := stream.Send(eventpb.FromEvent(event)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
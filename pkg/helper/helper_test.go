@@ -180,3 +180,17 @@ func TestInt62SplitAndMergeEx2(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// TestIdempotentEventIdIsStable tests that the same key derives the same ids.
+func TestIdempotentEventIdIsStable(t *testing.T) {
+	first := helper.IdempotentEventId("key", "aggregate", 0)
+	if first != helper.IdempotentEventId("key", "aggregate", 0) {
+		t.Error("Same key, aggregate and index should derive the same id")
+	}
+	if first == helper.IdempotentEventId("key", "aggregate", 1) {
+		t.Error("Different index should derive a different id")
+	}
+	if first == helper.IdempotentEventId("key", "otheraggregate", 0) {
+		t.Error("Different aggregate should derive a different id")
+	}
+}
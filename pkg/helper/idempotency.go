@@ -0,0 +1,17 @@
+package helper
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// idempotencyNamespace is the UUID namespace of event ids derived from idempotency keys.
+var idempotencyNamespace = uuid.MustParse("6f0c9a52-3c4e-4f55-9a0e-3b7d0f1f5c21")
+
+// IdempotentEventId derives a stable event id from an idempotency key, the
+// aggregate id and the position of the event in its batch.
+func IdempotentEventId(idempotencyKey string, aggregateId string, index int) string {
+	name := fmt.Sprintf("%s/%s/%d", aggregateId, idempotencyKey, index)
+	return uuid.NewSHA1(idempotencyNamespace, []byte(name)).String()
+}
@@ -0,0 +1,485 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/gin-gonic/gin"
+)
+
+// AdminController handles HTTP requests for administrative tasks.
+type AdminController struct {
+	repo *store.EventRepository
+}
+
+// NewAdminController creates a new AdminController.
+func NewAdminController(repo *store.EventRepository) *AdminController {
+	return &AdminController{
+		repo: repo,
+	}
+}
+
+// RequireAdmin rejects callers without the admin operation on all aggregates
+// with 403. It runs before the administrative routes.
+func (ctrl *AdminController) RequireAdmin(c *gin.Context) {
+	if !authorize(c, ctrl.repo.AccessRules(), models.Admin, "", "") {
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// DeleteAggregate handles the deletion of a given aggregate ID. The mode query
+// param selects a soft (default) or hard deletion.
+func (ctrl *AdminController) DeleteAggregate(c *gin.Context) {
+	aggregateId := c.Param("aggregateId")
+	if len(strings.TrimSpace(aggregateId)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Path param cant be empty or null"})
+		return
+	}
+	mode := models.DeletionMode(c.DefaultQuery("mode", string(models.SoftDelete)))
+	if mode != models.SoftDelete && mode != models.HardDelete {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mode value"})
+		return
+	}
+	err := ctrl.repo.DeleteAggregate(aggregateId, mode)
+	if err != nil {
+		var notFound *customerrors.AggregateNotFoundError
+		if errors.As(err, &notFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Aggregate not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// DestroySubjectKey handles destroying the encryption key of a given subject.
+// The data of the subject's events becomes unreadable, the events themselves stay.
+func (ctrl *AdminController) DestroySubjectKey(c *gin.Context) {
+	subject := c.Param("subject")
+	if len(strings.TrimSpace(subject)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Path param cant be empty or null"})
+		return
+	}
+	err := ctrl.repo.DestroySubjectKey(subject)
+	if err != nil {
+		var notFound *customerrors.SubjectNotFoundError
+		if errors.As(err, &notFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subject not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// SetCompressionDictionary handles storing the zstd dictionary sent as request body
+// for a given aggregate type. New events of the type are compressed with it.
+func (ctrl *AdminController) SetCompressionDictionary(c *gin.Context) {
+	aggregateType := c.Param("aggregateType")
+	if len(strings.TrimSpace(aggregateType)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Path param cant be empty or null"})
+		return
+	}
+	dictionary, err := c.GetRawData()
+	if err != nil || len(dictionary) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Body must contain the dictionary"})
+		return
+	}
+	writeDictionaryResult(c, ctrl.repo.SetCompressionDictionary(aggregateType, dictionary))
+}
+
+// TrainCompressionDictionary handles training a zstd dictionary on the recent events
+// of a given aggregate type. New events of the type are compressed with it.
+func (ctrl *AdminController) TrainCompressionDictionary(c *gin.Context) {
+	aggregateType := c.Param("aggregateType")
+	if len(strings.TrimSpace(aggregateType)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Path param cant be empty or null"})
+		return
+	}
+	writeDictionaryResult(c, ctrl.repo.TrainCompressionDictionary(aggregateType))
+}
+
+func writeDictionaryResult(c *gin.Context, err error) {
+	if err != nil {
+		var invalid *customerrors.InvalidDictionaryError
+		if errors.As(err, &invalid) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Dictionary can not be used", "reason": invalid.Reason})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListRetentionPolicies handles listing all retention policies.
+func (ctrl *AdminController) ListRetentionPolicies(c *gin.Context) {
+	resp, err := ctrl.repo.RetentionPolicies().ListPolicies()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.JSON(http.StatusOK, &resp)
+}
+
+// GetRetentionPolicy handles retrieving the retention policy of a given aggregate type.
+func (ctrl *AdminController) GetRetentionPolicy(c *gin.Context) {
+	resp, err := ctrl.repo.RetentionPolicies().GetPolicy(c.Param("aggregateType"))
+	if err != nil {
+		var notFound *customerrors.RetentionPolicyNotFoundError
+		if errors.As(err, &notFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Retention policy not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// SetRetentionPolicy handles storing the retention policy of a given aggregate type.
+func (ctrl *AdminController) SetRetentionPolicy(c *gin.Context) {
+	aggregateType := c.Param("aggregateType")
+	if len(strings.TrimSpace(aggregateType)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Path param cant be empty or null"})
+		return
+	}
+	var policy models.RetentionPolicy
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if policy.MaxAgeSeconds < 0 || policy.MaxCount < 0 || policy.TruncateBeforeVersion < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Retention limits must not be negative"})
+		return
+	}
+	policy.AggregateType = aggregateType
+	err := ctrl.repo.RetentionPolicies().SetPolicy(policy)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// DeleteRetentionPolicy handles removing the retention policy of a given aggregate type.
+func (ctrl *AdminController) DeleteRetentionPolicy(c *gin.Context) {
+	err := ctrl.repo.RetentionPolicies().DeletePolicy(c.Param("aggregateType"))
+	if err != nil {
+		var notFound *customerrors.RetentionPolicyNotFoundError
+		if errors.As(err, &notFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Retention policy not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListProducerKeys handles listing all producer keys, including revoked ones.
+func (ctrl *AdminController) ListProducerKeys(c *gin.Context) {
+	resp, err := ctrl.repo.ProducerKeys().ListKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.JSON(http.StatusOK, &resp)
+}
+
+// GetProducerKey handles retrieving a given producer key.
+func (ctrl *AdminController) GetProducerKey(c *gin.Context) {
+	resp, err := ctrl.repo.ProducerKeys().GetKey(c.Param("keyId"))
+	if err != nil {
+		writeProducerKeyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// RegisterProducerKey handles registering the ed25519 public key of a producer
+// under a given key id. Registering the same key again succeeds.
+func (ctrl *AdminController) RegisterProducerKey(c *gin.Context) {
+	keyId := c.Param("keyId")
+	if len(strings.TrimSpace(keyId)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Path param cant be empty or null"})
+		return
+	}
+	var key models.ProducerKey
+	if err := c.ShouldBindJSON(&key); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	key.Id = keyId
+	resp, err := ctrl.repo.ProducerKeys().RegisterKey(key)
+	if err != nil {
+		writeProducerKeyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// RevokeProducerKey handles revoking a given producer key. Events signed with it
+// are rejected afterwards; the key stays to verify the events signed before.
+func (ctrl *AdminController) RevokeProducerKey(c *gin.Context) {
+	resp, err := ctrl.repo.ProducerKeys().RevokeKey(c.Param("keyId"))
+	if err != nil {
+		writeProducerKeyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func writeProducerKeyError(c *gin.Context, err error) {
+	var notFound *customerrors.ProducerKeyNotFoundError
+	if errors.As(err, &notFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Producer key not found"})
+		return
+	}
+	var invalid *customerrors.InvalidProducerKeyError
+	if errors.As(err, &invalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Producer key is invalid", "reason": invalid.Reason})
+		return
+	}
+	var conflict *customerrors.ProducerKeyConflictError
+	if errors.As(err, &conflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A different key is registered with this id"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+}
+
+// ListAPIKeys handles listing all API keys, including revoked ones. Secrets are not returned.
+func (ctrl *AdminController) ListAPIKeys(c *gin.Context) {
+	resp, err := ctrl.repo.APIKeys().ListKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.JSON(http.StatusOK, &resp)
+}
+
+// CreateAPIKey handles creating an API key for the subject and roles in the
+// request body. The response is the only time the key is returned.
+func (ctrl *AdminController) CreateAPIKey(c *gin.Context) {
+	var request models.APIKeyRequest
+	if err := c.ShouldBindJSON(&request); err != nil || len(strings.TrimSpace(request.Subject)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body has to contain a subject"})
+		return
+	}
+	resp, err := ctrl.repo.APIKeys().CreateKey(request.Subject, request.Roles)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.JSON(http.StatusCreated, resp)
+}
+
+// GetAPIKey handles retrieving a given API key without its secret.
+func (ctrl *AdminController) GetAPIKey(c *gin.Context) {
+	resp, err := ctrl.repo.APIKeys().GetKey(c.Param("keyId"))
+	if err != nil {
+		writeAPIKeyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// RevokeAPIKey handles revoking a given API key; requests with it are rejected afterwards.
+func (ctrl *AdminController) RevokeAPIKey(c *gin.Context) {
+	resp, err := ctrl.repo.APIKeys().RevokeKey(c.Param("keyId"))
+	if err != nil {
+		writeAPIKeyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func writeAPIKeyError(c *gin.Context, err error) {
+	var notFound *customerrors.APIKeyNotFoundError
+	if errors.As(err, &notFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+}
+
+// ListAccessRules handles listing all access rules.
+func (ctrl *AdminController) ListAccessRules(c *gin.Context) {
+	resp, err := ctrl.repo.AccessRules().ListRules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.JSON(http.StatusOK, &resp)
+}
+
+// GetAccessRule handles retrieving a given access rule.
+func (ctrl *AdminController) GetAccessRule(c *gin.Context) {
+	resp, err := ctrl.repo.AccessRules().GetRule(c.Param("ruleId"))
+	if err != nil {
+		writeAccessRuleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// SetAccessRule handles creating or replacing the access rule with the id in the path.
+func (ctrl *AdminController) SetAccessRule(c *gin.Context) {
+	var rule models.AccessRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body has to be an access rule"})
+		return
+	}
+	rule.Id = c.Param("ruleId")
+	if err := ctrl.repo.AccessRules().SetRule(rule); err != nil {
+		writeAccessRuleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// DeleteAccessRule handles removing a given access rule.
+func (ctrl *AdminController) DeleteAccessRule(c *gin.Context) {
+	if err := ctrl.repo.AccessRules().DeleteRule(c.Param("ruleId")); err != nil {
+		writeAccessRuleError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func writeAccessRuleError(c *gin.Context, err error) {
+	var notFound *customerrors.AccessRuleNotFoundError
+	if errors.As(err, &notFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Access rule not found"})
+		return
+	}
+	var invalid *customerrors.InvalidAccessRuleError
+	if errors.As(err, &invalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Access rule is invalid", "reason": invalid.Reason})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+}
+
+// ApplyRetention handles applying the retention policies right away instead of
+// waiting for the retention job.
+func (ctrl *AdminController) ApplyRetention(c *gin.Context) {
+	removed, err := ctrl.repo.ApplyRetention()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": removed})
+}
+
+// ArchiveEvents handles moving the data of events older than the olderThan query
+// param (a duration like 720h) to segment files right away.
+func (ctrl *AdminController) ArchiveEvents(c *gin.Context) {
+	olderThan, err := time.ParseDuration(c.Query("olderThan"))
+	if err != nil || olderThan < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid olderThan value"})
+		return
+	}
+	archived, err := ctrl.repo.ArchiveEvents(olderThan)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"archived": archived})
+}
+
+// ListArchiveSegments handles listing the segment files of archived events.
+func (ctrl *AdminController) ListArchiveSegments(c *gin.Context) {
+	resp, err := ctrl.repo.ListArchiveSegments()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.JSON(http.StatusOK, &resp)
+}
+
+// Backup handles taking an online backup of the store to the target directory of
+// the request body. The target is resolved within the backup directory, absolute
+// paths and paths leaving it are rejected.
+func (ctrl *AdminController) Backup(c *gin.Context) {
+	var request models.BackupRequest
+	if err := c.ShouldBindJSON(&request); err != nil || len(strings.TrimSpace(request.Target)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if !filepath.IsLocal(request.Target) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Backup target has to be a relative path within the backup directory"})
+		return
+	}
+	backup, err := ctrl.repo.Backup(filepath.Join(store.GetBackupDirectory(), request.Target))
+	if err != nil {
+		var exists *customerrors.BackupTargetExistsError
+		if errors.As(err, &exists) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.JSON(http.StatusCreated, backup)
+}
+
+// ExportEvents handles streaming the events matching the query params aggregateId,
+// aggregateType, after and until as newline-delimited JSON.
+func (ctrl *AdminController) ExportEvents(c *gin.Context) {
+	var filter models.ExportFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query params"})
+		return
+	}
+	c.Header("Content-Type", models.NDJSONContentType)
+	_, err := ctrl.repo.ExportEvents(filter, c.Writer)
+	if err == nil {
+		return
+	}
+	if c.Writer.Written() {
+		// the status was already sent, ending the stream early is all that is left
+		c.Abort()
+		return
+	}
+	var notFound *customerrors.EventNotFoundError
+	if errors.As(err, &notFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event bounding the position range does not exist"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+}
+
+// ImportEvents handles importing events from a newline-delimited JSON request body
+// as written by ExportEvents.
+func (ctrl *AdminController) ImportEvents(c *gin.Context) {
+	imported, err := ctrl.repo.ImportEvents(c.Request.Body)
+	if err != nil {
+		var importErr *customerrors.ImportError
+		if !errors.As(err, &importErr) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+			return
+		}
+		status := http.StatusInternalServerError
+		switch importErr.Err.(type) {
+		case nil, *customerrors.SchemaValidationError:
+			status = http.StatusBadRequest
+		case *customerrors.DuplicateVersionError, *customerrors.EventIdConflictError, *customerrors.SubjectKeyDestroyedError, *customerrors.AggregateDeletedError:
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": "Import stopped", "reason": importErr.Reason, "line": importErr.Line, "imported": importErr.Imported})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"imported": imported})
+}
@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// AggregateVersionHeader carries the current version of an aggregate.
+	AggregateVersionHeader = "X-Aggregate-Version"
+	// AggregateTypeHeader carries the type of an aggregate.
+	AggregateTypeHeader = "X-Aggregate-Type"
+)
+
+// AggregateController handles HTTP requests for the aggregate catalogue.
+type AggregateController struct {
+	repo *store.EventRepository
+}
+
+// NewAggregateController creates a new AggregateController.
+func NewAggregateController(repo *store.EventRepository) *AggregateController {
+	return &AggregateController{
+		repo: repo,
+	}
+}
+
+// ListAggregates handles listing aggregates, optionally filtered by type.
+// Pages are requested with the id of the last aggregate of the previous page.
+// Only aggregates the caller may read are listed.
+func (ctrl *AggregateController) ListAggregates(c *gin.Context) {
+	limit, ok := parseLimit(c)
+	if !ok {
+		return
+	}
+	readable, all, ok := scopes(c, ctrl.repo.AccessRules(), models.Read)
+	if !ok {
+		return
+	}
+	var resp []models.AggregateSummary
+	var err error
+	if all {
+		resp, err = ctrl.repo.ListAggregates(c.Query("type"), c.Query("after"), limit)
+	} else {
+		resp, err = ctrl.repo.ListScopedAggregates(c.Query("type"), c.Query("after"), limit, readable)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.JSON(http.StatusOK, &resp)
+}
+
+// GetAggregate handles the retrieval of the summary of a given aggregate ID.
+func (ctrl *AggregateController) GetAggregate(c *gin.Context) {
+	aggregateId := c.Param("aggregateId")
+	if len(strings.TrimSpace(aggregateId)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Path param cant be empty or null"})
+		return
+	}
+	if !authorizeAggregate(c, ctrl.repo, models.Read, aggregateId, "") {
+		return
+	}
+	resp, err := ctrl.repo.GetAggregate(aggregateId)
+	if err != nil {
+		var notFound *customerrors.AggregateNotFoundError
+		if errors.As(err, &notFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Aggregate not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// VerifyAggregate handles walking the hash chain of a given aggregate ID. A broken
+// chain is reported in the body, not by the status.
+func (ctrl *AggregateController) VerifyAggregate(c *gin.Context) {
+	aggregateId := c.Param("aggregateId")
+	if len(strings.TrimSpace(aggregateId)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Path param cant be empty or null"})
+		return
+	}
+	if !authorizeAggregate(c, ctrl.repo, models.Read, aggregateId, "") {
+		return
+	}
+	resp, err := ctrl.repo.VerifyAggregate(aggregateId)
+	if err != nil {
+		var notFound *customerrors.AggregateNotFoundError
+		if errors.As(err, &notFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Aggregate not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// HeadAggregate handles the lookup of the current version and type of a given
+// aggregate ID. Both are returned as headers without a body.
+func (ctrl *AggregateController) HeadAggregate(c *gin.Context) {
+	aggregateId := c.Param("aggregateId")
+	if len(strings.TrimSpace(aggregateId)) == 0 {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if !authorizeAggregate(c, ctrl.repo, models.Read, aggregateId, "") {
+		return
+	}
+	version, aggregateType, err := ctrl.repo.GetCurrentVersion(aggregateId)
+	if err != nil {
+		var notFound *customerrors.AggregateNotFoundError
+		if errors.As(err, &notFound) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		var deleted *customerrors.AggregateDeletedError
+		if errors.As(err, &deleted) {
+			c.Status(http.StatusGone)
+			return
+		}
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Header(AggregateVersionHeader, strconv.FormatInt(version, 10))
+	c.Header(AggregateTypeHeader, aggregateType)
+	c.Status(http.StatusOK)
+}
+
+// GetStats handles the retrieval of global event store statistics.
+func (ctrl *AggregateController) GetStats(c *gin.Context) {
+	resp, err := ctrl.repo.GetStats()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
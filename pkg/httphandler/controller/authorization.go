@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/auth"
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// authorize checks that the caller may perform the operation on an aggregate.
+// It writes a forbidden response and returns false if not.
+func authorize(c *gin.Context, rules *store.AccessRules, operation models.Operation, aggregateType string, aggregateId string) bool {
+	allowed, err := rules.Allows(auth.PrincipalFrom(c), operation, aggregateType, aggregateId)
+	if err != nil {
+		log.Info().Err(err).Msg("Error checking access rules")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return false
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return false
+	}
+	return true
+}
+
+// authorizeAggregate checks that the caller may perform the operation on a stored
+// aggregate, by the type the aggregate was created with. An unknown aggregate is
+// checked with the given type. It writes an error response and returns false if
+// the operation is not allowed.
+func authorizeAggregate(c *gin.Context, repo *store.EventRepository, operation models.Operation, aggregateId string, aggregateType string) bool {
+	aggregate, err := repo.GetAggregate(aggregateId)
+	var notFound *customerrors.AggregateNotFoundError
+	if err != nil && !errors.As(err, &notFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return false
+	}
+	if err == nil {
+		aggregateType = aggregate.Type
+	}
+	return authorize(c, repo.AccessRules(), operation, aggregateType, aggregateId)
+}
+
+// authorizeAppend checks that the caller may append the events to an aggregate,
+// both by the type of the aggregate and the types of the events. Without events
+// the append only checks the expected version, which needs Read on the aggregate.
+func authorizeAppend(c *gin.Context, repo *store.EventRepository, aggregateId string, events []models.Event) bool {
+	if len(events) == 0 {
+		return authorizeAggregate(c, repo, models.Read, aggregateId, "")
+	}
+	for _, event := range events {
+		if !authorize(c, repo.AccessRules(), models.Append, event.AggregateType, aggregateId) {
+			return false
+		}
+	}
+	return authorizeAggregate(c, repo, models.Append, aggregateId, events[0].AggregateType)
+}
+
+// authorizeCondition checks that the caller may read all aggregates of the types
+// the queries of an append condition match, as a failing condition tells whether
+// such events exist. Queries without types match the events of every aggregate.
+func authorizeCondition(c *gin.Context, rules *store.AccessRules, condition *models.AppendCondition) bool {
+	if condition == nil {
+		return true
+	}
+	readable, all, ok := scopes(c, rules, models.Read)
+	if !ok || all {
+		return ok
+	}
+	for _, query := range condition.FailIfEventsMatch {
+		if len(query.AggregateTypes) == 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return false
+		}
+		for _, aggregateType := range query.AggregateTypes {
+			readsType := slices.ContainsFunc(readable, func(scope models.AggregateScope) bool {
+				return len(scope.AggregateIdPrefix) == 0 && scope.AggregateType == aggregateType
+			})
+			if !readsType {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// scopes returns the scopes the caller may perform all of the operations on, or
+// all if every aggregate is allowed. It writes an error response and returns
+// false if the rules cannot be read.
+func scopes(c *gin.Context, rules *store.AccessRules, operations ...models.Operation) ([]models.AggregateScope, bool, bool) {
+	scopes, all, err := rules.Scopes(auth.PrincipalFrom(c), operations...)
+	if err != nil {
+		log.Info().Err(err).Msg("Error checking access rules")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return nil, false, false
+	}
+	return scopes, all, true
+}
@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/codec"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// bindBody decodes the request body according to its Content-Type and validates it.
+// It writes an error response and returns false if that is not possible.
+func bindBody(c *gin.Context, v any) bool {
+	mediaType, ok := codec.MediaType(c.ContentType())
+	if !ok {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported content type"})
+		return false
+	}
+	if mediaType == codec.JSON {
+		if err := c.ShouldBindJSON(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return false
+		}
+		return true
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err == nil {
+		err = codec.Unmarshal(mediaType, body, v)
+	}
+	if err == nil {
+		err = binding.Validator.ValidateStruct(v)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// render writes v in the encoding the Accept header asks for, JSON by default.
+func render(c *gin.Context, status int, v any) {
+	mediaType := codec.Negotiate(c.GetHeader("Accept"))
+	if mediaType == codec.JSON {
+		c.JSON(status, v)
+		return
+	}
+	body, err := codec.Marshal(mediaType, v)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.Data(status, mediaType, body)
+}
@@ -5,13 +5,18 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/L4B0MB4/EVTSRC/pkg/helper"
 	"github.com/L4B0MB4/EVTSRC/pkg/models"
 	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
 	"github.com/L4B0MB4/EVTSRC/pkg/store"
 	"github.com/L4B0MB4/EVTSRC/pkg/tcp/server"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
+// IdempotencyKeyHeader identifies a batch of events across retries.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
 // EventController handles HTTP requests for events.
 type EventController struct {
 	repo      *store.EventRepository
@@ -27,6 +32,8 @@ func NewEventController(repo *store.EventRepository, tcpServer *server.TcpEventS
 }
 
 // GetEventsForAggregate handles the retrieval of events for a given aggregate ID.
+// The optional direction (forward, backward) and limit query params allow reading
+// only the newest events.
 func (ctrl *EventController) GetEventsForAggregate(c *gin.Context) {
 
 	aggregateId := c.Param("aggregateId")
@@ -36,19 +43,44 @@ func (ctrl *EventController) GetEventsForAggregate(c *gin.Context) {
 		return
 	}
 
-	resp, err := ctrl.repo.GetEventsForAggregate(aggregateId)
+	direction := models.ReadDirection(c.DefaultQuery("direction", string(models.Forward)))
+	if direction != models.Forward && direction != models.Backward {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid direction value"})
+		return
+	}
+	limit := 0
+	if limitStr := c.Query("limit"); len(strings.TrimSpace(limitStr)) > 0 {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit value"})
+			return
+		}
+	}
+
+	if !authorizeAggregate(c, ctrl.repo, models.Read, aggregateId, "") {
+		return
+	}
+
+	resp, err := ctrl.repo.ReadEventsForAggregate(aggregateId, direction, limit)
 	if err != nil {
+		if deleted, ok := err.(*customerrors.AggregateDeletedError); ok {
+			writeDeletedError(c, deleted)
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
 		return
 	}
 	if len(resp) == 0 {
-		c.JSON(http.StatusOK, []models.Event{})
+		render(c, http.StatusOK, []models.Event{})
 		return
 	}
-	c.JSON(http.StatusOK, &resp)
+	render(c, http.StatusOK, resp)
 }
 
 // AddEventToAggregate handles the addition of events to a given aggregate ID.
+// Events may carry their own ids; with an Idempotency-Key header, events without
+// an id get one derived from the key. Retrying an already committed batch succeeds.
 func (ctrl *EventController) AddEventToAggregate(c *gin.Context) {
 	var events []models.Event
 	aggregateId := c.Param("aggregateId")
@@ -56,32 +88,222 @@ func (ctrl *EventController) AddEventToAggregate(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Path param cant be empty or null"})
 		return
 	}
-	if err := c.ShouldBindJSON(&events); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !bindBody(c, &events) {
 		return
 	}
-	for i := range events {
-		events[i].AggregateId = aggregateId
+	idempotencyKey := strings.TrimSpace(c.GetHeader(IdempotencyKeyHeader))
+	if !prepareEvents(c, aggregateId, events, idempotencyKey, 0) {
+		return
+	}
+	if !authorizeAppend(c, ctrl.repo, aggregateId, events) {
+		return
 	}
 	err := ctrl.repo.AddEvents(events)
 	if err != nil {
-		_, ok := err.(*customerrors.DuplicateVersionError)
-		if ok {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Error trying to add the same event multiple times"})
+		writeAppendError(c, err)
+		return
+	}
+	ctrl.tcpServer.SendEvent("NewEvent")
+}
+
+// AppendTransaction handles appending events to several aggregates at once.
+// Every aggregate has to be at its expected version and the optional condition
+// has to hold, otherwise nothing is written.
+func (ctrl *EventController) AppendTransaction(c *gin.Context) {
+	var transaction models.AppendTransaction
+	if !bindBody(c, &transaction) {
+		return
+	}
+	idempotencyKey := strings.TrimSpace(c.GetHeader(IdempotencyKeyHeader))
+	index := 0
+	for _, streamAppend := range transaction.Appends {
+		if len(strings.TrimSpace(streamAppend.AggregateId)) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "AggregateId cant be empty or null"})
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		if !prepareEvents(c, streamAppend.AggregateId, streamAppend.Events, idempotencyKey, index) {
+			return
+		}
+		if !authorizeAppend(c, ctrl.repo, streamAppend.AggregateId, streamAppend.Events) {
+			return
+		}
+		index += len(streamAppend.Events)
+	}
+	if !authorizeCondition(c, ctrl.repo.AccessRules(), transaction.Condition) {
+		return
+	}
+	err := ctrl.repo.AppendToAggregatesIf(transaction.Appends, transaction.Condition)
+	if err != nil {
+		writeAppendError(c, err)
 		return
 	}
 	ctrl.tcpServer.SendEvent("NewEvent")
 }
 
+// prepareEvents assigns the aggregate ID to the events and derives missing event
+// ids from the idempotency key, numbering them from index. It writes a bad request
+// response and returns false if an event id is not a uuid.
+func prepareEvents(c *gin.Context, aggregateId string, events []models.Event, idempotencyKey string, index int) bool {
+	for i := range events {
+		events[i].AggregateId = aggregateId
+		if len(events[i].Id) == 0 && len(idempotencyKey) > 0 {
+			events[i].Id = helper.IdempotentEventId(idempotencyKey, aggregateId, index+i)
+		}
+		if len(events[i].Id) > 0 {
+			if _, err := uuid.Parse(events[i].Id); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Event id has to be a uuid"})
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// writeAppendError writes the response for an error returned while appending events.
+func writeAppendError(c *gin.Context, err error) {
+	_, ok := err.(*customerrors.DuplicateVersionError)
+	if ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error trying to add the same event multiple times"})
+		return
+	}
+	_, ok = err.(*customerrors.EventIdConflictError)
+	if ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "Event id is already used by a different event"})
+		return
+	}
+	wrongVersion, ok := err.(*customerrors.WrongExpectedVersionError)
+	if ok {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":           "Aggregate is not at the expected version",
+			"aggregateId":     wrongVersion.AggregateId,
+			"expectedVersion": wrongVersion.ExpectedVersion,
+			"currentVersion":  wrongVersion.CurrentVersion,
+		})
+		return
+	}
+	_, ok = err.(*customerrors.AppendConditionFailedError)
+	if ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "Events matching the append condition were written", "conditionFailed": true})
+		return
+	}
+	_, ok = err.(*customerrors.EventNotFoundError)
+	if ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Event referenced by the append condition does not exist"})
+		return
+	}
+	destroyed, ok := err.(*customerrors.SubjectKeyDestroyedError)
+	if ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "Key of the subject was destroyed", "subject": destroyed.Subject})
+		return
+	}
+	deleted, ok := err.(*customerrors.AggregateDeletedError)
+	if ok {
+		writeDeletedError(c, deleted)
+		return
+	}
+	schemaViolation, ok := err.(*customerrors.SchemaValidationError)
+	if ok {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Event data does not match the registered schema", "violations": schemaViolation.Violations})
+		return
+	}
+	invalidSignature, ok := err.(*customerrors.InvalidSignatureError)
+	if ok {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":        "Event signature is invalid",
+			"eventIndex":   invalidSignature.EventIndex,
+			"signingKeyId": invalidSignature.SigningKeyId,
+			"reason":       invalidSignature.Reason,
+		})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+}
+
+func writeDeletedError(c *gin.Context, err *customerrors.AggregateDeletedError) {
+	c.JSON(http.StatusGone, gin.H{"error": "Aggregate was deleted", "aggregateId": err.AggregateId, "deleted": err.Mode})
+}
+
 // GetEventsSince handles the retrieval of events since a given event ID with a limit.
+// Only events of aggregates the caller may both read and subscribe to are returned. An unknown
+// cursor event is answered with 404 instead of restarting the feed.
 func (ctrl *EventController) GetEventsSince(c *gin.Context) {
 	eventId := c.Param("eventId")
 	if len(strings.TrimSpace(eventId)) == 0 {
 		eventId = "0"
 	}
+	limit, ok := parseLimit(c)
+	if !ok {
+		return
+	}
+	readable, all, ok := scopes(c, ctrl.repo.AccessRules(), models.Read, models.Subscribe)
+	if !ok {
+		return
+	}
+	var resp []models.Event
+	var err error
+	if all {
+		resp, err = ctrl.repo.GetEventsSinceEvent(eventId, limit)
+	} else {
+		resp, err = ctrl.repo.GetScopedEventsSinceEvent(eventId, limit, readable)
+	}
+	if err != nil {
+		writeFeedError(c, err)
+		return
+	}
+	if len(resp) == 0 {
+		render(c, http.StatusOK, []models.Event{})
+		return
+	}
+	render(c, http.StatusOK, resp)
+}
+
+// GetEventsBefore handles the retrieval of events written before a given event ID,
+// newest first, with a limit. The event ID 0 reads from the newest event. Only
+// events of aggregates the caller may both read and subscribe to are returned.
+func (ctrl *EventController) GetEventsBefore(c *gin.Context) {
+	eventId := c.Param("eventId")
+	if len(strings.TrimSpace(eventId)) == 0 {
+		eventId = "0"
+	}
+	limit, ok := parseLimit(c)
+	if !ok {
+		return
+	}
+	readable, all, ok := scopes(c, ctrl.repo.AccessRules(), models.Read, models.Subscribe)
+	if !ok {
+		return
+	}
+	var resp []models.Event
+	var err error
+	if all {
+		resp, err = ctrl.repo.GetEventsBeforeEvent(eventId, limit)
+	} else {
+		resp, err = ctrl.repo.GetScopedEventsBeforeEvent(eventId, limit, readable)
+	}
+	if err != nil {
+		writeFeedError(c, err)
+		return
+	}
+	if len(resp) == 0 {
+		render(c, http.StatusOK, []models.Event{})
+		return
+	}
+	render(c, http.StatusOK, resp)
+}
+
+// writeFeedError writes the response for an error returned while reading a global feed.
+func writeFeedError(c *gin.Context, err error) {
+	_, ok := err.(*customerrors.EventNotFoundError)
+	if ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cursor event does not exist"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+}
+
+// parseLimit reads the optional limit query param, defaulting and capping it at 100.
+// It writes a bad request response and returns false if the value is invalid.
+func parseLimit(c *gin.Context) (int, bool) {
 	limitStr := c.Query("limit")
 	limit := 100
 	if len(strings.TrimSpace(limitStr)) > 0 {
@@ -89,20 +311,11 @@ func (ctrl *EventController) GetEventsSince(c *gin.Context) {
 		limit, err = strconv.Atoi(limitStr)
 		if err != nil || limit <= 0 {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit value"})
-			return
+			return 0, false
 		}
 		if limit > 100 {
 			limit = 100
 		}
 	}
-	resp, err := ctrl.repo.GetEventsSinceEvent(eventId, limit)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
-		return
-	}
-	if len(resp) == 0 {
-		c.JSON(http.StatusOK, []models.Event{})
-		return
-	}
-	c.JSON(http.StatusOK, &resp)
+	return limit, true
 }
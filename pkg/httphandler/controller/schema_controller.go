@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/gin-gonic/gin"
+)
+
+// SchemaController handles HTTP requests for the event schema registry.
+type SchemaController struct {
+	schemas *store.SchemaRegistry
+}
+
+// NewSchemaController creates a new SchemaController.
+func NewSchemaController(schemas *store.SchemaRegistry) *SchemaController {
+	return &SchemaController{
+		schemas: schemas,
+	}
+}
+
+// RegisterSchema handles registering the JSON Schema in the request body for
+// events with the given aggregate type and name and the schema version in the
+// version query param, 1 by default. An existing schema is replaced.
+func (ctrl *SchemaController) RegisterSchema(c *gin.Context) {
+	aggregateType := c.Param("aggregateType")
+	name := c.Param("eventName")
+	version, ok := schemaVersion(c)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil || len(body) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body has to contain a schema"})
+		return
+	}
+	err = ctrl.schemas.RegisterSchema(aggregateType, name, version, body)
+	if err != nil {
+		var invalid *customerrors.InvalidSchemaError
+		if errors.As(err, &invalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Schema is not a valid JSON Schema", "reason": invalid.Reason})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListSchemas handles listing all registered schemas.
+func (ctrl *SchemaController) ListSchemas(c *gin.Context) {
+	resp, err := ctrl.schemas.ListSchemas()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+		return
+	}
+	c.JSON(http.StatusOK, &resp)
+}
+
+// GetSchema handles the retrieval of the schema for a given aggregate type, event
+// name and schema version.
+func (ctrl *SchemaController) GetSchema(c *gin.Context) {
+	version, ok := schemaVersion(c)
+	if !ok {
+		return
+	}
+	resp, err := ctrl.schemas.GetSchema(c.Param("aggregateType"), c.Param("eventName"), version)
+	if err != nil {
+		writeSchemaError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// DeleteSchema handles removing the schema for a given aggregate type, event name
+// and schema version. Events of that version appended afterwards are no longer
+// validated.
+func (ctrl *SchemaController) DeleteSchema(c *gin.Context) {
+	version, ok := schemaVersion(c)
+	if !ok {
+		return
+	}
+	err := ctrl.schemas.DeleteSchema(c.Param("aggregateType"), c.Param("eventName"), version)
+	if err != nil {
+		writeSchemaError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// schemaVersion reads the optional version query param, defaulting to 1. It
+// writes an error response and returns false if the version is invalid.
+func schemaVersion(c *gin.Context) (int, bool) {
+	version, err := strconv.Atoi(c.DefaultQuery("version", "1"))
+	if err != nil || version <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version value"})
+		return 0, false
+	}
+	return version, true
+}
+
+func writeSchemaError(c *gin.Context, err error) {
+	var notFound *customerrors.SchemaNotFoundError
+	if errors.As(err, &notFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schema not found"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Unkown error occured"})
+}
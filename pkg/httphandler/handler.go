@@ -10,21 +10,30 @@ import (
 )
 
 type HttpHandler struct {
-	httpServer      *http.Server
-	router          *gin.Engine
-	eventController *controller.EventController
+	httpServer          *http.Server
+	router              *gin.Engine
+	eventController     *controller.EventController
+	aggregateController *controller.AggregateController
+	schemaController    *controller.SchemaController
+	adminController     *controller.AdminController
 }
 
-func NewHttpHandler(c *controller.EventController) *HttpHandler {
+// NewHttpHandler creates a new HttpHandler. The middleware, like the
+// authentication of the auth package, runs before every route.
+func NewHttpHandler(c *controller.EventController, a *controller.AggregateController, s *controller.SchemaController, ad *controller.AdminController, middleware ...gin.HandlerFunc) *HttpHandler {
 	r := gin.Default()
+	r.Use(middleware...)
 	srv := &http.Server{
 		Addr:    "0.0.0.0" + ":" + "5515",
 		Handler: r,
 	}
 	handler := &HttpHandler{
-		router:          r,
-		httpServer:      srv,
-		eventController: c,
+		router:              r,
+		httpServer:          srv,
+		eventController:     c,
+		aggregateController: a,
+		schemaController:    s,
+		adminController:     ad,
 	}
 
 	handler.RegisterRoutes()
@@ -35,7 +44,46 @@ func NewHttpHandler(c *controller.EventController) *HttpHandler {
 func (h *HttpHandler) RegisterRoutes() {
 	h.router.GET("aggregates/:aggregateId/events", h.eventController.GetEventsForAggregate)
 	h.router.POST("aggregates/:aggregateId/events", h.eventController.AddEventToAggregate)
+	h.router.POST("transactions", h.eventController.AppendTransaction)
 	h.router.GET("/events/:eventId/since", h.eventController.GetEventsSince)
+	h.router.GET("/events/:eventId/before", h.eventController.GetEventsBefore)
+	h.router.GET("aggregates", h.aggregateController.ListAggregates)
+	h.router.GET("aggregates/:aggregateId", h.aggregateController.GetAggregate)
+	h.router.HEAD("aggregates/:aggregateId", h.aggregateController.HeadAggregate)
+	h.router.GET("aggregates/:aggregateId/verify", h.aggregateController.VerifyAggregate)
+	h.router.GET("stats", h.adminController.RequireAdmin, h.aggregateController.GetStats)
+	h.router.GET("schemas", h.schemaController.ListSchemas)
+	h.router.GET("schemas/:aggregateType/:eventName", h.schemaController.GetSchema)
+	h.router.PUT("schemas/:aggregateType/:eventName", h.adminController.RequireAdmin, h.schemaController.RegisterSchema)
+	h.router.DELETE("schemas/:aggregateType/:eventName", h.adminController.RequireAdmin, h.schemaController.DeleteSchema)
+
+	admin := h.router.Group("admin", h.adminController.RequireAdmin)
+	admin.DELETE("aggregates/:aggregateId", h.adminController.DeleteAggregate)
+	admin.DELETE("subjects/:subject/key", h.adminController.DestroySubjectKey)
+	admin.PUT("compression/:aggregateType/dictionary", h.adminController.SetCompressionDictionary)
+	admin.POST("compression/:aggregateType/dictionary/train", h.adminController.TrainCompressionDictionary)
+	admin.GET("retention/policies", h.adminController.ListRetentionPolicies)
+	admin.GET("retention/policies/:aggregateType", h.adminController.GetRetentionPolicy)
+	admin.PUT("retention/policies/:aggregateType", h.adminController.SetRetentionPolicy)
+	admin.DELETE("retention/policies/:aggregateType", h.adminController.DeleteRetentionPolicy)
+	admin.POST("retention/run", h.adminController.ApplyRetention)
+	admin.GET("archive/segments", h.adminController.ListArchiveSegments)
+	admin.POST("archive/run", h.adminController.ArchiveEvents)
+	admin.GET("keys", h.adminController.ListProducerKeys)
+	admin.GET("keys/:keyId", h.adminController.GetProducerKey)
+	admin.PUT("keys/:keyId", h.adminController.RegisterProducerKey)
+	admin.POST("keys/:keyId/revoke", h.adminController.RevokeProducerKey)
+	admin.GET("api-keys", h.adminController.ListAPIKeys)
+	admin.POST("api-keys", h.adminController.CreateAPIKey)
+	admin.GET("api-keys/:keyId", h.adminController.GetAPIKey)
+	admin.POST("api-keys/:keyId/revoke", h.adminController.RevokeAPIKey)
+	admin.GET("access-rules", h.adminController.ListAccessRules)
+	admin.GET("access-rules/:ruleId", h.adminController.GetAccessRule)
+	admin.PUT("access-rules/:ruleId", h.adminController.SetAccessRule)
+	admin.DELETE("access-rules/:ruleId", h.adminController.DeleteAccessRule)
+	admin.POST("backup", h.adminController.Backup)
+	admin.GET("export", h.adminController.ExportEvents)
+	admin.POST("import", h.adminController.ImportEvents)
 }
 
 func (h *HttpHandler) Start() error {
@@ -0,0 +1,239 @@
+package integrationtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/auth"
+	"github.com/L4B0MB4/EVTSRC/pkg/grpcclient"
+	"github.com/L4B0MB4/EVTSRC/pkg/grpcserver"
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func setupGrpc() (*grpcclient.EventStoreGrpcClient, *grpcserver.EventStoreServer, *store.DatabaseConnection) {
+	return setupGrpcWithOptions(func(repository *store.EventRepository) []grpc.ServerOption {
+		return nil
+	})
+}
+
+func setupGrpcWithOptions(options func(repository *store.EventRepository) []grpc.ServerOption) (*grpcclient.EventStoreGrpcClient, *grpcserver.EventStoreServer, *store.DatabaseConnection) {
+	db := store.DatabaseConnection{}
+	db.SetUp()
+	conn, err := db.GetDbConnection()
+	if err != nil {
+		panic(err)
+	}
+	repository := store.NewEventRepository(conn)
+	grpcServer := grpcserver.NewEventStoreServer(repository, nil, options(repository)...)
+	go grpcServer.Start()
+	waitForServer("localhost:5530")
+	grpcClient, err := grpcclient.NewEventStoreGrpcClient("localhost:5530")
+	if err != nil {
+		panic(err)
+	}
+	return grpcClient, grpcServer, &db
+}
+
+func teardownGrpc(grpcClient *grpcclient.EventStoreGrpcClient, grpcServer *grpcserver.EventStoreServer, db *store.DatabaseConnection) {
+	grpcClient.Close()
+	grpcServer.Stop()
+	db.Teardown()
+	// wait until the port is free for the next test
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", "localhost:5530")
+		if err != nil {
+			return
+		}
+		conn.Close()
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func grpcEvents(from int, to int) []models.Event {
+	events := []models.Event{}
+	for v := from; v <= to; v++ {
+		events = append(events, models.Event{Version: int64(v), Name: "counted", Data: []byte{byte(v)}, AggregateType: "counter"})
+	}
+	return events
+}
+
+func TestGrpcAppendAndReadAggregate(t *testing.T) {
+	grpcClient, grpcServer, db := setupGrpc()
+	defer teardownGrpc(grpcClient, grpcServer, db)
+	ctx := context.Background()
+
+	version, err := grpcClient.Append(ctx, "counter1", models.NoStream, grpcEvents(1, 150))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(150), version)
+
+	_, err = grpcClient.Append(ctx, "counter1", 100, grpcEvents(151, 151))
+	wrongVersion, ok := err.(*customerrors.WrongExpectedVersionError)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, int64(150), wrongVersion.CurrentVersion)
+	}
+
+	stream, err := grpcClient.ReadAggregate(ctx, "counter1", 0, 0, models.Forward, 0)
+	assert.NoError(t, err)
+	events, err := stream.Collect()
+	assert.NoError(t, err)
+	assert.Len(t, events, 150)
+	assert.Equal(t, int64(150), events[149].Version)
+
+	stream, err = grpcClient.ReadAggregate(ctx, "counter1", 10, 20, models.Backward, 5)
+	assert.NoError(t, err)
+	events, err = stream.Collect()
+	assert.NoError(t, err)
+	assert.Len(t, events, 5)
+	assert.Equal(t, int64(20), events[0].Version)
+	assert.Equal(t, int64(16), events[4].Version)
+}
+
+func TestGrpcReadAllAndSubscribe(t *testing.T) {
+	grpcClient, grpcServer, db := setupGrpc()
+	defer teardownGrpc(grpcClient, grpcServer, db)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 1; i <= 3; i++ {
+		_, err := grpcClient.Append(ctx, fmt.Sprintf("counter%d", i), models.AnyVersion, grpcEvents(1, 2))
+		assert.NoError(t, err)
+	}
+	stream, err := grpcClient.ReadAll(ctx, "", 0)
+	assert.NoError(t, err)
+	all, err := stream.Collect()
+	assert.NoError(t, err)
+	assert.Len(t, all, 6)
+
+	subscription, err := grpcClient.Subscribe(ctx, all[3].Id)
+	assert.NoError(t, err)
+	for _, expected := range all[4:] {
+		event, err := subscription.Recv()
+		assert.NoError(t, err)
+		assert.Equal(t, expected.Id, event.Id)
+	}
+
+	_, err = grpcClient.Append(ctx, "counter4", models.NoStream, grpcEvents(1, 1))
+	assert.NoError(t, err)
+	event, err := subscription.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, "counter4", event.AggregateId)
+}
+
+func TestGrpcAuthentication(t *testing.T) {
+	grpcClient, grpcServer, db := setupGrpcWithOptions(func(repository *store.EventRepository) []grpc.ServerOption {
+		authenticator := auth.NewAPIKeyAuthenticator(repository.APIKeys())
+		return []grpc.ServerOption{
+			grpc.UnaryInterceptor(auth.UnaryInterceptor(authenticator)),
+			grpc.StreamInterceptor(auth.StreamInterceptor(authenticator)),
+		}
+	})
+	defer teardownGrpc(grpcClient, grpcServer, db)
+	ctx := context.Background()
+
+	_, err := grpcClient.Append(ctx, "counter9", models.NoStream, grpcEvents(1, 2))
+	assert.IsType(t, &customerrors.UnauthenticatedError{}, err)
+	stream, err := grpcClient.ReadAll(ctx, "", 0)
+	assert.NoError(t, err)
+	_, err = stream.Collect()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	issued, err := store.NewAPIKeys(conn).CreateKey("ingest", []string{models.AdminRole})
+	assert.NoError(t, err)
+	grpcClient.UseAPIKey("evtsrc_unknown")
+	_, err = grpcClient.Append(ctx, "counter9", models.NoStream, grpcEvents(1, 2))
+	assert.IsType(t, &customerrors.UnauthenticatedError{}, err)
+	grpcClient.UseAPIKey(issued.Key)
+	_, err = grpcClient.Append(ctx, "counter9", models.NoStream, grpcEvents(1, 2))
+	assert.NoError(t, err)
+	stream, err = grpcClient.ReadAll(ctx, "", 0)
+	assert.NoError(t, err)
+	events, err := stream.Collect()
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+}
+
+func TestGrpcAuthorization(t *testing.T) {
+	var repository *store.EventRepository
+	grpcClient, grpcServer, db := setupGrpcWithOptions(func(r *store.EventRepository) []grpc.ServerOption {
+		repository = r
+		authenticator := auth.NewAPIKeyAuthenticator(r.APIKeys())
+		return []grpc.ServerOption{
+			grpc.UnaryInterceptor(auth.UnaryInterceptor(authenticator)),
+			grpc.StreamInterceptor(auth.StreamInterceptor(authenticator)),
+		}
+	})
+	defer teardownGrpc(grpcClient, grpcServer, db)
+	ctx := context.Background()
+	admin, err := repository.APIKeys().CreateKey("operator", []string{models.AdminRole})
+	assert.NoError(t, err)
+	counters, err := repository.APIKeys().CreateKey("counting", []string{"counters"})
+	assert.NoError(t, err)
+	assert.NoError(t, repository.AccessRules().SetRule(models.AccessRule{Id: "counters", Role: "counters", AggregateScope: models.AggregateScope{AggregateType: "counter"}, Operations: []models.Operation{models.Read, models.Append, models.Subscribe}}))
+
+	grpcClient.UseAPIKey(admin.Key)
+	_, err = grpcClient.Append(ctx, "counter1", models.NoStream, grpcEvents(1, 2))
+	assert.NoError(t, err)
+	other := grpcEvents(1, 1)
+	other[0].AggregateType = "timer"
+	_, err = grpcClient.Append(ctx, "timer1", models.NoStream, other)
+	assert.NoError(t, err)
+
+	grpcClient.UseAPIKey(counters.Key)
+	_, err = grpcClient.Append(ctx, "counter2", models.NoStream, grpcEvents(1, 1))
+	assert.NoError(t, err)
+	_, err = grpcClient.Append(ctx, "timer1", 1, grpcEvents(2, 2))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	other[0].Version = 3
+	_, err = grpcClient.Append(ctx, "counter1", 2, other)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	stream, err := grpcClient.ReadAggregate(ctx, "counter1", 1, 0, models.Forward, 0)
+	assert.NoError(t, err)
+	events, err := stream.Collect()
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	stream, err = grpcClient.ReadAggregate(ctx, "timer1", 1, 0, models.Forward, 0)
+	assert.NoError(t, err)
+	_, err = stream.Collect()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	stream, err = grpcClient.ReadAll(ctx, "", 0)
+	assert.NoError(t, err)
+	events, err = stream.Collect()
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+	for _, event := range events {
+		assert.Equal(t, "counter", event.AggregateType)
+	}
+
+	subscribeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err = grpcClient.Subscribe(subscribeCtx, "")
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		event, err := stream.Recv()
+		assert.NoError(t, err)
+		assert.Equal(t, "counter", event.AggregateType)
+	}
+	grpcClient.UseAPIKey(admin.Key)
+	other[0].Version = 2
+	_, err = grpcClient.Append(ctx, "timer1", 1, other)
+	assert.NoError(t, err)
+	_, err = grpcClient.Append(ctx, "counter2", 1, grpcEvents(2, 2))
+	assert.NoError(t, err)
+	event, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, "counter2", event.AggregateId)
+}
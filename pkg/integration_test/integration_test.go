@@ -1,21 +1,41 @@
 package integrationtest
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/L4B0MB4/EVTSRC/pkg/auth"
 	"github.com/L4B0MB4/EVTSRC/pkg/client"
+	"github.com/L4B0MB4/EVTSRC/pkg/codec"
 	"github.com/L4B0MB4/EVTSRC/pkg/httphandler"
 	"github.com/L4B0MB4/EVTSRC/pkg/httphandler/controller"
 	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
 	"github.com/L4B0MB4/EVTSRC/pkg/store"
 	"github.com/L4B0MB4/EVTSRC/pkg/tcp/server"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 )
 
 func setup() (*client.EventSourcingHttpClient, *httphandler.HttpHandler, *store.DatabaseConnection) {
+	return setupWithMiddleware(nil)
+}
+
+// setupWithMiddleware starts the server with the middleware returned by middleware, if not nil.
+func setupWithMiddleware(middleware func(repository *store.EventRepository) gin.HandlerFunc) (*client.EventSourcingHttpClient, *httphandler.HttpHandler, *store.DatabaseConnection) {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	db := store.DatabaseConnection{}
 	db.SetUp()
@@ -35,11 +55,19 @@ func setup() (*client.EventSourcingHttpClient, *httphandler.HttpHandler, *store.
 	go tcpServer.Start()
 	tcpServer.Stop()
 	c := controller.NewEventController(repository, tcpServer)
-	h := httphandler.NewHttpHandler(c)
+	a := controller.NewAggregateController(repository)
+	s := controller.NewSchemaController(repository.Schemas())
+	ad := controller.NewAdminController(repository)
+	handlers := []gin.HandlerFunc{}
+	if middleware != nil {
+		handlers = append(handlers, middleware(repository))
+	}
+	h := httphandler.NewHttpHandler(c, a, s, ad, handlers...)
 
 	go func() {
 		h.Start()
 	}()
+	waitForServer("localhost:5515")
 	evclient, err := client.NewEventSourcingHttpClient("http://localhost:5515")
 	if err != nil {
 		panic(err)
@@ -47,6 +75,19 @@ func setup() (*client.EventSourcingHttpClient, *httphandler.HttpHandler, *store.
 	return evclient, h, &db
 }
 
+// waitForServer blocks until the http server accepts connections.
+func waitForServer(address string) {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	panic("http server did not start")
+}
+
 func teardown(httpHandler *httphandler.HttpHandler, db *store.DatabaseConnection) {
 	httpHandler.Stop()
 	db.Teardown()
@@ -131,3 +172,690 @@ func TestClientGetEventsSince(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestClientAggregateCatalogue(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	err := client.AddEventsWithoutValidation("catalogue1", []models.ChangeTrackedEvent{
+		{IsNew: true, Event: models.Event{Version: 1, Name: "created", Data: []byte{0, 1, 2}, AggregateType: "typeA"}},
+		{IsNew: true, Event: models.Event{Version: 2, Name: "changed", Data: []byte{1, 2, 3}, AggregateType: "typeA"}},
+	})
+	assert.NoError(t, err)
+	err = client.AddEventsWithoutValidation("catalogue2", []models.ChangeTrackedEvent{
+		{IsNew: true, Event: models.Event{Version: 1, Name: "created", Data: []byte{0, 1, 2}, AggregateType: "typeB"}},
+	})
+	assert.NoError(t, err)
+
+	aggregates, err := client.ListAggregates("typeB", "", 10)
+	assert.NoError(t, err)
+	assert.Len(t, aggregates, 1)
+	assert.Equal(t, "catalogue2", aggregates[0].Id)
+
+	aggregate, err := client.GetAggregate("catalogue1")
+	assert.NoError(t, err)
+	assert.Equal(t, "typeA", aggregate.Type)
+	assert.Equal(t, int64(2), aggregate.Version)
+	assert.Equal(t, int64(2), aggregate.EventCount)
+
+	_, err = client.GetAggregate("unknown")
+	assert.IsType(t, &customerrors.AggregateNotFoundError{}, err)
+
+	stats, err := client.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), stats.TotalEvents)
+	assert.Equal(t, int64(2), stats.EventsPerName["created"])
+}
+
+func TestClientGetCurrentVersion(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	version, err := client.GetCurrentVersion("versioned")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), version)
+
+	err = client.AddEventsWithoutValidation("versioned", []models.ChangeTrackedEvent{
+		{IsNew: true, Event: models.Event{Version: 1, Name: "created", Data: []byte{0, 1, 2}, AggregateType: "typeA"}},
+		{IsNew: true, Event: models.Event{Version: 2, Name: "changed", Data: []byte{1, 2, 3}, AggregateType: "typeA"}},
+	})
+	assert.NoError(t, err)
+
+	version, err = client.GetCurrentVersion("versioned")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), version)
+}
+
+func TestClientReadBackward(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	err := client.AddEventsWithoutValidation("recent", []models.ChangeTrackedEvent{
+		{IsNew: true, Event: models.Event{Version: 1, Name: "event1", Data: []byte{0, 1, 2}, AggregateType: "mytype"}},
+		{IsNew: true, Event: models.Event{Version: 2, Name: "event2", Data: []byte{1, 2, 3}, AggregateType: "mytype"}},
+		{IsNew: true, Event: models.Event{Version: 3, Name: "event3", Data: []byte{2, 3, 4}, AggregateType: "mytype"}},
+	})
+	assert.NoError(t, err)
+
+	events, err := client.GetEventsBackward("recent", 2)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, int64(3), events[0].Version)
+	assert.Equal(t, int64(2), events[1].Version)
+
+	events, err = client.GetEventsBefore("", 1)
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, int64(3), events[0].Version)
+
+	events, err = client.GetEventsBefore(events[0].Id, 5)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, int64(2), events[0].Version)
+	assert.Equal(t, int64(1), events[1].Version)
+}
+
+func TestClientRetryWithIdempotencyKey(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	events := []models.ChangeTrackedEvent{
+		{IsNew: true, Event: models.Event{Version: 1, Name: "event1", Data: []byte{0, 1, 2}, AggregateType: "mytype"}},
+		{IsNew: true, Event: models.Event{Version: 2, Name: "event2", Data: []byte{1, 2, 3}, AggregateType: "mytype"}},
+	}
+	err := client.AddEventsWithIdempotencyKey("retried", "request-1", events)
+	assert.NoError(t, err)
+	err = client.AddEventsWithIdempotencyKey("retried", "request-1", events)
+	assert.NoError(t, err)
+
+	err = client.AddEventsWithIdempotencyKey("retried", "request-2", events)
+	assert.Error(t, err)
+
+	evs, err := client.GetEventsBackward("retried", 10)
+	assert.NoError(t, err)
+	assert.Len(t, evs, 2)
+}
+
+func TestClientAppendTransaction(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	err := client.AppendTransaction([]models.StreamAppend{
+		{AggregateId: "order1", ExpectedVersion: models.NoStream, Events: []models.Event{{Version: 1, Name: "placed", Data: []byte{1}, AggregateType: "order"}}},
+		{AggregateId: "stock1", ExpectedVersion: models.NoStream, Events: []models.Event{{Version: 1, Name: "reserved", Data: []byte{1}, AggregateType: "stock"}}},
+	})
+	assert.NoError(t, err)
+
+	err = client.AppendTransaction([]models.StreamAppend{
+		{AggregateId: "order1", ExpectedVersion: 1, Events: []models.Event{{Version: 2, Name: "paid", Data: []byte{2}, AggregateType: "order"}}},
+		{AggregateId: "stock1", ExpectedVersion: models.NoStream, Events: []models.Event{{Version: 2, Name: "reserved", Data: []byte{2}, AggregateType: "stock"}}},
+	})
+	assert.IsType(t, &customerrors.WrongExpectedVersionError{}, err)
+
+	version, err := client.GetCurrentVersion("order1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), version)
+}
+
+func TestClientAppendTransactionIf(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	register := func(userId string) error {
+		return client.AppendTransactionIf([]models.StreamAppend{{
+			AggregateId: userId,
+			Events:      []models.Event{{Version: 1, Name: "UserRegistered", Data: []byte("alice"), AggregateType: "user", Tags: []string{"username:alice"}}},
+		}}, &models.AppendCondition{
+			FailIfEventsMatch: []models.EventQuery{{Tags: []string{"username:alice"}}},
+		})
+	}
+	assert.NoError(t, register("user1"))
+	assert.IsType(t, &customerrors.AppendConditionFailedError{}, register("user2"))
+}
+
+func TestClientSchemaRegistry(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	err := client.RegisterSchema("order", "placed", 1, []byte(`{"type": "object", "required": ["orderId"]}`))
+	assert.NoError(t, err)
+	err = client.RegisterSchema("order", "placed", 1, []byte(`{"required": "orderId"}`))
+	assert.IsType(t, &customerrors.InvalidSchemaError{}, err)
+
+	err = client.AppendTransaction([]models.StreamAppend{
+		{AggregateId: "order1", Events: []models.Event{{Version: 1, Name: "placed", Data: []byte(`{}`), AggregateType: "order"}}},
+	})
+	validationError, ok := err.(*customerrors.SchemaValidationError)
+	assert.True(t, ok)
+	assert.Len(t, validationError.Violations, 1)
+
+	err = client.AddEvents("order1", []models.ChangeTrackedEvent{
+		{IsNew: true, Event: models.Event{Version: 1, Name: "placed", Data: []byte(`{"orderId":"order1"}`), AggregateType: "order"}},
+	})
+	assert.NoError(t, err)
+
+	schemas, err := client.ListSchemas()
+	assert.NoError(t, err)
+	assert.Len(t, schemas, 1)
+	assert.NoError(t, client.DeleteSchema("order", "placed", 1))
+	_, err = client.GetSchema("order", "placed", 1)
+	assert.IsType(t, &customerrors.SchemaNotFoundError{}, err)
+}
+
+func TestClientUpcastsEvents(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	err := client.AddEvents("customer1", []models.ChangeTrackedEvent{
+		{IsNew: true, Event: models.Event{Version: 1, Name: "renamed", Data: []byte(`{"name":"Alice Smith"}`), AggregateType: "customer"}},
+		{IsNew: true, Event: models.Event{Version: 2, Name: "renamed", Data: []byte(`{"firstName":"Bob","lastName":"Jones"}`), AggregateType: "customer", SchemaVersion: 2}},
+	})
+	assert.NoError(t, err)
+
+	client.Upcasters().Register("renamed", 1, func(data []byte) ([]byte, error) {
+		return []byte(`{"firstName":"Alice","lastName":"Smith"}`), nil
+	})
+	iter, err := client.GetEventsOrdered("customer1")
+	assert.NoError(t, err)
+	first, ok := iter.Next()
+	assert.True(t, ok)
+	assert.Equal(t, 2, first.SchemaVersion)
+	assert.JSONEq(t, `{"firstName":"Alice","lastName":"Smith"}`, string(first.Data))
+	second, ok := iter.Next()
+	assert.True(t, ok)
+	assert.JSONEq(t, `{"firstName":"Bob","lastName":"Jones"}`, string(second.Data))
+}
+
+func TestJSONEventsAreServedAsEmbeddedJSON(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	err := client.AddEvents("json1", []models.ChangeTrackedEvent{
+		{IsNew: true, Event: models.Event{Version: 1, Name: "created", Data: []byte(`{"name":"alice"}`), AggregateType: "user", ContentType: models.JSONContentType}},
+		{IsNew: true, Event: models.Event{Version: 2, Name: "avatar", Data: []byte{0, 1, 2}, AggregateType: "user"}},
+	})
+	assert.NoError(t, err)
+
+	resp, err := http.Get("http://localhost:5515/aggregates/json1/events")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `"data":{"name":"alice"}`)
+	assert.Contains(t, string(body), `"data":"AAEC"`)
+
+	events, err := client.GetEventsBackward("json1", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, 2}, events[0].Data)
+	assert.Equal(t, `{"name":"alice"}`, string(events[1].Data))
+	assert.Equal(t, models.JSONContentType, events[1].ContentType)
+}
+
+func TestClientEncodings(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	for i, encoding := range []string{codec.Protobuf, codec.MessagePack} {
+		assert.NoError(t, client.UseEncoding(encoding))
+		aggregateId := fmt.Sprintf("encoded%d", i)
+		err := client.AddEvents(aggregateId, []models.ChangeTrackedEvent{
+			{IsNew: true, Event: models.Event{Version: 1, Name: "created", Data: []byte{0, 1, 2}, AggregateType: "binary"}},
+		})
+		assert.NoError(t, err, encoding)
+		err = client.AppendTransaction([]models.StreamAppend{
+			{AggregateId: aggregateId, ExpectedVersion: 1, Events: []models.Event{{Version: 2, Name: "changed", Data: []byte{3}, AggregateType: "binary"}}},
+		})
+		assert.NoError(t, err, encoding)
+
+		iter, err := client.GetEventsOrdered(aggregateId)
+		assert.NoError(t, err, encoding)
+		first, _ := iter.Next()
+		second, _ := iter.Next()
+		assert.Equal(t, []byte{0, 1, 2}, first.Data)
+		assert.Equal(t, []byte{3}, second.Data)
+	}
+	assert.Error(t, client.UseEncoding("text/xml"))
+}
+
+func TestClientDeleteAggregate(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	for _, aggregateId := range []string{"soft1", "hard1"} {
+		err := client.AddEvents(aggregateId, []models.ChangeTrackedEvent{
+			{IsNew: true, Event: models.Event{Version: 1, Name: "created", Data: []byte{1}, AggregateType: "doomed"}},
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, client.DeleteAggregate("soft1", models.SoftDelete))
+	assert.NoError(t, client.DeleteAggregate("hard1", models.HardDelete))
+	assert.IsType(t, &customerrors.AggregateNotFoundError{}, client.DeleteAggregate("unknown", models.HardDelete))
+
+	_, err := client.GetEventsOrdered("soft1")
+	assert.IsType(t, &customerrors.AggregateDeletedError{}, err)
+	_, err = client.GetCurrentVersion("hard1")
+	assert.IsType(t, &customerrors.AggregateDeletedError{}, err)
+	err = client.AddEvents("hard1", []models.ChangeTrackedEvent{
+		{IsNew: true, Event: models.Event{Version: 3, Name: "created", Data: []byte{1}, AggregateType: "doomed"}},
+	})
+	deleted, ok := err.(*customerrors.AggregateDeletedError)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, models.HardDelete, deleted.Mode)
+	}
+
+	events, err := client.GetEventsSince("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, models.TombstoneEventName, events[1].Name)
+}
+
+func TestClientDestroySubjectKey(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	err := client.AddEvents("user1", []models.ChangeTrackedEvent{
+		{IsNew: true, Event: models.Event{Version: 1, Name: "registered", Data: []byte("alice"), AggregateType: "user", Subject: "alice"}},
+	})
+	assert.NoError(t, err)
+	events, err := client.GetEventsOrdered("user1")
+	assert.NoError(t, err)
+	event, ok := events.Next()
+	assert.True(t, ok)
+	assert.Equal(t, []byte("alice"), event.Data)
+
+	assert.NoError(t, client.DestroySubjectKey("alice"))
+	assert.IsType(t, &customerrors.SubjectNotFoundError{}, client.DestroySubjectKey("bob"))
+
+	events, err = client.GetEventsOrdered("user1")
+	assert.NoError(t, err)
+	event, ok = events.Next()
+	assert.True(t, ok)
+	assert.Nil(t, event.Data)
+	err = client.AddEvents("user1", []models.ChangeTrackedEvent{
+		{IsNew: true, Event: models.Event{Version: 2, Name: "renamed", Data: []byte("alice"), AggregateType: "user", Subject: "alice"}},
+	})
+	assert.IsType(t, &customerrors.SubjectKeyDestroyedError{}, err)
+}
+
+func TestClientCompressionDictionary(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	_, ok := client.TrainCompressionDictionary("invoice").(*customerrors.InvalidDictionaryError)
+	assert.True(t, ok)
+	_, ok = client.SetCompressionDictionary("invoice", []byte("no dictionary")).(*customerrors.InvalidDictionaryError)
+	assert.True(t, ok)
+
+	payload := func(i int) []byte {
+		data := fmt.Sprintf(`{"invoice":%d,"items":[`, i)
+		for l := 0; l < 60; l++ {
+			data += fmt.Sprintf(`{"position":%d,"article":"a-%d","amount":%d},`, l, (i*31+l*17)%997, (i+l)%13)
+		}
+		return []byte(data + `{}]}`)
+	}
+	for i := 0; i < 10; i++ {
+		err := client.AddEvents(fmt.Sprintf("invoice%d", i), []models.ChangeTrackedEvent{
+			{IsNew: true, Event: models.Event{Version: 1, Name: "issued", Data: payload(i), AggregateType: "invoice"}},
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, client.TrainCompressionDictionary("invoice"))
+	err := client.AddEvents("invoice10", []models.ChangeTrackedEvent{
+		{IsNew: true, Event: models.Event{Version: 1, Name: "issued", Data: payload(10), AggregateType: "invoice"}},
+	})
+	assert.NoError(t, err)
+
+	events, err := client.GetEventsOrdered("invoice10")
+	assert.NoError(t, err)
+	event, ok := events.Next()
+	assert.True(t, ok)
+	assert.Equal(t, payload(10), event.Data)
+}
+
+func TestClientRetentionPolicies(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	events := []models.ChangeTrackedEvent{}
+	for i := 1; i <= 4; i++ {
+		events = append(events, models.ChangeTrackedEvent{IsNew: true, Event: models.Event{Version: int64(i), Name: "ticked", Data: []byte{byte(i)}, AggregateType: "telemetry"}})
+	}
+	assert.NoError(t, client.AddEvents("telemetry1", events))
+	feed, err := client.GetEventsSince("", 1)
+	assert.NoError(t, err)
+	cursor := feed[0].Id
+
+	_, err = client.GetRetentionPolicy("telemetry")
+	assert.IsType(t, &customerrors.RetentionPolicyNotFoundError{}, err)
+	assert.NoError(t, client.SetRetentionPolicy(models.RetentionPolicy{AggregateType: "telemetry", MaxCount: 1}))
+	policy, err := client.GetRetentionPolicy("telemetry")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), policy.MaxCount)
+	policies, err := client.ListRetentionPolicies()
+	assert.NoError(t, err)
+	assert.Len(t, policies, 1)
+
+	removed, err := client.ApplyRetention()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), removed)
+	iterator, err := client.GetEventsOrdered("telemetry1")
+	assert.NoError(t, err)
+	event, ok := iterator.Next()
+	assert.True(t, ok)
+	assert.Equal(t, int64(4), event.Version)
+	_, ok = iterator.Next()
+	assert.False(t, ok)
+	// a consumer whose cursor was removed continues after it
+	feed, err = client.GetEventsSince(cursor, 10)
+	assert.NoError(t, err)
+	assert.Len(t, feed, 1)
+	assert.Equal(t, int64(4), feed[0].Version)
+	_, err = client.GetEventsSince("0b7a3b2e-6a51-4a8f-9a39-3f1f3c0d2f10", 10)
+	assert.IsType(t, &customerrors.EventNotFoundError{}, err)
+
+	assert.NoError(t, client.DeleteRetentionPolicy("telemetry"))
+	assert.IsType(t, &customerrors.RetentionPolicyNotFoundError{}, client.DeleteRetentionPolicy("telemetry"))
+}
+
+func TestClientArchiveEvents(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	events := []models.ChangeTrackedEvent{}
+	for i := 1; i <= 3; i++ {
+		events = append(events, models.ChangeTrackedEvent{IsNew: true, Event: models.Event{Version: int64(i), Name: "ticked", Data: []byte{byte(i)}, AggregateType: "telemetry"}})
+	}
+	assert.NoError(t, client.AddEvents("telemetry2", events))
+
+	archived, err := client.ArchiveEvents(time.Hour)
+	assert.NoError(t, err)
+	assert.Zero(t, archived)
+	archived, err = client.ArchiveEvents(0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), archived)
+	segments, err := client.ListArchiveSegments()
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+	assert.Equal(t, int64(3), segments[0].EventCount)
+
+	iterator, err := client.GetEventsOrdered("telemetry2")
+	assert.NoError(t, err)
+	event, ok := iterator.Next()
+	assert.True(t, ok)
+	assert.Equal(t, []byte{1}, event.Data)
+}
+
+func TestClientBackup(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	events := []models.ChangeTrackedEvent{{IsNew: true, Event: models.Event{Version: 1, Name: "ticked", Data: []byte{1}, AggregateType: "telemetry"}}}
+	assert.NoError(t, client.AddEvents("telemetry3", events))
+
+	t.Setenv(store.BackupDirEnv, t.TempDir())
+	backup, err := client.Backup("nightly/backup1")
+	assert.NoError(t, err)
+	target := filepath.Join(store.GetBackupDirectory(), "nightly", "backup1")
+	assert.Equal(t, target, backup.Path)
+	assert.NoError(t, store.ValidateBackup(target, nil))
+	_, err = client.Backup("nightly/backup1")
+	assert.IsType(t, &customerrors.BackupTargetExistsError{}, err)
+
+	for _, outside := range []string{"../backup2", "nightly/../../backup2", filepath.Join(t.TempDir(), "backup2")} {
+		_, err = client.Backup(outside)
+		assert.Error(t, err)
+	}
+}
+
+func TestClientExportImport(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	events := []models.ChangeTrackedEvent{}
+	for i := 1; i <= 3; i++ {
+		events = append(events, models.ChangeTrackedEvent{IsNew: true, Event: models.Event{Version: int64(i), Name: "ticked", Data: []byte{byte(i)}, AggregateType: "telemetry"}})
+	}
+	assert.NoError(t, client.AddEvents("telemetry4", events))
+
+	var export bytes.Buffer
+	assert.NoError(t, client.ExportEvents(models.ExportFilter{AggregateId: "telemetry4"}, &export))
+	assert.Equal(t, 3, strings.Count(export.String(), "\n"))
+	assert.IsType(t, &customerrors.EventNotFoundError{}, client.ExportEvents(models.ExportFilter{After: "unknown"}, io.Discard))
+
+	imported, err := client.ImportEvents(bytes.NewReader(export.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), imported)
+
+	conflicting := strings.Replace(export.String(), `"telemetry4"`, `"telemetry5"`, 1)
+	_, err = client.ImportEvents(strings.NewReader(conflicting))
+	var importErr *customerrors.ImportError
+	assert.ErrorAs(t, err, &importErr)
+	assert.Equal(t, 1, importErr.Line)
+}
+
+func TestClientVerifyAggregate(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	events := []models.ChangeTrackedEvent{}
+	for i := 1; i <= 3; i++ {
+		events = append(events, models.ChangeTrackedEvent{IsNew: true, Event: models.Event{Version: int64(i), Name: "ticked", Data: []byte{byte(i)}, AggregateType: "telemetry"}})
+	}
+	assert.NoError(t, client.AddEvents("telemetry6", events))
+	stored, err := client.GetEventsSince("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, stored, 3)
+
+	verification, err := client.VerifyAggregate("telemetry6")
+	assert.NoError(t, err)
+	assert.True(t, verification.Valid)
+	assert.Equal(t, int64(3), verification.VerifiedEvents)
+	assert.Equal(t, stored[2].Hash, verification.Head)
+
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	_, err = conn.Exec("UPDATE events SET Name = 'altered' WHERE aggregateId = 'telemetry6' AND version_1 = 2")
+	assert.NoError(t, err)
+	verification, err = client.VerifyAggregate("telemetry6")
+	assert.NoError(t, err)
+	assert.False(t, verification.Valid)
+	assert.Equal(t, stored[1].Id, verification.BrokenLink.EventId)
+
+	_, err = client.VerifyAggregate("unknown")
+	assert.IsType(t, &customerrors.AggregateNotFoundError{}, err)
+}
+
+func TestClientSignedEvents(t *testing.T) {
+	client, httpHandler, db := setup()
+	defer teardown(httpHandler, db)
+
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	key, err := client.RegisterProducerKey(models.ProducerKey{Id: "telemetry-1", Producer: "telemetry", PublicKey: public})
+	assert.NoError(t, err)
+	assert.Equal(t, "telemetry", key.Producer)
+	_, err = client.RegisterProducerKey(models.ProducerKey{Id: "telemetry-1", Producer: "other", PublicKey: public})
+	assert.IsType(t, &customerrors.ProducerKeyConflictError{}, err)
+
+	client.SignWith("telemetry-1", private)
+	events := []models.ChangeTrackedEvent{{IsNew: true, Event: models.Event{Version: 1, Name: "ticked", Data: []byte(`{"value": 1}`), AggregateType: "telemetry", ContentType: models.JSONContentType}}}
+	assert.NoError(t, client.AddEvents("telemetry7", events))
+	stored, err := client.GetEventsSince("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+	signer, err := client.VerifySignature(stored[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "telemetry-1", signer.Id)
+
+	forged := models.Event{Version: 2, Name: "ticked", Data: []byte(`{"value": 2}`), AggregateId: "telemetry7", AggregateType: "telemetry", ContentType: models.JSONContentType}
+	forged.Sign("telemetry-1", private)
+	forged.Data = []byte(`{"value": 200}`)
+	err = client.AddEvents("telemetry7", []models.ChangeTrackedEvent{{IsNew: true, Event: forged}})
+	var invalid *customerrors.InvalidSignatureError
+	assert.ErrorAs(t, err, &invalid)
+	assert.Equal(t, "signature does not match the event", invalid.Reason)
+
+	_, err = client.RevokeProducerKey("telemetry-1")
+	assert.NoError(t, err)
+	err = client.AddEvents("telemetry7", []models.ChangeTrackedEvent{{IsNew: true, Event: models.Event{Version: 2, Name: "ticked", Data: []byte(`{"value": 2}`), AggregateType: "telemetry", ContentType: models.JSONContentType}}})
+	assert.ErrorAs(t, err, &invalid)
+	keys, err := client.ListProducerKeys()
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+	assert.NotNil(t, keys[0].RevokedAt)
+	_, err = client.GetProducerKey("unknown")
+	assert.IsType(t, &customerrors.ProducerKeyNotFoundError{}, err)
+}
+
+func TestClientAuthentication(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	keySet, err := auth.ParseKeySet([]byte(fmt.Sprintf(`{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"idp-1","x":"%s"}]}`, base64.RawURLEncoding.EncodeToString(public))))
+	assert.NoError(t, err)
+	evclient, httpHandler, db := setupWithMiddleware(func(repository *store.EventRepository) gin.HandlerFunc {
+		return auth.Middleware(auth.NewAPIKeyAuthenticator(repository.APIKeys()), auth.NewJWTAuthenticator(keySet, "idp", ""))
+	})
+	defer teardown(httpHandler, db)
+
+	events := []models.ChangeTrackedEvent{{IsNew: true, Event: models.Event{Version: 1, Name: "ticked", Data: []byte{1}, AggregateType: "telemetry"}}}
+	assert.Error(t, evclient.AddEvents("telemetry8", events))
+	_, err = evclient.GetStats()
+	assert.Error(t, err)
+
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	issued, err := store.NewAPIKeys(conn).CreateKey("ingest", []string{models.AdminRole})
+	assert.NoError(t, err)
+	evclient.UseAPIKey(issued.Key)
+	assert.NoError(t, evclient.AddEvents("telemetry8", events))
+	assert.NoError(t, evclient.SetAccessRule(models.AccessRule{Id: "reporting", Role: "reporting", Operations: []models.Operation{models.Read, models.Subscribe}}))
+	created, err := evclient.CreateAPIKey(models.APIKeyRequest{Subject: "reporting", Roles: []string{"reporting"}})
+	assert.NoError(t, err)
+	keys, err := evclient.ListAPIKeys()
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	evclient.UseAPIKey(created.Key)
+	stored, err := evclient.GetEventsSince("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+	_, err = evclient.RevokeAPIKey(created.Id)
+	assert.Error(t, err)
+	evclient.UseAPIKey(issued.Key)
+	_, err = evclient.RevokeAPIKey(created.Id)
+	assert.NoError(t, err)
+	evclient.UseAPIKey(created.Key)
+	_, err = evclient.GetEventsSince("", 10)
+	assert.Error(t, err)
+
+	token := func(issuer string, expiresAt time.Time) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{"sub": "dashboard", "iss": issuer, "exp": expiresAt.Unix(), "roles": []string{"reporting"}})
+		token.Header["kid"] = "idp-1"
+		signed, err := token.SignedString(private)
+		assert.NoError(t, err)
+		return signed
+	}
+	evclient.UseBearerToken(token("idp", time.Now().Add(time.Hour)))
+	stored, err = evclient.GetEventsSince("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+	evclient.UseBearerToken(token("other", time.Now().Add(time.Hour)))
+	_, err = evclient.GetEventsSince("", 10)
+	assert.Error(t, err)
+	evclient.UseTokenSource(func() (string, error) {
+		return token("idp", time.Now().Add(-time.Hour)), nil
+	})
+	_, err = evclient.GetEventsSince("", 10)
+	assert.Error(t, err)
+}
+
+func TestClientAuthorization(t *testing.T) {
+	evclient, httpHandler, db := setupWithMiddleware(func(repository *store.EventRepository) gin.HandlerFunc {
+		return auth.Middleware(auth.NewAPIKeyAuthenticator(repository.APIKeys()))
+	})
+	defer teardown(httpHandler, db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	admin, err := store.NewAPIKeys(conn).CreateKey("operator", []string{models.AdminRole})
+	assert.NoError(t, err)
+	evclient.UseAPIKey(admin.Key)
+
+	newEvents := func(aggregateType string) []models.ChangeTrackedEvent {
+		return []models.ChangeTrackedEvent{{IsNew: true, Event: models.Event{Version: 1, Name: "created", Data: []byte{1}, AggregateType: aggregateType}}}
+	}
+	assert.NoError(t, evclient.AddEvents("payment1", newEvents("payments")))
+	assert.NoError(t, evclient.AddEvents("order1", newEvents("orders")))
+	assert.NoError(t, evclient.AddEvents("payment2", newEvents("payments")))
+	assert.NoError(t, evclient.SetAccessRule(models.AccessRule{Id: "payments-read", Role: "payments", AggregateScope: models.AggregateScope{AggregateType: "payments"}, Operations: []models.Operation{models.Read, models.Subscribe}}))
+	assert.NoError(t, evclient.SetAccessRule(models.AccessRule{Id: "orders-write", Role: "orders", AggregateScope: models.AggregateScope{AggregateIdPrefix: "order"}, Operations: []models.Operation{models.Append}}))
+	err = evclient.SetAccessRule(models.AccessRule{Id: "broken", Role: "orders", Operations: []models.Operation{"delete"}})
+	assert.IsType(t, &customerrors.InvalidAccessRuleError{}, err)
+	rules, err := evclient.ListAccessRules()
+	assert.NoError(t, err)
+	assert.Len(t, rules, 2)
+	payments, err := evclient.CreateAPIKey(models.APIKeyRequest{Subject: "billing", Roles: []string{"payments"}})
+	assert.NoError(t, err)
+	orders, err := evclient.CreateAPIKey(models.APIKeyRequest{Subject: "shop", Roles: []string{"orders"}})
+	assert.NoError(t, err)
+
+	evclient.UseAPIKey(payments.Key)
+	feed, err := evclient.GetEventsSince("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, feed, 2)
+	for _, event := range feed {
+		assert.Equal(t, "payments", event.AggregateType)
+	}
+	feed, err = evclient.GetEventsSince(feed[0].Id, 10)
+	assert.NoError(t, err)
+	assert.Len(t, feed, 1)
+	assert.Equal(t, "payment2", feed[0].AggregateId)
+	aggregates, err := evclient.ListAggregates("", "", 10)
+	assert.NoError(t, err)
+	assert.Len(t, aggregates, 2)
+	_, err = evclient.GetAggregate("payment1")
+	assert.NoError(t, err)
+	_, err = evclient.GetAggregate("order1")
+	assert.IsType(t, &customerrors.AccessDeniedError{}, err)
+	// unknown aggregates are denied as well instead of telling they do not exist
+	_, err = evclient.GetAggregate("order9")
+	assert.IsType(t, &customerrors.AccessDeniedError{}, err)
+	err = evclient.AddEvents("payment3", newEvents("payments"))
+	assert.IsType(t, &customerrors.AccessDeniedError{}, err)
+	_, err = evclient.ListAccessRules()
+	assert.IsType(t, &customerrors.AccessDeniedError{}, err)
+
+	evclient.UseAPIKey(orders.Key)
+	assert.NoError(t, evclient.AddEvents("order2", newEvents("orders")))
+	err = evclient.AddEvents("payment3", newEvents("orders"))
+	assert.IsType(t, &customerrors.AccessDeniedError{}, err)
+	// expectations and conditions would tell the versions and events of other aggregates
+	orderAppend := models.StreamAppend{AggregateId: "order3", ExpectedVersion: models.NoStream, Events: []models.Event{newEvents("orders")[0].Event}}
+	err = evclient.AppendTransaction([]models.StreamAppend{orderAppend, {AggregateId: "payment1", ExpectedVersion: 1, Events: []models.Event{}}})
+	assert.IsType(t, &customerrors.AccessDeniedError{}, err)
+	err = evclient.AppendTransactionIf([]models.StreamAppend{orderAppend}, &models.AppendCondition{FailIfEventsMatch: []models.EventQuery{{AggregateTypes: []string{"payments"}}}})
+	assert.IsType(t, &customerrors.AccessDeniedError{}, err)
+	err = evclient.AppendTransactionIf([]models.StreamAppend{orderAppend}, &models.AppendCondition{FailIfEventsMatch: []models.EventQuery{{Names: []string{"created"}}}})
+	assert.IsType(t, &customerrors.AccessDeniedError{}, err)
+	assert.NoError(t, evclient.AppendTransaction([]models.StreamAppend{orderAppend}))
+	feed, err = evclient.GetEventsSince("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, feed, 0)
+
+	evclient.UseAPIKey(admin.Key)
+	// subscribing alone does not grant reading the events of the feeds
+	assert.NoError(t, evclient.SetAccessRule(models.AccessRule{Id: "audit-feed", Role: "auditor", Operations: []models.Operation{models.Subscribe}}))
+	auditor, err := evclient.CreateAPIKey(models.APIKeyRequest{Subject: "audit", Roles: []string{"auditor"}})
+	assert.NoError(t, err)
+	evclient.UseAPIKey(auditor.Key)
+	feed, err = evclient.GetEventsSince("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, feed, 0)
+
+	evclient.UseAPIKey(admin.Key)
+	assert.NoError(t, evclient.DeleteAccessRule("payments-read"))
+	assert.IsType(t, &customerrors.AccessRuleNotFoundError{}, evclient.DeleteAccessRule("payments-read"))
+	evclient.UseAPIKey(payments.Key)
+	_, err = evclient.GetAggregate("payment1")
+	assert.IsType(t, &customerrors.AccessDeniedError{}, err)
+}
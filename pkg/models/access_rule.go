@@ -0,0 +1,69 @@
+package models
+
+import "strings"
+
+// Operation is a right an access rule grants on aggregates.
+type Operation string
+
+const (
+	// Read allows reading the events and summaries of aggregates.
+	Read Operation = "read"
+	// Append allows appending events to aggregates.
+	Append Operation = "append"
+	// Subscribe allows following the events of aggregates through the global
+	// feeds, together with Read.
+	Subscribe Operation = "subscribe"
+	// Admin allows the administrative routes; only rules for all aggregates grant them.
+	Admin Operation = "admin"
+)
+
+// AdminRole is granted every operation on every aggregate without any rule, so
+// the first rules can be set up with a key of this role.
+const AdminRole = "admin"
+
+// IsOperation reports whether the operation is one of the known operations.
+func IsOperation(operation Operation) bool {
+	return operation == Read || operation == Append || operation == Subscribe || operation == Admin
+}
+
+// AggregateScope selects aggregates by type and id prefix. Empty fields match
+// every aggregate.
+type AggregateScope struct {
+	AggregateType     string `json:"aggregateType,omitempty"`
+	AggregateIdPrefix string `json:"aggregateIdPrefix,omitempty"`
+}
+
+// Matches reports whether the aggregate is in the scope.
+func (s AggregateScope) Matches(aggregateType string, aggregateId string) bool {
+	return (len(s.AggregateType) == 0 || s.AggregateType == aggregateType) && strings.HasPrefix(aggregateId, s.AggregateIdPrefix)
+}
+
+// Intersect returns the scope of the aggregates in both scopes. It returns
+// false if no aggregate can be in both.
+func (s AggregateScope) Intersect(other AggregateScope) (AggregateScope, bool) {
+	if len(s.AggregateType) == 0 {
+		s.AggregateType = other.AggregateType
+	} else if len(other.AggregateType) > 0 && other.AggregateType != s.AggregateType {
+		return AggregateScope{}, false
+	}
+	switch {
+	case strings.HasPrefix(other.AggregateIdPrefix, s.AggregateIdPrefix):
+		s.AggregateIdPrefix = other.AggregateIdPrefix
+	case !strings.HasPrefix(s.AggregateIdPrefix, other.AggregateIdPrefix):
+		return AggregateScope{}, false
+	}
+	return s, true
+}
+
+// IsAll reports whether the scope matches every aggregate.
+func (s AggregateScope) IsAll() bool {
+	return len(s.AggregateType) == 0 && len(s.AggregateIdPrefix) == 0
+}
+
+// AccessRule grants the callers with a role operations on the aggregates of a scope.
+type AccessRule struct {
+	Id   string `json:"id"`
+	Role string `json:"role"`
+	AggregateScope
+	Operations []Operation `json:"operations"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// AggregateSummary describes an aggregate stored in the event store.
+type AggregateSummary struct {
+	Id           string    `json:"id"`
+	Type         string    `json:"type"`
+	Version      int64     `json:"version"`
+	EventCount   int64     `json:"eventCount"`
+	FirstEventAt time.Time `json:"firstEventAt"`
+	LastEventAt  time.Time `json:"lastEventAt"`
+	// Deleted is empty unless the aggregate was deleted.
+	Deleted DeletionMode `json:"deleted,omitempty"`
+}
+
+// EventStoreStats contains global counters of the event store.
+type EventStoreStats struct {
+	TotalEvents            int64            `json:"totalEvents"`
+	TotalAggregates        int64            `json:"totalAggregates"`
+	EventsPerAggregateType map[string]int64 `json:"eventsPerAggregateType"`
+	EventsPerName          map[string]int64 `json:"eventsPerName"`
+}
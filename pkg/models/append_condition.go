@@ -0,0 +1,16 @@
+package models
+
+// EventQuery matches events by name, aggregate type and tags. Empty fields match
+// every event; an event has to carry all of the given tags.
+type EventQuery struct {
+	Names          []string `json:"names,omitempty"`
+	AggregateTypes []string `json:"aggregateTypes,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+}
+
+// AppendCondition lets an append fail if any event matching one of the queries
+// was written after the event with the id After. An empty After checks all events.
+type AppendCondition struct {
+	FailIfEventsMatch []EventQuery `json:"failIfEventsMatch" binding:"required"`
+	After             string       `json:"after"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// ArchiveSegment describes a segment file holding the data of archived events.
+type ArchiveSegment struct {
+	Id           int64     `json:"id"`
+	File         string    `json:"file"`
+	EventCount   int64     `json:"eventCount"`
+	FirstEventAt time.Time `json:"firstEventAt"`
+	LastEventAt  time.Time `json:"lastEventAt"`
+}
@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// Principal is the caller a request was authenticated as.
+type Principal struct {
+	Subject string `json:"subject"`
+	// Method is the kind of credentials the caller presented, "api-key" or "jwt".
+	Method string   `json:"method"`
+	Roles  []string `json:"roles,omitempty"`
+}
+
+// APIKey describes a static API key stored in the store. Its secret is only
+// returned once, when the key is created.
+type APIKey struct {
+	Id        string     `json:"id"`
+	Subject   string     `json:"subject"`
+	Roles     []string   `json:"roles,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// APIKeyRequest is the body of a request creating an API key.
+type APIKeyRequest struct {
+	Subject string   `json:"subject" binding:"required"`
+	Roles   []string `json:"roles,omitempty"`
+}
+
+// IssuedAPIKey is a newly created API key together with the key to send in
+// requests. The key cannot be retrieved again.
+type IssuedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
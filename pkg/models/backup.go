@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// Backup describes an online backup of the store. Path is the directory holding
+// the database file and the segment files of archived events.
+type Backup struct {
+	Path      string    `json:"path"`
+	SizeBytes int64     `json:"sizeBytes"`
+	Segments  int       `json:"segments"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// BackupRequest is the body of a backup request. Target is a relative path
+// within the backup directory of the server.
+type BackupRequest struct {
+	Target string `json:"target" binding:"required"`
+}
@@ -0,0 +1,26 @@
+package models
+
+// ChainVerification is the result of walking the hash chain of an aggregate.
+type ChainVerification struct {
+	AggregateId string `json:"aggregateId"`
+	Valid       bool   `json:"valid"`
+	// VerifiedEvents is the number of events whose hash and link were checked
+	// before the chain ended or broke.
+	VerifiedEvents int64 `json:"verifiedEvents"`
+	// UnchainedEvents is the number of events appended before events were hashed.
+	UnchainedEvents int64 `json:"unchainedEvents,omitempty"`
+	// Truncated is set if the first event links to an event that no longer
+	// exists, removed by a retention policy or a hard deletion.
+	Truncated bool `json:"truncated,omitempty"`
+	// Head is the hash of the last verified event.
+	Head string `json:"head,omitempty"`
+	// BrokenLink is the first event that failed the verification.
+	BrokenLink *BrokenLink `json:"brokenLink,omitempty"`
+}
+
+// BrokenLink describes an event that failed the verification of its hash chain.
+type BrokenLink struct {
+	EventId string `json:"eventId"`
+	Version int64  `json:"version"`
+	Reason  string `json:"reason"`
+}
@@ -0,0 +1,17 @@
+package customerrors
+
+import (
+	"fmt"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+)
+
+// AggregateDeletedError is returned when reading or appending to a deleted aggregate.
+type AggregateDeletedError struct {
+	AggregateId string
+	Mode        models.DeletionMode
+}
+
+func (a *AggregateDeletedError) Error() string {
+	return fmt.Sprintf("AGGREGATE DELETED ERROR: aggregate %s was %s deleted", a.AggregateId, a.Mode)
+}
@@ -0,0 +1,8 @@
+package customerrors
+
+type AggregateNotFoundError struct {
+}
+
+func (a *AggregateNotFoundError) Error() string {
+	return "AGGREGATE NOT FOUND ERROR"
+}
@@ -0,0 +1,10 @@
+package customerrors
+
+// AppendConditionFailedError is returned when events matching the condition of
+// an append were written after the position the append was decided on.
+type AppendConditionFailedError struct {
+}
+
+func (a *AppendConditionFailedError) Error() string {
+	return "APPEND CONDITION FAILED ERROR"
+}
@@ -0,0 +1,44 @@
+package customerrors
+
+// UnauthenticatedError is returned when a request carries credentials that are
+// malformed, unknown, expired or revoked.
+type UnauthenticatedError struct {
+	Reason string
+}
+
+func (u *UnauthenticatedError) Error() string {
+	return "UNAUTHENTICATED ERROR: " + u.Reason
+}
+
+type APIKeyNotFoundError struct {
+}
+
+func (a *APIKeyNotFoundError) Error() string {
+	return "API KEY NOT FOUND ERROR"
+}
+
+// AccessDeniedError is returned when the caller has no rule granting the operation.
+type AccessDeniedError struct {
+}
+
+func (a *AccessDeniedError) Error() string {
+	return "ACCESS DENIED ERROR"
+}
+
+// InvalidAccessRuleError is returned when an access rule to store has no role or
+// an unknown operation.
+type InvalidAccessRuleError struct {
+	Reason string
+}
+
+func (i *InvalidAccessRuleError) Error() string {
+	return "INVALID ACCESS RULE ERROR: " + i.Reason
+}
+
+// AccessRuleNotFoundError is returned when there is no access rule with the id.
+type AccessRuleNotFoundError struct {
+}
+
+func (a *AccessRuleNotFoundError) Error() string {
+	return "ACCESS RULE NOT FOUND ERROR"
+}
@@ -0,0 +1,18 @@
+package customerrors
+
+// BackupTargetExistsError is returned when the target of a backup already exists.
+type BackupTargetExistsError struct {
+}
+
+func (b *BackupTargetExistsError) Error() string {
+	return "BACKUP TARGET EXISTS ERROR"
+}
+
+// InvalidBackupError is returned when a backup fails validation and cannot be restored.
+type InvalidBackupError struct {
+	Reason string
+}
+
+func (i *InvalidBackupError) Error() string {
+	return "INVALID BACKUP ERROR: " + i.Reason
+}
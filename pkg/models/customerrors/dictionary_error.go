@@ -0,0 +1,10 @@
+package customerrors
+
+// InvalidDictionaryError is returned when a compression dictionary cannot be used or trained.
+type InvalidDictionaryError struct {
+	Reason string
+}
+
+func (i *InvalidDictionaryError) Error() string {
+	return "INVALID DICTIONARY ERROR: " + i.Reason
+}
@@ -0,0 +1,10 @@
+package customerrors
+
+// EventIdConflictError is returned when an event id is already used by a
+// different event.
+type EventIdConflictError struct {
+}
+
+func (e *EventIdConflictError) Error() string {
+	return "EVENT ID CONFLICT ERROR"
+}
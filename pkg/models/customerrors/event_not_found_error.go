@@ -0,0 +1,9 @@
+package customerrors
+
+// EventNotFoundError is returned when a referenced event does not exist.
+type EventNotFoundError struct {
+}
+
+func (e *EventNotFoundError) Error() string {
+	return "EVENT NOT FOUND ERROR"
+}
@@ -0,0 +1,21 @@
+package customerrors
+
+import "fmt"
+
+// ImportError is returned when an import stops at a line of the input. The
+// events of all lines before it were imported. Err is the error the line was
+// rejected with, if any.
+type ImportError struct {
+	Line     int
+	Imported int64
+	Reason   string
+	Err      error
+}
+
+func (i *ImportError) Error() string {
+	return fmt.Sprintf("IMPORT ERROR IN LINE %d: %s", i.Line, i.Reason)
+}
+
+func (i *ImportError) Unwrap() error {
+	return i.Err
+}
@@ -0,0 +1,8 @@
+package customerrors
+
+type RetentionPolicyNotFoundError struct {
+}
+
+func (r *RetentionPolicyNotFoundError) Error() string {
+	return "RETENTION POLICY NOT FOUND ERROR"
+}
@@ -0,0 +1,8 @@
+package customerrors
+
+type SchemaNotFoundError struct {
+}
+
+func (s *SchemaNotFoundError) Error() string {
+	return "SCHEMA NOT FOUND ERROR"
+}
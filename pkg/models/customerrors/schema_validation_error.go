@@ -0,0 +1,22 @@
+package customerrors
+
+import "github.com/L4B0MB4/EVTSRC/pkg/models"
+
+// SchemaValidationError is returned when event payloads do not match the
+// schema registered for their aggregate type and name.
+type SchemaValidationError struct {
+	Violations []models.SchemaViolation
+}
+
+func (s *SchemaValidationError) Error() string {
+	return "SCHEMA VALIDATION ERROR"
+}
+
+// InvalidSchemaError is returned when a schema to register is not a valid JSON Schema.
+type InvalidSchemaError struct {
+	Reason string
+}
+
+func (i *InvalidSchemaError) Error() string {
+	return "INVALID SCHEMA ERROR: " + i.Reason
+}
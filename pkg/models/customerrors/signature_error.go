@@ -0,0 +1,39 @@
+package customerrors
+
+// InvalidSignatureError is returned when a signed event cannot be verified with
+// the producer key it names.
+type InvalidSignatureError struct {
+	EventIndex   int
+	SigningKeyId string
+	Reason       string
+}
+
+func (i *InvalidSignatureError) Error() string {
+	return "INVALID SIGNATURE ERROR: " + i.Reason
+}
+
+// InvalidProducerKeyError is returned when a producer key to register is not a
+// valid ed25519 public key.
+type InvalidProducerKeyError struct {
+	Reason string
+}
+
+func (i *InvalidProducerKeyError) Error() string {
+	return "INVALID PRODUCER KEY ERROR: " + i.Reason
+}
+
+// ProducerKeyConflictError is returned when registering a different key under the
+// id of a registered producer key.
+type ProducerKeyConflictError struct {
+}
+
+func (p *ProducerKeyConflictError) Error() string {
+	return "PRODUCER KEY CONFLICT ERROR"
+}
+
+type ProducerKeyNotFoundError struct {
+}
+
+func (p *ProducerKeyNotFoundError) Error() string {
+	return "PRODUCER KEY NOT FOUND ERROR"
+}
@@ -0,0 +1,18 @@
+package customerrors
+
+// SubjectKeyDestroyedError is returned when appending events for a subject whose
+// key was destroyed.
+type SubjectKeyDestroyedError struct {
+	Subject string
+}
+
+func (s *SubjectKeyDestroyedError) Error() string {
+	return "SUBJECT KEY DESTROYED ERROR: " + s.Subject
+}
+
+type SubjectNotFoundError struct {
+}
+
+func (s *SubjectNotFoundError) Error() string {
+	return "SUBJECT NOT FOUND ERROR"
+}
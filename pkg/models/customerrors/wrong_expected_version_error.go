@@ -0,0 +1,15 @@
+package customerrors
+
+import "fmt"
+
+// WrongExpectedVersionError is returned when an aggregate is not at the version
+// an append expected.
+type WrongExpectedVersionError struct {
+	AggregateId     string
+	ExpectedVersion int64
+	CurrentVersion  int64
+}
+
+func (w *WrongExpectedVersionError) Error() string {
+	return fmt.Sprintf("WRONG EXPECTED VERSION ERROR: aggregate %s is at version %d, expected %d", w.AggregateId, w.CurrentVersion, w.ExpectedVersion)
+}
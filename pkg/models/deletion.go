@@ -0,0 +1,16 @@
+package models
+
+// DeletionMode is how an aggregate was deleted.
+type DeletionMode string
+
+const (
+	// SoftDelete keeps the events of an aggregate, but rejects reads of and appends to it.
+	SoftDelete DeletionMode = "soft"
+	// HardDelete removes the events of an aggregate and leaves a tombstone event
+	// in the global feed. Appends to the aggregate are rejected afterwards.
+	HardDelete DeletionMode = "hard"
+)
+
+// TombstoneEventName is the name of the event left in place of the events of a
+// hard deleted aggregate.
+const TombstoneEventName = "$tombstone"
@@ -1,10 +1,101 @@
 package models
 
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"strings"
+)
+
+// JSONContentType marks events whose data is a JSON document.
+const JSONContentType = "application/json"
+
 type Event struct {
-	Id            string `json:"id"`
-	Version       int64  `json:"version" binding:"required"`
-	Name          string `json:"name" binding:"required"`
-	Data          []byte `json:"data" binding:"required"`
-	AggregateId   string `json:"aggregateId"`
-	AggregateType string `json:"aggregateType" binding:"required"`
+	Id            string   `json:"id"`
+	Version       int64    `json:"version" binding:"required"`
+	Name          string   `json:"name" binding:"required"`
+	Data          []byte   `json:"data" binding:"required"`
+	AggregateId   string   `json:"aggregateId"`
+	AggregateType string   `json:"aggregateType" binding:"required"`
+	Tags          []string `json:"tags,omitempty"`
+	// SchemaVersion is the version of the shape of Data. Zero means the event
+	// was written without a version and is treated as version 1.
+	SchemaVersion int `json:"schemaVersion,omitempty"`
+	// ContentType is the media type of Data. Data of JSON events is embedded
+	// as JSON in the JSON representation of the event, any other data is base64 encoded.
+	ContentType string `json:"contentType,omitempty"`
+	// Subject identifies whose personal data the event carries. Data of events
+	// with a subject is stored encrypted with the key of the subject; once the key
+	// is destroyed, Data is returned as nil. Use the aggregate id for a key per aggregate.
+	Subject string `json:"subject,omitempty"`
+	// Hash is the hex encoded hash chaining the event to the event appended before
+	// it to the same aggregate. It is set by the store and ignored on appends.
+	Hash string `json:"hash,omitempty"`
+	// SigningKeyId is the id of the registered producer key Signature was made with.
+	SigningKeyId string `json:"signingKeyId,omitempty"`
+	// Signature is the optional ed25519 signature of the producer over SigningPayload.
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// IsJSONContentType reports whether the media type is application/json or a
+// structured syntax suffix type like application/cloudevents+json.
+func IsJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == JSONContentType || (strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"))
+}
+
+// event has the fields of Event without its JSON methods.
+type event Event
+
+// MarshalJSON embeds the data of JSON events as JSON and base64 encodes all other data.
+func (e Event) MarshalJSON() ([]byte, error) {
+	data, err := e.marshalData()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		event
+		Data json.RawMessage `json:"data"`
+	}{event(e), data})
+}
+
+func (e Event) marshalData() (json.RawMessage, error) {
+	if e.Data == nil {
+		return json.RawMessage("null"), nil
+	}
+	if IsJSONContentType(e.ContentType) && json.Valid(e.Data) {
+		return json.RawMessage(e.Data), nil
+	}
+	return json.Marshal(e.Data)
+}
+
+// UnmarshalJSON reads the data of JSON events as embedded JSON, which is stored
+// compacted, and expects all other data base64 encoded.
+func (e *Event) UnmarshalJSON(b []byte) error {
+	aux := struct {
+		*event
+		Data json.RawMessage `json:"data"`
+	}{event: (*event)(e)}
+	err := json.Unmarshal(b, &aux)
+	if err != nil {
+		return err
+	}
+	e.Data = nil
+	if len(aux.Data) == 0 || bytes.Equal(aux.Data, []byte("null")) {
+		return nil
+	}
+	if !IsJSONContentType(e.ContentType) {
+		return json.Unmarshal(aux.Data, &e.Data)
+	}
+	var compacted bytes.Buffer
+	err = json.Compact(&compacted, aux.Data)
+	if err != nil {
+		return errors.New("data of a JSON event is not valid JSON")
+	}
+	e.Data = compacted.Bytes()
+	return nil
 }
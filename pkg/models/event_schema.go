@@ -0,0 +1,22 @@
+package models
+
+import "encoding/json"
+
+// EventSchema is the JSON Schema the payload of an event with the given
+// aggregate type, name and schema version has to satisfy.
+type EventSchema struct {
+	AggregateType string          `json:"aggregateType"`
+	Name          string          `json:"name"`
+	Version       int             `json:"version"`
+	Schema        json.RawMessage `json:"schema"`
+}
+
+// SchemaViolation describes why the payload of an event does not match its schema.
+type SchemaViolation struct {
+	EventIndex       int    `json:"eventIndex"`
+	AggregateType    string `json:"aggregateType"`
+	Name             string `json:"name"`
+	InstanceLocation string `json:"instanceLocation"`
+	KeywordLocation  string `json:"keywordLocation"`
+	Message          string `json:"message"`
+}
@@ -0,0 +1,40 @@
+package models_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONEventDataIsEmbedded(t *testing.T) {
+	event := models.Event{Version: 1, Name: "created", Data: []byte(`{"a":1}`), AggregateType: "t", ContentType: models.JSONContentType}
+	b, err := json.Marshal(event)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"data":{"a":1}`)
+
+	var decoded models.Event
+	err = json.Unmarshal([]byte(`{"version":1,"name":"created","data":{ "a" : 1 },"contentType":"application/json"}`), &decoded)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, string(decoded.Data))
+}
+
+func TestBinaryEventDataIsBase64(t *testing.T) {
+	event := models.Event{Version: 1, Name: "created", Data: []byte{0, 1, 2}, AggregateType: "t"}
+	b, err := json.Marshal(event)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"data":"AAEC"`)
+
+	var decoded models.Event
+	assert.NoError(t, json.Unmarshal(b, &decoded))
+	assert.Equal(t, event, decoded)
+}
+
+func TestIsJSONContentType(t *testing.T) {
+	assert.True(t, models.IsJSONContentType("application/json"))
+	assert.True(t, models.IsJSONContentType("application/json; charset=utf-8"))
+	assert.True(t, models.IsJSONContentType("application/cloudevents+json"))
+	assert.False(t, models.IsJSONContentType("application/octet-stream"))
+	assert.False(t, models.IsJSONContentType(""))
+}
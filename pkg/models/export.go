@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// NDJSONContentType is the media type of exported events, one JSON document per line.
+const NDJSONContentType = "application/x-ndjson"
+
+// ExportedEvent is one line of an export. Timestamp is when the event was
+// appended to the exporting store. AppendId is shared by the events appended in
+// one transaction, which are imported together again. PrevHash and DataHash are
+// the hex encoded fields of the hash chain the exporting store verified the
+// event with, next to Event.Hash; an import checks them before appending.
+type ExportedEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	AppendId  int64     `json:"appendId,omitempty"`
+	PrevHash  string    `json:"prevHash,omitempty"`
+	DataHash  string    `json:"dataHash,omitempty"`
+	Event     Event     `json:"event"`
+}
+
+// ExportFilter selects the events of an export. Empty fields match every event.
+// After and Until are event ids bounding the position range in the global
+// order: After is excluded, Until is included.
+type ExportFilter struct {
+	AggregateId   string `form:"aggregateId"`
+	AggregateType string `form:"aggregateType"`
+	After         string `form:"after"`
+	Until         string `form:"until"`
+}
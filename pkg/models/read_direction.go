@@ -0,0 +1,11 @@
+package models
+
+// ReadDirection selects the order in which events are read.
+type ReadDirection string
+
+const (
+	// Forward reads the oldest events first.
+	Forward ReadDirection = "forward"
+	// Backward reads the newest events first.
+	Backward ReadDirection = "backward"
+)
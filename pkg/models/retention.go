@@ -0,0 +1,13 @@
+package models
+
+// RetentionPolicy limits the history kept for the aggregates of a type. Events
+// matching any of the limits are removed; a zero value disables a limit.
+type RetentionPolicy struct {
+	AggregateType string `json:"aggregateType"`
+	// MaxAgeSeconds removes events that were appended more than this many seconds ago.
+	MaxAgeSeconds int64 `json:"maxAgeSeconds,omitempty"`
+	// MaxCount keeps at most this many of the newest events of every aggregate.
+	MaxCount int64 `json:"maxCount,omitempty"`
+	// TruncateBeforeVersion removes the events with a lower version.
+	TruncateBeforeVersion int64 `json:"truncateBeforeVersion,omitempty"`
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+)
+
+// signatureContext separates event signatures from other uses of a producer key.
+const signatureContext = "evtsrc event signature v1"
+
+// ProducerKey is the ed25519 public key of a producer, registered in the store
+// to verify the signatures of the events it appends.
+type ProducerKey struct {
+	Id       string `json:"id"`
+	Producer string `json:"producer"`
+	// PublicKey is the raw 32 byte ed25519 public key, base64 encoded in JSON.
+	PublicKey    []byte    `json:"publicKey"`
+	RegisteredAt time.Time `json:"registeredAt"`
+	// RevokedAt is set once the key was revoked. Events signed with a revoked key
+	// are rejected; the key is kept to verify the events signed before.
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// SigningPayload returns the bytes a producer signs: the signing key id and all
+// fields of the event a producer sets, except the id, which the store may
+// assign. The data of JSON events is compacted, as the store keeps it.
+// Signatures cover the event as appended, so events returned upcasted or with
+// their subject key destroyed cannot be verified.
+func (e Event) SigningPayload() []byte {
+	var b []byte
+	field := func(value []byte) {
+		b = binary.AppendUvarint(b, uint64(len(value)))
+		b = append(b, value...)
+	}
+	number := func(value int64) {
+		b = binary.BigEndian.AppendUint64(b, uint64(value))
+	}
+	field([]byte(signatureContext))
+	field([]byte(e.SigningKeyId))
+	field([]byte(e.AggregateId))
+	field([]byte(e.AggregateType))
+	field([]byte(e.Name))
+	number(e.Version)
+	number(int64(e.SchemaVersion))
+	field([]byte(e.ContentType))
+	field([]byte(e.Subject))
+	number(int64(len(e.Tags)))
+	for _, tag := range e.Tags {
+		field([]byte(tag))
+	}
+	data := e.Data
+	if IsJSONContentType(e.ContentType) {
+		var compacted bytes.Buffer
+		if json.Compact(&compacted, data) == nil {
+			data = compacted.Bytes()
+		}
+	}
+	field(data)
+	return b
+}
+
+// Sign signs the event with the private key of the registered producer key keyId.
+// The aggregate id has to be set before signing.
+func (e *Event) Sign(keyId string, key ed25519.PrivateKey) {
+	e.SigningKeyId = keyId
+	e.Signature = ed25519.Sign(key, e.SigningPayload())
+}
+
+// VerifySignature reports whether the event carries a valid signature made with
+// the private key of publicKey.
+func (e Event) VerifySignature(publicKey ed25519.PublicKey) bool {
+	if len(publicKey) != ed25519.PublicKeySize || len(e.Signature) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(publicKey, e.SigningPayload(), e.Signature)
+}
@@ -0,0 +1,43 @@
+package models_test
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedEventVerifies(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	event := models.Event{Version: 1, Name: "created", Data: []byte(`{ "a": 1 }`), AggregateId: "a1", AggregateType: "t", ContentType: models.JSONContentType, Tags: []string{"x"}}
+	event.Sign("producer1", private)
+	assert.Equal(t, "producer1", event.SigningKeyId)
+	assert.True(t, event.VerifySignature(public))
+
+	// the store compacts JSON data and assigns the id
+	b, err := json.Marshal(event)
+	assert.NoError(t, err)
+	var decoded models.Event
+	assert.NoError(t, json.Unmarshal(b, &decoded))
+	decoded.Id = "6f1d2a3b-4c5d-4e6f-8a9b-0c1d2e3f4a01"
+	assert.Equal(t, event.Signature, decoded.Signature)
+	assert.True(t, decoded.VerifySignature(public))
+
+	altered := decoded
+	altered.Version = 2
+	assert.False(t, altered.VerifySignature(public))
+	altered = decoded
+	altered.SigningKeyId = "producer2"
+	assert.False(t, altered.VerifySignature(public))
+	altered = decoded
+	altered.Tags = []string{"y"}
+	assert.False(t, altered.VerifySignature(public))
+
+	other, _, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	assert.False(t, decoded.VerifySignature(other))
+	assert.False(t, models.Event{Version: 1}.VerifySignature(public))
+}
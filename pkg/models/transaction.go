@@ -0,0 +1,23 @@
+package models
+
+const (
+	// AnyVersion skips the expected version check of a StreamAppend.
+	AnyVersion int64 = -1
+	// NoStream expects the aggregate to have no events yet.
+	NoStream int64 = 0
+)
+
+// StreamAppend appends events to one aggregate if its current version equals
+// ExpectedVersion. NoStream expects a new aggregate, AnyVersion skips the check.
+type StreamAppend struct {
+	AggregateId     string  `json:"aggregateId" binding:"required"`
+	ExpectedVersion int64   `json:"expectedVersion"`
+	Events          []Event `json:"events" binding:"required,dive"`
+}
+
+// AppendTransaction groups appends to several aggregates that are committed
+// all-or-nothing. An optional condition has to hold as well.
+type AppendTransaction struct {
+	Appends   []StreamAppend   `json:"appends" binding:"required,dive"`
+	Condition *AppendCondition `json:"condition,omitempty"`
+}
@@ -0,0 +1,236 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/rs/zerolog/log"
+)
+
+// AccessRules stores the rules granting roles operations on aggregates and
+// decides what a principal may do. All rules are kept in memory once loaded.
+type AccessRules struct {
+	store *sql.DB
+	mu    sync.RWMutex
+	// rules is nil until the rules are loaded
+	rules []models.AccessRule
+}
+
+// NewAccessRules creates a new AccessRules.
+func NewAccessRules(db *sql.DB) *AccessRules {
+	return &AccessRules{store: db}
+}
+
+// SetRule stores an access rule, replacing an existing one with the same id. It
+// returns an InvalidAccessRuleError if the id or role is empty or an operation is unknown.
+func (a *AccessRules) SetRule(rule models.AccessRule) error {
+	if len(strings.TrimSpace(rule.Id)) == 0 || len(strings.TrimSpace(rule.Role)) == 0 {
+		return &customerrors.InvalidAccessRuleError{Reason: "id and role must not be empty"}
+	}
+	if len(rule.Operations) == 0 {
+		return &customerrors.InvalidAccessRuleError{Reason: "rule has to grant at least one operation"}
+	}
+	for _, operation := range rule.Operations {
+		if !models.IsOperation(operation) {
+			return &customerrors.InvalidAccessRuleError{Reason: "unknown operation " + string(operation)}
+		}
+	}
+	operations, err := json.Marshal(rule.Operations)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.store.Exec(`
+		INSERT INTO access_rules (id, role, aggregateType, aggregateIdPrefix, operations) VALUES (?,?,?,?,?)
+		ON CONFLICT(id) DO UPDATE SET
+			role = excluded.role,
+			aggregateType = excluded.aggregateType,
+			aggregateIdPrefix = excluded.aggregateIdPrefix,
+			operations = excluded.operations
+	`, rule.Id, rule.Role, rule.AggregateType, rule.AggregateIdPrefix, string(operations))
+	if err != nil {
+		log.Info().Err(err).Msg("Error storing access rule")
+		return errors.New("could not store access rule")
+	}
+	a.rules = nil
+	return nil
+}
+
+// GetRule retrieves an access rule. It returns an AccessRuleNotFoundError if there is none.
+func (a *AccessRules) GetRule(id string) (*models.AccessRule, error) {
+	rules, err := a.ListRules()
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if rule.Id == id {
+			return &rule, nil
+		}
+	}
+	return nil, &customerrors.AccessRuleNotFoundError{}
+}
+
+// ListRules retrieves all access rules ordered by id.
+func (a *AccessRules) ListRules() ([]models.AccessRule, error) {
+	rules, err := a.load()
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(rules), nil
+}
+
+// DeleteRule removes an access rule. It returns an AccessRuleNotFoundError if there is none.
+func (a *AccessRules) DeleteRule(id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result, err := a.store.Exec("DELETE FROM access_rules WHERE id = ?", id)
+	if err != nil {
+		log.Info().Err(err).Msg("Error deleting access rule")
+		return errors.New("could not delete access rule")
+	}
+	a.rules = nil
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return &customerrors.AccessRuleNotFoundError{}
+	}
+	return nil
+}
+
+// Allows reports whether the principal may perform the operation on an aggregate.
+// Without a principal, when authentication is disabled, everything is allowed.
+// Use an empty type and id for operations not bound to an aggregate.
+func (a *AccessRules) Allows(principal *models.Principal, operation models.Operation, aggregateType string, aggregateId string) (bool, error) {
+	scopes, all, err := a.Scopes(principal, operation)
+	if err != nil || all {
+		return all, err
+	}
+	for _, scope := range scopes {
+		if scope.Matches(aggregateType, aggregateId) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Scopes returns the scopes of the aggregates the principal may perform all of
+// the operations on. all is set if the principal may perform them on every aggregate.
+func (a *AccessRules) Scopes(principal *models.Principal, operations ...models.Operation) (scopes []models.AggregateScope, all bool, err error) {
+	if principal == nil || slices.Contains(principal.Roles, models.AdminRole) {
+		return nil, true, nil
+	}
+	rules, err := a.load()
+	if err != nil {
+		return nil, false, err
+	}
+	all = true
+	for _, operation := range operations {
+		granted, grantedAll := grantedScopes(rules, principal, operation)
+		if grantedAll {
+			continue
+		}
+		if all {
+			scopes, all = granted, false
+			continue
+		}
+		scopes = intersectScopes(scopes, granted)
+	}
+	return scopes, all, nil
+}
+
+// grantedScopes returns the scopes the rules grant the principal the operation on.
+func grantedScopes(rules []models.AccessRule, principal *models.Principal, operation models.Operation) (scopes []models.AggregateScope, all bool) {
+	for _, rule := range rules {
+		if !slices.Contains(principal.Roles, rule.Role) || !slices.Contains(rule.Operations, operation) {
+			continue
+		}
+		if rule.IsAll() {
+			return nil, true
+		}
+		scopes = append(scopes, rule.AggregateScope)
+	}
+	return scopes, false
+}
+
+// intersectScopes returns the scopes of the aggregates in one scope of each list.
+func intersectScopes(a []models.AggregateScope, b []models.AggregateScope) []models.AggregateScope {
+	scopes := []models.AggregateScope{}
+	for _, first := range a {
+		for _, second := range b {
+			if scope, ok := first.Intersect(second); ok && !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes
+}
+
+// load returns the rules, reading them if they are not loaded yet.
+func (a *AccessRules) load() ([]models.AccessRule, error) {
+	a.mu.RLock()
+	rules := a.rules
+	a.mu.RUnlock()
+	if rules != nil {
+		return rules, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.rules != nil {
+		return a.rules, nil
+	}
+	rows, err := a.store.Query("SELECT id, role, aggregateType, aggregateIdPrefix, operations FROM access_rules ORDER BY id")
+	if err != nil {
+		log.Info().Err(err).Msg("Error running query statement")
+		return nil, errors.New("could not query access rules")
+	}
+	defer rows.Close()
+	rules = []models.AccessRule{}
+	for rows.Next() {
+		var rule models.AccessRule
+		var operations string
+		if err = rows.Scan(&rule.Id, &rule.Role, &rule.AggregateType, &rule.AggregateIdPrefix, &operations); err != nil {
+			log.Info().Err(err).Msg("Error scanning rows")
+			return nil, errors.New("could not retrieve access rule")
+		}
+		if err = json.Unmarshal([]byte(operations), &rule.Operations); err != nil {
+			log.Info().Err(err).Msg("Error reading operations")
+			return nil, errors.New("could not retrieve access rule")
+		}
+		rules = append(rules, rule)
+	}
+	if err = rows.Err(); err != nil {
+		log.Info().Err(err).Msg("Error checking row errors")
+		return nil, errors.New("could not retrieve all access rules")
+	}
+	a.rules = rules
+	return rules, nil
+}
+
+// scopeCondition returns an SQL condition, and its args, selecting the rows
+// whose type and id columns are in one of the scopes. No scopes select nothing.
+func scopeCondition(scopes []models.AggregateScope, typeColumn string, idColumn string) (string, []any) {
+	if len(scopes) == 0 {
+		return "0", nil
+	}
+	conditions := []string{}
+	args := []any{}
+	for _, scope := range scopes {
+		condition := []string{"1"}
+		if len(scope.AggregateType) > 0 {
+			condition = append(condition, typeColumn+" = ?")
+			args = append(args, scope.AggregateType)
+		}
+		if len(scope.AggregateIdPrefix) > 0 {
+			condition = append(condition, "substr("+idColumn+", 1, length(?)) = ?")
+			args = append(args, scope.AggregateIdPrefix, scope.AggregateIdPrefix)
+		}
+		conditions = append(conditions, "("+strings.Join(condition, " AND ")+")")
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
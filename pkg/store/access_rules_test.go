@@ -0,0 +1,133 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessRules(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	rules := store.NewAccessRules(conn)
+
+	for _, invalid := range []models.AccessRule{
+		{Id: "", Role: "payments", Operations: []models.Operation{models.Read}},
+		{Id: "payments", Role: " ", Operations: []models.Operation{models.Read}},
+		{Id: "payments", Role: "payments"},
+		{Id: "payments", Role: "payments", Operations: []models.Operation{"delete"}},
+	} {
+		assert.IsType(t, &customerrors.InvalidAccessRuleError{}, rules.SetRule(invalid))
+	}
+	payments := models.AccessRule{Id: "payments", Role: "payments", AggregateScope: models.AggregateScope{AggregateType: "payments"}, Operations: []models.Operation{models.Read}}
+	assert.NoError(t, rules.SetRule(payments))
+	assert.NoError(t, rules.SetRule(models.AccessRule{Id: "eu-orders", Role: "orders", AggregateScope: models.AggregateScope{AggregateIdPrefix: "eu-"}, Operations: []models.Operation{models.Read, models.Append}}))
+	assert.NoError(t, rules.SetRule(models.AccessRule{Id: "feed", Role: "auditor", Operations: []models.Operation{models.Subscribe}}))
+
+	reader := &models.Principal{Subject: "billing", Roles: []string{"payments"}}
+	allowed, err := rules.Allows(reader, models.Read, "payments", "payment1")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, err = rules.Allows(reader, models.Read, "orders", "order1")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	allowed, err = rules.Allows(reader, models.Append, "payments", "payment1")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	allowed, err = rules.Allows(&models.Principal{Roles: []string{"orders"}}, models.Append, "orders", "eu-1")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, err = rules.Allows(&models.Principal{Roles: []string{"orders"}}, models.Admin, "", "")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	for _, principal := range []*models.Principal{nil, {Roles: []string{models.AdminRole}}} {
+		allowed, err = rules.Allows(principal, models.Admin, "", "")
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+	}
+
+	scopes, all, err := rules.Scopes(&models.Principal{Roles: []string{"payments", "orders"}}, models.Read)
+	assert.NoError(t, err)
+	assert.False(t, all)
+	assert.ElementsMatch(t, []models.AggregateScope{{AggregateType: "payments"}, {AggregateIdPrefix: "eu-"}}, scopes)
+	_, all, err = rules.Scopes(&models.Principal{Roles: []string{"auditor"}}, models.Subscribe)
+	assert.NoError(t, err)
+	assert.True(t, all)
+	// the feeds need read and subscribe, the auditor only follows what it may read
+	scopes, all, err = rules.Scopes(&models.Principal{Roles: []string{"auditor", "orders"}}, models.Read, models.Subscribe)
+	assert.NoError(t, err)
+	assert.False(t, all)
+	assert.Equal(t, []models.AggregateScope{{AggregateIdPrefix: "eu-"}}, scopes)
+	scopes, all, err = rules.Scopes(&models.Principal{Roles: []string{"auditor"}}, models.Read, models.Subscribe)
+	assert.NoError(t, err)
+	assert.False(t, all)
+	assert.Empty(t, scopes)
+	scopes, _, err = rules.Scopes(&models.Principal{Roles: []string{"payments", "orders"}}, models.Read, models.Append)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []models.AggregateScope{{AggregateIdPrefix: "eu-"}, {AggregateType: "payments", AggregateIdPrefix: "eu-"}}, scopes)
+
+	stored, err := rules.GetRule("payments")
+	assert.NoError(t, err)
+	assert.Equal(t, &payments, stored)
+	payments.Operations = []models.Operation{models.Subscribe}
+	assert.NoError(t, rules.SetRule(payments))
+	allowed, err = rules.Allows(reader, models.Read, "payments", "payment1")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	list, err := rules.ListRules()
+	assert.NoError(t, err)
+	assert.Len(t, list, 3)
+	assert.Equal(t, "eu-orders", list[0].Id)
+
+	assert.NoError(t, rules.DeleteRule("payments"))
+	assert.IsType(t, &customerrors.AccessRuleNotFoundError{}, rules.DeleteRule("payments"))
+	_, err = rules.GetRule("payments")
+	assert.IsType(t, &customerrors.AccessRuleNotFoundError{}, err)
+}
+
+func TestScopedQueries(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "payment1", "payments", 2)
+	addStream(t, r, "order1", "orders", 2)
+	addStream(t, r, "payment2", "payments", 2)
+	addStream(t, r, "eu-order2", "orders", 1)
+	// an event of another type does not move the aggregate out of its scope
+	assert.NoError(t, r.AddEvents([]models.Event{{Version: 3, Name: "ticked", Data: []byte("3"), AggregateId: "payment1", AggregateType: "orders"}}))
+
+	scopes := []models.AggregateScope{{AggregateType: "payments"}}
+	events, err := r.GetScopedEventsSinceEvent("0", 3, scopes)
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+	for _, event := range events {
+		assert.Contains(t, []string{"payment1", "payment2"}, event.AggregateId)
+	}
+	events, err = r.GetScopedEventsSinceEvent(events[2].Id, 10, scopes)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, "payment1", events[1].AggregateId)
+
+	events, err = r.GetScopedEventsBeforeEvent("0", 10, []models.AggregateScope{{AggregateIdPrefix: "eu-"}, {AggregateType: "orders", AggregateIdPrefix: "order"}})
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+	assert.Equal(t, "eu-order2", events[0].AggregateId)
+	events, err = r.GetScopedEventsSinceEvent("0", 10, nil)
+	assert.NoError(t, err)
+	assert.Len(t, events, 0)
+
+	aggregates, err := r.ListScopedAggregates("", "", 10, []models.AggregateScope{{AggregateType: "orders"}})
+	assert.NoError(t, err)
+	assert.Len(t, aggregates, 2)
+	assert.Equal(t, "eu-order2", aggregates[0].Id)
+	aggregates, err = r.ListScopedAggregates("orders", "", 10, []models.AggregateScope{{AggregateIdPrefix: "pay"}})
+	assert.NoError(t, err)
+	assert.Len(t, aggregates, 0)
+}
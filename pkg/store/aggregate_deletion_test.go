@@ -0,0 +1,102 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func addDeletable(t *testing.T, r *store.EventRepository, aggregateId string) {
+	err := r.AddEvents([]models.Event{
+		{Version: 1, Name: "created", Data: []byte{1}, AggregateId: aggregateId, AggregateType: "doomed", Tags: []string{"doomed"}},
+		{Version: 2, Name: "changed", Data: []byte{2}, AggregateId: aggregateId, AggregateType: "doomed"},
+	})
+	assert.NoError(t, err)
+}
+
+func TestSoftDeleteRejectsReadsAndAppends(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addDeletable(t, r, "soft1")
+
+	assert.IsType(t, &customerrors.AggregateNotFoundError{}, r.DeleteAggregate("unknown", models.SoftDelete))
+	assert.NoError(t, r.DeleteAggregate("soft1", models.SoftDelete))
+	assert.NoError(t, r.DeleteAggregate("soft1", models.SoftDelete))
+
+	_, err = r.GetEventsForAggregate("soft1")
+	assert.IsType(t, &customerrors.AggregateDeletedError{}, err)
+	err = r.AddEvents([]models.Event{{Version: 3, Name: "changed", Data: []byte{3}, AggregateId: "soft1", AggregateType: "doomed"}})
+	assert.IsType(t, &customerrors.AggregateDeletedError{}, err)
+	_, _, err = r.GetCurrentVersion("soft1")
+	assert.IsType(t, &customerrors.AggregateDeletedError{}, err)
+
+	// the events stay in the global feed
+	events, err := r.GetEventsSinceEvent("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	aggregate, err := r.GetAggregate("soft1")
+	assert.NoError(t, err)
+	assert.Equal(t, models.SoftDelete, aggregate.Deleted)
+}
+
+func TestHardDeleteLeavesTombstone(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addDeletable(t, r, "hard1")
+	addDeletable(t, r, "kept1")
+
+	assert.NoError(t, r.DeleteAggregate("hard1", models.HardDelete))
+	assert.NoError(t, r.DeleteAggregate("hard1", models.HardDelete))
+	assert.NoError(t, r.DeleteAggregate("hard1", models.SoftDelete))
+
+	events, err := r.GetEventsSinceEvent("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+	tombstone := events[2]
+	assert.Equal(t, models.TombstoneEventName, tombstone.Name)
+	assert.Equal(t, "hard1", tombstone.AggregateId)
+	assert.Equal(t, "doomed", tombstone.AggregateType)
+	assert.Equal(t, int64(3), tombstone.Version)
+
+	_, err = r.GetEventsForAggregate("hard1")
+	assert.IsType(t, &customerrors.AggregateDeletedError{}, err)
+	err = r.AppendToAggregates([]models.StreamAppend{{AggregateId: "hard1", ExpectedVersion: models.AnyVersion, Events: []models.Event{{Version: 4, Name: "changed", Data: []byte{4}, AggregateType: "doomed"}}}})
+	assert.IsType(t, &customerrors.AggregateDeletedError{}, err)
+
+}
+
+func TestHardDeleteKeepsFeedCursors(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addDeletable(t, r, "hard2")
+	addDeletable(t, r, "kept2")
+	feed, err := r.GetEventsSinceEvent(store.FeedStart, 2)
+	assert.NoError(t, err)
+	cursor := feed[1].Id
+	assert.Equal(t, "hard2", feed[1].AggregateId)
+
+	assert.NoError(t, r.DeleteAggregate("hard2", models.HardDelete))
+
+	events, err := r.GetEventsSinceEvent(cursor, 10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+	assert.Equal(t, "kept2", events[0].AggregateId)
+	assert.Equal(t, models.TombstoneEventName, events[2].Name)
+	events, err = r.GetEventsBeforeEvent(cursor, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+	_, err = r.GetEventsSinceEvent("unknown", 10)
+	assert.IsType(t, &customerrors.EventNotFoundError{}, err)
+}
@@ -0,0 +1,201 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/helper"
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/rs/zerolog/log"
+)
+
+// aggregateColumns are the columns read by scanAggregate, in order.
+const aggregateColumns = "id, type, version_0, version_1, event_count, created_0, created_1, updated_0, updated_1, deleted"
+
+// ListAggregates retrieves aggregates ordered by id, starting after the given id.
+// An empty aggregateType returns aggregates of all types.
+func (e *EventRepository) ListAggregates(aggregateType string, afterId string, limit int) ([]models.AggregateSummary, error) {
+	return e.listAggregates(aggregateType, afterId, limit, "1", nil)
+}
+
+// ListScopedAggregates is ListAggregates skipping aggregates outside of the
+// scopes. No scopes return no aggregates.
+func (e *EventRepository) ListScopedAggregates(aggregateType string, afterId string, limit int, scopes []models.AggregateScope) ([]models.AggregateSummary, error) {
+	condition, args := scopeCondition(scopes, "type", "id")
+	return e.listAggregates(aggregateType, afterId, limit, condition, args)
+}
+
+func (e *EventRepository) listAggregates(aggregateType string, afterId string, limit int, condition string, conditionArgs []any) ([]models.AggregateSummary, error) {
+	query := `
+		SELECT ` + aggregateColumns + `
+		FROM aggregate_state
+		WHERE id > ? AND (? = '' OR type = ?) AND ` + condition + `
+		ORDER BY id
+		LIMIT ?
+	`
+	stmt, err := e.store.Prepare(query)
+	if err != nil {
+		log.Info().Err(err).Msg("Error preparing statement")
+		return nil, errors.New("could not prepare statement for query aggregates")
+	}
+	defer stmt.Close()
+
+	args := append(append([]any{afterId, aggregateType, aggregateType}, conditionArgs...), limit)
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		log.Info().Err(err).Msg("Error running query statement")
+		return nil, errors.New("could not query aggregates")
+	}
+	defer rows.Close()
+
+	aggregates := []models.AggregateSummary{}
+	for rows.Next() {
+		aggregate, err := scanAggregate(rows)
+		if err != nil {
+			return nil, err
+		}
+		aggregates = append(aggregates, *aggregate)
+	}
+	if err = rows.Err(); err != nil {
+		log.Info().Err(err).Msg("Error checking row errors")
+		return nil, errors.New("could not retrieve all aggregates")
+	}
+	return aggregates, nil
+}
+
+// GetAggregate retrieves the summary of a single aggregate.
+// It returns an AggregateNotFoundError if the aggregate has no events.
+func (e *EventRepository) GetAggregate(aggregateId string) (*models.AggregateSummary, error) {
+	stmt, err := e.store.Prepare("SELECT " + aggregateColumns + " FROM aggregate_state WHERE id = ?")
+	if err != nil {
+		log.Info().Err(err).Msg("Error preparing statement")
+		return nil, errors.New("could not prepare statement for query aggregate")
+	}
+	defer stmt.Close()
+
+	aggregate, err := scanAggregate(stmt.QueryRow(aggregateId))
+	if err == sql.ErrNoRows {
+		return nil, &customerrors.AggregateNotFoundError{}
+	}
+	return aggregate, err
+}
+
+// GetCurrentVersion retrieves the head version and type of an aggregate by its
+// primary key. It returns an AggregateNotFoundError if the aggregate has no events
+// and an AggregateDeletedError if it was deleted.
+func (e *EventRepository) GetCurrentVersion(aggregateId string) (int64, string, error) {
+	var v0, v1 int32
+	var aggregateType, deleted string
+	err := e.store.QueryRow("SELECT version_0, version_1, type, deleted FROM aggregate_state WHERE id = ?", aggregateId).Scan(&v0, &v1, &aggregateType, &deleted)
+	if err == sql.ErrNoRows {
+		return 0, "", &customerrors.AggregateNotFoundError{}
+	}
+	if err != nil {
+		log.Info().Err(err).Msg("Error querying aggregate version")
+		return 0, "", errors.New("could not query aggregate version")
+	}
+	if len(deleted) > 0 {
+		return 0, "", &customerrors.AggregateDeletedError{AggregateId: aggregateId, Mode: models.DeletionMode(deleted)}
+	}
+	version, err := helper.MergeInt62(v0, v1)
+	if err != nil {
+		log.Info().Err(err).Msg("Error transforming version")
+		return 0, "", errors.New("could not retrieve aggregate version")
+	}
+	return version, aggregateType, nil
+}
+
+// GetStats counts the events in the store in total, per aggregate type and per event name.
+func (e *EventRepository) GetStats() (*models.EventStoreStats, error) {
+	stats := &models.EventStoreStats{}
+	err := e.store.QueryRow("SELECT COUNT(*) FROM events").Scan(&stats.TotalEvents)
+	if err != nil {
+		log.Info().Err(err).Msg("Error counting events")
+		return nil, errors.New("could not count events")
+	}
+	err = e.store.QueryRow("SELECT COUNT(*) FROM aggregate_state").Scan(&stats.TotalAggregates)
+	if err != nil {
+		log.Info().Err(err).Msg("Error counting aggregates")
+		return nil, errors.New("could not count aggregates")
+	}
+	stats.EventsPerAggregateType, err = e.countEventsGroupedBy("aggregateType")
+	if err != nil {
+		return nil, err
+	}
+	stats.EventsPerName, err = e.countEventsGroupedBy("Name")
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// countEventsGroupedBy counts events per distinct value of a column of the events table.
+func (e *EventRepository) countEventsGroupedBy(column string) (map[string]int64, error) {
+	rows, err := e.store.Query("SELECT COALESCE(" + column + ", ''), COUNT(*) FROM events GROUP BY " + column)
+	if err != nil {
+		log.Info().Err(err).Msg("Error running query statement")
+		return nil, errors.New("could not count events")
+	}
+	defer rows.Close()
+
+	counts := map[string]int64{}
+	for rows.Next() {
+		var key string
+		var count int64
+		if err = rows.Scan(&key, &count); err != nil {
+			log.Info().Err(err).Msg("Error scanning rows")
+			return nil, errors.New("could not count events")
+		}
+		counts[key] += count
+	}
+	if err = rows.Err(); err != nil {
+		log.Info().Err(err).Msg("Error checking row errors")
+		return nil, errors.New("could not count events")
+	}
+	return counts, nil
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanAggregate reads a row selected with aggregateColumns.
+func scanAggregate(row rowScanner) (*models.AggregateSummary, error) {
+	var aggregate models.AggregateSummary
+	var v0, v1, c0, c1, u0, u1 int32
+	err := row.Scan(&aggregate.Id, &aggregate.Type, &v0, &v1, &aggregate.EventCount, &c0, &c1, &u0, &u1, &aggregate.Deleted)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		log.Info().Err(err).Msg("Error scanning rows")
+		return nil, errors.New("could not retrieve aggregate")
+	}
+	aggregate.Version, err = helper.MergeInt62(v0, v1)
+	if err != nil {
+		log.Info().Err(err).Msg("Error transforming version")
+		return nil, errors.New("could not retrieve aggregate")
+	}
+	aggregate.FirstEventAt, err = mergeTimestamp(c0, c1)
+	if err != nil {
+		return nil, errors.New("could not retrieve aggregate")
+	}
+	aggregate.LastEventAt, err = mergeTimestamp(u0, u1)
+	if err != nil {
+		return nil, errors.New("could not retrieve aggregate")
+	}
+	return &aggregate, nil
+}
+
+// mergeTimestamp turns a split microsecond timestamp back into a time.
+func mergeTimestamp(t0 int32, t1 int32) (time.Time, error) {
+	micros, err := helper.MergeInt62(t0, t1)
+	if err != nil {
+		log.Info().Err(err).Msg("Error transforming timestamp")
+		return time.Time{}, err
+	}
+	return time.UnixMicro(micros).UTC(), nil
+}
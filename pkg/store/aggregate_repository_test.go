@@ -0,0 +1,92 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupCatalogue(t *testing.T) (*store.EventRepository, *store.DatabaseConnection) {
+	db := setup()
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	repo := store.NewEventRepository(conn)
+	err = repo.AddEvents([]models.Event{
+		{AggregateId: "agg1", AggregateType: "type1", Name: "Created", Version: 1, Data: []byte("data1")},
+		{AggregateId: "agg1", AggregateType: "type1", Name: "Changed", Version: 2, Data: []byte("data2")},
+		{AggregateId: "agg2", AggregateType: "type2", Name: "Created", Version: 1, Data: []byte("data3")},
+		{AggregateId: "agg3", AggregateType: "type1", Name: "Created", Version: 1, Data: []byte("data4")},
+	})
+	assert.NoError(t, err)
+	return repo, db
+}
+
+func TestListAggregatesPaginated(t *testing.T) {
+	repo, db := setupCatalogue(t)
+	defer teardown(db)
+
+	aggregates, err := repo.ListAggregates("", "", 2)
+	assert.NoError(t, err)
+	assert.Len(t, aggregates, 2)
+	assert.Equal(t, "agg1", aggregates[0].Id)
+	assert.Equal(t, "agg2", aggregates[1].Id)
+
+	aggregates, err = repo.ListAggregates("", aggregates[1].Id, 2)
+	assert.NoError(t, err)
+	assert.Len(t, aggregates, 1)
+	assert.Equal(t, "agg3", aggregates[0].Id)
+}
+
+func TestListAggregatesByType(t *testing.T) {
+	repo, db := setupCatalogue(t)
+	defer teardown(db)
+
+	aggregates, err := repo.ListAggregates("type1", "", 100)
+	assert.NoError(t, err)
+	assert.Len(t, aggregates, 2)
+	assert.Equal(t, "agg1", aggregates[0].Id)
+	assert.Equal(t, "agg3", aggregates[1].Id)
+}
+
+func TestGetAggregate(t *testing.T) {
+	repo, db := setupCatalogue(t)
+	defer teardown(db)
+
+	aggregate, err := repo.GetAggregate("agg1")
+	assert.NoError(t, err)
+	assert.Equal(t, "type1", aggregate.Type)
+	assert.Equal(t, int64(2), aggregate.Version)
+	assert.Equal(t, int64(2), aggregate.EventCount)
+	assert.True(t, aggregate.FirstEventAt.Before(aggregate.LastEventAt))
+
+	_, err = repo.GetAggregate("unknown")
+	assert.IsType(t, &customerrors.AggregateNotFoundError{}, err)
+}
+
+func TestGetStats(t *testing.T) {
+	repo, db := setupCatalogue(t)
+	defer teardown(db)
+
+	stats, err := repo.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), stats.TotalEvents)
+	assert.Equal(t, int64(3), stats.TotalAggregates)
+	assert.Equal(t, map[string]int64{"type1": 3, "type2": 1}, stats.EventsPerAggregateType)
+	assert.Equal(t, map[string]int64{"Created": 3, "Changed": 1}, stats.EventsPerName)
+}
+
+func TestGetCurrentVersion(t *testing.T) {
+	repo, db := setupCatalogue(t)
+	defer teardown(db)
+
+	version, aggregateType, err := repo.GetCurrentVersion("agg1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), version)
+	assert.Equal(t, "type1", aggregateType)
+
+	_, _, err = repo.GetCurrentVersion("unknown")
+	assert.IsType(t, &customerrors.AggregateNotFoundError{}, err)
+}
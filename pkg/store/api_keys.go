@@ -0,0 +1,176 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// apiKeySecretSize is the number of random bytes of the secret of an API key.
+const apiKeySecretSize = 32
+
+// APIKeys stores static API keys. A key is sent as "<id>.<secret>"; only the
+// SHA-256 digest of the secret is stored.
+type APIKeys struct {
+	store *sql.DB
+}
+
+// NewAPIKeys creates a new APIKeys.
+func NewAPIKeys(db *sql.DB) *APIKeys {
+	return &APIKeys{store: db}
+}
+
+// CreateKey creates an API key for a subject with the given roles. The returned
+// key is the only copy of the secret.
+func (a *APIKeys) CreateKey(subject string, roles []string) (*models.IssuedAPIKey, error) {
+	if len(strings.TrimSpace(subject)) == 0 {
+		return nil, errors.New("subject of an API key must not be empty")
+	}
+	secret := make([]byte, apiKeySecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		log.Info().Err(err).Msg("Error generating API key")
+		return nil, errors.New("could not generate API key")
+	}
+	digest := sha256.Sum256(secret)
+	var encodedRoles []byte
+	if len(roles) > 0 {
+		encodedRoles, _ = json.Marshal(roles)
+	}
+	issued := &models.IssuedAPIKey{
+		APIKey: models.APIKey{
+			Id:        uuid.New().String(),
+			Subject:   subject,
+			Roles:     roles,
+			CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+		},
+	}
+	issued.Key = issued.Id + "." + base64.RawURLEncoding.EncodeToString(secret)
+	_, err := a.store.Exec("INSERT INTO api_keys (id, subject, roles, secretHash, createdAt) VALUES (?,?,?,?,?)",
+		issued.Id, subject, encodedRoles, digest[:], issued.CreatedAt.UnixMicro())
+	if err != nil {
+		log.Info().Err(err).Msg("Error storing API key")
+		return nil, errors.New("could not store API key")
+	}
+	return issued, nil
+}
+
+// Authenticate returns the principal of an API key. It returns an
+// UnauthenticatedError if the key is malformed, unknown or revoked.
+func (a *APIKeys) Authenticate(key string) (*models.Principal, error) {
+	id, encodedSecret, found := strings.Cut(key, ".")
+	secret, err := base64.RawURLEncoding.DecodeString(encodedSecret)
+	if !found || err != nil || len(secret) != apiKeySecretSize {
+		return nil, &customerrors.UnauthenticatedError{Reason: "API key is malformed"}
+	}
+	var digest []byte
+	stored, err := a.load(id, &digest)
+	var notFound *customerrors.APIKeyNotFoundError
+	if errors.As(err, &notFound) {
+		return nil, &customerrors.UnauthenticatedError{Reason: "API key is unknown"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(secret)
+	if subtle.ConstantTimeCompare(sum[:], digest) != 1 {
+		return nil, &customerrors.UnauthenticatedError{Reason: "API key is unknown"}
+	}
+	if stored.RevokedAt != nil {
+		return nil, &customerrors.UnauthenticatedError{Reason: "API key was revoked"}
+	}
+	return &models.Principal{Subject: stored.Subject, Method: "api-key", Roles: stored.Roles}, nil
+}
+
+// GetKey retrieves an API key without its secret. It returns an
+// APIKeyNotFoundError if there is none.
+func (a *APIKeys) GetKey(id string) (*models.APIKey, error) {
+	var digest []byte
+	return a.load(id, &digest)
+}
+
+// ListKeys retrieves all API keys, including revoked ones, ordered by creation.
+func (a *APIKeys) ListKeys() ([]models.APIKey, error) {
+	rows, err := a.store.Query("SELECT id, subject, roles, createdAt, revokedAt, secretHash FROM api_keys ORDER BY createdAt, id")
+	if err != nil {
+		log.Info().Err(err).Msg("Error running query statement")
+		return nil, errors.New("could not query API keys")
+	}
+	defer rows.Close()
+	keys := []models.APIKey{}
+	for rows.Next() {
+		var digest []byte
+		key, err := scanAPIKey(rows, &digest)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	if err = rows.Err(); err != nil {
+		log.Info().Err(err).Msg("Error checking row errors")
+		return nil, errors.New("could not retrieve all API keys")
+	}
+	return keys, nil
+}
+
+// RevokeKey revokes an API key; requests with it are rejected from now on.
+// It returns an APIKeyNotFoundError if there is no such key.
+func (a *APIKeys) RevokeKey(id string) (*models.APIKey, error) {
+	_, err := a.store.Exec("UPDATE api_keys SET revokedAt = ? WHERE id = ? AND revokedAt = 0", time.Now().UnixMicro(), id)
+	if err != nil {
+		log.Info().Err(err).Msg("Error revoking API key")
+		return nil, errors.New("could not revoke API key")
+	}
+	return a.GetKey(id)
+}
+
+// load reads an API key and the digest of its secret.
+func (a *APIKeys) load(id string, digest *[]byte) (*models.APIKey, error) {
+	rows, err := a.store.Query("SELECT id, subject, roles, createdAt, revokedAt, secretHash FROM api_keys WHERE id = ?", id)
+	if err != nil {
+		log.Info().Err(err).Msg("Error running query statement")
+		return nil, errors.New("could not query API key")
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			log.Info().Err(err).Msg("Error checking row errors")
+			return nil, errors.New("could not query API key")
+		}
+		return nil, &customerrors.APIKeyNotFoundError{}
+	}
+	return scanAPIKey(rows, digest)
+}
+
+func scanAPIKey(rows *sql.Rows, digest *[]byte) (*models.APIKey, error) {
+	var key models.APIKey
+	var roles []byte
+	var createdAt, revokedAt int64
+	err := rows.Scan(&key.Id, &key.Subject, &roles, &createdAt, &revokedAt, digest)
+	if err != nil {
+		log.Info().Err(err).Msg("Error scanning rows")
+		return nil, errors.New("could not retrieve API key")
+	}
+	if len(roles) > 0 {
+		if err = json.Unmarshal(roles, &key.Roles); err != nil {
+			log.Info().Err(err).Msg("Error reading roles")
+			return nil, errors.New("could not retrieve API key")
+		}
+	}
+	key.CreatedAt = time.UnixMicro(createdAt).UTC()
+	if revokedAt > 0 {
+		revoked := time.UnixMicro(revokedAt).UTC()
+		key.RevokedAt = &revoked
+	}
+	return &key, nil
+}
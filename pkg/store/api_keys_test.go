@@ -0,0 +1,52 @@
+package store_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeys(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	keys := store.NewAPIKeys(conn)
+
+	issued, err := keys.CreateKey("payments", []string{"payments-reader"})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(issued.Key, issued.Id+"."))
+	principal, err := keys.Authenticate(issued.Key)
+	assert.NoError(t, err)
+	assert.Equal(t, &models.Principal{Subject: "payments", Method: "api-key", Roles: []string{"payments-reader"}}, principal)
+
+	other, err := keys.CreateKey("reporting", nil)
+	assert.NoError(t, err)
+	forged := issued.Id + other.Key[strings.Index(other.Key, "."):]
+	for _, key := range []string{forged, "no-secret", issued.Id + ".short", other.Id + "x" + other.Key[len(other.Id):]} {
+		_, err = keys.Authenticate(key)
+		assert.IsType(t, &customerrors.UnauthenticatedError{}, err, key)
+	}
+	_, err = keys.CreateKey(" ", nil)
+	assert.Error(t, err)
+
+	revoked, err := keys.RevokeKey(issued.Id)
+	assert.NoError(t, err)
+	assert.NotNil(t, revoked.RevokedAt)
+	_, err = keys.Authenticate(issued.Key)
+	assert.Equal(t, &customerrors.UnauthenticatedError{Reason: "API key was revoked"}, err)
+	_, err = keys.Authenticate(other.Key)
+	assert.NoError(t, err)
+
+	listed, err := keys.ListKeys()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []models.APIKey{*revoked, other.APIKey}, listed)
+	_, err = keys.GetKey("unknown")
+	assert.IsType(t, &customerrors.APIKeyNotFoundError{}, err)
+	_, err = keys.RevokeKey("unknown")
+	assert.IsType(t, &customerrors.APIKeyNotFoundError{}, err)
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"database/sql"
+	"slices"
+	"strings"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/rs/zerolog/log"
+)
+
+// checkCondition fails with an AppendConditionFailedError if an event matching one
+// of the condition's queries was written after the event the condition refers to.
+func checkCondition(tx *sql.Tx, condition *models.AppendCondition) error {
+	if len(condition.FailIfEventsMatch) == 0 {
+		return nil
+	}
+	var t0, t1 int32
+	if len(condition.After) > 0 {
+		err := tx.QueryRow(`
+			SELECT timestamp_0, timestamp_1 FROM events WHERE id = ?
+			UNION ALL
+			SELECT timestamp_0, timestamp_1 FROM removed_events WHERE id = ?
+			LIMIT 1`, condition.After, condition.After).Scan(&t0, &t1)
+		if err == sql.ErrNoRows {
+			return &customerrors.EventNotFoundError{}
+		}
+		if err != nil {
+			log.Info().Err(err).Msg("Error querying condition position")
+			return err
+		}
+	}
+
+	queries := make([]string, 0, len(condition.FailIfEventsMatch))
+	args := []any{t0, t0, t1}
+	for _, eventQuery := range condition.FailIfEventsMatch {
+		query, queryArgs := eventQueryClause(eventQuery)
+		queries = append(queries, query)
+		args = append(args, queryArgs...)
+	}
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM events
+			WHERE (events.timestamp_0 > ? OR (events.timestamp_0 = ? AND events.timestamp_1 > ?))
+			AND (` + strings.Join(queries, " OR ") + `)
+		)
+	`
+	var matched bool
+	err := tx.QueryRow(query, args...).Scan(&matched)
+	if err != nil {
+		log.Info().Err(err).Msg("Error checking append condition")
+		return err
+	}
+	if matched {
+		return &customerrors.AppendConditionFailedError{}
+	}
+	return nil
+}
+
+// eventQueryClause builds the where clause matching a single event query.
+func eventQueryClause(eventQuery models.EventQuery) (string, []any) {
+	clauses := []string{}
+	args := []any{}
+	if len(eventQuery.Names) > 0 {
+		clauses = append(clauses, "events.Name IN ("+placeholders(len(eventQuery.Names))+")")
+		for _, name := range eventQuery.Names {
+			args = append(args, name)
+		}
+	}
+	if len(eventQuery.AggregateTypes) > 0 {
+		clauses = append(clauses, "events.aggregateType IN ("+placeholders(len(eventQuery.AggregateTypes))+")")
+		for _, aggregateType := range eventQuery.AggregateTypes {
+			args = append(args, aggregateType)
+		}
+	}
+	if len(eventQuery.Tags) > 0 {
+		tags := slices.Clone(eventQuery.Tags)
+		slices.Sort(tags)
+		tags = slices.Compact(tags)
+		clauses = append(clauses, `events.id IN (
+			SELECT eventId FROM event_tags WHERE tag IN (`+placeholders(len(tags))+`)
+			GROUP BY eventId HAVING COUNT(*) = ?)`)
+		for _, tag := range tags {
+			args = append(args, tag)
+		}
+		args = append(args, len(tags))
+	}
+	if len(clauses) == 0 {
+		return "1 = 1", args
+	}
+	return "(" + strings.Join(clauses, " AND ") + ")", args
+}
+
+// placeholders returns n comma separated query placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
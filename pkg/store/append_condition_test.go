@@ -0,0 +1,91 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func registerUser(r *store.EventRepository, userId string, username string, after string) error {
+	return r.AppendToAggregatesIf([]models.StreamAppend{{
+		AggregateId:     userId,
+		ExpectedVersion: models.NoStream,
+		Events: []models.Event{{
+			Version:       1,
+			Name:          "UserRegistered",
+			Data:          []byte(username),
+			AggregateType: "user",
+			Tags:          []string{"username:" + username},
+		}},
+	}}, &models.AppendCondition{
+		FailIfEventsMatch: []models.EventQuery{{Names: []string{"UserRegistered"}, Tags: []string{"username:" + username}}},
+		After:             after,
+	})
+}
+
+func TestAppendConditionEnforcesUniqueUsername(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	assert.NoError(t, registerUser(r, "user1", "alice", ""))
+	assert.NoError(t, registerUser(r, "user2", "bob", ""))
+	err = registerUser(r, "user3", "alice", "")
+	assert.IsType(t, &customerrors.AppendConditionFailedError{}, err)
+
+	evs, err := r.GetEventsForAggregate("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"username:alice"}, evs[0].Tags)
+	evs, err = r.GetEventsForAggregate("user3")
+	assert.NoError(t, err)
+	assert.Len(t, evs, 0)
+}
+
+func TestAppendConditionOnlyChecksEventsAfterPosition(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	assert.NoError(t, registerUser(r, "user1", "alice", ""))
+	evs, err := r.GetEventsForAggregate("user1")
+	assert.NoError(t, err)
+
+	// the decision was made knowing alice's registration
+	assert.NoError(t, registerUser(r, "user2", "alice", evs[0].Id))
+
+	err = registerUser(r, "user3", "carol", "00000000-0000-0000-0000-000000000000")
+	assert.IsType(t, &customerrors.EventNotFoundError{}, err)
+}
+
+func TestAppendConditionMatchesAggregateTypes(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	assert.NoError(t, r.AddEvents([]models.Event{
+		{Version: 1, Name: "opened", Data: []byte{0}, AggregateId: "account1", AggregateType: "account"},
+	}))
+	appends := []models.StreamAppend{{
+		AggregateId:     "report1",
+		ExpectedVersion: models.AnyVersion,
+		Events:          []models.Event{{Version: 1, Name: "created", Data: []byte{0}, AggregateType: "report"}},
+	}}
+	err = r.AppendToAggregatesIf(appends, &models.AppendCondition{
+		FailIfEventsMatch: []models.EventQuery{{AggregateTypes: []string{"invoice"}}, {AggregateTypes: []string{"account"}}},
+	})
+	assert.IsType(t, &customerrors.AppendConditionFailedError{}, err)
+
+	err = r.AppendToAggregatesIf(appends, &models.AppendCondition{
+		FailIfEventsMatch: []models.EventQuery{{AggregateTypes: []string{"invoice"}}},
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,456 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/helper"
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// ArchiveAfterEnv holds the age, as a duration like "720h", after which the server
+// moves the data of events to segment files. Archiving is disabled if it is empty.
+const ArchiveAfterEnv = "EVTSRC_ARCHIVE_AFTER"
+
+// ArchiveInterval is how often the archive job of the server runs.
+const ArchiveInterval = 10 * time.Minute
+
+// segmentEvents is the maximal number of events written to one segment file.
+const segmentEvents = 10000
+
+// GetSegmentDirectory returns the directory of the segment files, next to the database file.
+func GetSegmentDirectory() string {
+	return filepath.Join(filepath.Dir(_DBFILE), "segments")
+}
+
+// segmentStore reads the data of archived events from the segment files. An
+// archived event keeps its row in the events table, only its data is moved to a
+// segment file and the row references the segment instead.
+type segmentStore struct {
+	store   *sql.DB
+	dir     string
+	mu      sync.Mutex
+	readers map[int64]*segmentReader
+	// archiving serializes archive runs
+	archiving sync.Mutex
+}
+
+func newSegmentStore(db *sql.DB) *segmentStore {
+	return &segmentStore{
+		store:   db,
+		dir:     GetSegmentDirectory(),
+		readers: map[int64]*segmentReader{},
+	}
+}
+
+// read returns the stored data of an archived event.
+func (s *segmentStore) read(segment int64, eventId string) ([]byte, error) {
+	id, err := uuid.Parse(eventId)
+	if err != nil {
+		return nil, errors.New("invalid event id")
+	}
+	reader, err := s.reader(segment)
+	if err != nil {
+		return nil, err
+	}
+	data, ok, err := reader.read(id)
+	if err != nil {
+		log.Info().Err(err).Int64("segment", segment).Msg("Error reading segment")
+		return nil, errors.New("could not read archived event")
+	}
+	if !ok {
+		return nil, errors.New("could not find archived event in its segment")
+	}
+	return data, nil
+}
+
+// reader returns the opened segment file, opening it on first use.
+func (s *segmentStore) reader(segment int64) (*segmentReader, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reader, ok := s.readers[segment]; ok {
+		return reader, nil
+	}
+	var file string
+	err := s.store.QueryRow("SELECT file FROM segments WHERE id = ?", segment).Scan(&file)
+	if err != nil {
+		log.Info().Err(err).Msg("Error querying segment")
+		return nil, errors.New("could not query segment")
+	}
+	reader, err := openSegment(filepath.Join(s.dir, file))
+	if err != nil {
+		log.Info().Err(err).Str("file", file).Msg("Error opening segment")
+		return nil, errors.New("could not open segment")
+	}
+	s.readers[segment] = reader
+	return reader, nil
+}
+
+// remove closes and deletes segment files that are no longer referenced.
+func (s *segmentStore) remove(obsolete map[int64]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for segment, file := range obsolete {
+		if reader, ok := s.readers[segment]; ok {
+			reader.close()
+			delete(s.readers, segment)
+		}
+		err := os.Remove(filepath.Join(s.dir, file))
+		if err != nil && !os.IsNotExist(err) {
+			log.Info().Err(err).Str("file", file).Msg("Error removing segment")
+		}
+	}
+}
+
+func (s *segmentStore) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for segment, reader := range s.readers {
+		reader.close()
+		delete(s.readers, segment)
+	}
+}
+
+// archiveRun references the events whose data was written to a segment file
+// instead of appending events. A run without a file only unregisters unused
+// segments. archived and obsolete are set by the writer.
+type archiveRun struct {
+	file     string
+	ids      []string
+	first    time.Time
+	last     time.Time
+	archived int64
+	// obsolete are the segments no longer referenced by any event
+	obsolete map[int64]string
+}
+
+// archive moves the data of up to segmentEvents events appended before the cutoff
+// to a new segment file. It returns the number of archived events and whether
+// events were left to archive.
+func (s *segmentStore) archive(writer *eventWriter, cutoff time.Time) (int64, bool, error) {
+	t0, t1, err := helper.SplitInt62(cutoff.UnixMicro())
+	if err != nil {
+		return 0, false, err
+	}
+	rows, err := s.store.Query(`
+		SELECT id, data, timestamp_0, timestamp_1 FROM events
+		WHERE segment = 0 AND data IS NOT NULL AND (timestamp_0, timestamp_1) < (?, ?)
+		ORDER BY timestamp_0, timestamp_1
+		LIMIT ?`, t0, t1, segmentEvents)
+	if err != nil {
+		log.Info().Err(err).Msg("Error querying events to archive")
+		return 0, false, errors.New("could not archive events")
+	}
+	run := &archiveRun{}
+	records := []segmentRecord{}
+	for rows.Next() {
+		var id string
+		var data []byte
+		var ts0, ts1 int32
+		if err = rows.Scan(&id, &data, &ts0, &ts1); err != nil {
+			rows.Close()
+			log.Info().Err(err).Msg("Error scanning events to archive")
+			return 0, false, errors.New("could not archive events")
+		}
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			rows.Close()
+			return 0, false, errors.New("invalid event id")
+		}
+		timestamp, err := helper.MergeInt62(ts0, ts1)
+		if err != nil {
+			rows.Close()
+			return 0, false, err
+		}
+		if len(records) == 0 {
+			run.first = time.UnixMicro(timestamp)
+		}
+		run.last = time.UnixMicro(timestamp)
+		records = append(records, segmentRecord{id: parsed, data: data})
+		run.ids = append(run.ids, id)
+	}
+	rows.Close()
+	if len(records) == 0 {
+		return 0, false, nil
+	}
+
+	if err = os.MkdirAll(s.dir, os.ModePerm); err != nil {
+		log.Info().Err(err).Msg("Creating directory for segment files")
+		return 0, false, errors.New("could not archive events")
+	}
+	run.file = fmt.Sprintf("%d-%s.seg", run.first.UnixMicro(), uuid.NewString())
+	path := filepath.Join(s.dir, run.file)
+	if err = writeSegment(path, records); err != nil {
+		log.Info().Err(err).Msg("Error writing segment")
+		return 0, false, errors.New("could not archive events")
+	}
+	err = writer.submitRequest(&appendRequest{archive: run})
+	if err != nil {
+		os.Remove(path)
+		if errors.Is(err, errArchiveOutdated) {
+			// events were removed meanwhile, archive the remaining ones again
+			return 0, true, nil
+		}
+		return 0, false, err
+	}
+	s.remove(run.obsolete)
+	return run.archived, len(records) == segmentEvents, nil
+}
+
+// errArchiveOutdated is returned by the writer if events of an archive run were
+// removed after their data was written to the segment file.
+var errArchiveOutdated = errors.New("archived events were removed meanwhile")
+
+// segmentCompaction replaces the file of a segment by a file holding only the
+// data of the events still referencing the segment.
+type segmentCompaction struct {
+	segment    int64
+	file       string
+	previous   string
+	eventCount int
+}
+
+// compact unregisters the segments no longer referenced and rewrites the files of
+// the segments some of whose events were removed, so the data of removed events
+// does not stay on disk. It has to be called while holding archiving.
+func (s *segmentStore) compact(writer *eventWriter) error {
+	run := &archiveRun{}
+	err := writer.submitRequest(&appendRequest{archive: run})
+	if err != nil {
+		return err
+	}
+	s.remove(run.obsolete)
+
+	rows, err := s.store.Query("SELECT id, file FROM segments WHERE eventCount > (SELECT COUNT(*) FROM events WHERE events.segment = segments.id)")
+	if err != nil {
+		log.Info().Err(err).Msg("Error querying segments to compact")
+		return errors.New("could not compact segments")
+	}
+	shrunk := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var file string
+		if err = rows.Scan(&id, &file); err != nil {
+			rows.Close()
+			log.Info().Err(err).Msg("Error scanning segments to compact")
+			return errors.New("could not compact segments")
+		}
+		shrunk[id] = file
+	}
+	rows.Close()
+	for segment, file := range shrunk {
+		if err = s.rewrite(writer, segment, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewrite writes the data of the events still referencing a segment to a new
+// file, swaps it in and deletes the previous file.
+func (s *segmentStore) rewrite(writer *eventWriter, segment int64, file string) error {
+	rows, err := s.store.Query("SELECT id FROM events WHERE segment = ?", segment)
+	if err != nil {
+		log.Info().Err(err).Msg("Error querying events of segment")
+		return errors.New("could not compact segments")
+	}
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			log.Info().Err(err).Msg("Error scanning events of segment")
+			return errors.New("could not compact segments")
+		}
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			rows.Close()
+			return errors.New("invalid event id")
+		}
+		ids = append(ids, parsed)
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		// the segment is unregistered by the next run
+		return nil
+	}
+	reader, err := s.reader(segment)
+	if err != nil {
+		return err
+	}
+	records := make([]segmentRecord, 0, len(ids))
+	for _, id := range ids {
+		data, ok, err := reader.read(id)
+		if err != nil {
+			log.Info().Err(err).Int64("segment", segment).Msg("Error reading segment")
+			return errors.New("could not compact segments")
+		}
+		if !ok {
+			return errors.New("could not find archived event in its segment")
+		}
+		records = append(records, segmentRecord{id: id, data: data})
+	}
+
+	prefix, _, _ := strings.Cut(file, "-")
+	compaction := &segmentCompaction{
+		segment:    segment,
+		file:       fmt.Sprintf("%s-%s.seg", prefix, uuid.NewString()),
+		previous:   file,
+		eventCount: len(records),
+	}
+	path := filepath.Join(s.dir, compaction.file)
+	if err = writeSegment(path, records); err != nil {
+		log.Info().Err(err).Msg("Error writing segment")
+		return errors.New("could not compact segments")
+	}
+	err = writer.submitRequest(&appendRequest{compaction: compaction})
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	s.remove(map[int64]string{segment: file})
+	return nil
+}
+
+// writeCompaction registers the rewritten file of a segment. Events removed
+// meanwhile keep their data in the new file until the next compaction, as the
+// event count stays above the number of referencing events.
+func (w *eventWriter) writeCompaction(tx *sql.Tx, compaction *segmentCompaction) error {
+	result, err := tx.Exec("UPDATE segments SET file = ?, eventCount = ? WHERE id = ? AND file = ?",
+		compaction.file, compaction.eventCount, compaction.segment, compaction.previous)
+	if err != nil {
+		log.Info().Err(err).Msg("Error registering compacted segment")
+		return errors.New("could not compact segments")
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errors.New("segment was removed meanwhile")
+	}
+	return nil
+}
+
+// writeArchive registers the segment file of a run and removes the data of its
+// events from the events table. Segments no longer referenced are unregistered.
+func (w *eventWriter) writeArchive(tx *sql.Tx, run *archiveRun) error {
+	if len(run.file) > 0 {
+		err := w.registerSegment(tx, run)
+		if err != nil {
+			return err
+		}
+	}
+	rows, err := tx.Query("SELECT id, file FROM segments WHERE NOT EXISTS (SELECT 1 FROM events WHERE events.segment = segments.id)")
+	if err != nil {
+		log.Info().Err(err).Msg("Error querying unused segments")
+		return errors.New("could not archive events")
+	}
+	run.obsolete = map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var file string
+		if err = rows.Scan(&id, &file); err != nil {
+			rows.Close()
+			return err
+		}
+		run.obsolete[id] = file
+	}
+	rows.Close()
+	for id := range run.obsolete {
+		if _, err = tx.Exec("DELETE FROM segments WHERE id = ?", id); err != nil {
+			log.Info().Err(err).Msg("Error unregistering segment")
+			return errors.New("could not archive events")
+		}
+	}
+	return nil
+}
+
+// registerSegment registers the segment file of a run and removes the data of its
+// events from the events table. It fails with errArchiveOutdated if some of the
+// events were removed, so the file never holds data of events no longer stored.
+func (w *eventWriter) registerSegment(tx *sql.Tx, run *archiveRun) error {
+	f0, f1, err := helper.SplitInt62(run.first.UnixMicro())
+	if err != nil {
+		return err
+	}
+	l0, l1, err := helper.SplitInt62(run.last.UnixMicro())
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec("INSERT INTO segments (file, eventCount, first_0, first_1, last_0, last_1) VALUES (?,?,?,?,?,?)",
+		run.file, len(run.ids), f0, f1, l0, l1)
+	if err != nil {
+		log.Info().Err(err).Msg("Error registering segment")
+		return errors.New("could not archive events")
+	}
+	segment, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	update, err := tx.Prepare("UPDATE events SET data = NULL, segment = ? WHERE id = ? AND segment = 0")
+	if err != nil {
+		log.Info().Err(err).Msg("Error preparing archive statement")
+		return errors.New("could not archive events")
+	}
+	defer update.Close()
+	for _, id := range run.ids {
+		result, err := update.Exec(segment, id)
+		if err != nil {
+			log.Info().Err(err).Msg("Error archiving event")
+			return errors.New("could not archive events")
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		run.archived += affected
+	}
+	if run.archived != int64(len(run.ids)) {
+		return errArchiveOutdated
+	}
+	return nil
+}
+
+// listSegments retrieves all registered segment files ordered by their first event.
+func (s *segmentStore) listSegments() ([]models.ArchiveSegment, error) {
+	rows, err := s.store.Query("SELECT id, file, eventCount, first_0, first_1, last_0, last_1 FROM segments ORDER BY first_0, first_1")
+	if err != nil {
+		log.Info().Err(err).Msg("Error running query statement")
+		return nil, errors.New("could not query segments")
+	}
+	defer rows.Close()
+	segments := []models.ArchiveSegment{}
+	for rows.Next() {
+		var segment models.ArchiveSegment
+		var f0, f1, l0, l1 int32
+		if err = rows.Scan(&segment.Id, &segment.File, &segment.EventCount, &f0, &f1, &l0, &l1); err != nil {
+			log.Info().Err(err).Msg("Error scanning rows")
+			return nil, errors.New("could not retrieve segment")
+		}
+		first, err := helper.MergeInt62(f0, f1)
+		if err != nil {
+			return nil, err
+		}
+		last, err := helper.MergeInt62(l0, l1)
+		if err != nil {
+			return nil, err
+		}
+		segment.FirstEventAt = time.UnixMicro(first).UTC()
+		segment.LastEventAt = time.UnixMicro(last).UTC()
+		segments = append(segments, segment)
+	}
+	if err = rows.Err(); err != nil {
+		log.Info().Err(err).Msg("Error checking row errors")
+		return nil, errors.New("could not retrieve all segments")
+	}
+	return segments, nil
+}
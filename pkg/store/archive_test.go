@@ -0,0 +1,209 @@
+package store_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func rawSegment(t *testing.T, db *store.DatabaseConnection, aggregateId string) (int, int64) {
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	var archived int
+	var segment int64
+	err = conn.QueryRow("SELECT COUNT(*), MAX(segment) FROM events WHERE aggregateId = ? AND data IS NULL AND segment != 0", aggregateId).Scan(&archived, &segment)
+	assert.NoError(t, err)
+	return archived, segment
+}
+
+func TestArchivedEventsAreServed(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	events := []models.Event{}
+	for i := 1; i <= 300; i++ {
+		events = append(events, models.Event{Id: fmt.Sprintf("5b0e4c1a-7d2f-4e8a-9c3b-%012d", i), Version: int64(i), Name: "placed", Data: largePayload(i), AggregateId: "order1", AggregateType: "order"})
+	}
+	assert.NoError(t, r.AddEvents(events))
+	addStream(t, r, "small1", "small", 3)
+
+	archived, err := r.ArchiveEvents(time.Hour)
+	assert.NoError(t, err)
+	assert.Zero(t, archived)
+	archived, err = r.ArchiveEvents(0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(303), archived)
+	count, _ := rawSegment(t, db, "order1")
+	assert.Equal(t, 300, count)
+
+	segments, err := r.ListArchiveSegments()
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+	assert.Equal(t, int64(303), segments[0].EventCount)
+	assert.FileExists(t, filepath.Join(store.GetSegmentDirectory(), segments[0].File))
+
+	stored, err := r.GetEventsForAggregate("order1")
+	assert.NoError(t, err)
+	assert.Len(t, stored, 300)
+	for i, event := range stored {
+		assert.Equal(t, largePayload(i+1), event.Data)
+	}
+	since, err := r.GetEventsSinceEvent(stored[150].Id, 200)
+	assert.NoError(t, err)
+	assert.Len(t, since, 152)
+	assert.Equal(t, largePayload(152), since[0].Data)
+	assert.Equal(t, []byte("3"), since[151].Data)
+
+	// replaying archived events compares against the archived data
+	assert.NoError(t, r.AddEvents(events[:2]))
+	events[0].Data = []byte("changed")
+	assert.Error(t, r.AddEvents(events[:1]))
+
+	addStream(t, r, "small2", "small", 1)
+	reopened := store.NewEventRepository(conn)
+	stored, err = reopened.GetEventsForAggregate("small1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), stored[1].Data)
+	stored, err = reopened.GetEventsForAggregate("small2")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), stored[0].Data)
+}
+
+func TestArchivedEventsStayEncrypted(t *testing.T) {
+	t.Setenv(store.MasterKeyEnv, newMasterKey(t))
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	err = r.AddEvents([]models.Event{
+		{Version: 1, Name: "placed", Data: []byte("secret payload"), AggregateId: "order2", AggregateType: "order"},
+		{Version: 2, Name: "paid", Data: largePayload(3), AggregateId: "order2", AggregateType: "order", Subject: "customer2"},
+	})
+	assert.NoError(t, err)
+	archived, err := r.ArchiveEvents(0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), archived)
+
+	segments, err := r.ListArchiveSegments()
+	assert.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(store.GetSegmentDirectory(), segments[0].File))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(content), "secret payload")
+
+	events, err := r.GetEventsForAggregate("order2")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret payload"), events[0].Data)
+	assert.Equal(t, largePayload(3), events[1].Data)
+	assert.NoError(t, r.DestroySubjectKey("customer2"))
+	events, err = r.GetEventsForAggregate("order2")
+	assert.NoError(t, err)
+	assert.Nil(t, events[1].Data)
+}
+
+func TestUnusedSegmentsAreRemoved(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	addStream(t, r, "doomed1", "doomed", 3)
+	_, err = r.ArchiveEvents(0)
+	assert.NoError(t, err)
+	addStream(t, r, "kept1", "kept", 2)
+	_, err = r.ArchiveEvents(0)
+	assert.NoError(t, err)
+	segments, err := r.ListArchiveSegments()
+	assert.NoError(t, err)
+	assert.Len(t, segments, 2)
+	_, segment := rawSegment(t, db, "doomed1")
+	assert.Equal(t, segments[0].Id, segment)
+
+	assert.NoError(t, r.DeleteAggregate("doomed1", models.HardDelete))
+	_, err = r.ArchiveEvents(time.Hour)
+	assert.NoError(t, err)
+	remaining, err := r.ListArchiveSegments()
+	assert.NoError(t, err)
+	assert.Len(t, remaining, 1)
+	assert.Equal(t, segments[1].Id, remaining[0].Id)
+	assert.NoFileExists(t, filepath.Join(store.GetSegmentDirectory(), segments[0].File))
+
+	events, err := r.GetEventsForAggregate("kept1")
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+}
+
+func segmentFilesContain(t *testing.T, payload []byte) bool {
+	files, err := os.ReadDir(store.GetSegmentDirectory())
+	assert.NoError(t, err)
+	for _, file := range files {
+		content, err := os.ReadFile(filepath.Join(store.GetSegmentDirectory(), file.Name()))
+		assert.NoError(t, err)
+		if bytes.Contains(content, payload) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRemovedEventsAreCompactedFromSegments(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	assert.NoError(t, r.RetentionPolicies().SetPolicy(models.RetentionPolicy{AggregateType: "session", MaxCount: 1}))
+
+	// random payloads stay readable in the compressed blocks
+	payloads := map[string][]byte{}
+	for _, aggregateId := range []string{"doomed2", "session1", "kept2"} {
+		payloads[aggregateId] = make([]byte, 256)
+		_, err = rand.Read(payloads[aggregateId])
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, r.AddEvents([]models.Event{
+		{Version: 1, Name: "opened", Data: payloads["doomed2"], ContentType: "application/octet-stream", AggregateId: "doomed2", AggregateType: "doomed"},
+		{Version: 1, Name: "opened", Data: payloads["session1"], ContentType: "application/octet-stream", AggregateId: "session1", AggregateType: "session"},
+		{Version: 1, Name: "opened", Data: payloads["kept2"], ContentType: "application/octet-stream", AggregateId: "kept2", AggregateType: "kept"},
+	}))
+	archived, err := r.ArchiveEvents(0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), archived)
+	for _, payload := range payloads {
+		assert.True(t, segmentFilesContain(t, payload))
+	}
+
+	assert.NoError(t, r.DeleteAggregate("doomed2", models.HardDelete))
+	assert.False(t, segmentFilesContain(t, payloads["doomed2"]))
+	assert.True(t, segmentFilesContain(t, payloads["session1"]))
+
+	assert.NoError(t, r.AddEvents([]models.Event{{Version: 2, Name: "closed", Data: []byte("{}"), AggregateId: "session1", AggregateType: "session"}}))
+	removed, err := r.ApplyRetention()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), removed)
+	assert.False(t, segmentFilesContain(t, payloads["session1"]))
+
+	segments, err := r.ListArchiveSegments()
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+	assert.Equal(t, int64(1), segments[0].EventCount)
+	files, err := os.ReadDir(store.GetSegmentDirectory())
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	events, err := r.GetEventsForAggregate("kept2")
+	assert.NoError(t, err)
+	assert.Equal(t, payloads["kept2"], events[0].Data)
+}
@@ -0,0 +1,345 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/rs/zerolog/log"
+)
+
+// backupDbFile is the name of the database file within a backup directory.
+const backupDbFile = "eventstore.db"
+
+// backupTables are the tables a backup has to contain to be restored.
+var backupTables = []string{"events", "aggregate_state", "event_tags", "segments", "data_keys"}
+
+// BackupDirEnv holds the directory the backups requested over the API are written
+// to. It defaults to the directory backups next to the database file.
+const BackupDirEnv = "EVTSRC_BACKUP_DIR"
+
+// GetBackupDirectory returns the directory the backups requested over the API are written to.
+func GetBackupDirectory() string {
+	if dir := os.Getenv(BackupDirEnv); len(dir) > 0 {
+		return dir
+	}
+	return filepath.Join(filepath.Dir(_DBFILE), "backups")
+}
+
+// preRestoreSuffix is appended to the database and segment files replaced by a restore.
+const preRestoreSuffix = ".pre-restore"
+
+// Backup writes a consistent copy of the store to the directory target, which must
+// not exist yet. The database is copied with VACUUM INTO, so it can run while the
+// store is served, followed by the segment files referenced by the copy. Encrypted
+// data stays encrypted, restoring it needs the same master key. It returns a
+// BackupTargetExistsError if target exists.
+func Backup(db *sql.DB, target string) (*models.Backup, error) {
+	return backupTo(db, GetSegmentDirectory(), target)
+}
+
+// Backup writes a consistent copy of the store to the directory target, see Backup.
+// Archiving is paused meanwhile so no segment file referenced by the copy is removed.
+func (e *EventRepository) Backup(target string) (*models.Backup, error) {
+	segments := e.data.segments
+	segments.archiving.Lock()
+	defer segments.archiving.Unlock()
+	return backupTo(e.store, segments.dir, target)
+}
+
+func backupTo(db *sql.DB, segmentDir string, target string) (*models.Backup, error) {
+	if _, err := os.Stat(target); err == nil {
+		return nil, &customerrors.BackupTargetExistsError{}
+	} else if !os.IsNotExist(err) {
+		log.Info().Err(err).Msg("Checking backup target")
+		return nil, errors.New("could not back up store")
+	}
+	if err := os.MkdirAll(filepath.Join(target, "segments"), os.ModePerm); err != nil {
+		log.Info().Err(err).Msg("Creating backup directory")
+		return nil, errors.New("could not back up store")
+	}
+	backup, err := writeBackup(db, segmentDir, target)
+	if err != nil {
+		os.RemoveAll(target)
+		return nil, err
+	}
+	log.Debug().Str("path", target).Int64("size", backup.SizeBytes).Msg("Backed up store")
+	return backup, nil
+}
+
+func writeBackup(db *sql.DB, segmentDir string, target string) (*models.Backup, error) {
+	dbFile := filepath.Join(target, backupDbFile)
+	_, err := db.Exec("VACUUM INTO ?", dbFile)
+	if err != nil {
+		log.Info().Err(err).Msg("Error copying database")
+		return nil, errors.New("could not back up store")
+	}
+	info, err := os.Stat(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	backup := &models.Backup{Path: target, SizeBytes: info.Size(), CreatedAt: time.Now().UTC()}
+
+	files, err := backupSegmentFiles(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		size, err := copyFile(filepath.Join(segmentDir, file), filepath.Join(target, "segments", file))
+		if err != nil {
+			log.Info().Err(err).Str("file", file).Msg("Error copying segment")
+			return nil, errors.New("could not back up segment files")
+		}
+		backup.SizeBytes += size
+		backup.Segments++
+	}
+	return backup, nil
+}
+
+// backupSegmentFiles lists the segment files referenced by a backed up database.
+func backupSegmentFiles(dbFile string) ([]string, error) {
+	db, err := openBackupDb(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT file FROM segments")
+	if err != nil {
+		log.Info().Err(err).Msg("Error querying segments of backup")
+		return nil, errors.New("could not query segments of backup")
+	}
+	defer rows.Close()
+	files := []string{}
+	for rows.Next() {
+		var file string
+		if err = rows.Scan(&file); err != nil {
+			log.Info().Err(err).Msg("Error scanning rows")
+			return nil, errors.New("could not query segments of backup")
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+func openBackupDb(dbFile string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+dbFile+"?mode=ro")
+	if err != nil {
+		log.Info().Err(err).Msg("Opening backup")
+		return nil, errors.New("could not open backup")
+	}
+	return db, nil
+}
+
+// ValidateBackup checks that the backup in the directory path can be restored: the
+// database passes the integrity check, holds all tables of the store, every
+// referenced segment file is present and readable and every data key can be
+// unwrapped with the master keys. It returns an InvalidBackupError otherwise.
+func ValidateBackup(path string, master *MasterKeys) error {
+	dbFile := filepath.Join(path, backupDbFile)
+	if _, err := os.Stat(dbFile); err != nil {
+		return &customerrors.InvalidBackupError{Reason: "database file missing"}
+	}
+	db, err := openBackupDb(dbFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return &customerrors.InvalidBackupError{Reason: "integrity check failed: " + err.Error()}
+	}
+	results := []string{}
+	for rows.Next() {
+		var result string
+		if err = rows.Scan(&result); err != nil {
+			rows.Close()
+			return &customerrors.InvalidBackupError{Reason: "integrity check failed: " + err.Error()}
+		}
+		results = append(results, result)
+	}
+	rows.Close()
+	if len(results) != 1 || results[0] != "ok" {
+		return &customerrors.InvalidBackupError{Reason: fmt.Sprintf("integrity check failed: %v", results)}
+	}
+
+	for _, table := range backupTables {
+		var count int
+		err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+		if err != nil || count == 0 {
+			return &customerrors.InvalidBackupError{Reason: "table " + table + " missing"}
+		}
+	}
+
+	segments, err := db.Query("SELECT file, eventCount FROM segments")
+	if err != nil {
+		return &customerrors.InvalidBackupError{Reason: "segments not readable"}
+	}
+	defer segments.Close()
+	for segments.Next() {
+		var file string
+		var eventCount int
+		if err = segments.Scan(&file, &eventCount); err != nil {
+			return &customerrors.InvalidBackupError{Reason: "segments not readable"}
+		}
+		reader, err := openSegment(filepath.Join(path, "segments", file))
+		if err != nil {
+			return &customerrors.InvalidBackupError{Reason: "segment " + file + " not readable: " + err.Error()}
+		}
+		entries := len(reader.entries)
+		reader.close()
+		if entries != eventCount {
+			return &customerrors.InvalidBackupError{Reason: "segment " + file + " incomplete"}
+		}
+	}
+	if err = segments.Err(); err != nil {
+		return &customerrors.InvalidBackupError{Reason: "segments not readable"}
+	}
+	return validateBackupKeys(db, master)
+}
+
+// validateBackupKeys checks that every data key of a backup can be unwrapped with
+// the master keys, so the restored store can decrypt its events.
+func validateBackupKeys(db *sql.DB, master *MasterKeys) error {
+	rows, err := db.Query("SELECT id, key, masterKey FROM data_keys")
+	if err != nil {
+		return &customerrors.InvalidBackupError{Reason: "data keys not readable"}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var wrapped []byte
+		var masterKey string
+		if err = rows.Scan(&id, &wrapped, &masterKey); err != nil {
+			return &customerrors.InvalidBackupError{Reason: "data keys not readable"}
+		}
+		if master == nil {
+			return &customerrors.InvalidBackupError{Reason: "backup is encrypted but no master key is configured"}
+		}
+		key := master.byId(masterKey)
+		if key == nil {
+			return &customerrors.InvalidBackupError{Reason: fmt.Sprintf("data key %d is wrapped with an unknown master key", id)}
+		}
+		if _, err = openWithKey(key, wrapped); err != nil {
+			return &customerrors.InvalidBackupError{Reason: fmt.Sprintf("data key %d cannot be unwrapped", id)}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return &customerrors.InvalidBackupError{Reason: "data keys not readable"}
+	}
+	return nil
+}
+
+// Restore validates the backup in the directory path and swaps it in for the
+// database and segment files of the store. The replaced files are kept with the
+// suffix .pre-restore and moved back if the swap fails. The master keys have to
+// unwrap the data keys of the backup. It must not run while the store is served.
+func Restore(path string, master *MasterKeys) error {
+	err := ValidateBackup(path, master)
+	if err != nil {
+		return err
+	}
+	dbFile := GetDbFileLocation()
+	segmentDir := GetSegmentDirectory()
+	if err = os.MkdirAll(filepath.Dir(dbFile), os.ModePerm); err != nil {
+		log.Info().Err(err).Msg("Creating directory for database files")
+		return errors.New("could not restore backup")
+	}
+
+	// copy the backup next to the store first, so the swap itself only renames
+	stagedDb := dbFile + ".restore"
+	stagedSegments := segmentDir + ".restore"
+	os.RemoveAll(stagedSegments)
+	if _, err = copyFile(filepath.Join(path, backupDbFile), stagedDb); err != nil {
+		log.Info().Err(err).Msg("Error staging database")
+		return errors.New("could not restore backup")
+	}
+	if err = copyDir(filepath.Join(path, "segments"), stagedSegments); err != nil {
+		os.Remove(stagedDb)
+		os.RemoveAll(stagedSegments)
+		log.Info().Err(err).Msg("Error staging segment files")
+		return errors.New("could not restore backup")
+	}
+
+	os.RemoveAll(segmentDir + preRestoreSuffix)
+	renames := [][2]string{}
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(dbFile + preRestoreSuffix + suffix)
+		renames = append(renames, [2]string{dbFile + suffix, dbFile + preRestoreSuffix + suffix})
+	}
+	renames = append(renames, [2]string{segmentDir, segmentDir + preRestoreSuffix}, [2]string{stagedDb, dbFile}, [2]string{stagedSegments, segmentDir})
+	done := [][2]string{}
+	for _, rename := range renames {
+		err = os.Rename(rename[0], rename[1])
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Info().Err(err).Str("file", rename[0]).Msg("Error swapping in backup")
+			rollbackRenames(done)
+			os.Remove(stagedDb)
+			os.RemoveAll(stagedSegments)
+			return errors.New("could not restore backup")
+		}
+		done = append(done, rename)
+	}
+	log.Debug().Str("path", path).Msg("Restored backup")
+	return nil
+}
+
+// rollbackRenames moves the renamed files back in reverse order.
+func rollbackRenames(done [][2]string) {
+	for i := len(done) - 1; i >= 0; i-- {
+		if err := os.Rename(done[i][1], done[i][0]); err != nil {
+			log.Error().Err(err).Str("file", done[i][0]).Msg("Error moving back replaced file")
+		}
+	}
+}
+
+// copyFile copies src to the new file dst, syncs it and returns its size.
+func copyFile(src string, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return size, err
+}
+
+// copyDir copies the files of the directory src to the new directory dst.
+func copyDir(src string, dst string) error {
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if _, err = copyFile(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package store_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupIncludesSegments(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "archived1", "archived", 3)
+	_, err = r.ArchiveEvents(0)
+	assert.NoError(t, err)
+	addStream(t, r, "recent1", "recent", 2)
+
+	target := filepath.Join(t.TempDir(), "backup")
+	backup, err := r.Backup(target)
+	assert.NoError(t, err)
+	assert.Equal(t, target, backup.Path)
+	assert.Equal(t, 1, backup.Segments)
+	assert.Positive(t, backup.SizeBytes)
+	assert.NoError(t, store.ValidateBackup(target, nil))
+
+	_, err = r.Backup(target)
+	assert.IsType(t, &customerrors.BackupTargetExistsError{}, err)
+}
+
+func TestValidateBackupRejectsBrokenBackups(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "archived2", "archived", 3)
+	_, err = r.ArchiveEvents(0)
+	assert.NoError(t, err)
+
+	target := filepath.Join(t.TempDir(), "backup")
+	_, err = store.Backup(conn, target)
+	assert.NoError(t, err)
+	segments, err := os.ReadDir(filepath.Join(target, "segments"))
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+	segment := filepath.Join(target, "segments", segments[0].Name())
+	assert.NoError(t, os.WriteFile(segment, []byte("truncated"), 0644))
+	assert.IsType(t, &customerrors.InvalidBackupError{}, store.ValidateBackup(target, nil))
+	assert.NoError(t, os.Remove(segment))
+	assert.IsType(t, &customerrors.InvalidBackupError{}, store.ValidateBackup(target, nil))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(target, "eventstore.db"), []byte("not a database"), 0644))
+	assert.Error(t, store.ValidateBackup(target, nil))
+	assert.IsType(t, &customerrors.InvalidBackupError{}, store.ValidateBackup(t.TempDir(), nil))
+	assert.Error(t, store.Restore(target, nil))
+}
+
+func TestRestoreBackup(t *testing.T) {
+	db := setup()
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "restored1", "restored", 3)
+	_, err = r.ArchiveEvents(0)
+	assert.NoError(t, err)
+	target := filepath.Join(t.TempDir(), "backup")
+	_, err = r.Backup(target)
+	assert.NoError(t, err)
+	addStream(t, r, "lost1", "lost", 2)
+	r.Close()
+	conn.Close()
+
+	assert.NoError(t, store.Restore(target, nil))
+	assert.FileExists(t, store.GetDbFileLocation()+".pre-restore")
+
+	restored := store.DatabaseConnection{}
+	restored.SetUp()
+	assert.True(t, restored.IsInitialized())
+	defer teardown(&restored)
+	conn, err = restored.GetDbConnection()
+	assert.NoError(t, err)
+	r = store.NewEventRepository(conn)
+	defer r.Close()
+	events, err := r.GetEventsForAggregate("restored1")
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+	assert.Equal(t, []byte("3"), events[2].Data)
+	events, err = r.GetEventsSinceEvent("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+}
+
+func TestValidateBackupNeedsMasterKey(t *testing.T) {
+	t.Setenv(store.MasterKeyEnv, newMasterKey(t))
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "encrypted1", "encrypted", 2)
+	target := filepath.Join(t.TempDir(), "backup")
+	_, err = r.Backup(target)
+	assert.NoError(t, err)
+
+	master, err := store.LoadMasterKeys()
+	assert.NoError(t, err)
+	assert.NoError(t, store.ValidateBackup(target, master))
+	assert.IsType(t, &customerrors.InvalidBackupError{}, store.ValidateBackup(target, nil))
+	t.Setenv(store.MasterKeyEnv, newMasterKey(t))
+	other, err := store.LoadMasterKeys()
+	assert.NoError(t, err)
+	assert.IsType(t, &customerrors.InvalidBackupError{}, store.ValidateBackup(target, other))
+	assert.IsType(t, &customerrors.InvalidBackupError{}, store.Restore(target, other))
+	other.Previous = [][]byte{master.Current}
+	assert.NoError(t, store.ValidateBackup(target, other))
+}
+
+func TestFailedRestoreKeepsStore(t *testing.T) {
+	db := setup()
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "restored2", "restored", 3)
+	_, err = r.ArchiveEvents(0)
+	assert.NoError(t, err)
+	target := filepath.Join(t.TempDir(), "backup")
+	_, err = r.Backup(target)
+	assert.NoError(t, err)
+	addStream(t, r, "kept3", "kept", 2)
+	r.Close()
+	conn.Close()
+
+	// a directory in place of a replaced file lets the swap fail after the database was moved
+	dbFile := store.GetDbFileLocation()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dbFile+".pre-restore-shm", "blocked"), os.ModePerm))
+	assert.NoError(t, os.WriteFile(dbFile+"-shm", nil, 0644))
+	assert.Error(t, store.Restore(target, nil))
+	assert.NoFileExists(t, dbFile+".pre-restore")
+	assert.NoFileExists(t, dbFile+".restore")
+	assert.NoDirExists(t, store.GetSegmentDirectory()+".restore")
+	assert.NoError(t, os.RemoveAll(dbFile+".pre-restore-shm"))
+	assert.NoError(t, os.Remove(dbFile+"-shm"))
+
+	kept := store.DatabaseConnection{}
+	kept.SetUp()
+	assert.True(t, kept.IsInitialized())
+	defer teardown(&kept)
+	conn, err = kept.GetDbConnection()
+	assert.NoError(t, err)
+	r = store.NewEventRepository(conn)
+	defer r.Close()
+	events, err := r.GetEventsForAggregate("kept3")
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	events, err = r.GetEventsForAggregate("restored2")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("3"), events[2].Data)
+}
@@ -0,0 +1,28 @@
+package store
+
+import "sync"
+
+// commitNotifier wakes up readers waiting for new events.
+type commitNotifier struct {
+	mu      sync.Mutex
+	pending chan struct{}
+}
+
+func newCommitNotifier() *commitNotifier {
+	return &commitNotifier{pending: make(chan struct{})}
+}
+
+// wait returns a channel that is closed with the next commit.
+func (n *commitNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.pending
+}
+
+// notify wakes up all readers waiting for a commit.
+func (n *commitNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.pending)
+	n.pending = make(chan struct{})
+}
@@ -0,0 +1,376 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
+)
+
+// CompressionThresholdEnv holds the minimal size in bytes of the data of an event
+// to be compressed. A negative value disables compression.
+const CompressionThresholdEnv = "EVTSRC_COMPRESSION_THRESHOLD"
+
+const defaultCompressionThreshold = 1024
+
+// zstdCodec is recorded for rows whose data is compressed with zstd. Rows stored
+// uncompressed record an empty codec.
+const zstdCodec = "zstd"
+
+// dictionarySamples is the number of recent events a dictionary is trained on.
+const dictionarySamples = 1000
+
+// dictionaryHistorySize limits the content a trained dictionary references.
+const dictionaryHistorySize = 64 << 10
+
+// compressionDictionary is a zstd dictionary of an aggregate type.
+type compressionDictionary struct {
+	id      int64
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// compressor compresses the data of events above a size threshold with zstd,
+// using the active dictionary of their aggregate type if there is one. The
+// content of dictionaries, which is taken from event data, is encrypted like
+// the data itself.
+type compressor struct {
+	store      *sql.DB
+	encryption *dataEncryption
+	threshold  int
+	encoder    *zstd.Encoder
+	decoder    *zstd.Decoder
+	mu         sync.Mutex
+	active     map[string]*compressionDictionary
+	byId       map[int64]*compressionDictionary
+}
+
+func newCompressor(db *sql.DB, encryption *dataEncryption) (*compressor, error) {
+	threshold := defaultCompressionThreshold
+	if value := os.Getenv(CompressionThresholdEnv); len(value) > 0 {
+		var err error
+		threshold, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.New("compression threshold must be a number")
+		}
+	}
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &compressor{
+		store:      db,
+		encryption: encryption,
+		threshold:  threshold,
+		encoder:    encoder,
+		decoder:    decoder,
+		active:     map[string]*compressionDictionary{},
+		byId:       map[int64]*compressionDictionary{},
+	}, nil
+}
+
+// compress returns the codec, the dictionary and the compressed data. Data below
+// the threshold, or data that does not get smaller, is returned unchanged with an empty codec.
+func (c *compressor) compress(aggregateType string, data []byte) (string, int64, []byte, error) {
+	if c.threshold < 0 || len(data) < c.threshold || len(data) == 0 {
+		return "", 0, data, nil
+	}
+	dictionary, err := c.activeDictionary(aggregateType)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	encoder, dictionaryId := c.encoder, int64(0)
+	if dictionary != nil {
+		encoder, dictionaryId = dictionary.encoder, dictionary.id
+	}
+	compressed := encoder.EncodeAll(data, nil)
+	if len(compressed) >= len(data) {
+		return "", 0, data, nil
+	}
+	return zstdCodec, dictionaryId, compressed, nil
+}
+
+// decompress reverses compress.
+func (c *compressor) decompress(codec string, dictionaryId int64, data []byte) ([]byte, error) {
+	switch codec {
+	case "":
+		return data, nil
+	case zstdCodec:
+		decoder := c.decoder
+		if dictionaryId != 0 {
+			dictionary, err := c.dictionary(dictionaryId)
+			if err != nil {
+				return nil, err
+			}
+			decoder = dictionary.decoder
+		}
+		plain, err := decoder.DecodeAll(data, nil)
+		if err != nil {
+			log.Info().Err(err).Msg("Error decompressing event data")
+			return nil, errors.New("could not decompress event")
+		}
+		return plain, nil
+	default:
+		return nil, errors.New("could not decompress event: unknown codec " + codec)
+	}
+}
+
+// activeDictionary returns the dictionary new events of an aggregate type are
+// compressed with, or nil if the type has none.
+func (c *compressor) activeDictionary(aggregateType string) (*compressionDictionary, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if dictionary, ok := c.active[aggregateType]; ok {
+		return dictionary, nil
+	}
+	var id, dataKey int64
+	var content []byte
+	err := c.store.QueryRow("SELECT id, dictionary, dataKey FROM compression_dictionaries WHERE aggregateType = ? AND active = 1", aggregateType).Scan(&id, &content, &dataKey)
+	if err == sql.ErrNoRows {
+		c.active[aggregateType] = nil
+		return nil, nil
+	}
+	if err != nil {
+		log.Info().Err(err).Msg("Error querying compression dictionary")
+		return nil, errors.New("could not load compression dictionary")
+	}
+	dictionary, err := c.load(id, aggregateType, dataKey, content)
+	if err != nil {
+		return nil, err
+	}
+	c.active[aggregateType] = dictionary
+	return dictionary, nil
+}
+
+// dictionary returns a dictionary by its id, also if it is no longer active.
+func (c *compressor) dictionary(id int64) (*compressionDictionary, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if dictionary, ok := c.byId[id]; ok {
+		return dictionary, nil
+	}
+	var aggregateType string
+	var dataKey int64
+	var content []byte
+	err := c.store.QueryRow("SELECT aggregateType, dataKey, dictionary FROM compression_dictionaries WHERE id = ?", id).Scan(&aggregateType, &dataKey, &content)
+	if err != nil {
+		log.Info().Err(err).Msg("Error querying compression dictionary")
+		return nil, errors.New("could not load compression dictionary")
+	}
+	return c.load(id, aggregateType, dataKey, content)
+}
+
+// load decrypts the content of a dictionary and creates its encoder and
+// decoder. c.mu must be held.
+func (c *compressor) load(id int64, aggregateType string, dataKey int64, content []byte) (*compressionDictionary, error) {
+	content, err := c.encryption.decrypt(dataKey, dictionaryAssociatedData(aggregateType), content)
+	if err != nil {
+		return nil, err
+	}
+	dictionary, err := newCompressionDictionary(id, content)
+	if err != nil {
+		log.Info().Err(err).Msg("Error loading compression dictionary")
+		return nil, errors.New("could not load compression dictionary")
+	}
+	c.byId[id] = dictionary
+	return dictionary, nil
+}
+
+func newCompressionDictionary(id int64, content []byte) (*compressionDictionary, error) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(content))
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(content))
+	if err != nil {
+		return nil, err
+	}
+	return &compressionDictionary{id: id, encoder: encoder, decoder: decoder}, nil
+}
+
+// setDictionary stores a dictionary in the zstd dictionary format and makes it
+// the active one of the aggregate type. Previous dictionaries are kept to
+// decompress the events compressed with them.
+func (c *compressor) setDictionary(aggregateType string, content []byte) error {
+	dictionary, err := newCompressionDictionary(0, content)
+	if err != nil {
+		return &customerrors.InvalidDictionaryError{Reason: err.Error()}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tx, err := c.store.Begin()
+	if err != nil {
+		log.Info().Err(err).Msg("Error beginning transaction")
+		return errors.New("could not store compression dictionary")
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE compression_dictionaries SET active = 0 WHERE aggregateType = ?", aggregateType)
+	if err != nil {
+		log.Info().Err(err).Msg("Error deactivating compression dictionary")
+		return errors.New("could not store compression dictionary")
+	}
+	dataKey, sealed, err := c.encryption.encrypt(dictionaryAssociatedData(aggregateType), content)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec("INSERT INTO compression_dictionaries (aggregateType, dictionary, active, dataKey) VALUES (?,?,1,?)", aggregateType, sealed, dataKey)
+	if err != nil {
+		log.Info().Err(err).Msg("Error storing compression dictionary")
+		return errors.New("could not store compression dictionary")
+	}
+	dictionary.id, err = result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Info().Err(err).Msg("Error committing compression dictionary")
+		return errors.New("could not store compression dictionary")
+	}
+	c.byId[dictionary.id] = dictionary
+	c.active[aggregateType] = dictionary
+	return nil
+}
+
+// dictionaryAssociatedData binds the encrypted content of a dictionary to its aggregate type.
+func dictionaryAssociatedData(aggregateType string) string {
+	return "compression-dictionary/" + aggregateType
+}
+
+// trainDictionary builds a dictionary from samples of event data, the most recent
+// samples last. The newer half of the samples makes up the content of the
+// dictionary, its tables are derived from the older half.
+func trainDictionary(samples [][]byte) (content []byte, err error) {
+	if len(samples) < 8 {
+		return nil, &customerrors.InvalidDictionaryError{Reason: "not enough events to train a dictionary"}
+	}
+	half := len(samples) / 2
+	var history []byte
+	for i := len(samples) - 1; i >= half && len(history) < dictionaryHistorySize; i-- {
+		history = append(append([]byte{}, samples[i]...), history...)
+	}
+	if len(history) > dictionaryHistorySize {
+		history = history[len(history)-dictionaryHistorySize:]
+	}
+	// BuildDict panics on samples it cannot derive tables from
+	defer func() {
+		if r := recover(); r != nil {
+			content, err = nil, &customerrors.InvalidDictionaryError{Reason: fmt.Sprint("could not train dictionary: ", r)}
+		}
+	}()
+	content, err = zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       1,
+		Contents: samples[:half],
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+	})
+	if err != nil {
+		return nil, &customerrors.InvalidDictionaryError{Reason: err.Error()}
+	}
+	return content, nil
+}
+
+// CompressEvents compresses the data of all stored events that are not compressed
+// yet, keeping their encryption at rest. Events with a subject are skipped, their
+// data is sealed before it is stored. It must not run while the store is served.
+// It returns the number of compressed events.
+func CompressEvents(db *sql.DB, master *MasterKeys) (int64, error) {
+	encryption, err := newDataEncryption(db, master)
+	if err != nil {
+		return 0, err
+	}
+	compression, err := newCompressor(db, encryption)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	lastId := ""
+	for {
+		compressed, last, err := compressBatch(db, compression, encryption, lastId)
+		if err != nil {
+			return total, err
+		}
+		total += compressed
+		if len(last) == 0 {
+			return total, nil
+		}
+		lastId = last
+	}
+}
+
+// compressBatch compresses up to rewriteBatchSize uncompressed events with an id
+// greater than afterId. It returns the last id it looked at, empty if there were no events left.
+func compressBatch(db *sql.DB, compression *compressor, encryption *dataEncryption, afterId string) (int64, string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Info().Err(err).Msg("Error beginning transaction")
+		return 0, "", errors.New("could not compress events")
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`
+		SELECT id, aggregateType, data, dataKey FROM events
+		WHERE id > ? AND codec = '' AND subject = '' AND data IS NOT NULL
+		ORDER BY id LIMIT ?`, afterId, rewriteBatchSize)
+	if err != nil {
+		log.Info().Err(err).Msg("Error querying events to compress")
+		return 0, "", errors.New("could not compress events")
+	}
+	type row struct {
+		id            string
+		aggregateType string
+		data          []byte
+		dataKey       int64
+	}
+	var batch []row
+	for rows.Next() {
+		var r row
+		if err = rows.Scan(&r.id, &r.aggregateType, &r.data, &r.dataKey); err != nil {
+			rows.Close()
+			log.Info().Err(err).Msg("Error scanning events to compress")
+			return 0, "", errors.New("could not compress events")
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if len(batch) == 0 {
+		return 0, "", nil
+	}
+	var compressed int64
+	for _, r := range batch {
+		plain, err := encryption.decrypt(r.dataKey, r.id, r.data)
+		if err != nil {
+			return 0, "", err
+		}
+		codec, dictionary, data, err := compression.compress(r.aggregateType, plain)
+		if err != nil {
+			return 0, "", err
+		}
+		if len(codec) == 0 {
+			continue
+		}
+		dataKey, data, err := encryption.encrypt(r.id, data)
+		if err != nil {
+			return 0, "", err
+		}
+		_, err = tx.Exec("UPDATE events SET data = ?, dataKey = ?, codec = ?, dictionary = ? WHERE id = ?", data, dataKey, codec, dictionary, r.id)
+		if err != nil {
+			log.Info().Err(err).Msg("Error updating compressed event")
+			return 0, "", errors.New("could not compress events")
+		}
+		compressed++
+	}
+	if err = tx.Commit(); err != nil {
+		log.Info().Err(err).Msg("Error committing compressed events")
+		return 0, "", errors.New("could not compress events")
+	}
+	return compressed, batch[len(batch)-1].id, nil
+}
@@ -0,0 +1,187 @@
+package store_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func largePayload(i int) []byte {
+	lines := make([]string, 40)
+	for l := range lines {
+		lines[l] = fmt.Sprintf(`{"sku":"article-%05d","quantity":%d,"price":"%d.%02d"}`, (i*7919+l*104729)%99991, l%7+1, (i+l)%50, (i*l)%100)
+	}
+	return []byte(fmt.Sprintf(`{"orderId":%d,"customer":"customer-%x","lines":[%s]}`, i, i*2654435761, strings.Join(lines, ",")))
+}
+
+func rawCompression(t *testing.T, db *store.DatabaseConnection, aggregateId string) (string, int64, int) {
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	var codec string
+	var dictionary int64
+	var size int
+	err = conn.QueryRow("SELECT codec, dictionary, length(data) FROM events WHERE aggregateId = ?", aggregateId).Scan(&codec, &dictionary, &size)
+	assert.NoError(t, err)
+	return codec, dictionary, size
+}
+
+func TestLargeDataIsCompressed(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	event := models.Event{Id: "7d7a0c52-3b7b-4f0e-9a8e-0b1c6f5d2e31", Version: 1, Name: "placed", Data: largePayload(1), AggregateId: "order1", AggregateType: "order", ContentType: models.JSONContentType}
+	assert.NoError(t, r.AddEvents([]models.Event{event, {Version: 1, Name: "placed", Data: []byte(`{}`), AggregateId: "order2", AggregateType: "order"}}))
+	assert.NoError(t, r.AddEvents([]models.Event{event}))
+
+	codec, _, size := rawCompression(t, db, "order1")
+	assert.Equal(t, "zstd", codec)
+	assert.Less(t, size, len(event.Data))
+	codec, _, _ = rawCompression(t, db, "order2")
+	assert.Equal(t, "", codec)
+
+	events, err := r.GetEventsForAggregate("order1")
+	assert.NoError(t, err)
+	assert.Equal(t, event.Data, events[0].Data)
+	events, err = r.GetEventsSinceEvent("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, event.Data, events[0].Data)
+}
+
+func TestCompressionWithEncryptionAndSubject(t *testing.T) {
+	t.Setenv(store.MasterKeyEnv, newMasterKey(t))
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	err = r.AddEvents([]models.Event{{Version: 1, Name: "placed", Data: largePayload(2), AggregateId: "order3", AggregateType: "order", Subject: "customer1"}})
+	assert.NoError(t, err)
+	codec, _, size := rawCompression(t, db, "order3")
+	assert.Equal(t, "zstd", codec)
+	assert.Less(t, size, len(largePayload(2)))
+
+	events, err := r.GetEventsForAggregate("order3")
+	assert.NoError(t, err)
+	assert.Equal(t, largePayload(2), events[0].Data)
+	assert.NoError(t, r.DestroySubjectKey("customer1"))
+	events, err = r.GetEventsForAggregate("order3")
+	assert.NoError(t, err)
+	assert.Nil(t, events[0].Data)
+}
+
+func TestCompressionDictionary(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	assert.IsType(t, &customerrors.InvalidDictionaryError{}, r.TrainCompressionDictionary("order"))
+	assert.IsType(t, &customerrors.InvalidDictionaryError{}, r.SetCompressionDictionary("order", []byte("no dictionary")))
+
+	for i := 0; i < 20; i++ {
+		err = r.AddEvents([]models.Event{{Version: 1, Name: "placed", Data: largePayload(i), AggregateId: fmt.Sprintf("sample%d", i), AggregateType: "order"}})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, r.TrainCompressionDictionary("order"))
+	assert.NoError(t, r.AddEvents([]models.Event{{Version: 1, Name: "placed", Data: largePayload(100), AggregateId: "dict1", AggregateType: "order"}}))
+	codec, dictionary, _ := rawCompression(t, db, "dict1")
+	assert.Equal(t, "zstd", codec)
+	assert.NotZero(t, dictionary)
+
+	// a new dictionary replaces the active one, events compressed with the old one stay readable
+	assert.NoError(t, r.TrainCompressionDictionary("order"))
+	assert.NoError(t, r.AddEvents([]models.Event{{Version: 1, Name: "placed", Data: largePayload(101), AggregateId: "dict2", AggregateType: "order"}}))
+	_, second, _ := rawCompression(t, db, "dict2")
+	assert.NotEqual(t, dictionary, second)
+
+	r = store.NewEventRepository(conn)
+	events, err := r.GetEventsForAggregate("dict1")
+	assert.NoError(t, err)
+	assert.Equal(t, largePayload(100), events[0].Data)
+	events, err = r.GetEventsForAggregate("dict2")
+	assert.NoError(t, err)
+	assert.Equal(t, largePayload(101), events[0].Data)
+}
+
+func TestCompressionDictionaryIsEncrypted(t *testing.T) {
+	t.Setenv(store.MasterKeyEnv, newMasterKey(t))
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	for i := 0; i < 20; i++ {
+		err = r.AddEvents([]models.Event{{Version: 1, Name: "placed", Data: largePayload(i), AggregateId: fmt.Sprintf("sample%d", i), AggregateType: "order"}})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, r.TrainCompressionDictionary("order"))
+	var content []byte
+	var dataKey int64
+	err = conn.QueryRow("SELECT dictionary, dataKey FROM compression_dictionaries WHERE aggregateType = 'order'").Scan(&content, &dataKey)
+	assert.NoError(t, err)
+	assert.NotZero(t, dataKey)
+	assert.False(t, bytes.Contains(content, []byte(`"customer":"customer-`)))
+
+	assert.NoError(t, r.AddEvents([]models.Event{{Version: 1, Name: "placed", Data: largePayload(100), AggregateId: "dict1", AggregateType: "order"}}))
+	r = store.NewEventRepository(conn)
+	events, err := r.GetEventsForAggregate("dict1")
+	assert.NoError(t, err)
+	assert.Equal(t, largePayload(100), events[0].Data)
+
+	// the dictionary stays readable after its data key was rotated away
+	master, err := store.LoadMasterKeys()
+	assert.NoError(t, err)
+	_, err = store.ReencryptEvents(conn, master)
+	assert.NoError(t, err)
+	r = store.NewEventRepository(conn)
+	events, err = r.GetEventsForAggregate("dict1")
+	assert.NoError(t, err)
+	assert.Equal(t, largePayload(100), events[0].Data)
+}
+
+func TestCompressEvents(t *testing.T) {
+	t.Setenv(store.CompressionThresholdEnv, "-1")
+	t.Setenv(store.MasterKeyEnv, newMasterKey(t))
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	assert.NoError(t, r.AddEvents([]models.Event{
+		{Version: 1, Name: "placed", Data: largePayload(1), AggregateId: "old1", AggregateType: "order"},
+		{Version: 1, Name: "placed", Data: []byte(`{}`), AggregateId: "old2", AggregateType: "order"},
+		{Version: 1, Name: "placed", Data: largePayload(3), AggregateId: "old3", AggregateType: "order", Subject: "customer2"},
+	}))
+	r.Close()
+	codec, _, _ := rawCompression(t, db, "old1")
+	assert.Equal(t, "", codec)
+
+	t.Setenv(store.CompressionThresholdEnv, "")
+	keys, err := store.LoadMasterKeys()
+	assert.NoError(t, err)
+	count, err := store.CompressEvents(conn, keys)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	codec, _, _ = rawCompression(t, db, "old1")
+	assert.Equal(t, "zstd", codec)
+
+	r = store.NewEventRepository(conn)
+	for aggregateId, data := range map[string][]byte{"old1": largePayload(1), "old2": []byte(`{}`), "old3": largePayload(3)} {
+		events, err := r.GetEventsForAggregate(aggregateId)
+		assert.NoError(t, err)
+		assert.Equal(t, data, events[0].Data)
+	}
+}
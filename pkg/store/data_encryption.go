@@ -0,0 +1,389 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// rewriteBatchSize is the number of events rewritten per transaction by the
+// offline re-encryption and compression.
+const rewriteBatchSize = 500
+
+// dataEncryption encrypts the data column at rest (envelope encryption). The
+// data is encrypted with a data key, the data keys are stored wrapped with the
+// master key. Every row records the data key it was encrypted with; 0 means plaintext.
+type dataEncryption struct {
+	store  *sql.DB
+	master *MasterKeys
+	mu     sync.RWMutex
+	keys   map[int64]cipher.AEAD
+	active int64
+}
+
+// newDataEncryption loads the data keys. Data keys wrapped with a previous master
+// key are rewrapped with the current one and a data key is created if none is
+// active. Without master keys the data is stored in plaintext, which fails if
+// the store already holds data keys.
+func newDataEncryption(db *sql.DB, master *MasterKeys) (*dataEncryption, error) {
+	enc := &dataEncryption{
+		store:  db,
+		master: master,
+		keys:   map[int64]cipher.AEAD{},
+	}
+	if master == nil {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM data_keys").Scan(&count)
+		if err != nil {
+			log.Info().Err(err).Msg("Error counting data keys")
+			return nil, errors.New("could not load data keys")
+		}
+		if count > 0 {
+			return nil, errors.New("could not open encrypted store without master key")
+		}
+		return enc, nil
+	}
+	err := enc.load()
+	if err != nil {
+		return nil, err
+	}
+	if enc.active == 0 {
+		err = enc.rotate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return enc, nil
+}
+
+// load unwraps all data keys and rewraps those wrapped with a previous master key.
+func (d *dataEncryption) load() error {
+	type dataKey struct {
+		id        int64
+		wrapped   []byte
+		masterKey string
+		active    bool
+	}
+	rows, err := d.store.Query("SELECT id, key, masterKey, active FROM data_keys")
+	if err != nil {
+		log.Info().Err(err).Msg("Error querying data keys")
+		return errors.New("could not load data keys")
+	}
+	var stored []dataKey
+	for rows.Next() {
+		var key dataKey
+		err = rows.Scan(&key.id, &key.wrapped, &key.masterKey, &key.active)
+		if err != nil {
+			rows.Close()
+			log.Info().Err(err).Msg("Error scanning data keys")
+			return errors.New("could not load data keys")
+		}
+		stored = append(stored, key)
+	}
+	rows.Close()
+
+	current := masterKeyId(d.master.Current)
+	for _, key := range stored {
+		master := d.master.byId(key.masterKey)
+		if master == nil {
+			return errors.New("could not unwrap data key: unknown master key")
+		}
+		plain, err := openWithKey(master, key.wrapped)
+		if err != nil {
+			log.Info().Err(err).Msg("Error unwrapping data key")
+			return errors.New("could not unwrap data key")
+		}
+		if key.masterKey != current {
+			rewrapped, err := sealWithKey(d.master.Current, plain)
+			if err != nil {
+				return err
+			}
+			_, err = d.store.Exec("UPDATE data_keys SET key = ?, masterKey = ? WHERE id = ?", rewrapped, current, key.id)
+			if err != nil {
+				log.Info().Err(err).Msg("Error rewrapping data key")
+				return errors.New("could not rewrap data key")
+			}
+			log.Debug().Int64("dataKey", key.id).Msg("Rewrapped data key with current master key")
+		}
+		aead, err := newAEAD(plain)
+		if err != nil {
+			return err
+		}
+		d.keys[key.id] = aead
+		if key.active {
+			d.active = key.id
+		}
+	}
+	return nil
+}
+
+// rotate creates a new data key that is used for all data written from now on.
+func (d *dataEncryption) rotate() error {
+	plain := make([]byte, 32)
+	if _, err := rand.Read(plain); err != nil {
+		return err
+	}
+	wrapped, err := sealWithKey(d.master.Current, plain)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(plain)
+	if err != nil {
+		return err
+	}
+	tx, err := d.store.Begin()
+	if err != nil {
+		log.Info().Err(err).Msg("Error beginning transaction")
+		return errors.New("could not rotate data key")
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("UPDATE data_keys SET active = 0 WHERE active = 1"); err != nil {
+		log.Info().Err(err).Msg("Error deactivating data key")
+		return errors.New("could not rotate data key")
+	}
+	result, err := tx.Exec("INSERT INTO data_keys (key, masterKey, active) VALUES (?,?,1)", wrapped, masterKeyId(d.master.Current))
+	if err != nil {
+		log.Info().Err(err).Msg("Error storing data key")
+		return errors.New("could not rotate data key")
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Info().Err(err).Msg("Error committing data key")
+		return errors.New("could not rotate data key")
+	}
+	d.mu.Lock()
+	d.keys[id] = aead
+	d.active = id
+	d.mu.Unlock()
+	return nil
+}
+
+// encrypt encrypts the data of an event with the active data key and returns
+// the id of that key. Without encryption, or for nil data, 0 and the data itself are returned.
+func (d *dataEncryption) encrypt(eventId string, data []byte) (int64, []byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.active == 0 || data == nil {
+		return 0, data, nil
+	}
+	aead := d.keys[d.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, nil, err
+	}
+	return d.active, aead.Seal(nonce, nonce, data, []byte(eventId)), nil
+}
+
+// decrypt decrypts the data of an event that was encrypted with the given data key.
+func (d *dataEncryption) decrypt(dataKey int64, eventId string, data []byte) ([]byte, error) {
+	if dataKey == 0 {
+		return data, nil
+	}
+	d.mu.RLock()
+	aead, ok := d.keys[dataKey]
+	d.mu.RUnlock()
+	if !ok {
+		return nil, errors.New("could not decrypt event: unknown data key")
+	}
+	nonceSize := aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("could not decrypt event")
+	}
+	plain, err := aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(eventId))
+	if err != nil {
+		log.Info().Err(err).Msg("Error decrypting event data")
+		return nil, errors.New("could not decrypt event")
+	}
+	return plain, nil
+}
+
+// RotateDataKey rewraps the data keys with the current master key and creates a
+// new data key for all data written from now on. Existing events keep their data key.
+func RotateDataKey(db *sql.DB, master *MasterKeys) error {
+	if master == nil {
+		return errors.New("no master key configured")
+	}
+	enc, err := newDataEncryption(db, master)
+	if err != nil {
+		return err
+	}
+	return enc.rotate()
+}
+
+// ReencryptEvents rotates the data key and re-encrypts every event and
+// compression dictionary with it, including those stored in plaintext. Data
+// keys no longer in use are removed, so previous master keys are not needed
+// afterwards. Archived events keep their data key, segment files are never
+// changed. It must not run while the store is served. It returns the number of
+// re-encrypted events.
+func ReencryptEvents(db *sql.DB, master *MasterKeys) (int64, error) {
+	if master == nil {
+		return 0, errors.New("no master key configured")
+	}
+	enc, err := newDataEncryption(db, master)
+	if err != nil {
+		return 0, err
+	}
+	err = enc.rotate()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for {
+		count, err := enc.reencryptBatch()
+		if err != nil {
+			return total, err
+		}
+		total += count
+		if count < rewriteBatchSize {
+			break
+		}
+	}
+	err = enc.reencryptDictionaries()
+	if err != nil {
+		return total, err
+	}
+	_, err = db.Exec("DELETE FROM data_keys WHERE active = 0 AND id NOT IN (SELECT DISTINCT dataKey FROM events) AND id NOT IN (SELECT DISTINCT dataKey FROM compression_dictionaries)")
+	if err != nil {
+		log.Info().Err(err).Msg("Error removing unused data keys")
+		return total, errors.New("could not remove unused data keys")
+	}
+	return total, nil
+}
+
+// reencryptBatch re-encrypts up to rewriteBatchSize events that are not
+// encrypted with the active data key.
+func (d *dataEncryption) reencryptBatch() (int64, error) {
+	tx, err := d.store.Begin()
+	if err != nil {
+		log.Info().Err(err).Msg("Error beginning transaction")
+		return 0, errors.New("could not re-encrypt events")
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT id, data, dataKey FROM events WHERE dataKey != ? AND data IS NOT NULL LIMIT ?", d.active, rewriteBatchSize)
+	if err != nil {
+		log.Info().Err(err).Msg("Error querying events to re-encrypt")
+		return 0, errors.New("could not re-encrypt events")
+	}
+	type row struct {
+		id      string
+		data    []byte
+		dataKey int64
+	}
+	var batch []row
+	for rows.Next() {
+		var r row
+		if err = rows.Scan(&r.id, &r.data, &r.dataKey); err != nil {
+			rows.Close()
+			log.Info().Err(err).Msg("Error scanning events to re-encrypt")
+			return 0, errors.New("could not re-encrypt events")
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	for _, r := range batch {
+		plain, err := d.decrypt(r.dataKey, r.id, r.data)
+		if err != nil {
+			return 0, err
+		}
+		dataKey, data, err := d.encrypt(r.id, plain)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec("UPDATE events SET data = ?, dataKey = ? WHERE id = ?", data, dataKey, r.id)
+		if err != nil {
+			log.Info().Err(err).Msg("Error updating re-encrypted event")
+			return 0, errors.New("could not re-encrypt events")
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		log.Info().Err(err).Msg("Error committing re-encrypted events")
+		return 0, errors.New("could not re-encrypt events")
+	}
+	return int64(len(batch)), nil
+}
+
+// reencryptDictionaries re-encrypts the content of all compression dictionaries
+// that are not encrypted with the active data key.
+func (d *dataEncryption) reencryptDictionaries() error {
+	rows, err := d.store.Query("SELECT id, aggregateType, dictionary, dataKey FROM compression_dictionaries WHERE dataKey != ?", d.active)
+	if err != nil {
+		log.Info().Err(err).Msg("Error querying compression dictionaries to re-encrypt")
+		return errors.New("could not re-encrypt compression dictionaries")
+	}
+	type row struct {
+		id            int64
+		aggregateType string
+		content       []byte
+		dataKey       int64
+	}
+	var dictionaries []row
+	for rows.Next() {
+		var r row
+		if err = rows.Scan(&r.id, &r.aggregateType, &r.content, &r.dataKey); err != nil {
+			rows.Close()
+			log.Info().Err(err).Msg("Error scanning compression dictionaries to re-encrypt")
+			return errors.New("could not re-encrypt compression dictionaries")
+		}
+		dictionaries = append(dictionaries, r)
+	}
+	rows.Close()
+	for _, r := range dictionaries {
+		plain, err := d.decrypt(r.dataKey, dictionaryAssociatedData(r.aggregateType), r.content)
+		if err != nil {
+			return err
+		}
+		dataKey, content, err := d.encrypt(dictionaryAssociatedData(r.aggregateType), plain)
+		if err != nil {
+			return err
+		}
+		_, err = d.store.Exec("UPDATE compression_dictionaries SET dictionary = ?, dataKey = ? WHERE id = ?", content, dataKey, r.id)
+		if err != nil {
+			log.Info().Err(err).Msg("Error updating re-encrypted compression dictionary")
+			return errors.New("could not re-encrypt compression dictionaries")
+		}
+	}
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealWithKey encrypts plain with key and a random nonce, which is prepended.
+func sealWithKey(key []byte, plain []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// openWithKey decrypts the output of sealWithKey.
+func openWithKey(key []byte, sealed []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("sealed value too short")
+	}
+	return aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+}
@@ -0,0 +1,146 @@
+package store_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMasterKey(t *testing.T) string {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	assert.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func rawData(t *testing.T, db *store.DatabaseConnection, aggregateId string) ([]byte, int64) {
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	var data []byte
+	var dataKey int64
+	err = conn.QueryRow("SELECT data, dataKey FROM events WHERE aggregateId = ?", aggregateId).Scan(&data, &dataKey)
+	assert.NoError(t, err)
+	return data, dataKey
+}
+
+func TestDataIsEncryptedAtRest(t *testing.T) {
+	t.Setenv(store.MasterKeyEnv, newMasterKey(t))
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	assert.NotNil(t, r)
+
+	event := models.Event{Id: "0f8c7d32-5c1e-4f55-8a3c-6d7b2e9a1c44", Version: 1, Name: "created", Data: []byte("secret payload"), AggregateId: "enc1", AggregateType: "enc"}
+	assert.NoError(t, r.AddEvents([]models.Event{event}))
+	assert.NoError(t, r.AddEvents([]models.Event{event}))
+
+	data, dataKey := rawData(t, db, "enc1")
+	assert.NotZero(t, dataKey)
+	assert.False(t, bytes.Contains(data, []byte("secret payload")))
+
+	events, err := r.GetEventsForAggregate("enc1")
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, []byte("secret payload"), events[0].Data)
+	events, err = r.GetEventsSinceEvent("", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret payload"), events[0].Data)
+}
+
+func TestMasterKeyFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.key")
+	assert.NoError(t, os.WriteFile(path, []byte(newMasterKey(t)+"\n"), 0600))
+	t.Setenv(store.MasterKeyFileEnv, path)
+	keys, err := store.LoadMasterKeys()
+	assert.NoError(t, err)
+	assert.Len(t, keys.Current, 32)
+
+	t.Setenv(store.MasterKeyFileEnv, "")
+	t.Setenv(store.MasterKeyEnv, "tooshort")
+	_, err = store.LoadMasterKeys()
+	assert.Error(t, err)
+}
+
+func TestMasterKeyRotation(t *testing.T) {
+	oldKey := newMasterKey(t)
+	newKey := newMasterKey(t)
+	t.Setenv(store.MasterKeyEnv, oldKey)
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	assert.NoError(t, r.AddEvents([]models.Event{{Version: 1, Name: "created", Data: []byte("before"), AggregateId: "rot1", AggregateType: "enc"}}))
+	r.Close()
+
+	// without the old master key the data keys cannot be unwrapped
+	t.Setenv(store.MasterKeyEnv, newKey)
+	assert.Nil(t, store.NewEventRepository(conn))
+
+	t.Setenv(store.PreviousMasterKeysEnv, oldKey)
+	r = store.NewEventRepository(conn)
+	assert.NotNil(t, r)
+	r.Close()
+
+	// the data keys were rewrapped, the old master key is no longer needed
+	t.Setenv(store.PreviousMasterKeysEnv, "")
+	r = store.NewEventRepository(conn)
+	assert.NotNil(t, r)
+	events, err := r.GetEventsForAggregate("rot1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("before"), events[0].Data)
+
+	t.Setenv(store.MasterKeyEnv, "")
+	assert.Nil(t, store.NewEventRepository(conn))
+}
+
+func TestReencryptEvents(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	assert.NoError(t, r.AddEvents([]models.Event{
+		{Version: 1, Name: "created", Data: []byte("plain"), AggregateId: "re1", AggregateType: "enc"},
+		{Version: 1, Name: "created", AggregateId: "re2", AggregateType: "enc"},
+	}))
+	r.Close()
+	_, dataKey := rawData(t, db, "re1")
+	assert.Zero(t, dataKey)
+
+	t.Setenv(store.MasterKeyEnv, newMasterKey(t))
+	keys, err := store.LoadMasterKeys()
+	assert.NoError(t, err)
+	count, err := store.ReencryptEvents(conn, keys)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	data, firstKey := rawData(t, db, "re1")
+	assert.NotZero(t, firstKey)
+	assert.NotEqual(t, []byte("plain"), data)
+
+	count, err = store.ReencryptEvents(conn, keys)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	_, secondKey := rawData(t, db, "re1")
+	assert.NotEqual(t, firstKey, secondKey)
+	var dataKeys int
+	assert.NoError(t, conn.QueryRow("SELECT COUNT(*) FROM data_keys").Scan(&dataKeys))
+	assert.Equal(t, 1, dataKeys)
+
+	r = store.NewEventRepository(conn)
+	events, err := r.GetEventsForAggregate("re1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("plain"), events[0].Data)
+	events, err = r.GetEventsForAggregate("re2")
+	assert.NoError(t, err)
+	assert.Nil(t, events[0].Data)
+}
@@ -0,0 +1,89 @@
+package store
+
+import "crypto/sha256"
+
+// eventData turns the data of events into its stored form and back. The data is
+// compressed, sealed with the key of its subject and encrypted at rest, in this
+// order. The stored data of archived events is read from their segment.
+type eventData struct {
+	compression *compressor
+	subjects    *subjectKeys
+	encryption  *dataEncryption
+	segments    *segmentStore
+}
+
+// storedData is the data of an event as stored in a row of the events table.
+type storedData struct {
+	eventId    string
+	subject    string
+	codec      string
+	dictionary int64
+	dataKey    int64
+	segment    int64
+	data       []byte
+}
+
+// encode sets the stored form and the digest of the data of an event.
+func (d *eventData) encode(entity *eventEntity) error {
+	codec, dictionary, data, err := d.compression.compress(entity.AggregateType, entity.Data)
+	if err != nil {
+		return err
+	}
+	if len(entity.Subject) > 0 {
+		data, err = d.subjects.seal(entity.Subject, entity.id, data)
+		if err != nil {
+			return err
+		}
+	}
+	entity.dataHash, err = d.digest(entity.Subject, entity.Data)
+	if err != nil {
+		return err
+	}
+	dataKey, data, err := d.encryption.encrypt(entity.id.String(), data)
+	if err != nil {
+		return err
+	}
+	entity.stored = storedData{
+		eventId:    entity.id.String(),
+		subject:    entity.Subject,
+		codec:      codec,
+		dictionary: dictionary,
+		dataKey:    dataKey,
+		data:       data,
+	}
+	return nil
+}
+
+// decode returns the data of an event from its stored form. The data of a
+// subject whose key was destroyed is nil.
+func (d *eventData) decode(stored storedData) ([]byte, error) {
+	if stored.segment != 0 {
+		var err error
+		stored.data, err = d.segments.read(stored.segment, stored.eventId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := d.encryption.decrypt(stored.dataKey, stored.eventId, stored.data)
+	if err != nil {
+		return nil, err
+	}
+	if len(stored.subject) > 0 {
+		data, err = d.subjects.open(stored.subject, data)
+		if err != nil || data == nil {
+			return nil, err
+		}
+	}
+	return d.compression.decompress(stored.codec, stored.dictionary, data)
+}
+
+// digest returns the digest of the data of an event chained by its hash. The
+// digest of data with a subject is keyed with the key of the subject, it is nil
+// once the key is destroyed.
+func (d *eventData) digest(subject string, data []byte) ([]byte, error) {
+	if len(subject) > 0 {
+		return d.subjects.digest(subject, data)
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
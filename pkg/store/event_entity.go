@@ -12,4 +12,13 @@ type eventEntity struct {
 	models.Event
 	timestamp time.Time
 	id        uuid.UUID
+	stored    storedData
+	// hash chains the event to prevHash, the hash of the event appended before it
+	// to the same aggregate. dataHash is the digest of the plaintext data, set by encode.
+	hash     []byte
+	prevHash []byte
+	dataHash []byte
+	// appendId identifies the events appended in one transaction: it is the
+	// timestamp of the first of them. It is 0 for events written on their own.
+	appendId int64
 }
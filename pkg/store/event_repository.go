@@ -2,9 +2,10 @@ package store
 
 import (
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
-	"strings"
-	"sync"
+	"math"
 	"time"
 
 	"github.com/L4B0MB4/EVTSRC/pkg/helper"
@@ -16,240 +17,679 @@ import (
 
 // EventRepository handles the storage of events.
 type EventRepository struct {
-	store *sql.DB
-	mu    sync.Mutex
+	store     *sql.DB
+	writer    *eventWriter
+	schemas   *SchemaRegistry
+	data      *eventData
+	retention *RetentionPolicies
+	keys      *ProducerKeys
+	apiKeys   *APIKeys
+	rules     *AccessRules
+	// stopJobs is closed to stop the background jobs
+	stopJobs chan struct{}
 }
 
-// NewEventRepository creates a new EventRepository.
+// NewEventRepository creates a new EventRepository and starts its writer.
+// The data of events is encrypted at rest if a master key is configured, see LoadMasterKeys.
 func NewEventRepository(db *sql.DB) *EventRepository {
 	if db == nil {
 		return nil
 	}
+	master, err := LoadMasterKeys()
+	if err != nil {
+		log.Info().Err(err).Msg("Loading master keys")
+		return nil
+	}
+	encryption, err := newDataEncryption(db, master)
+	if err != nil {
+		log.Info().Err(err).Msg("Setting up encryption at rest")
+		return nil
+	}
+	compression, err := newCompressor(db, encryption)
+	if err != nil {
+		log.Info().Err(err).Msg("Setting up compression")
+		return nil
+	}
+	data := &eventData{compression: compression, subjects: newSubjectKeys(db), encryption: encryption, segments: newSegmentStore(db)}
+	writer, err := newEventWriter(db, data)
+	if err != nil {
+		log.Info().Err(err).Msg("Creating event writer")
+		return nil
+	}
+	go writer.run()
 
-	return &EventRepository{store: db, mu: sync.Mutex{}}
+	return &EventRepository{store: db, writer: writer, schemas: NewSchemaRegistry(db), data: data, retention: NewRetentionPolicies(db), keys: NewProducerKeys(db), apiKeys: NewAPIKeys(db), rules: NewAccessRules(db), stopJobs: make(chan struct{})}
 }
 
-// AddEvents adds multiple events to the repository.
-func (e *EventRepository) AddEvents(events []models.Event) error {
+// Schemas returns the registry whose schemas every appended event is validated against.
+func (e *EventRepository) Schemas() *SchemaRegistry {
+	return e.schemas
+}
+
+// ProducerKeys returns the keys the signatures of appended events are verified with.
+func (e *EventRepository) ProducerKeys() *ProducerKeys {
+	return e.keys
+}
+
+// APIKeys returns the API keys requests can be authenticated with.
+func (e *EventRepository) APIKeys() *APIKeys {
+	return e.apiKeys
+}
+
+// AccessRules returns the rules deciding what authenticated callers may do.
+func (e *EventRepository) AccessRules() *AccessRules {
+	return e.rules
+}
+
+// NextCommit returns a channel that is closed once the writer committed again.
+// Readers take it before reading so that no commit is missed in between.
+func (e *EventRepository) NextCommit() <-chan struct{} {
+	return e.writer.committed.wait()
+}
+
+// Close stops the writer. Calls to AddEvents fail afterwards.
+func (e *EventRepository) Close() {
+	select {
+	case <-e.stopJobs:
+	default:
+		close(e.stopJobs)
+	}
+	e.writer.stop()
+	e.data.segments.close()
+}
+
+// RetentionPolicies returns the retention policies applied by ApplyRetention.
+func (e *EventRepository) RetentionPolicies() *RetentionPolicies {
+	return e.retention
+}
 
-	tx, err := e.store.Begin()
+// ApplyRetention removes the events exceeding the retention policies of their
+// aggregate type and returns how many were removed. Reads of a truncated
+// aggregate start at its first remaining version and removed events no longer
+// appear in the global feed.
+func (e *EventRepository) ApplyRetention() (int64, error) {
+	policies, err := e.retention.ListPolicies()
+	if err != nil {
+		return 0, err
+	}
+	if len(policies) == 0 {
+		return 0, nil
+	}
+	run := &retentionRun{policies: policies, now: time.Now()}
+	err = e.writer.submitRequest(&appendRequest{retention: run})
+	if err != nil {
+		return 0, err
+	}
+	if run.removed > 0 {
+		return run.removed, e.compactSegments()
+	}
+	return run.removed, nil
+}
+
+// StartRetention applies the retention policies every interval until the repository is closed.
+func (e *EventRepository) StartRetention(interval time.Duration) {
+	e.startJob(interval, func() {
+		removed, err := e.ApplyRetention()
+		if err != nil {
+			log.Info().Err(err).Msg("Applying retention policies")
+		} else if removed > 0 {
+			log.Debug().Int64("removed", removed).Msg("Applied retention policies")
+		}
+	})
+}
+
+// ArchiveEvents moves the data of events appended more than olderThan ago to
+// compressed segment files and returns the number of archived events. Archived
+// events keep their row and are served by all reads as before.
+func (e *EventRepository) ArchiveEvents(olderThan time.Duration) (int64, error) {
+	segments := e.data.segments
+	segments.archiving.Lock()
+	defer segments.archiving.Unlock()
+	cutoff := time.Now().Add(-olderThan)
+	var total int64
+	for {
+		archived, more, err := segments.archive(e.writer, cutoff)
+		if err != nil {
+			return total, err
+		}
+		total += archived
+		if !more {
+			return total, segments.compact(e.writer)
+		}
+	}
+}
+
+// compactSegments rewrites the segment files that still hold the data of removed events.
+func (e *EventRepository) compactSegments() error {
+	segments := e.data.segments
+	segments.archiving.Lock()
+	defer segments.archiving.Unlock()
+	return segments.compact(e.writer)
+}
+
+// ListArchiveSegments retrieves the segment files holding the data of archived events.
+func (e *EventRepository) ListArchiveSegments() ([]models.ArchiveSegment, error) {
+	return e.data.segments.listSegments()
+}
+
+// StartArchiving archives the events older than olderThan every interval until
+// the repository is closed.
+func (e *EventRepository) StartArchiving(interval time.Duration, olderThan time.Duration) {
+	e.startJob(interval, func() {
+		archived, err := e.ArchiveEvents(olderThan)
+		if err != nil {
+			log.Info().Err(err).Msg("Archiving events")
+		} else if archived > 0 {
+			log.Debug().Int64("archived", archived).Msg("Archived events")
+		}
+	})
+}
+
+// startJob runs job every interval until the repository is closed.
+func (e *EventRepository) startJob(interval time.Duration, job func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				job()
+			case <-e.stopJobs:
+				return
+			}
+		}
+	}()
+}
+
+// AddEvents adds multiple events to the repository. All events of one call
+// are committed atomically, possibly together with concurrent calls.
+// Events without an id get a new one. Repeating a call whose events (by id)
+// are all committed already succeeds without writing them again. Signed events
+// have to verify with their registered producer key.
+func (e *EventRepository) AddEvents(events []models.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	e.schemas.changes.RLock()
+	defer e.schemas.changes.RUnlock()
+	err := e.schemas.Validate(events)
+	if err != nil {
+		return err
+	}
+	err = e.keys.Verify(events)
 	if err != nil {
 		return err
 	}
+	return e.submitEvents(events)
+}
 
+// submitEvents hands events to the writer like AddEvents, without checking them
+// against the schemas and producer keys.
+func (e *EventRepository) submitEvents(events []models.Event) error {
+	entities := make([]*eventEntity, 0, len(events))
 	for _, event := range events {
-		eEvent := &eventEntity{
-			Event:     event,
-			timestamp: time.Now(),
-			id:        uuid.New(),
-		}
-		err = e.addEvent(tx, eEvent)
+		entity, err := e.newEventEntity(event)
 		if err != nil {
-			tx.Rollback()
-			log.Info().Err(err).Msg("Aborted transaction")
 			return err
 		}
+		entities = append(entities, entity)
 	}
+	return e.writer.submit(entities)
+}
 
-	return tx.Commit()
+// AppendToAggregates adds the events of several aggregates in one transaction.
+// Nothing is written unless every aggregate is at its expected version.
+func (e *EventRepository) AppendToAggregates(appends []models.StreamAppend) error {
+	return e.AppendToAggregatesIf(appends, nil)
 }
 
-// addEvent adds a single event to the repository within a transaction.
-func (e *EventRepository) addEvent(tx *sql.Tx, event *eventEntity) error {
-	e.mu.Lock()
-	time.Sleep(1 * time.Microsecond) //one item per microsecond
-	e.mu.Unlock()
-	t0, t1, err := helper.SplitInt62(event.timestamp.UnixMicro())
+// AppendToAggregatesIf works like AppendToAggregates, but additionally fails with
+// an AppendConditionFailedError if an event matching the condition was written
+// after the condition's position. A nil condition always holds. The event
+// indexes of schema violations and invalid signatures count the events of all
+// appends in order.
+func (e *EventRepository) AppendToAggregatesIf(appends []models.StreamAppend, condition *models.AppendCondition) error {
+	events := []models.Event{}
+	expectations := make([]versionExpectation, 0, len(appends))
+	for _, streamAppend := range appends {
+		for _, event := range streamAppend.Events {
+			event.AggregateId = streamAppend.AggregateId
+			events = append(events, event)
+		}
+		expectations = append(expectations, versionExpectation{
+			aggregateId: streamAppend.AggregateId,
+			version:     streamAppend.ExpectedVersion,
+		})
+	}
+	if len(appends) == 0 {
+		return nil
+	}
+	e.schemas.changes.RLock()
+	defer e.schemas.changes.RUnlock()
+	err := e.schemas.Validate(events)
 	if err != nil {
 		return err
 	}
-
-	v0, v1, err := helper.SplitInt62(event.Version)
+	err = e.keys.Verify(events)
 	if err != nil {
 		return err
 	}
+	entities := make([]*eventEntity, 0, len(events))
+	for _, event := range events {
+		entity, err := e.newEventEntity(event)
+		if err != nil {
+			return err
+		}
+		entities = append(entities, entity)
+	}
+	return e.writer.submitRequest(&appendRequest{
+		events:       entities,
+		expectations: expectations,
+		condition:    condition,
+	})
+}
 
-	stmt, err := e.store.Prepare(`
-        INSERT INTO events (id, aggregateId,timestamp_0 ,timestamp_1, Name, version_0, version_1, data)
-        VALUES (?,?,?,?,?,?,?,?)
-    `)
+// newEventEntity wraps an event for storage, keeping a supplied id or creating a new one.
+// The data of events with a subject is encrypted.
+func (e *EventRepository) newEventEntity(event models.Event) (*eventEntity, error) {
+	id := uuid.New()
+	if len(event.Id) > 0 {
+		var err error
+		id, err = uuid.Parse(event.Id)
+		if err != nil {
+			return nil, errors.New("invalid event id")
+		}
+	}
+	if models.IsJSONContentType(event.ContentType) && !json.Valid(event.Data) {
+		return nil, errors.New("data of a JSON event is not valid JSON")
+	}
+	entity := &eventEntity{
+		Event: event,
+		id:    id,
+	}
+	err := e.data.encode(entity)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+
+// eventColumns are the columns read by scanEvents, in order.
+const eventColumns = "events.id, events.Name, events.version_0, events.version_1, events.data, events.aggregateId, events.aggregateType, events.tags, events.schemaVersion, events.contentType, events.subject, events.dataKey, events.codec, events.dictionary, events.segment, events.hash, events.signingKeyId, events.signature"
+
+// GetEventsForAggregate retrieves all events for a given aggregate ID.
+func (e *EventRepository) GetEventsForAggregate(aggregateId string) ([]models.Event, error) {
+	return e.ReadEventsForAggregate(aggregateId, models.Forward, 0)
+}
+
+// ReadEventsForAggregate retrieves the events of a given aggregate ID in the given
+// direction. Backward reads return the newest events first. A limit <= 0 reads all events.
+func (e *EventRepository) ReadEventsForAggregate(aggregateId string, direction models.ReadDirection, limit int) ([]models.Event, error) {
+	return e.ReadEventRange(aggregateId, 0, 0, direction, limit)
+}
+
+// DeleteAggregate deletes an aggregate. A soft deletion keeps its events, a hard
+// deletion removes them, rewriting the segment files holding their data, and
+// leaves a tombstone event in the global feed. Reads of and appends to a deleted
+// aggregate fail with an AggregateDeletedError. It returns an
+// AggregateNotFoundError if the aggregate has no events.
+func (e *EventRepository) DeleteAggregate(aggregateId string, mode models.DeletionMode) error {
+	if mode != models.SoftDelete && mode != models.HardDelete {
+		return errors.New("invalid deletion mode")
+	}
+	tombstone := &eventEntity{
+		Event: models.Event{
+			Name:        models.TombstoneEventName,
+			Data:        []byte("{}"),
+			AggregateId: aggregateId,
+			ContentType: models.JSONContentType,
+		},
+		id: uuid.New(),
+	}
+	err := e.data.encode(tombstone)
 	if err != nil {
-		log.Info().Err(err).Msg("Preparing insert statement for events table")
 		return err
 	}
-	defer stmt.Close()
+	err = e.writer.submitRequest(&appendRequest{
+		deletion: &aggregateDeletion{aggregateId: aggregateId, mode: mode, tombstone: tombstone},
+	})
+	if err != nil || mode != models.HardDelete {
+		return err
+	}
+	return e.compactSegments()
+}
 
-	_, err = tx.Stmt(stmt).Exec(event.id, event.AggregateId, t0, t1, event.Name, v0, v1, event.Data)
+// ReadEventRange retrieves the events of a given aggregate ID with a version between
+// fromVersion and toVersion, both inclusive, in the given direction. A toVersion <= 0
+// reads up to the newest event and a limit <= 0 reads all events of the range.
+func (e *EventRepository) ReadEventRange(aggregateId string, fromVersion int64, toVersion int64, direction models.ReadDirection, limit int) ([]models.Event, error) {
+	order := "ASC"
+	if direction == models.Backward {
+		order = "DESC"
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+	err := e.checkNotDeleted(aggregateId)
 	if err != nil {
-		tx.Rollback()
-		log.Info().Err(err).Msg("Aborted transaction")
-		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-			return &customerrors.DuplicateVersionError{}
+		return nil, err
+	}
+	if fromVersion < 0 {
+		fromVersion = 0
+	}
+	from0, from1, err := helper.SplitInt62(fromVersion)
+	if err != nil {
+		return nil, err
+	}
+	var to0, to1 int32 = math.MaxInt32, math.MaxInt32
+	if toVersion > 0 {
+		to0, to1, err = helper.SplitInt62(toVersion)
+		if err != nil {
+			return nil, err
 		}
-		return err
 	}
 
-	stmtAgg, err := e.store.Prepare(`
-        INSERT INTO aggregate_state(id,type, version_0, version_1)
-        VALUES (?,?,?,?)
-    `)
+	// Prepare the SQL query
+	query := `
+		SELECT ` + eventColumns + `
+		FROM events
+		WHERE events.aggregateId = ?
+			AND (events.version_0, events.version_1) >= (?, ?)
+			AND (events.version_0, events.version_1) <= (?, ?)
+		ORDER BY events.version_0 ` + order + `, events.version_1 ` + order + `
+		LIMIT ?
+	`
+
+	stmt, err := e.store.Prepare(query)
 	if err != nil {
-		log.Info().Err(err).Msg("Preparing insert statement for aggregate_state table")
-		return err
+		log.Info().Err(err).Msg("Error preparing statement")
+		return nil, errors.New("could not prepare statement for query events")
 	}
 	defer stmt.Close()
 
-	_, err = tx.Stmt(stmtAgg).Exec(event.AggregateId, event.AggregateType, v0, v1)
+	// Execute the query
+	rows, err := stmt.Query(aggregateId, from0, from1, to0, to1, limit)
 	if err != nil {
-		return err
+		log.Info().Err(err).Msg("Error running query statement")
+		return nil, errors.New("could not query events")
 	}
+	defer rows.Close()
+
+	return e.readEvents(rows)
+}
 
+// checkNotDeleted returns an AggregateDeletedError if the aggregate was deleted.
+func (e *EventRepository) checkNotDeleted(aggregateId string) error {
+	var deleted string
+	err := e.store.QueryRow("SELECT deleted FROM aggregate_state WHERE id = ?", aggregateId).Scan(&deleted)
+	if err != nil && err != sql.ErrNoRows {
+		log.Info().Err(err).Msg("Error querying aggregate state")
+		return errors.New("could not query aggregate state")
+	}
+	if len(deleted) > 0 {
+		return &customerrors.AggregateDeletedError{AggregateId: aggregateId, Mode: models.DeletionMode(deleted)}
+	}
 	return nil
 }
 
-// GetEventsForAggregate retrieves all events for a given aggregate ID.
-func (e *EventRepository) GetEventsForAggregate(aggregateId string) ([]models.Event, error) {
+// FeedStart is the cursor reading the global feeds from their start, the oldest
+// event forward and the newest event backward. An empty cursor works the same.
+const FeedStart = "0"
+
+func isFeedStart(eventId string) bool {
+	return len(eventId) == 0 || eventId == FeedStart
+}
+
+// GetEventsSinceEvent retrieves events since a given event ID with a limit.
+// Events removed by retention or a hard deletion keep their position, so the
+// feed continues after them. It returns an EventNotFoundError if the event
+// never existed; the feed is not restarted silently.
+func (repo *EventRepository) GetEventsSinceEvent(eventId string, limit int) ([]models.Event, error) {
+	return repo.getEventsSinceEvent(eventId, limit, "1", nil)
+}
+
+// GetScopedEventsSinceEvent retrieves events since a given event ID with a limit,
+// skipping events of aggregates outside of the scopes. The type of an aggregate is
+// the one it was created with. No scopes return no events.
+func (repo *EventRepository) GetScopedEventsSinceEvent(eventId string, limit int, scopes []models.AggregateScope) ([]models.Event, error) {
+	condition, args := scopeCondition(scopes, "type", "id")
+	condition = "events.aggregateId IN (SELECT id FROM aggregate_state WHERE " + condition + ")"
+	return repo.getEventsSinceEvent(eventId, limit, condition, args)
+}
+
+func (repo *EventRepository) getEventsSinceEvent(eventId string, limit int, condition string, conditionArgs []any) ([]models.Event, error) {
+	t0, t1, found, err := repo.getEventTimestamp(eventId)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		if !isFeedStart(eventId) {
+			return nil, &customerrors.EventNotFoundError{}
+		}
+		t0 = 0
+		t1 = 0
+	}
 
-	// Prepare the SQL query
 	query := `
-		SELECT events.Name, events.version_0, events.version_1, events.data,events.aggregateId,aggregate_state.type
-		FROM events 
-		JOIN aggregate_state 
-			ON events.aggregateId = aggregate_state.id 
-		 	and events.version_0 = aggregate_state.version_0 
-			and events.version_1 = aggregate_state.version_1 
-		WHERE aggregate_state.id = ?
-		ORDER BY events.version_0 ASC, events.version_1 ASC
+		SELECT ` + eventColumns + `
+		FROM events
+		WHERE (events.timestamp_0 > ? OR (events.timestamp_0 = ? AND events.timestamp_1 > ?)) AND ` + condition + `
+		ORDER BY events.timestamp_0, events.timestamp_1, events.aggregateId, events.version_0 ASC, events.version_1 ASC
+		LIMIT ?
 	`
 
-	stmt, err := e.store.Prepare(query)
+	stmt, err := repo.store.Prepare(query)
 	if err != nil {
 		log.Info().Err(err).Msg("Error preparing statement")
 		return nil, errors.New("could not prepare statement for query events")
 	}
 	defer stmt.Close()
 
-	// Execute the query
-	rows, err := stmt.Query(aggregateId)
+	args := append(append([]any{t0, t0, t1}, conditionArgs...), limit)
+	rows, err := stmt.Query(args...)
 	if err != nil {
 		log.Info().Err(err).Msg("Error running query statement")
 		return nil, errors.New("could not query events")
 	}
 	defer rows.Close()
 
-	// Initialize a slice to hold all events
-	var events []models.Event
+	return repo.readEvents(rows)
+}
 
-	// Iterate over the results and store them in the slice
-	for rows.Next() {
-		var event models.Event
+// GetEventsBeforeEvent retrieves events written before a given event ID, newest
+// first, with a limit. FeedStart reads from the newest event, another unknown
+// event ID fails with an EventNotFoundError.
+func (repo *EventRepository) GetEventsBeforeEvent(eventId string, limit int) ([]models.Event, error) {
+	return repo.getEventsBeforeEvent(eventId, limit, "1", nil)
+}
 
-		var v0 int32
-		var v1 int32
-		err = rows.Scan(&event.Name, &v0, &v1, &event.Data, &event.AggregateId, &event.AggregateType)
-		if err != nil {
-			log.Info().Err(err).Msg("Error scanning rows")
-			return nil, errors.New("could not retrieve event")
-		}
-		version, err := helper.MergeInt62(v0, v1)
-		if err != nil {
-			log.Info().Err(err).Msg("Error transforming version")
-			return nil, errors.New("could not retrieve event")
+// GetScopedEventsBeforeEvent is GetEventsBeforeEvent skipping events of
+// aggregates outside of the scopes. No scopes return no events.
+func (repo *EventRepository) GetScopedEventsBeforeEvent(eventId string, limit int, scopes []models.AggregateScope) ([]models.Event, error) {
+	condition, args := scopeCondition(scopes, "type", "id")
+	condition = "events.aggregateId IN (SELECT id FROM aggregate_state WHERE " + condition + ")"
+	return repo.getEventsBeforeEvent(eventId, limit, condition, args)
+}
+
+func (repo *EventRepository) getEventsBeforeEvent(eventId string, limit int, condition string, conditionArgs []any) ([]models.Event, error) {
+	t0, t1, found, err := repo.getEventTimestamp(eventId)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		if !isFeedStart(eventId) {
+			return nil, &customerrors.EventNotFoundError{}
 		}
-		event.Version = version
+		t0 = math.MaxInt32
+		t1 = math.MaxInt32
+	}
 
-		// Append the event to the slice
-		events = append(events, event)
+	query := `
+		SELECT ` + eventColumns + `
+		FROM events
+		WHERE (events.timestamp_0 < ? OR (events.timestamp_0 = ? AND events.timestamp_1 < ?)) AND ` + condition + `
+		ORDER BY events.timestamp_0 DESC, events.timestamp_1 DESC, events.aggregateId DESC, events.version_0 DESC, events.version_1 DESC
+		LIMIT ?
+	`
+
+	stmt, err := repo.store.Prepare(query)
+	if err != nil {
+		log.Info().Err(err).Msg("Error preparing statement")
+		return nil, errors.New("could not prepare statement for query events")
 	}
+	defer stmt.Close()
 
-	// Check for any error that might have occurred during iteration
-	if err = rows.Err(); err != nil {
-		log.Info().Err(err).Msg("Error checking row errors")
-		return nil, errors.New("could not retrieve all events")
+	args := append(append([]any{t0, t0, t1}, conditionArgs...), limit)
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		log.Info().Err(err).Msg("Error running query statement")
+		return nil, errors.New("could not query events")
 	}
-	return events, nil
+	defer rows.Close()
+
+	return repo.readEvents(rows)
 }
 
-// GetEventsSinceEvent retrieves events since a given event ID with a limit.
-func (repo *EventRepository) GetEventsSinceEvent(eventId string, limit int) ([]models.Event, error) {
+// getEventTimestamp retrieves the split timestamp of an event, including events
+// that were removed. found is false if there is no event with the given ID.
+func (repo *EventRepository) getEventTimestamp(eventId string) (int32, int32, bool, error) {
 	query := `
 		SELECT events.timestamp_0, events.timestamp_1
-		FROM events 
+		FROM events
 		WHERE events.id = ?
+		UNION ALL
+		SELECT removed_events.timestamp_0, removed_events.timestamp_1
+		FROM removed_events
+		WHERE removed_events.id = ?
+		LIMIT 1
 	`
 	stmt, err := repo.store.Prepare(query)
 	if err != nil {
 		log.Info().Err(err).Msg("Error preparing statement")
-		return nil, errors.New("could not prepare statement for query event")
+		return 0, 0, false, errors.New("could not prepare statement for query event")
 	}
 	defer stmt.Close()
 
 	var t0 int32
 	var t1 int32
 
-	err = stmt.QueryRow(eventId).Scan(&t0, &t1)
+	err = stmt.QueryRow(eventId, eventId).Scan(&t0, &t1)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			t0 = 0
-			t1 = 0
-
-		} else {
-			log.Info().Err(err).Msg("Error querying event")
-			return nil, errors.New("could not query event")
+			return 0, 0, false, nil
 		}
+		log.Info().Err(err).Msg("Error querying event")
+		return 0, 0, false, errors.New("could not query event")
 	}
+	return t0, t1, true, nil
+}
 
-	query = `
-		SELECT events.id, events.Name, events.version_0, events.version_1, events.data,events.aggregateId,aggregate_state.type
-		FROM events 
-		JOIN aggregate_state 
-			ON events.aggregateId = aggregate_state.id AND events.version_0 = aggregate_state.version_0 AND events.version_1 = aggregate_state.version_1
-		WHERE (events.timestamp_0 > ? OR (events.timestamp_0 = ? AND events.timestamp_1 > ?))
-		ORDER BY events.timestamp_0, events.timestamp_1, events.aggregateId, events.version_0 ASC, events.version_1 ASC
-	`
+// readEvents scans the rows and decodes the data of their events.
+func (e *EventRepository) readEvents(rows *sql.Rows) ([]models.Event, error) {
+	return scanEvents(rows, e.data)
+}
 
-	stmt, err = repo.store.Prepare(query)
-	if err != nil {
-		log.Info().Err(err).Msg("Error preparing statement")
-		return nil, errors.New("could not prepare statement for query events")
-	}
-	defer stmt.Close()
+// DestroySubjectKey destroys the key of a subject. The data of its events can no
+// longer be read and new events for the subject are rejected. Backups taken
+// before still contain the key. It returns a SubjectNotFoundError if the subject
+// has no key.
+func (e *EventRepository) DestroySubjectKey(subject string) error {
+	return e.data.subjects.destroy(subject)
+}
+
+// SetCompressionDictionary makes a zstd dictionary the one new events of an aggregate
+// type are compressed with. It returns an InvalidDictionaryError if the dictionary
+// is not in the zstd dictionary format.
+func (e *EventRepository) SetCompressionDictionary(aggregateType string, dictionary []byte) error {
+	return e.data.compression.setDictionary(aggregateType, dictionary)
+}
 
-	rows, err := stmt.Query(t0, t0, t1)
+// TrainCompressionDictionary trains a zstd dictionary on the most recent events of an
+// aggregate type and makes it the one new events of the type are compressed with.
+// Events with a subject are not used. It returns an InvalidDictionaryError if
+// there are not enough events to train on.
+func (e *EventRepository) TrainCompressionDictionary(aggregateType string) error {
+	query := `
+		SELECT ` + eventColumns + `
+		FROM events
+		WHERE events.aggregateType = ? AND events.subject = '' AND events.data IS NOT NULL
+		ORDER BY events.timestamp_0 DESC, events.timestamp_1 DESC
+		LIMIT ?
+	`
+	rows, err := e.store.Query(query, aggregateType, dictionarySamples)
 	if err != nil {
 		log.Info().Err(err).Msg("Error running query statement")
-		return nil, errors.New("could not query events")
+		return errors.New("could not query events")
 	}
 	defer rows.Close()
+	events, err := e.readEvents(rows)
+	if err != nil {
+		return err
+	}
+	samples := make([][]byte, 0, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		samples = append(samples, events[i].Data)
+	}
+	dictionary, err := trainDictionary(samples)
+	if err != nil {
+		return err
+	}
+	return e.SetCompressionDictionary(aggregateType, dictionary)
+}
 
+// scanEvents reads all rows selected with eventColumns and decodes their data.
+func scanEvents(rows *sql.Rows, data *eventData) ([]models.Event, error) {
 	var events []models.Event
 
-	noEvents := 0
 	for rows.Next() {
-		var event models.Event
-		var v0 int32
-		var v1 int32
-		err = rows.Scan(&event.Id, &event.Name, &v0, &v1, &event.Data, &event.AggregateId, &event.AggregateType)
-		if err != nil {
-			log.Info().Err(err).Msg("Error scanning rows")
-			return nil, errors.New("could not retrieve event")
-		}
-		version, err := helper.MergeInt62(v0, v1)
+		event, err := scanEvent(rows, data)
 		if err != nil {
-			log.Info().Err(err).Msg("Error transforming version")
-			return nil, errors.New("could not retrieve event")
+			return nil, err
 		}
-		event.Version = version
 		events = append(events, event)
-		noEvents++
-		if limit <= noEvents {
-			break
-		}
 	}
 
-	if err = rows.Err(); err != nil {
+	// Check for any error that might have occurred during iteration
+	if err := rows.Err(); err != nil {
 		log.Info().Err(err).Msg("Error checking row errors")
 		return nil, errors.New("could not retrieve all events")
 	}
 	return events, nil
 }
+
+// scanEvent scans the current row, selected with eventColumns followed by the
+// columns of extra, and decodes the data of its event.
+func scanEvent(rows *sql.Rows, data *eventData, extra ...any) (models.Event, error) {
+	var event models.Event
+	var v0 int32
+	var v1 int32
+	var tags []byte
+	var stored storedData
+	var hash []byte
+	dest := []any{&event.Id, &event.Name, &v0, &v1, &stored.data, &event.AggregateId, &event.AggregateType, &tags, &event.SchemaVersion, &event.ContentType, &event.Subject, &stored.dataKey, &stored.codec, &stored.dictionary, &stored.segment, &hash, &event.SigningKeyId, &event.Signature}
+	err := rows.Scan(append(dest, extra...)...)
+	if err != nil {
+		log.Info().Err(err).Msg("Error scanning rows")
+		return event, errors.New("could not retrieve event")
+	}
+	stored.eventId, stored.subject = event.Id, event.Subject
+	event.Hash = hex.EncodeToString(hash)
+	event.Data, err = data.decode(stored)
+	if err != nil {
+		return event, err
+	}
+	if len(tags) > 0 {
+		err = json.Unmarshal(tags, &event.Tags)
+		if err != nil {
+			log.Info().Err(err).Msg("Error reading tags")
+			return event, errors.New("could not retrieve event")
+		}
+	}
+	version, err := helper.MergeInt62(v0, v1)
+	if err != nil {
+		log.Info().Err(err).Msg("Error transforming version")
+		return event, errors.New("could not retrieve event")
+	}
+	event.Version = version
+	return event, nil
+}
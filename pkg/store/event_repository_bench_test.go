@@ -0,0 +1,96 @@
+package store_test
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+)
+
+// setupBenchmarkRepository creates a repository on a fresh database. The
+// repository is closed and the database removed when the benchmark ends.
+func setupBenchmarkRepository(b *testing.B) *store.EventRepository {
+	db := setup()
+	conn, err := db.GetDbConnection()
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := store.NewEventRepository(conn)
+	b.Cleanup(func() {
+		r.Close()
+		teardown(db)
+	})
+	return r
+}
+
+// BenchmarkAddEventsSequential appends single events one call after another.
+func BenchmarkAddEventsSequential(b *testing.B) {
+	r := setupBenchmarkRepository(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := r.AddEvents([]models.Event{{
+			Version:       int64(i + 1),
+			Name:          "benchevent",
+			Data:          []byte("{\"value\":1}"),
+			AggregateId:   "benchaggregate",
+			AggregateType: "bench",
+		}})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkAddEventsBatch appends events in batches of ten per call.
+func BenchmarkAddEventsBatch(b *testing.B) {
+	r := setupBenchmarkRepository(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		events := make([]models.Event, 10)
+		for j := range events {
+			events[j] = models.Event{
+				Version:       int64(i*10 + j + 1),
+				Name:          "benchevent",
+				Data:          []byte("{\"value\":1}"),
+				AggregateId:   "benchaggregate",
+				AggregateType: "bench",
+			}
+		}
+		err := r.AddEvents(events)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkAddEventsParallel appends single events from many goroutines,
+// each writing to its own aggregate, like concurrent POST requests do.
+func BenchmarkAddEventsParallel(b *testing.B) {
+	r := setupBenchmarkRepository(b)
+
+	var aggregates atomic.Int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		aggregateId := fmt.Sprintf("benchaggregate-%d", aggregates.Add(1))
+		var version int64
+		for pb.Next() {
+			version++
+			err := r.AddEvents([]models.Event{{
+				Version:       version,
+				Name:          "benchevent",
+				Data:          []byte("{\"value\":1}"),
+				AggregateId:   aggregateId,
+				AggregateType: "bench",
+			}})
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -1,10 +1,15 @@
 package store_test
 
 import (
+	"crypto/ed25519"
+	"database/sql"
+	"fmt"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
 	"github.com/L4B0MB4/EVTSRC/pkg/store"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
@@ -304,3 +309,348 @@ func TestGetEventsSinceEvent(t *testing.T) {
 	assert.Equal(t, event3.Name, events[0].Name)
 	assert.Equal(t, event4.Name, events[1].Name)
 }
+
+func TestAddEventsConcurrentlyWithOneConflict(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	defer r.Close()
+
+	errs := make([]error, 20)
+	wg := sync.WaitGroup{}
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			aggregateId := fmt.Sprintf("aggregate%d", i)
+			if i == 0 {
+				// same aggregate and version as request 1
+				aggregateId = "aggregate1"
+			}
+			errs[i] = r.AddEvents([]models.Event{{
+				Version:       1,
+				Name:          "testevent",
+				Data:          []byte{0, 1},
+				AggregateId:   aggregateId,
+				AggregateType: "aggregateType",
+			}})
+		}(i)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	assert.Equal(t, 1, failed)
+	for i := 1; i < len(errs); i++ {
+		evs, err := r.GetEventsForAggregate(fmt.Sprintf("aggregate%d", i))
+		assert.NoError(t, err)
+		assert.Len(t, evs, 1)
+	}
+}
+
+func TestAddEventsAfterClose(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	r.Close()
+
+	err = r.AddEvents([]models.Event{{
+		Version:       1,
+		Name:          "testevent",
+		Data:          []byte{0, 1},
+		AggregateId:   "anyaggregateId",
+		AggregateType: "aggregateType",
+	}})
+	assert.Error(t, err)
+}
+
+func TestAggregateStateHasOneRowPerAggregate(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	ev := models.Event{
+		Version:       1,
+		Name:          "testevent",
+		Data:          []byte{0, 1},
+		AggregateId:   "anyaggregateId",
+		AggregateType: "aggregateType",
+	}
+	ev2 := ev
+	ev2.Version = 2
+	ev3 := ev
+	ev3.Version = 3
+	assert.NoError(t, r.AddEvents([]models.Event{ev}))
+	assert.NoError(t, r.AddEvents([]models.Event{ev3, ev2}))
+
+	var rows, count, v0, v1 int
+	var aggregateType string
+	err = conn.QueryRow("SELECT COUNT(*), MAX(type), MAX(event_count), MAX(version_0), MAX(version_1) FROM aggregate_state").Scan(&rows, &aggregateType, &count, &v0, &v1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, rows)
+	assert.Equal(t, "aggregateType", aggregateType)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, 0, v0)
+	assert.Equal(t, 3, v1)
+}
+
+func TestSetUpMigratesLegacyAggregateState(t *testing.T) {
+	db := setup()
+	teardown(db)
+
+	legacy, err := sql.Open("sqlite3", store.GetDbFileLocation())
+	assert.NoError(t, err)
+	statements := []string{
+		"CREATE TABLE events (id TEXT PRIMARY KEY, aggregateId TEXT, timestamp_0 INTEGER,timestamp_1 INTEGER,Name TEXT, version_0 INTEGER,version_1 INTEGER,data BLOB,UNIQUE(aggregateId,version_0, version_1) ON CONFLICT FAIL)",
+		"CREATE TABLE aggregate_state (id TEXT,type TEXT,version_0 INTEGER,version_1 INTEGER,UNIQUE(id,version_0, version_1) ON CONFLICT FAIL )",
+		"CREATE INDEX IX_aggregate_state__typr ON aggregate_state(type)",
+		"INSERT INTO events VALUES ('e1','agg1',0,10,'created',0,1,x'00')",
+		"INSERT INTO events VALUES ('e2','agg1',0,20,'changed',0,2,x'01')",
+		"INSERT INTO aggregate_state VALUES ('agg1','legacytype',0,1)",
+		"INSERT INTO aggregate_state VALUES ('agg1','legacytype',0,2)",
+	}
+	for _, stmt := range statements {
+		_, err = legacy.Exec(stmt)
+		assert.NoError(t, err)
+	}
+	legacy.Close()
+
+	db = &store.DatabaseConnection{}
+	db.SetUp()
+	defer teardown(db)
+	assert.True(t, db.IsInitialized())
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	evs, err := r.GetEventsForAggregate("agg1")
+	assert.NoError(t, err)
+	assert.Len(t, evs, 2)
+	assert.Equal(t, "legacytype", evs[1].AggregateType)
+
+	var count, v1, created, updated int
+	err = conn.QueryRow("SELECT event_count, version_1, created_1, updated_1 FROM aggregate_state WHERE id = 'agg1'").Scan(&count, &v1, &created, &updated)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 2, v1)
+	assert.Equal(t, 10, created)
+	assert.Equal(t, 20, updated)
+}
+
+func TestReadEventsForAggregateBackward(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	events := []models.Event{}
+	for i := 1; i <= 5; i++ {
+		events = append(events, models.Event{
+			Version:       int64(i),
+			Name:          fmt.Sprintf("Event%d", i),
+			Data:          []byte{0, 1},
+			AggregateId:   "anyaggregateId",
+			AggregateType: "aggregateType",
+		})
+	}
+	assert.NoError(t, r.AddEvents(events))
+
+	evs, err := r.ReadEventsForAggregate("anyaggregateId", models.Backward, 2)
+	assert.NoError(t, err)
+	assert.Len(t, evs, 2)
+	assert.Equal(t, int64(5), evs[0].Version)
+	assert.Equal(t, int64(4), evs[1].Version)
+
+	evs, err = r.ReadEventsForAggregate("anyaggregateId", models.Forward, 0)
+	assert.NoError(t, err)
+	assert.Len(t, evs, 5)
+	assert.Equal(t, int64(1), evs[0].Version)
+}
+
+func TestGetEventsBeforeEvent(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	repo := store.NewEventRepository(conn)
+
+	err = repo.AddEvents([]models.Event{
+		{AggregateId: "agg1", Name: "Event1", Version: 1, Data: []byte("data1"), AggregateType: "type1"},
+		{AggregateId: "agg1", Name: "Event2", Version: 2, Data: []byte("data2"), AggregateType: "type1"},
+	})
+	assert.NoError(t, err)
+	err = repo.AddEvents([]models.Event{
+		{AggregateId: "agg2", Name: "Event3", Version: 1, Data: []byte("data3"), AggregateType: "type2"},
+	})
+	assert.NoError(t, err)
+
+	events, err := repo.GetEventsBeforeEvent("", 2)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, "Event3", events[0].Name)
+	assert.Equal(t, "Event2", events[1].Name)
+
+	events, err = repo.GetEventsBeforeEvent(events[1].Id, 2)
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "Event1", events[0].Name)
+}
+
+func TestAddEventsReplayWithSameIds(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	events := []models.Event{
+		{Id: "0b7a3b2e-6a51-4a8f-9a39-3f1f3c0d2f10", Version: 1, Name: "testevent", Data: []byte{0, 1}, AggregateId: "anyaggregateId", AggregateType: "aggregateType"},
+		{Id: "0b7a3b2e-6a51-4a8f-9a39-3f1f3c0d2f11", Version: 2, Name: "testevent", Data: []byte{1, 2}, AggregateId: "anyaggregateId", AggregateType: "aggregateType"},
+	}
+	assert.NoError(t, r.AddEvents(events))
+	assert.NoError(t, r.AddEvents(events))
+
+	evs, err := r.GetEventsForAggregate("anyaggregateId")
+	assert.NoError(t, err)
+	assert.Len(t, evs, 2)
+	aggregate, err := r.GetAggregate("anyaggregateId")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), aggregate.EventCount)
+}
+
+func TestAddEventsWithUsedIdConflicts(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	ev := models.Event{Id: "0b7a3b2e-6a51-4a8f-9a39-3f1f3c0d2f10", Version: 1, Name: "testevent", Data: []byte{0, 1}, AggregateId: "anyaggregateId", AggregateType: "aggregateType"}
+	assert.NoError(t, r.AddEvents([]models.Event{ev}))
+
+	changed := ev
+	changed.Data = []byte{9, 9}
+	err = r.AddEvents([]models.Event{changed})
+	assert.IsType(t, &customerrors.EventIdConflictError{}, err)
+
+	otherId := ev
+	otherId.Id = "0b7a3b2e-6a51-4a8f-9a39-3f1f3c0d2f12"
+	err = r.AddEvents([]models.Event{otherId})
+	assert.IsType(t, &customerrors.DuplicateVersionError{}, err)
+
+	retagged := ev
+	retagged.Tags = []string{"other"}
+	err = r.AddEvents([]models.Event{retagged})
+	assert.IsType(t, &customerrors.EventIdConflictError{}, err)
+
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	_, err = r.ProducerKeys().RegisterKey(models.ProducerKey{Id: "producer-1", PublicKey: public})
+	assert.NoError(t, err)
+	resigned := ev
+	resigned.Sign("producer-1", private)
+	err = r.AddEvents([]models.Event{resigned})
+	assert.IsType(t, &customerrors.EventIdConflictError{}, err)
+}
+
+func TestAppendWithoutEventsIsNoReplay(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	assert.NoError(t, r.AddEvents([]models.Event{{Version: 1, Name: "opened", Data: []byte{0}, AggregateId: "account1", AggregateType: "account"}}))
+
+	err = r.AppendToAggregates([]models.StreamAppend{{AggregateId: "account1", ExpectedVersion: 3, Events: []models.Event{}}})
+	assert.IsType(t, &customerrors.WrongExpectedVersionError{}, err)
+}
+
+func TestAppendToAggregatesAllOrNothing(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	assert.NoError(t, r.AddEvents([]models.Event{
+		{Version: 1, Name: "opened", Data: []byte{0}, AggregateId: "account1", AggregateType: "account"},
+	}))
+
+	err = r.AppendToAggregates([]models.StreamAppend{
+		{AggregateId: "account1", ExpectedVersion: 1, Events: []models.Event{{Version: 2, Name: "debited", Data: []byte{1}, AggregateType: "account"}}},
+		{AggregateId: "account2", ExpectedVersion: models.NoStream, Events: []models.Event{{Version: 1, Name: "credited", Data: []byte{1}, AggregateType: "account"}}},
+	})
+	assert.NoError(t, err)
+
+	err = r.AppendToAggregates([]models.StreamAppend{
+		{AggregateId: "account1", ExpectedVersion: 2, Events: []models.Event{{Version: 3, Name: "debited", Data: []byte{2}, AggregateType: "account"}}},
+		{AggregateId: "account2", ExpectedVersion: 5, Events: []models.Event{{Version: 2, Name: "credited", Data: []byte{2}, AggregateType: "account"}}},
+	})
+	wrongVersion, ok := err.(*customerrors.WrongExpectedVersionError)
+	assert.True(t, ok)
+	assert.Equal(t, "account2", wrongVersion.AggregateId)
+	assert.Equal(t, int64(1), wrongVersion.CurrentVersion)
+
+	evs, err := r.GetEventsForAggregate("account1")
+	assert.NoError(t, err)
+	assert.Len(t, evs, 2)
+
+	err = r.AppendToAggregates([]models.StreamAppend{
+		{AggregateId: "account2", ExpectedVersion: models.AnyVersion, Events: []models.Event{{Version: 2, Name: "credited", Data: []byte{2}, AggregateType: "account"}}},
+	})
+	assert.NoError(t, err)
+}
+
+func TestSchemaVersionIsStored(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	err = r.AddEvents([]models.Event{
+		{Version: 1, Name: "created", Data: []byte("{}"), AggregateId: "versioned", AggregateType: "t"},
+		{Version: 2, Name: "created", Data: []byte("{}"), AggregateId: "versioned", AggregateType: "t", SchemaVersion: 2},
+	})
+	assert.NoError(t, err)
+	events, err := r.GetEventsForAggregate("versioned")
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, 0, events[0].SchemaVersion)
+	assert.Equal(t, 2, events[1].SchemaVersion)
+}
+
+func TestReadEventRange(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	events := []models.Event{}
+	for v := int64(1); v <= 10; v++ {
+		events = append(events, models.Event{Version: v, Name: "counted", Data: []byte{byte(v)}, AggregateId: "ranged", AggregateType: "t"})
+	}
+	assert.NoError(t, r.AddEvents(events))
+
+	read, err := r.ReadEventRange("ranged", 3, 6, models.Forward, 0)
+	assert.NoError(t, err)
+	assert.Len(t, read, 4)
+	assert.Equal(t, int64(3), read[0].Version)
+
+	read, err = r.ReadEventRange("ranged", 5, 0, models.Backward, 2)
+	assert.NoError(t, err)
+	assert.Len(t, read, 2)
+	assert.Equal(t, int64(10), read[0].Version)
+	assert.Equal(t, int64(9), read[1].Version)
+}
@@ -0,0 +1,662 @@
+package store
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/helper"
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/rs/zerolog/log"
+)
+
+// maxBatchSize limits how many AddEvents calls are committed in one transaction.
+const maxBatchSize = 256
+
+var errWriterClosed = errors.New("event writer is closed")
+
+// appendRequest is a single AddEvents call waiting for the writer.
+type appendRequest struct {
+	events       []*eventEntity
+	expectations []versionExpectation
+	condition    *models.AppendCondition
+	deletion     *aggregateDeletion
+	retention    *retentionRun
+	archive      *archiveRun
+	compaction   *segmentCompaction
+	result       chan error
+}
+
+// aggregateDeletion deletes an aggregate instead of appending events. The
+// tombstone is written in place of the events of a hard deleted aggregate.
+type aggregateDeletion struct {
+	aggregateId string
+	mode        models.DeletionMode
+	tombstone   *eventEntity
+}
+
+// versionExpectation requires an aggregate to be at a version before a request is written.
+type versionExpectation struct {
+	aggregateId string
+	version     int64
+}
+
+// eventWriter is the single goroutine that writes events to the database.
+// Concurrent requests are collected and committed together in one transaction
+// (group commit), each request isolated by its own savepoint.
+type eventWriter struct {
+	db            *sql.DB
+	requests      chan *appendRequest
+	quit          chan struct{}
+	done          chan struct{}
+	stmts         writerStatements
+	lastTimestamp int64
+	committed     *commitNotifier
+	data          *eventData
+}
+
+// writerStatements are the statements prepared once and reused by every transaction.
+type writerStatements struct {
+	insertEvent     *sql.Stmt
+	upsertAggregate *sql.Stmt
+	selectEvent     *sql.Stmt
+	selectVersion   *sql.Stmt
+	selectHash      *sql.Stmt
+	insertTag       *sql.Stmt
+}
+
+// in returns the statements bound to the given transaction.
+func (s writerStatements) in(tx *sql.Tx) writerStatements {
+	return writerStatements{
+		insertEvent:     tx.Stmt(s.insertEvent),
+		upsertAggregate: tx.Stmt(s.upsertAggregate),
+		selectEvent:     tx.Stmt(s.selectEvent),
+		selectVersion:   tx.Stmt(s.selectVersion),
+		selectHash:      tx.Stmt(s.selectHash),
+		insertTag:       tx.Stmt(s.insertTag),
+	}
+}
+
+func (s writerStatements) close() {
+	for _, stmt := range []*sql.Stmt{s.insertEvent, s.upsertAggregate, s.selectEvent, s.selectVersion, s.selectHash, s.insertTag} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+}
+
+// newEventWriter prepares the insert statements and reads the last used timestamp.
+func newEventWriter(db *sql.DB, data *eventData) (*eventWriter, error) {
+	insertEvent, err := db.Prepare(`
+        INSERT INTO events (id, aggregateId, aggregateType, timestamp_0 ,timestamp_1, Name, version_0, version_1, data, tags, schemaVersion, contentType, subject, dataKey, codec, dictionary, hash, prevHash, dataHash, signingKeyId, signature, appendId)
+        VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)
+    `)
+	if err != nil {
+		log.Info().Err(err).Msg("Preparing insert statement for events table")
+		return nil, err
+	}
+	upsertAggregate, err := db.Prepare(`
+        INSERT INTO aggregate_state(id, type, version_0, version_1, event_count, created_0, created_1, updated_0, updated_1, hash)
+        VALUES (?,?,?,?,?,?,?,?,?,?)
+        ON CONFLICT(id) DO UPDATE SET
+            version_0 = CASE WHEN (excluded.version_0, excluded.version_1) > (aggregate_state.version_0, aggregate_state.version_1)
+                THEN excluded.version_0 ELSE aggregate_state.version_0 END,
+            version_1 = CASE WHEN (excluded.version_0, excluded.version_1) > (aggregate_state.version_0, aggregate_state.version_1)
+                THEN excluded.version_1 ELSE aggregate_state.version_1 END,
+            event_count = aggregate_state.event_count + excluded.event_count,
+            updated_0 = excluded.updated_0,
+            updated_1 = excluded.updated_1,
+            hash = excluded.hash
+    `)
+	if err != nil {
+		insertEvent.Close()
+		log.Info().Err(err).Msg("Preparing insert statement for aggregate_state table")
+		return nil, err
+	}
+	selectEvent, err := db.Prepare(`
+        SELECT aggregateId, aggregateType, Name, version_0, version_1, data, tags, schemaVersion, contentType, subject, dataKey, codec, dictionary, segment, signingKeyId, signature
+        FROM events
+        WHERE id = ?
+    `)
+	if err != nil {
+		insertEvent.Close()
+		upsertAggregate.Close()
+		log.Info().Err(err).Msg("Preparing select statement for events table")
+		return nil, err
+	}
+	selectVersion, err := db.Prepare(`
+        SELECT version_0, version_1, deleted
+        FROM aggregate_state
+        WHERE id = ?
+    `)
+	if err != nil {
+		insertEvent.Close()
+		upsertAggregate.Close()
+		selectEvent.Close()
+		log.Info().Err(err).Msg("Preparing select statement for aggregate_state table")
+		return nil, err
+	}
+	selectHash, err := db.Prepare("SELECT hash FROM aggregate_state WHERE id = ?")
+	if err != nil {
+		insertEvent.Close()
+		upsertAggregate.Close()
+		selectEvent.Close()
+		selectVersion.Close()
+		log.Info().Err(err).Msg("Preparing select statement for aggregate_state table")
+		return nil, err
+	}
+	insertTag, err := db.Prepare("INSERT OR IGNORE INTO event_tags (tag, eventId) VALUES (?,?)")
+	if err != nil {
+		insertEvent.Close()
+		upsertAggregate.Close()
+		selectEvent.Close()
+		selectVersion.Close()
+		selectHash.Close()
+		log.Info().Err(err).Msg("Preparing insert statement for event_tags table")
+		return nil, err
+	}
+
+	w := &eventWriter{
+		db:        db,
+		requests:  make(chan *appendRequest),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+		committed: newCommitNotifier(),
+		data:      data,
+		stmts: writerStatements{
+			insertEvent:     insertEvent,
+			upsertAggregate: upsertAggregate,
+			selectEvent:     selectEvent,
+			selectVersion:   selectVersion,
+			selectHash:      selectHash,
+			insertTag:       insertTag,
+		},
+	}
+	w.lastTimestamp, err = w.readLastTimestamp()
+	if err != nil {
+		w.closeStatements()
+		return nil, err
+	}
+	return w, nil
+}
+
+// readLastTimestamp returns the newest event timestamp so ordering survives restarts.
+func (w *eventWriter) readLastTimestamp() (int64, error) {
+	var t0, t1 int32
+	err := w.db.QueryRow(`
+		SELECT timestamp_0, timestamp_1
+		FROM events
+		ORDER BY timestamp_0 DESC, timestamp_1 DESC
+		LIMIT 1
+	`).Scan(&t0, &t1)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		log.Info().Err(err).Msg("Error reading last event timestamp")
+		return 0, err
+	}
+	return helper.MergeInt62(t0, t1)
+}
+
+// submit hands the events to the writer and waits for the result of their commit.
+// The events are only written if all expectations hold.
+func (w *eventWriter) submit(events []*eventEntity, expectations ...versionExpectation) error {
+	return w.submitRequest(&appendRequest{
+		events:       events,
+		expectations: expectations,
+	})
+}
+
+// submitRequest hands a prepared request to the writer and waits for its result.
+func (w *eventWriter) submitRequest(req *appendRequest) error {
+	req.result = make(chan error, 1)
+	select {
+	case w.requests <- req:
+	case <-w.quit:
+		return errWriterClosed
+	}
+	return <-req.result
+}
+
+// run collects pending requests and commits them until the writer is stopped.
+func (w *eventWriter) run() {
+	defer close(w.done)
+	for {
+		var req *appendRequest
+		select {
+		case req = <-w.requests:
+		case <-w.quit:
+			w.closeStatements()
+			return
+		}
+		batch := []*appendRequest{req}
+	collect:
+		for len(batch) < maxBatchSize {
+			select {
+			case req = <-w.requests:
+				batch = append(batch, req)
+			default:
+				break collect
+			}
+		}
+		w.commit(batch)
+	}
+}
+
+// stop ends the writer goroutine and waits until it has exited.
+func (w *eventWriter) stop() {
+	select {
+	case <-w.quit:
+	default:
+		close(w.quit)
+	}
+	<-w.done
+}
+
+func (w *eventWriter) closeStatements() {
+	w.stmts.close()
+}
+
+// commit writes all requests of the batch in a single transaction. A failing
+// request is rolled back to its savepoint without affecting the others.
+func (w *eventWriter) commit(batch []*appendRequest) {
+	results := make([]error, len(batch))
+	tx, err := w.db.Begin()
+	if err != nil {
+		log.Info().Err(err).Msg("Could not begin transaction")
+		for _, req := range batch {
+			req.result <- err
+		}
+		return
+	}
+	stmts := w.stmts.in(tx)
+	lastTimestamp := w.lastTimestamp
+
+	for i, req := range batch {
+		if _, err = tx.Exec("SAVEPOINT append_request"); err != nil {
+			break
+		}
+		results[i] = w.writeRequest(tx, stmts, req)
+		if results[i] != nil {
+			if _, err = tx.Exec("ROLLBACK TO append_request"); err != nil {
+				break
+			}
+			results[i] = w.checkReplay(stmts, req.events, results[i])
+			if results[i] != nil {
+				log.Info().Err(results[i]).Msg("Aborted transaction")
+			}
+		}
+		if _, err = tx.Exec("RELEASE append_request"); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		log.Info().Err(err).Msg("Aborted group commit")
+		w.lastTimestamp = lastTimestamp
+		for _, req := range batch {
+			req.result <- err
+		}
+		return
+	}
+	w.committed.notify()
+	for i, req := range batch {
+		req.result <- results[i]
+	}
+}
+
+// writeRequest checks the expectations and the condition of a request and writes its events.
+func (w *eventWriter) writeRequest(tx *sql.Tx, stmts writerStatements, req *appendRequest) error {
+	if req.deletion != nil {
+		return w.writeDeletion(tx, stmts, req.deletion)
+	}
+	if req.retention != nil {
+		return w.writeRetention(tx, req.retention)
+	}
+	if req.archive != nil {
+		return w.writeArchive(tx, req.archive)
+	}
+	if req.compaction != nil {
+		return w.writeCompaction(tx, req.compaction)
+	}
+	err := w.checkNotDeleted(stmts.selectVersion, req.events)
+	if err != nil {
+		return err
+	}
+	for _, expectation := range req.expectations {
+		err := w.checkExpectation(stmts.selectVersion, expectation)
+		if err != nil {
+			return err
+		}
+	}
+	if req.condition != nil {
+		err := checkCondition(tx, req.condition)
+		if err != nil {
+			return err
+		}
+	}
+	return w.writeEvents(stmts, req.events)
+}
+
+// checkExpectation compares the current version of an aggregate to the expected one.
+func (w *eventWriter) checkExpectation(selectVersion *sql.Stmt, expectation versionExpectation) error {
+	if expectation.version == models.AnyVersion {
+		return nil
+	}
+	var v0, v1 int32
+	var deleted string
+	current := models.NoStream
+	err := selectVersion.QueryRow(expectation.aggregateId).Scan(&v0, &v1, &deleted)
+	if err != nil && err != sql.ErrNoRows {
+		log.Info().Err(err).Msg("Error reading aggregate version")
+		return err
+	}
+	if err == nil {
+		current, err = helper.MergeInt62(v0, v1)
+		if err != nil {
+			return err
+		}
+	}
+	if current != expectation.version {
+		return &customerrors.WrongExpectedVersionError{
+			AggregateId:     expectation.aggregateId,
+			ExpectedVersion: expectation.version,
+			CurrentVersion:  current,
+		}
+	}
+	return nil
+}
+
+// checkNotDeleted rejects requests appending to a deleted aggregate.
+func (w *eventWriter) checkNotDeleted(selectVersion *sql.Stmt, events []*eventEntity) error {
+	checked := map[string]bool{}
+	for _, event := range events {
+		if checked[event.AggregateId] {
+			continue
+		}
+		checked[event.AggregateId] = true
+		var v0, v1 int32
+		var deleted string
+		err := selectVersion.QueryRow(event.AggregateId).Scan(&v0, &v1, &deleted)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Info().Err(err).Msg("Error reading aggregate state")
+			return err
+		}
+		if len(deleted) > 0 {
+			return &customerrors.AggregateDeletedError{AggregateId: event.AggregateId, Mode: models.DeletionMode(deleted)}
+		}
+	}
+	return nil
+}
+
+// writeDeletion marks an aggregate as deleted. A hard deletion removes its events
+// and tags and writes the tombstone as the only remaining event of the aggregate.
+// Deleting an aggregate again succeeds without changes unless a soft deletion
+// becomes a hard one.
+func (w *eventWriter) writeDeletion(tx *sql.Tx, stmts writerStatements, deletion *aggregateDeletion) error {
+	var v0, v1 int32
+	var aggregateType, deleted string
+	err := tx.QueryRow("SELECT version_0, version_1, type, deleted FROM aggregate_state WHERE id = ?", deletion.aggregateId).Scan(&v0, &v1, &aggregateType, &deleted)
+	if err == sql.ErrNoRows {
+		return &customerrors.AggregateNotFoundError{}
+	}
+	if err != nil {
+		log.Info().Err(err).Msg("Error reading aggregate state")
+		return err
+	}
+	if deleted == string(models.HardDelete) || deleted == string(deletion.mode) {
+		return nil
+	}
+	if deletion.mode == models.SoftDelete {
+		_, err = tx.Exec("UPDATE aggregate_state SET deleted = ? WHERE id = ?", models.SoftDelete, deletion.aggregateId)
+		return err
+	}
+
+	version, err := helper.MergeInt62(v0, v1)
+	if err != nil {
+		return err
+	}
+	if err = recordRemovedEvents(tx, "aggregateId = ?", deletion.aggregateId); err != nil {
+		return err
+	}
+	statements := []string{
+		"DELETE FROM event_tags WHERE eventId IN (SELECT id FROM events WHERE aggregateId = ?)",
+		"DELETE FROM events WHERE aggregateId = ?",
+	}
+	for _, query := range statements {
+		if _, err = tx.Exec(query, deletion.aggregateId); err != nil {
+			log.Info().Err(err).Msg("Error removing events of deleted aggregate")
+			return err
+		}
+	}
+	tombstone := deletion.tombstone
+	tombstone.AggregateType = aggregateType
+	tombstone.Version = version + 1
+	tombstone.timestamp = w.nextTimestamp()
+	head, err := chainHead(stmts.selectHash, deletion.aggregateId)
+	if err != nil {
+		return err
+	}
+	tombstone.chain(head)
+	if err = w.writeEvent(stmts, tombstone); err != nil {
+		return err
+	}
+	v0, v1, err = helper.SplitInt62(tombstone.Version)
+	if err != nil {
+		return err
+	}
+	u0, u1, err := helper.SplitInt62(tombstone.timestamp.UnixMicro())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE aggregate_state
+		SET deleted = ?, version_0 = ?, version_1 = ?, event_count = 1, updated_0 = ?, updated_1 = ?, hash = ?, truncatedHash = ?
+		WHERE id = ?`, models.HardDelete, v0, v1, u0, u1, tombstone.hash, head, deletion.aggregateId)
+	return err
+}
+
+// recordRemovedEvents keeps the position of the events matching the condition
+// before they are removed, so feeds can continue after them.
+func recordRemovedEvents(tx *sql.Tx, condition string, args ...any) error {
+	_, err := tx.Exec(`
+		INSERT OR IGNORE INTO removed_events (id, timestamp_0, timestamp_1)
+		SELECT id, timestamp_0, timestamp_1 FROM events WHERE `+condition, args...)
+	if err != nil {
+		log.Info().Err(err).Msg("Error recording removed events")
+	}
+	return err
+}
+
+// aggregateChange summarizes the events a request adds to one aggregate.
+type aggregateChange struct {
+	aggregateId   string
+	aggregateType string
+	version       int64
+	count         int64
+	first         time.Time
+	last          time.Time
+	// hash is the hash of the last event, the new head of the hash chain
+	hash []byte
+}
+
+// writeEvents inserts the events of a single request and updates the state
+// of every touched aggregate once.
+func (w *eventWriter) writeEvents(stmts writerStatements, events []*eventEntity) error {
+	changes := []*aggregateChange{}
+	byAggregate := map[string]*aggregateChange{}
+	for _, event := range events {
+		change, ok := byAggregate[event.AggregateId]
+		if !ok {
+			head, err := chainHead(stmts.selectHash, event.AggregateId)
+			if err != nil {
+				return err
+			}
+			change = &aggregateChange{
+				aggregateId:   event.AggregateId,
+				aggregateType: event.AggregateType,
+				hash:          head,
+			}
+			byAggregate[event.AggregateId] = change
+			changes = append(changes, change)
+		}
+		event.timestamp = w.nextTimestamp()
+		event.appendId = events[0].timestamp.UnixMicro()
+		event.chain(change.hash)
+		err := w.writeEvent(stmts, event)
+		if err != nil {
+			return err
+		}
+		if change.count == 0 {
+			change.first = event.timestamp
+		}
+		change.count++
+		change.last = event.timestamp
+		change.hash = event.hash
+		if event.Version > change.version {
+			change.version = event.Version
+		}
+	}
+	for _, change := range changes {
+		err := w.writeAggregateChange(stmts.upsertAggregate, change)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextTimestamp returns the current time in microseconds, but always strictly
+// greater than the previous timestamp to keep the global order unique.
+func (w *eventWriter) nextTimestamp() time.Time {
+	ts := time.Now().UnixMicro()
+	if ts <= w.lastTimestamp {
+		ts = w.lastTimestamp + 1
+	}
+	w.lastTimestamp = ts
+	return time.UnixMicro(ts)
+}
+
+// writeEvent inserts a single event and its tags.
+func (w *eventWriter) writeEvent(stmts writerStatements, event *eventEntity) error {
+	t0, t1, err := helper.SplitInt62(event.timestamp.UnixMicro())
+	if err != nil {
+		return err
+	}
+
+	v0, v1, err := helper.SplitInt62(event.Version)
+	if err != nil {
+		return err
+	}
+
+	var tags []byte
+	if len(event.Tags) > 0 {
+		tags, err = json.Marshal(event.Tags)
+		if err != nil {
+			return err
+		}
+	}
+
+	stored := event.stored
+	_, err = stmts.insertEvent.Exec(event.id, event.AggregateId, event.AggregateType, t0, t1, event.Name, v0, v1, stored.data, tags, event.SchemaVersion, event.ContentType, event.Subject, stored.dataKey, stored.codec, stored.dictionary, event.hash, event.prevHash, event.dataHash, event.SigningKeyId, event.Signature, event.appendId)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return &customerrors.DuplicateVersionError{}
+		}
+		return err
+	}
+	for _, tag := range event.Tags {
+		_, err = stmts.insertTag.Exec(tag, event.id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAggregateChange creates or updates the aggregate_state row of an aggregate.
+func (w *eventWriter) writeAggregateChange(upsertAggregate *sql.Stmt, change *aggregateChange) error {
+	v0, v1, err := helper.SplitInt62(change.version)
+	if err != nil {
+		return err
+	}
+	c0, c1, err := helper.SplitInt62(change.first.UnixMicro())
+	if err != nil {
+		return err
+	}
+	u0, u1, err := helper.SplitInt62(change.last.UnixMicro())
+	if err != nil {
+		return err
+	}
+	_, err = upsertAggregate.Exec(change.aggregateId, change.aggregateType, v0, v1, change.count, c0, c1, u0, u1, change.hash)
+	return err
+}
+
+// checkReplay decides whether a request that failed with a duplicate or an
+// unexpected version is an exact replay of already committed events. Requests
+// without events are never replays. Replays succeed without writing anything,
+// events reusing the id of a different event fail with an EventIdConflictError
+// and every other failure is returned unchanged.
+func (w *eventWriter) checkReplay(stmts writerStatements, events []*eventEntity, failure error) error {
+	var duplicate *customerrors.DuplicateVersionError
+	var wrongVersion *customerrors.WrongExpectedVersionError
+	if !errors.As(failure, &duplicate) && !errors.As(failure, &wrongVersion) {
+		return failure
+	}
+	replay := len(events) > 0
+	for _, event := range events {
+		var stored models.Event
+		var v0, v1 int32
+		var storedTags []byte
+		data := storedData{eventId: event.id.String()}
+		err := stmts.selectEvent.QueryRow(event.id).Scan(&stored.AggregateId, &stored.AggregateType, &stored.Name, &v0, &v1, &data.data, &storedTags, &stored.SchemaVersion, &stored.ContentType, &stored.Subject, &data.dataKey, &data.codec, &data.dictionary, &data.segment, &stored.SigningKeyId, &stored.Signature)
+		if err == sql.ErrNoRows {
+			replay = false
+			continue
+		}
+		if err != nil {
+			log.Info().Err(err).Msg("Error reading event for replay check")
+			return failure
+		}
+		stored.Version, err = helper.MergeInt62(v0, v1)
+		if err != nil {
+			return failure
+		}
+		data.subject = stored.Subject
+		stored.Data, err = w.data.decode(data)
+		if err != nil {
+			return failure
+		}
+		var tags []byte
+		if len(event.Tags) > 0 {
+			tags, err = json.Marshal(event.Tags)
+			if err != nil {
+				return failure
+			}
+		}
+		if stored.AggregateId != event.AggregateId || stored.AggregateType != event.AggregateType ||
+			stored.Name != event.Name || stored.Version != event.Version || stored.SchemaVersion != event.SchemaVersion ||
+			stored.ContentType != event.ContentType || stored.Subject != event.Subject ||
+			!bytes.Equal(stored.Data, event.Data) || !bytes.Equal(storedTags, tags) ||
+			stored.SigningKeyId != event.SigningKeyId || !bytes.Equal(stored.Signature, event.Signature) {
+			return &customerrors.EventIdConflictError{}
+		}
+	}
+	if !replay {
+		return failure
+	}
+	log.Debug().Msg("Request is a replay of committed events")
+	return nil
+}
@@ -0,0 +1,301 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/helper"
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/rs/zerolog/log"
+)
+
+// exportBatchSize is the number of events read per query by an export and
+// appended per transaction by an import.
+const exportBatchSize = 500
+
+// ExportEvents writes the events matching the filter to w as newline-delimited
+// JSON, one ExportedEvent per line in the global order. The data is exported
+// decrypted and decompressed, as stored; upcasters are not applied. The fields of
+// the hash chain and the signatures are exported with the events. Deleted
+// aggregates are skipped: neither the events of soft deleted aggregates nor the
+// tombstones of hard deleted ones are exported, so an import cannot bring them
+// back as aggregates that can be read and appended to. It returns the number of
+// exported events and an EventNotFoundError if After or Until is not the id of an
+// event.
+func (e *EventRepository) ExportEvents(filter models.ExportFilter, w io.Writer) (int64, error) {
+	var from0, from1 int32
+	var to0, to1 int32 = math.MaxInt32, math.MaxInt32
+	if len(filter.After) > 0 {
+		t0, t1, found, err := e.getEventTimestamp(filter.After)
+		if err != nil {
+			return 0, err
+		}
+		if !found {
+			return 0, &customerrors.EventNotFoundError{}
+		}
+		from0, from1 = t0, t1
+	}
+	if len(filter.Until) > 0 {
+		t0, t1, found, err := e.getEventTimestamp(filter.Until)
+		if err != nil {
+			return 0, err
+		}
+		if !found {
+			return 0, &customerrors.EventNotFoundError{}
+		}
+		to0, to1 = t0, t1
+	}
+	conditions := []string{
+		"(events.timestamp_0, events.timestamp_1) <= (?, ?)",
+		"events.aggregateId NOT IN (SELECT id FROM aggregate_state WHERE deleted != '')",
+	}
+	args := []any{to0, to1}
+	if len(filter.AggregateId) > 0 {
+		conditions = append(conditions, "events.aggregateId = ?")
+		args = append(args, filter.AggregateId)
+	}
+	if len(filter.AggregateType) > 0 {
+		conditions = append(conditions, "events.aggregateType = ?")
+		args = append(args, filter.AggregateType)
+	}
+	query := `
+		SELECT ` + eventColumns + `, events.timestamp_0, events.timestamp_1, events.appendId, events.prevHash, events.dataHash
+		FROM events
+		WHERE (events.timestamp_0, events.timestamp_1) > (?, ?) AND ` + strings.Join(conditions, " AND ") + `
+		ORDER BY events.timestamp_0, events.timestamp_1
+		LIMIT ?
+	`
+	stmt, err := e.store.Prepare(query)
+	if err != nil {
+		log.Info().Err(err).Msg("Error preparing statement")
+		return 0, errors.New("could not prepare statement for export")
+	}
+	defer stmt.Close()
+
+	encoder := json.NewEncoder(w)
+	var exported int64
+	for {
+		batch, err := e.exportBatch(stmt, append([]any{from0, from1}, append(args, exportBatchSize)...))
+		if err != nil {
+			return exported, err
+		}
+		// the rows are closed before writing, so a slow reader does not keep the query open
+		for _, line := range batch {
+			if err = encoder.Encode(line.ExportedEvent); err != nil {
+				return exported, err
+			}
+			exported++
+		}
+		if len(batch) < exportBatchSize {
+			return exported, nil
+		}
+		from0, from1 = batch[len(batch)-1].t0, batch[len(batch)-1].t1
+	}
+}
+
+type exportLine struct {
+	models.ExportedEvent
+	t0 int32
+	t1 int32
+}
+
+func (e *EventRepository) exportBatch(stmt *sql.Stmt, args []any) ([]exportLine, error) {
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		log.Info().Err(err).Msg("Error running query statement")
+		return nil, errors.New("could not query events to export")
+	}
+	defer rows.Close()
+	batch := []exportLine{}
+	for rows.Next() {
+		var line exportLine
+		var prevHash, dataHash []byte
+		line.Event, err = scanEvent(rows, e.data, &line.t0, &line.t1, &line.AppendId, &prevHash, &dataHash)
+		if err != nil {
+			return nil, err
+		}
+		line.PrevHash = hex.EncodeToString(prevHash)
+		line.DataHash = hex.EncodeToString(dataHash)
+		timestamp, err := helper.MergeInt62(line.t0, line.t1)
+		if err != nil {
+			return nil, err
+		}
+		line.Timestamp = time.UnixMicro(timestamp).UTC()
+		batch = append(batch, line)
+	}
+	if err = rows.Err(); err != nil {
+		log.Info().Err(err).Msg("Error checking row errors")
+		return nil, errors.New("could not retrieve all events to export")
+	}
+	return batch, nil
+}
+
+// ImportEvents appends the events of an export read from r in the order of its
+// lines. Ids, versions, metadata and signatures are kept, the events get new
+// timestamps so they follow the events already in the store and are chained
+// anew. The events of one transaction of the exporting store are appended in one
+// transaction again. Lines already imported are accepted as replays, so a failed
+// import can be repeated with the same input. The events are not checked against
+// the schemas and producer keys of the store: the exporting store accepted them
+// and their history is checked with the hash chain instead, so revoked or unknown
+// keys and changed schemas do not stop an import. A line whose hash chain fields
+// do not match it, a tombstone (exports skip deleted aggregates), or any other
+// conflict stops the import with an ImportError naming the line, or the first
+// line of the rejected transaction; all lines before it are imported. It returns
+// the number of imported lines.
+func (e *EventRepository) ImportEvents(r io.Reader) (int64, error) {
+	reader := bufio.NewReader(r)
+	var imported int64
+	batch := &importBatch{}
+	// heads are the hashes of the lines read last for every aggregate
+	heads := map[string]string{}
+	line := 0
+	for {
+		content, readErr := reader.ReadBytes('\n')
+		// rejected is set if the line cannot be imported, after appending the lines before it
+		var rejected *customerrors.ImportError
+		if readErr != nil && readErr != io.EOF {
+			rejected = &customerrors.ImportError{Line: line + 1, Reason: "could not read input", Err: readErr}
+		}
+		if len(content) > 0 {
+			line++
+		}
+		content = bytes.TrimSpace(content)
+		if rejected == nil && len(content) > 0 {
+			var exported models.ExportedEvent
+			err := json.Unmarshal(content, &exported)
+			if err != nil || len(exported.Event.Id) == 0 || len(exported.Event.AggregateId) == 0 {
+				rejected = &customerrors.ImportError{Line: line, Reason: "line is not an exported event"}
+			} else if exported.Event.Name == models.TombstoneEventName {
+				rejected = &customerrors.ImportError{Line: line, Reason: "tombstones of deleted aggregates cannot be imported"}
+			} else if reason := checkExportedChain(exported, heads); len(reason) > 0 {
+				rejected = &customerrors.ImportError{Line: line, Reason: "integrity check failed: " + reason}
+			} else {
+				// a batch only ends between transactions
+				if batch.startsTransaction(exported.AppendId) && len(batch.events) >= exportBatchSize {
+					count, err := e.appendImportBatch(batch)
+					imported += count
+					if err != nil {
+						err.Imported = imported
+						return imported, err
+					}
+				}
+				batch.add(exported, line)
+			}
+		}
+		if len(batch.events) > 0 && (readErr != nil || rejected != nil) {
+			count, err := e.appendImportBatch(batch)
+			imported += count
+			if err != nil {
+				rejected = err
+			}
+		}
+		if rejected != nil {
+			rejected.Imported = imported
+			return imported, rejected
+		}
+		if readErr == io.EOF {
+			return imported, nil
+		}
+	}
+}
+
+// importBatch collects the events of an import appended in one transaction.
+type importBatch struct {
+	events []models.Event
+	// lines are the line numbers of the events
+	lines []int
+	// transactions are the indexes of the first events of the transactions of the exporting store
+	transactions []int
+	appendId     int64
+}
+
+// startsTransaction reports whether an event with the append id does not belong
+// to the transaction of the last event. Events without an append id are a
+// transaction of their own.
+func (b *importBatch) startsTransaction(appendId int64) bool {
+	return len(b.events) == 0 || appendId == 0 || appendId != b.appendId
+}
+
+func (b *importBatch) add(exported models.ExportedEvent, line int) {
+	if b.startsTransaction(exported.AppendId) {
+		b.transactions = append(b.transactions, len(b.events))
+	}
+	b.events = append(b.events, exported.Event)
+	b.lines = append(b.lines, line)
+	b.appendId = exported.AppendId
+}
+
+// appendImportBatch appends a batch of events in one transaction and empties the
+// batch. If the batch is rejected, its transactions are appended one by one to
+// find the rejected one.
+func (e *EventRepository) appendImportBatch(batch *importBatch) (int64, *customerrors.ImportError) {
+	defer func() {
+		*batch = importBatch{events: batch.events[:0], lines: batch.lines[:0], transactions: batch.transactions[:0]}
+	}()
+	if e.submitEvents(batch.events) == nil {
+		return int64(len(batch.events)), nil
+	}
+	for i, start := range batch.transactions {
+		end := len(batch.events)
+		if i+1 < len(batch.transactions) {
+			end = batch.transactions[i+1]
+		}
+		err := e.submitEvents(batch.events[start:end])
+		if err != nil {
+			return int64(start), &customerrors.ImportError{Line: batch.lines[start], Reason: err.Error(), Err: err}
+		}
+	}
+	return int64(len(batch.events)), nil
+}
+
+// checkExportedChain checks the hash chain fields of an exported event the way
+// VerifyAggregate does and returns why they do not match it, or an empty string.
+// The first line of an aggregate may link to an event that is not exported. The
+// data of events with a subject cannot be checked, its digest is keyed with the
+// subject key of the exporting store.
+func checkExportedChain(exported models.ExportedEvent, heads map[string]string) string {
+	event := exported.Event
+	head, seen := heads[event.AggregateId]
+	heads[event.AggregateId] = event.Hash
+	if len(event.Hash) == 0 {
+		// appended before hashing
+		return ""
+	}
+	hash, err := hex.DecodeString(event.Hash)
+	if err != nil {
+		return "hash is not hex encoded"
+	}
+	prevHash, err := hex.DecodeString(exported.PrevHash)
+	if err != nil {
+		return "previous hash is not hex encoded"
+	}
+	dataHash, err := hex.DecodeString(exported.DataHash)
+	if err != nil {
+		return "data hash is not hex encoded"
+	}
+	if seen && head != exported.PrevHash {
+		return "link to the previous event is broken"
+	}
+	// the digest of data with a subject is keyed with the subject key of the exporting store
+	if len(event.Subject) == 0 {
+		sum := sha256.Sum256(event.Data)
+		if !bytes.Equal(sum[:], dataHash) {
+			return "data does not match its digest"
+		}
+	}
+	if !bytes.Equal(eventHash(prevHash, event.Id, event, exported.Timestamp.UnixMicro(), dataHash), hash) {
+		return "hash does not match the event"
+	}
+	return ""
+}
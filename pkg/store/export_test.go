@@ -0,0 +1,292 @@
+package store_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func exportLines(t *testing.T, r *store.EventRepository, filter models.ExportFilter) []models.ExportedEvent {
+	var out bytes.Buffer
+	count, err := r.ExportEvents(filter, &out)
+	assert.NoError(t, err)
+	lines := []models.ExportedEvent{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		var exported models.ExportedEvent
+		assert.NoError(t, json.Unmarshal([]byte(line), &exported))
+		lines = append(lines, exported)
+	}
+	assert.Equal(t, int64(len(lines)), count)
+	return lines
+}
+
+func TestExportEventsFiltered(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "ticker1", "ticker", 600)
+	addStream(t, r, "order1", "order", 3)
+	addStream(t, r, "order2", "order", 2)
+
+	all := exportLines(t, r, models.ExportFilter{})
+	assert.Len(t, all, 605)
+	for i := 1; i < len(all); i++ {
+		assert.True(t, all[i-1].Timestamp.Before(all[i].Timestamp))
+	}
+	assert.Equal(t, []byte("600"), all[599].Event.Data)
+	assert.Equal(t, []string{"ticker"}, all[0].Event.Tags)
+
+	assert.Len(t, exportLines(t, r, models.ExportFilter{AggregateType: "order"}), 5)
+	assert.Len(t, exportLines(t, r, models.ExportFilter{AggregateId: "order2"}), 2)
+	ranged := exportLines(t, r, models.ExportFilter{After: all[598].Event.Id, Until: all[601].Event.Id})
+	assert.Len(t, ranged, 3)
+	assert.Equal(t, all[599].Event.Id, ranged[0].Event.Id)
+	ranged = exportLines(t, r, models.ExportFilter{AggregateType: "order", After: all[598].Event.Id, Until: all[601].Event.Id})
+	assert.Len(t, ranged, 2)
+
+	_, err = r.ExportEvents(models.ExportFilter{After: "unknown"}, &bytes.Buffer{})
+	assert.IsType(t, &customerrors.EventNotFoundError{}, err)
+}
+
+func TestImportExportedEvents(t *testing.T) {
+	db := setup()
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "ticker2", "ticker", 3)
+	err = r.AddEvents([]models.Event{{Version: 1, Name: "placed", Data: []byte(`{"total":3}`), AggregateId: "order3", AggregateType: "order", ContentType: models.JSONContentType, SchemaVersion: 2, Subject: "customer3"}})
+	assert.NoError(t, err)
+	var export bytes.Buffer
+	_, err = r.ExportEvents(models.ExportFilter{}, &export)
+	assert.NoError(t, err)
+	original, err := r.GetEventsSinceEvent("", 10)
+	assert.NoError(t, err)
+	r.Close()
+	teardown(db)
+
+	db = setup()
+	defer teardown(db)
+	conn, err = db.GetDbConnection()
+	assert.NoError(t, err)
+	r = store.NewEventRepository(conn)
+	addStream(t, r, "existing1", "existing", 1)
+	imported, err := r.ImportEvents(bytes.NewReader(export.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), imported)
+	imported, err = r.ImportEvents(bytes.NewReader(export.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), imported)
+
+	events, err := r.GetEventsSinceEvent("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 5)
+	assert.Equal(t, "existing1", events[0].AggregateId)
+	// imported events are chained with their new timestamps
+	for i := range original {
+		assert.NotEmpty(t, events[i+1].Hash)
+		original[i].Hash, events[i+1].Hash = "", ""
+	}
+	assert.Equal(t, original, events[1:])
+}
+
+func TestImportSkipsAppendChecks(t *testing.T) {
+	db := setup()
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	_, err = r.ProducerKeys().RegisterKey(models.ProducerKey{Id: "producer-1", PublicKey: public})
+	assert.NoError(t, err)
+	signed := models.Event{Version: 1, Name: "placed", Data: []byte(`{"total":3}`), AggregateId: "order4", AggregateType: "order", ContentType: models.JSONContentType}
+	signed.Sign("producer-1", private)
+	assert.NoError(t, r.AddEvents([]models.Event{signed}))
+	_, err = r.ProducerKeys().RevokeKey("producer-1")
+	assert.NoError(t, err)
+	var export bytes.Buffer
+	_, err = r.ExportEvents(models.ExportFilter{}, &export)
+	assert.NoError(t, err)
+	r.Close()
+	teardown(db)
+
+	db = setup()
+	defer teardown(db)
+	conn, err = db.GetDbConnection()
+	assert.NoError(t, err)
+	r = store.NewEventRepository(conn)
+	assert.NoError(t, r.Schemas().RegisterSchema("order", "placed", 1, []byte(`{"type": "object", "required": ["currency"]}`)))
+	// the key is unknown to this store and the event no longer matches the schema
+	imported, err := r.ImportEvents(bytes.NewReader(export.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), imported)
+	events, err := r.GetEventsForAggregate("order4")
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "producer-1", events[0].SigningKeyId)
+	assert.Equal(t, signed.Signature, events[0].Signature)
+}
+
+func TestExportSkipsDeletedAggregates(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "kept5", "ticker", 2)
+	addStream(t, r, "soft5", "ticker", 2)
+	addStream(t, r, "hard5", "ticker", 2)
+	assert.NoError(t, r.DeleteAggregate("soft5", models.SoftDelete))
+	assert.NoError(t, r.DeleteAggregate("hard5", models.HardDelete))
+
+	lines := exportLines(t, r, models.ExportFilter{})
+	assert.Len(t, lines, 2)
+	for _, line := range lines {
+		assert.Equal(t, "kept5", line.Event.AggregateId)
+	}
+
+	tombstone, err := json.Marshal(models.ExportedEvent{Event: models.Event{Id: "0b7a3b2e-6a51-4a8f-9a39-3f1f3c0d2f20", Version: 3, Name: models.TombstoneEventName, AggregateId: "hard6", AggregateType: "ticker"}})
+	assert.NoError(t, err)
+	_, err = r.ImportEvents(bytes.NewReader(tombstone))
+	var importErr *customerrors.ImportError
+	assert.ErrorAs(t, err, &importErr)
+	assert.Equal(t, 1, importErr.Line)
+	_, err = r.GetAggregate("hard6")
+	assert.IsType(t, &customerrors.AggregateNotFoundError{}, err)
+}
+
+func TestImportStopsAtConflict(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	assert.NoError(t, r.AddEvents([]models.Event{{Id: "6f1d2a3b-4c5d-4e6f-8a9b-0c1d2e3f4a01", Version: 1, Name: "ticked", Data: []byte("1"), AggregateId: "ticker3", AggregateType: "ticker"}}))
+
+	line := func(id string, version int64, data string) string {
+		content, err := json.Marshal(models.ExportedEvent{Event: models.Event{Id: id, Version: version, Name: "ticked", Data: []byte(data), AggregateId: "ticker4", AggregateType: "ticker"}})
+		assert.NoError(t, err)
+		return string(content)
+	}
+	input := strings.Join([]string{
+		line("6f1d2a3b-4c5d-4e6f-8a9b-0c1d2e3f4a02", 1, "1"),
+		"",
+		line("6f1d2a3b-4c5d-4e6f-8a9b-0c1d2e3f4a03", 2, "2"),
+		line("6f1d2a3b-4c5d-4e6f-8a9b-0c1d2e3f4a01", 3, "3"),
+		line("6f1d2a3b-4c5d-4e6f-8a9b-0c1d2e3f4a04", 4, "4"),
+	}, "\n")
+	imported, err := r.ImportEvents(strings.NewReader(input))
+	assert.Equal(t, int64(2), imported)
+	var importErr *customerrors.ImportError
+	assert.True(t, errors.As(err, &importErr))
+	assert.Equal(t, 4, importErr.Line)
+	assert.Equal(t, int64(2), importErr.Imported)
+	assert.IsType(t, &customerrors.EventIdConflictError{}, errors.Unwrap(err))
+	events, err := r.GetEventsForAggregate("ticker4")
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+
+	_, err = r.ImportEvents(strings.NewReader(fmt.Sprintf("%s\n{\"event\":{}}\n", line("6f1d2a3b-4c5d-4e6f-8a9b-0c1d2e3f4a05", 3, "3"))))
+	assert.True(t, errors.As(err, &importErr))
+	assert.Equal(t, 2, importErr.Line)
+	assert.Equal(t, int64(1), importErr.Imported)
+	assert.Nil(t, importErr.Err)
+	events, err = r.GetEventsForAggregate("ticker4")
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+}
+
+func TestImportKeepsTransactions(t *testing.T) {
+	db := setup()
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "ticker5", "ticker", 1)
+	err = r.AddEvents([]models.Event{
+		{Version: 1, Name: "placed", Data: []byte("1"), AggregateId: "order5", AggregateType: "order"},
+		{Version: 1, Name: "reserved", Data: []byte("1"), AggregateId: "stock5", AggregateType: "stock"},
+	})
+	assert.NoError(t, err)
+	lines := exportLines(t, r, models.ExportFilter{})
+	assert.Len(t, lines, 3)
+	assert.NotEqual(t, lines[0].AppendId, lines[1].AppendId)
+	assert.Equal(t, lines[1].AppendId, lines[2].AppendId)
+	assert.NotEmpty(t, lines[1].DataHash)
+	r.Close()
+	teardown(db)
+
+	db = setup()
+	defer teardown(db)
+	conn, err = db.GetDbConnection()
+	assert.NoError(t, err)
+	r = store.NewEventRepository(conn)
+	addStream(t, r, "stock5", "stock", 1)
+	var export bytes.Buffer
+	for _, line := range lines {
+		assert.NoError(t, json.NewEncoder(&export).Encode(line))
+	}
+	imported, err := r.ImportEvents(&export)
+	assert.Equal(t, int64(1), imported)
+	var importErr *customerrors.ImportError
+	assert.True(t, errors.As(err, &importErr))
+	assert.Equal(t, 2, importErr.Line)
+	// the conflict of the second event of the transaction rejects the first one as well
+	events, err := r.GetEventsForAggregate("order5")
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func TestImportChecksHashChain(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "ticker6", "ticker", 3)
+	lines := exportLines(t, r, models.ExportFilter{})
+
+	encode := func(lines []models.ExportedEvent) *bytes.Buffer {
+		var export bytes.Buffer
+		for _, line := range lines {
+			assert.NoError(t, json.NewEncoder(&export).Encode(line))
+		}
+		return &export
+	}
+	imported, err := r.ImportEvents(encode(lines))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), imported)
+
+	tampered := append([]models.ExportedEvent{}, lines...)
+	tampered[1].Event.Data = []byte("20")
+	_, err = r.ImportEvents(encode(tampered))
+	var importErr *customerrors.ImportError
+	assert.True(t, errors.As(err, &importErr))
+	assert.Equal(t, 2, importErr.Line)
+	assert.Contains(t, importErr.Reason, "digest")
+
+	tampered = append([]models.ExportedEvent{}, lines...)
+	tampered[2].Event.Name = "tocked"
+	_, err = r.ImportEvents(encode(tampered))
+	assert.True(t, errors.As(err, &importErr))
+	assert.Equal(t, 3, importErr.Line)
+	assert.Contains(t, importErr.Reason, "hash does not match")
+
+	// dropping a line breaks the link of the next one
+	_, err = r.ImportEvents(encode([]models.ExportedEvent{lines[0], lines[2]}))
+	assert.True(t, errors.As(err, &importErr))
+	assert.Equal(t, 2, importErr.Line)
+	assert.Contains(t, importErr.Reason, "link")
+}
@@ -0,0 +1,186 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/helper"
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/rs/zerolog/log"
+)
+
+// Every event is hashed together with the hash of the event appended before it to
+// the same aggregate, so altering, removing or reordering an event breaks the chain
+// from that event on. The data is covered by the digest of its plaintext, which is
+// stored with the event: the chain stays verifiable after the data was
+// re-encrypted, compressed, archived or its subject key destroyed. The digest of
+// data with a subject is keyed with the subject key, so it does not reveal the
+// data once the key is destroyed. Removing the oldest events of an aggregate
+// records the hash the first remaining event links to in truncatedHash of the
+// aggregate state.
+
+// chain sets the hashes of an event appended after the event with the hash prev.
+// It has to be called after the timestamp of the event is assigned and its data
+// is encoded.
+func (e *eventEntity) chain(prev []byte) {
+	if e.dataHash == nil {
+		sum := sha256.Sum256(e.Data)
+		e.dataHash = sum[:]
+	}
+	e.prevHash = prev
+	e.hash = eventHash(prev, e.id.String(), e.Event, e.timestamp.UnixMicro(), e.dataHash)
+}
+
+// eventHash hashes the previous hash and every stored field of an event, each
+// prefixed with its length, including the signature of signed events.
+func eventHash(prev []byte, id string, event models.Event, timestamp int64, dataHash []byte) []byte {
+	h := sha256.New()
+	field := func(value []byte) {
+		h.Write(binary.AppendUvarint(nil, uint64(len(value))))
+		h.Write(value)
+	}
+	number := func(value int64) {
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(value)))
+	}
+	field(prev)
+	field([]byte(id))
+	field([]byte(event.AggregateId))
+	field([]byte(event.AggregateType))
+	field([]byte(event.Name))
+	number(event.Version)
+	number(timestamp)
+	number(int64(event.SchemaVersion))
+	field([]byte(event.ContentType))
+	field([]byte(event.Subject))
+	var tags []byte
+	if len(event.Tags) > 0 {
+		tags, _ = json.Marshal(event.Tags)
+	}
+	field(tags)
+	field(dataHash)
+	// the signature is only hashed if present, so chains of unsigned events stay as they were
+	if len(event.Signature) > 0 {
+		field([]byte(event.SigningKeyId))
+		field(event.Signature)
+	}
+	return h.Sum(nil)
+}
+
+// chainHead reads the hash of the event last appended to an aggregate. It is nil
+// for new aggregates and aggregates whose events were appended before hashing.
+func chainHead(selectHash *sql.Stmt, aggregateId string) ([]byte, error) {
+	var hash []byte
+	err := selectHash.QueryRow(aggregateId).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Info().Err(err).Msg("Error reading hash of aggregate")
+		return nil, err
+	}
+	return hash, nil
+}
+
+// VerifyAggregate walks the hash chain of an aggregate in the order its events
+// were appended and reports the first broken link. Every event has to link to the
+// hash of the event before it, its hash has to match its content and its data has
+// to match the digest it was appended with; data of destroyed subject keys is not
+// checked. The first event may only link to removed events if their removal was
+// recorded, events appended before hashing may only precede the chain and the last
+// event has to be the head recorded for the aggregate. It returns an
+// AggregateNotFoundError if the aggregate does not exist.
+func (e *EventRepository) VerifyAggregate(aggregateId string) (*models.ChainVerification, error) {
+	if _, err := e.GetAggregate(aggregateId); err != nil {
+		return nil, err
+	}
+	var head, truncated []byte
+	err := e.store.QueryRow("SELECT hash, truncatedHash FROM aggregate_state WHERE id = ?", aggregateId).Scan(&head, &truncated)
+	if err != nil {
+		log.Info().Err(err).Msg("Error reading hash of aggregate")
+		return nil, errors.New("could not query events to verify")
+	}
+	rows, err := e.store.Query(`
+		SELECT `+eventColumns+`, events.timestamp_0, events.timestamp_1, events.prevHash, events.dataHash
+		FROM events
+		WHERE events.aggregateId = ?
+		ORDER BY events.timestamp_0, events.timestamp_1`, aggregateId)
+	if err != nil {
+		log.Info().Err(err).Msg("Error running query statement")
+		return nil, errors.New("could not query events to verify")
+	}
+	defer rows.Close()
+
+	verification := &models.ChainVerification{AggregateId: aggregateId}
+	expected := truncated
+	var last models.Event
+	chained := false
+	for rows.Next() {
+		var t0, t1 int32
+		var prevHash, dataHash []byte
+		event, err := scanEvent(rows, e.data, &t0, &t1, &prevHash, &dataHash)
+		if err != nil && len(event.Id) == 0 {
+			return nil, err
+		}
+		broken := func(reason string) *models.ChainVerification {
+			verification.BrokenLink = &models.BrokenLink{EventId: event.Id, Version: event.Version, Reason: reason}
+			return verification
+		}
+		if err != nil {
+			return broken("data cannot be read: " + err.Error()), nil
+		}
+		last = event
+		hash, _ := hex.DecodeString(event.Hash)
+		if len(hash) == 0 {
+			if chained {
+				return broken("event is not chained after chained events"), nil
+			}
+			verification.UnchainedEvents++
+			continue
+		}
+		if !bytes.Equal(prevHash, expected) {
+			return broken("link to the previous event is broken"), nil
+		}
+		if !chained && len(prevHash) > 0 {
+			verification.Truncated = true
+		}
+		chained = true
+		// the data of a destroyed subject key cannot be checked, only its digest is chained
+		shredded := len(event.Subject) > 0 && event.Data == nil
+		if !shredded {
+			digest, err := e.data.digest(event.Subject, event.Data)
+			if err != nil {
+				return nil, err
+			}
+			// events with a subject chained before their digest was keyed have a plain one
+			legacy := sha256.Sum256(event.Data)
+			if !bytes.Equal(digest, dataHash) && (len(event.Subject) == 0 || !bytes.Equal(legacy[:], dataHash)) {
+				return broken("data does not match its digest"), nil
+			}
+		}
+		timestamp, err := helper.MergeInt62(t0, t1)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(eventHash(prevHash, event.Id, event, timestamp, dataHash), hash) {
+			return broken("hash does not match the event"), nil
+		}
+		verification.VerifiedEvents++
+		verification.Head = hex.EncodeToString(hash)
+		expected = hash
+	}
+	if err = rows.Err(); err != nil {
+		log.Info().Err(err).Msg("Error checking row errors")
+		return nil, errors.New("could not verify all events")
+	}
+	if !bytes.Equal(expected, head) {
+		verification.BrokenLink = &models.BrokenLink{EventId: last.Id, Version: last.Version, Reason: "last event is not the head of the aggregate"}
+		return verification, nil
+	}
+	verification.Valid = true
+	return verification, nil
+}
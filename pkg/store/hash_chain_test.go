@@ -0,0 +1,187 @@
+package store_test
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashChainIsVerified(t *testing.T) {
+	t.Setenv(store.MasterKeyEnv, newMasterKey(t))
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "audited1", "audited", 3)
+	assert.NoError(t, r.AddEvents([]models.Event{{Version: 4, Name: "signed", Data: largePayload(4), AggregateId: "audited1", AggregateType: "audited", Subject: "customer4"}}))
+	addStream(t, r, "other1", "other", 2)
+
+	events, err := r.GetEventsForAggregate("audited1")
+	assert.NoError(t, err)
+	assert.Len(t, events, 4)
+	for _, event := range events {
+		assert.Len(t, event.Hash, 64)
+	}
+	assert.NotEqual(t, events[0].Hash, events[1].Hash)
+
+	verification, err := r.VerifyAggregate("audited1")
+	assert.NoError(t, err)
+	assert.True(t, verification.Valid)
+	assert.Equal(t, int64(4), verification.VerifiedEvents)
+	assert.Equal(t, events[3].Hash, verification.Head)
+	assert.False(t, verification.Truncated)
+
+	// the chain survives archiving and the destruction of a subject key
+	_, err = r.ArchiveEvents(0)
+	assert.NoError(t, err)
+	assert.NoError(t, r.DestroySubjectKey("customer4"))
+	verification, err = r.VerifyAggregate("audited1")
+	assert.NoError(t, err)
+	assert.True(t, verification.Valid)
+	assert.Equal(t, int64(4), verification.VerifiedEvents)
+
+	_, err = r.VerifyAggregate("unknown")
+	assert.IsType(t, &customerrors.AggregateNotFoundError{}, err)
+}
+
+func TestHashChainReportsFirstBrokenLink(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "tampered1", "tampered", 4)
+	addStream(t, r, "tampered2", "tampered", 4)
+	addStream(t, r, "tampered3", "tampered", 4)
+
+	_, err = conn.Exec("UPDATE events SET Name = 'altered' WHERE aggregateId = 'tampered1' AND version_1 IN (2, 3)")
+	assert.NoError(t, err)
+	verification, err := r.VerifyAggregate("tampered1")
+	assert.NoError(t, err)
+	assert.False(t, verification.Valid)
+	assert.Equal(t, int64(1), verification.VerifiedEvents)
+	assert.Equal(t, int64(2), verification.BrokenLink.Version)
+	assert.Equal(t, "hash does not match the event", verification.BrokenLink.Reason)
+
+	_, err = conn.Exec("UPDATE events SET data = X'39' WHERE aggregateId = 'tampered2' AND version_1 = 3")
+	assert.NoError(t, err)
+	verification, err = r.VerifyAggregate("tampered2")
+	assert.NoError(t, err)
+	assert.False(t, verification.Valid)
+	assert.Equal(t, int64(3), verification.BrokenLink.Version)
+	assert.Equal(t, "data does not match its digest", verification.BrokenLink.Reason)
+
+	_, err = conn.Exec("DELETE FROM events WHERE aggregateId = 'tampered3' AND version_1 = 2")
+	assert.NoError(t, err)
+	verification, err = r.VerifyAggregate("tampered3")
+	assert.NoError(t, err)
+	assert.False(t, verification.Valid)
+	assert.Equal(t, int64(3), verification.BrokenLink.Version)
+	assert.Equal(t, "link to the previous event is broken", verification.BrokenLink.Reason)
+
+	// removing the oldest or the newest events is only valid through retention or deletion
+	addStream(t, r, "tampered4", "tampered", 3)
+	_, err = conn.Exec("DELETE FROM events WHERE aggregateId = 'tampered4' AND version_1 = 1")
+	assert.NoError(t, err)
+	verification, err = r.VerifyAggregate("tampered4")
+	assert.NoError(t, err)
+	assert.False(t, verification.Valid)
+	assert.Equal(t, int64(2), verification.BrokenLink.Version)
+	assert.Equal(t, "link to the previous event is broken", verification.BrokenLink.Reason)
+
+	addStream(t, r, "tampered5", "tampered", 3)
+	_, err = conn.Exec("DELETE FROM events WHERE aggregateId = 'tampered5' AND version_1 = 3")
+	assert.NoError(t, err)
+	verification, err = r.VerifyAggregate("tampered5")
+	assert.NoError(t, err)
+	assert.False(t, verification.Valid)
+	assert.Equal(t, int64(2), verification.VerifiedEvents)
+	assert.Equal(t, "last event is not the head of the aggregate", verification.BrokenLink.Reason)
+
+	addStream(t, r, "tampered6", "tampered", 3)
+	_, err = conn.Exec("UPDATE events SET hash = NULL WHERE aggregateId = 'tampered6' AND version_1 = 2")
+	assert.NoError(t, err)
+	verification, err = r.VerifyAggregate("tampered6")
+	assert.NoError(t, err)
+	assert.False(t, verification.Valid)
+	assert.Equal(t, int64(2), verification.BrokenLink.Version)
+	assert.Equal(t, "event is not chained after chained events", verification.BrokenLink.Reason)
+}
+
+func TestHashChainKeysDigestOfSubjectData(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	assert.NoError(t, r.AddEvents([]models.Event{
+		{Version: 1, Name: "registered", Data: []byte(`{"name":"Jane"}`), AggregateId: "person1", AggregateType: "person", Subject: "person1"},
+		{Version: 2, Name: "moved", Data: []byte(`{"city":"Berlin"}`), AggregateId: "person1", AggregateType: "person"},
+	}))
+	digests := [][]byte{}
+	rows, err := conn.Query("SELECT dataHash FROM events WHERE aggregateId = 'person1' ORDER BY version_1")
+	assert.NoError(t, err)
+	for rows.Next() {
+		var digest []byte
+		assert.NoError(t, rows.Scan(&digest))
+		digests = append(digests, digest)
+	}
+	rows.Close()
+	plain := sha256.Sum256([]byte(`{"name":"Jane"}`))
+	assert.NotEqual(t, plain[:], digests[0])
+	plain = sha256.Sum256([]byte(`{"city":"Berlin"}`))
+	assert.Equal(t, plain[:], digests[1])
+
+	verification, err := r.VerifyAggregate("person1")
+	assert.NoError(t, err)
+	assert.True(t, verification.Valid)
+	assert.NoError(t, r.DestroySubjectKey("person1"))
+	verification, err = r.VerifyAggregate("person1")
+	assert.NoError(t, err)
+	assert.True(t, verification.Valid)
+	assert.Equal(t, int64(2), verification.VerifiedEvents)
+}
+
+func TestHashChainAfterTruncationAndLegacyEvents(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "truncated1", "truncated", 5)
+	assert.NoError(t, r.RetentionPolicies().SetPolicy(models.RetentionPolicy{AggregateType: "truncated", MaxCount: 2}))
+	_, err = r.ApplyRetention()
+	assert.NoError(t, err)
+	verification, err := r.VerifyAggregate("truncated1")
+	assert.NoError(t, err)
+	assert.True(t, verification.Valid)
+	assert.True(t, verification.Truncated)
+	assert.Equal(t, int64(2), verification.VerifiedEvents)
+
+	// a hard deletion leaves the tombstone linked to the removed events
+	addStream(t, r, "deleted1", "deleted", 2)
+	assert.NoError(t, r.DeleteAggregate("deleted1", models.HardDelete))
+	verification, err = r.VerifyAggregate("deleted1")
+	assert.NoError(t, err)
+	assert.True(t, verification.Valid)
+	assert.True(t, verification.Truncated)
+	assert.Equal(t, int64(1), verification.VerifiedEvents)
+
+	// events appended before hashing start a new chain
+	addStream(t, r, "legacy1", "legacy", 2)
+	_, err = conn.Exec("UPDATE events SET hash = NULL, prevHash = NULL, dataHash = NULL WHERE aggregateId = 'legacy1'")
+	assert.NoError(t, err)
+	_, err = conn.Exec("UPDATE aggregate_state SET hash = NULL WHERE id = 'legacy1'")
+	assert.NoError(t, err)
+	assert.NoError(t, r.AddEvents([]models.Event{{Version: 3, Name: "ticked", Data: []byte("3"), AggregateId: "legacy1", AggregateType: "legacy"}}))
+	verification, err = r.VerifyAggregate("legacy1")
+	assert.NoError(t, err)
+	assert.True(t, verification.Valid)
+	assert.Equal(t, int64(2), verification.UnchainedEvents)
+	assert.Equal(t, int64(1), verification.VerifiedEvents)
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+)
+
+// MasterKeyEnv holds the base64 encoded 32 byte master key that wraps the data keys.
+const MasterKeyEnv = "EVTSRC_MASTER_KEY"
+
+// MasterKeyFileEnv names a file holding the base64 encoded master key. It takes
+// precedence over MasterKeyEnv.
+const MasterKeyFileEnv = "EVTSRC_MASTER_KEY_FILE"
+
+// PreviousMasterKeysEnv holds comma separated base64 encoded master keys that were
+// replaced. Data keys still wrapped with one of them are rewrapped with the
+// current master key when the store is opened.
+const PreviousMasterKeysEnv = "EVTSRC_PREVIOUS_MASTER_KEYS"
+
+// MasterKeys are the current and the previous master keys used for encryption at rest.
+type MasterKeys struct {
+	Current  []byte
+	Previous [][]byte
+}
+
+// LoadMasterKeys reads the master keys from the environment. It returns nil
+// without an error if no master key is configured.
+func LoadMasterKeys() (*MasterKeys, error) {
+	encoded := os.Getenv(MasterKeyEnv)
+	if path := os.Getenv(MasterKeyFileEnv); len(path) > 0 {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.New("could not read master key file")
+		}
+		encoded = string(content)
+	}
+	if len(strings.TrimSpace(encoded)) == 0 {
+		return nil, nil
+	}
+	current, err := decodeMasterKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	keys := &MasterKeys{Current: current}
+	for _, previous := range strings.Split(os.Getenv(PreviousMasterKeysEnv), ",") {
+		if len(strings.TrimSpace(previous)) == 0 {
+			continue
+		}
+		key, err := decodeMasterKey(previous)
+		if err != nil {
+			return nil, err
+		}
+		keys.Previous = append(keys.Previous, key)
+	}
+	return keys, nil
+}
+
+func decodeMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("master key must be 32 base64 encoded bytes")
+	}
+	return key, nil
+}
+
+// masterKeyId identifies a master key without revealing it.
+func masterKeyId(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// byId returns the current or previous master key with the given id, or nil if
+// none of them has it.
+func (m *MasterKeys) byId(id string) []byte {
+	if masterKeyId(m.Current) == id {
+		return m.Current
+	}
+	for _, previous := range m.Previous {
+		if masterKeyId(previous) == id {
+			return previous
+		}
+	}
+	return nil
+}
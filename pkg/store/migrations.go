@@ -0,0 +1,133 @@
+package store
+
+import (
+	"database/sql"
+
+	"github.com/rs/zerolog/log"
+)
+
+// hasColumn reports whether the table has a column with the given name.
+func hasColumn(db preparer, table string, column string) (bool, error) {
+	stmt, err := db.Prepare("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?")
+	if err != nil {
+		log.Info().Err(err).Msg("Preparing statement for table info")
+		return false, err
+	}
+	defer stmt.Close()
+	var count int
+	err = stmt.QueryRow(table, column).Scan(&count)
+	if err != nil {
+		log.Info().Err(err).Msg("Reading table info")
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// addColumnIfMissing adds a column to a table created by an older version.
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	if err != nil {
+		log.Info().Err(err).Msgf("Adding column %s to %s table", column, table)
+	}
+	return err
+}
+
+// migrateLegacyAggregateState moves databases that stored one aggregate_state
+// row per event to the layout with the aggregate type on the event row and a
+// single aggregate_state row per aggregate.
+func migrateLegacyAggregateState(db *sql.DB) error {
+	migrated, err := hasColumn(db, "events", "aggregateType")
+	if err != nil || migrated {
+		return err
+	}
+	log.Info().Msg("Migrating aggregate_state to one row per aggregate")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		"ALTER TABLE events ADD COLUMN aggregateType TEXT",
+		`UPDATE events SET aggregateType = (
+			SELECT aggregate_state.type FROM aggregate_state
+			WHERE aggregate_state.id = events.aggregateId
+				AND aggregate_state.version_0 = events.version_0
+				AND aggregate_state.version_1 = events.version_1)`,
+		"DROP TABLE aggregate_state",
+	}
+	for _, query := range statements {
+		if _, err = tx.Exec(query); err != nil {
+			tx.Rollback()
+			log.Info().Err(err).Msg("Migrating legacy aggregate_state")
+			return err
+		}
+	}
+	if err = createAggregateStateTable(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO aggregate_state (id, type, version_0, version_1, event_count, created_0, created_1, updated_0, updated_1)
+		SELECT aggregateId,
+			(SELECT first.aggregateType FROM events first WHERE first.aggregateId = grouped.aggregateId
+				ORDER BY first.version_0, first.version_1 LIMIT 1),
+			MAX(version_0 * 2147483648 + version_1) >> 31,
+			MAX(version_0 * 2147483648 + version_1) & 2147483647,
+			COUNT(*),
+			MIN(timestamp_0 * 2147483648 + timestamp_1) >> 31,
+			MIN(timestamp_0 * 2147483648 + timestamp_1) & 2147483647,
+			MAX(timestamp_0 * 2147483648 + timestamp_1) >> 31,
+			MAX(timestamp_0 * 2147483648 + timestamp_1) & 2147483647
+		FROM events grouped
+		GROUP BY aggregateId`)
+	if err != nil {
+		tx.Rollback()
+		log.Info().Err(err).Msg("Filling aggregate_state from events")
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateUnversionedSchemas moves the schemas of databases that kept one schema
+// per aggregate type and event name to version 1 of the versioned layout.
+func migrateUnversionedSchemas(db *sql.DB) error {
+	exists, err := hasColumn(db, "event_schemas", "schema")
+	if err != nil || !exists {
+		return err
+	}
+	migrated, err := hasColumn(db, "event_schemas", "version")
+	if err != nil || migrated {
+		return err
+	}
+	log.Info().Msg("Migrating event_schemas to one schema per version")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("ALTER TABLE event_schemas RENAME TO event_schemas_unversioned"); err != nil {
+		tx.Rollback()
+		log.Info().Err(err).Msg("Migrating unversioned event_schemas")
+		return err
+	}
+	if err = createEventSchemaTable(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	statements := []string{
+		"INSERT INTO event_schemas (aggregateType, name, version, schema) SELECT aggregateType, name, 1, schema FROM event_schemas_unversioned",
+		"DROP TABLE event_schemas_unversioned",
+	}
+	for _, query := range statements {
+		if _, err = tx.Exec(query); err != nil {
+			tx.Rollback()
+			log.Info().Err(err).Msg("Migrating unversioned event_schemas")
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,208 @@
+package store
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/rs/zerolog/log"
+)
+
+// ProducerKeys stores the ed25519 public keys of producers and verifies the
+// signatures of appended events against them. Keys are never removed, only
+// revoked, so the signatures of stored events stay verifiable.
+type ProducerKeys struct {
+	store  *sql.DB
+	mu     sync.RWMutex
+	cached map[string]*models.ProducerKey
+}
+
+// NewProducerKeys creates a new ProducerKeys.
+func NewProducerKeys(db *sql.DB) *ProducerKeys {
+	return &ProducerKeys{
+		store:  db,
+		cached: map[string]*models.ProducerKey{},
+	}
+}
+
+// RegisterKey stores a producer key. Registering the same key again returns the
+// stored one; a different key with the id of a registered key fails with a
+// ProducerKeyConflictError. It returns an InvalidProducerKeyError if the id is
+// empty or the key is not an ed25519 public key.
+func (p *ProducerKeys) RegisterKey(key models.ProducerKey) (*models.ProducerKey, error) {
+	if len(strings.TrimSpace(key.Id)) == 0 {
+		return nil, &customerrors.InvalidProducerKeyError{Reason: "id is empty"}
+	}
+	if len(key.PublicKey) != ed25519.PublicKeySize {
+		return nil, &customerrors.InvalidProducerKeyError{Reason: "public key has to be a 32 byte ed25519 key"}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.store.Exec(`
+		INSERT INTO producer_keys (id, producer, publicKey, registeredAt) VALUES (?,?,?,?)
+		ON CONFLICT(id) DO NOTHING
+	`, key.Id, key.Producer, key.PublicKey, time.Now().UnixMicro())
+	if err != nil {
+		log.Info().Err(err).Msg("Error storing producer key")
+		return nil, errors.New("could not store producer key")
+	}
+	stored, err := p.load(key.Id)
+	if err != nil {
+		return nil, err
+	}
+	if stored.Producer != key.Producer || !bytes.Equal(stored.PublicKey, key.PublicKey) {
+		return nil, &customerrors.ProducerKeyConflictError{}
+	}
+	p.cached[key.Id] = stored
+	return stored, nil
+}
+
+// GetKey retrieves a producer key. It returns a ProducerKeyNotFoundError if there is none.
+func (p *ProducerKeys) GetKey(id string) (*models.ProducerKey, error) {
+	return p.load(id)
+}
+
+// ListKeys retrieves all producer keys, including revoked ones, ordered by id.
+func (p *ProducerKeys) ListKeys() ([]models.ProducerKey, error) {
+	rows, err := p.store.Query("SELECT id, producer, publicKey, registeredAt, revokedAt FROM producer_keys ORDER BY id")
+	if err != nil {
+		log.Info().Err(err).Msg("Error running query statement")
+		return nil, errors.New("could not query producer keys")
+	}
+	defer rows.Close()
+	keys := []models.ProducerKey{}
+	for rows.Next() {
+		key, err := scanProducerKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	if err = rows.Err(); err != nil {
+		log.Info().Err(err).Msg("Error checking row errors")
+		return nil, errors.New("could not retrieve all producer keys")
+	}
+	return keys, nil
+}
+
+// RevokeKey revokes a producer key; events signed with it are rejected from now
+// on. Revoking a revoked key keeps its revocation time. It returns a
+// ProducerKeyNotFoundError if there is no such key.
+func (p *ProducerKeys) RevokeKey(id string) (*models.ProducerKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.store.Exec("UPDATE producer_keys SET revokedAt = ? WHERE id = ? AND revokedAt = 0", time.Now().UnixMicro(), id)
+	if err != nil {
+		log.Info().Err(err).Msg("Error revoking producer key")
+		return nil, errors.New("could not revoke producer key")
+	}
+	delete(p.cached, id)
+	return p.load(id)
+}
+
+// Verify checks the signatures of all signed events. Unsigned events are
+// accepted. It returns an InvalidSignatureError for the first event whose
+// signature is incomplete, made with an unknown or revoked key or does not
+// match the event.
+func (p *ProducerKeys) Verify(events []models.Event) error {
+	for i, event := range events {
+		err := p.verify(i, event)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *ProducerKeys) verify(index int, event models.Event) error {
+	if len(event.SigningKeyId) == 0 && len(event.Signature) == 0 {
+		return nil
+	}
+	invalid := func(reason string) error {
+		return &customerrors.InvalidSignatureError{EventIndex: index, SigningKeyId: event.SigningKeyId, Reason: reason}
+	}
+	if len(event.SigningKeyId) == 0 || len(event.Signature) == 0 {
+		return invalid("signature and signing key id have to be set together")
+	}
+	key, err := p.lookup(event.SigningKeyId)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return invalid("producer key is not registered")
+	}
+	if key.RevokedAt != nil {
+		return invalid("producer key was revoked")
+	}
+	if !event.VerifySignature(key.PublicKey) {
+		return invalid("signature does not match the event")
+	}
+	return nil
+}
+
+// lookup returns the producer key with the id, loading it on first use.
+// It returns nil if no key is registered.
+func (p *ProducerKeys) lookup(id string) (*models.ProducerKey, error) {
+	p.mu.RLock()
+	key, ok := p.cached[id]
+	p.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok = p.cached[id]; ok {
+		return key, nil
+	}
+	key, err := p.load(id)
+	var notFound *customerrors.ProducerKeyNotFoundError
+	if errors.As(err, &notFound) {
+		// unknown ids are not cached, they may be registered any time
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.cached[id] = key
+	return key, nil
+}
+
+func (p *ProducerKeys) load(id string) (*models.ProducerKey, error) {
+	rows, err := p.store.Query("SELECT id, producer, publicKey, registeredAt, revokedAt FROM producer_keys WHERE id = ?", id)
+	if err != nil {
+		log.Info().Err(err).Msg("Error running query statement")
+		return nil, errors.New("could not query producer key")
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			log.Info().Err(err).Msg("Error checking row errors")
+			return nil, errors.New("could not query producer key")
+		}
+		return nil, &customerrors.ProducerKeyNotFoundError{}
+	}
+	return scanProducerKey(rows)
+}
+
+func scanProducerKey(rows *sql.Rows) (*models.ProducerKey, error) {
+	var key models.ProducerKey
+	var registeredAt, revokedAt int64
+	err := rows.Scan(&key.Id, &key.Producer, &key.PublicKey, &registeredAt, &revokedAt)
+	if err != nil {
+		log.Info().Err(err).Msg("Error scanning rows")
+		return nil, errors.New("could not retrieve producer key")
+	}
+	key.RegisteredAt = time.UnixMicro(registeredAt).UTC()
+	if revokedAt > 0 {
+		revoked := time.UnixMicro(revokedAt).UTC()
+		key.RevokedAt = &revoked
+	}
+	return &key, nil
+}
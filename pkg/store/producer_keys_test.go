@@ -0,0 +1,107 @@
+package store_test
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterProducerKeys(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	keys := store.NewProducerKeys(conn)
+	public, _, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	registered, err := keys.RegisterKey(models.ProducerKey{Id: "billing-1", Producer: "billing", PublicKey: public})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(public), registered.PublicKey)
+	assert.False(t, registered.RegisteredAt.IsZero())
+	again, err := keys.RegisterKey(models.ProducerKey{Id: "billing-1", Producer: "billing", PublicKey: public})
+	assert.NoError(t, err)
+	assert.Equal(t, registered, again)
+
+	other, _, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	_, err = keys.RegisterKey(models.ProducerKey{Id: "billing-1", Producer: "billing", PublicKey: other})
+	assert.IsType(t, &customerrors.ProducerKeyConflictError{}, err)
+	_, err = keys.RegisterKey(models.ProducerKey{Id: "short", PublicKey: []byte{1, 2}})
+	assert.IsType(t, &customerrors.InvalidProducerKeyError{}, err)
+	_, err = keys.RegisterKey(models.ProducerKey{PublicKey: public})
+	assert.IsType(t, &customerrors.InvalidProducerKeyError{}, err)
+
+	revoked, err := keys.RevokeKey("billing-1")
+	assert.NoError(t, err)
+	assert.NotNil(t, revoked.RevokedAt)
+	_, err = keys.RevokeKey("unknown")
+	assert.IsType(t, &customerrors.ProducerKeyNotFoundError{}, err)
+	_, err = keys.GetKey("unknown")
+	assert.IsType(t, &customerrors.ProducerKeyNotFoundError{}, err)
+	listed, err := keys.ListKeys()
+	assert.NoError(t, err)
+	assert.Equal(t, []models.ProducerKey{*revoked}, listed)
+}
+
+func TestSignedEventsAreVerifiedOnAppend(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	_, err = r.ProducerKeys().RegisterKey(models.ProducerKey{Id: "orders-1", Producer: "orders", PublicKey: public})
+	assert.NoError(t, err)
+
+	signed := func(version int64) models.Event {
+		event := models.Event{Version: version, Name: "placed", Data: []byte(`{"total": 3}`), AggregateId: "order1", AggregateType: "order", ContentType: models.JSONContentType}
+		event.Sign("orders-1", private)
+		return event
+	}
+	assert.NoError(t, r.AddEvents([]models.Event{signed(1), {Version: 2, Name: "noted", Data: []byte("2"), AggregateId: "order1", AggregateType: "order"}}))
+	assert.NoError(t, r.AppendToAggregates([]models.StreamAppend{{AggregateId: "order1", ExpectedVersion: 2, Events: []models.Event{signed(3)}}}))
+
+	events, err := r.GetEventsForAggregate("order1")
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+	assert.Equal(t, "orders-1", events[0].SigningKeyId)
+	assert.True(t, events[0].VerifySignature(public))
+	assert.Empty(t, events[1].Signature)
+	assert.True(t, events[2].VerifySignature(public))
+	verification, err := r.VerifyAggregate("order1")
+	assert.NoError(t, err)
+	assert.True(t, verification.Valid)
+
+	tampered := signed(4)
+	tampered.Data = []byte(`{"total": 300}`)
+	err = r.AddEvents([]models.Event{signed(4), tampered})
+	assert.Equal(t, &customerrors.InvalidSignatureError{EventIndex: 1, SigningKeyId: "orders-1", Reason: "signature does not match the event"}, err)
+	unknown := signed(4)
+	unknown.SigningKeyId = "unknown"
+	err = r.AddEvents([]models.Event{unknown})
+	assert.Equal(t, "producer key is not registered", err.(*customerrors.InvalidSignatureError).Reason)
+	incomplete := signed(4)
+	incomplete.Signature = nil
+	assert.IsType(t, &customerrors.InvalidSignatureError{}, r.AddEvents([]models.Event{incomplete}))
+	// the index counts the events of all appends
+	err = r.AppendToAggregates([]models.StreamAppend{
+		{AggregateId: "order2", ExpectedVersion: models.NoStream, Events: []models.Event{{Version: 1, Name: "noted", Data: []byte("1"), AggregateType: "order"}}},
+		{AggregateId: "order1", ExpectedVersion: 3, Events: []models.Event{tampered}},
+	})
+	assert.Equal(t, &customerrors.InvalidSignatureError{EventIndex: 1, SigningKeyId: "orders-1", Reason: "signature does not match the event"}, err)
+
+	_, err = r.ProducerKeys().RevokeKey("orders-1")
+	assert.NoError(t, err)
+	err = r.AddEvents([]models.Event{signed(4)})
+	assert.Equal(t, "producer key was revoked", err.(*customerrors.InvalidSignatureError).Reason)
+	events, err = r.GetEventsForAggregate("order1")
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+	assert.True(t, events[0].VerifySignature(public))
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/helper"
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/rs/zerolog/log"
+)
+
+// RetentionInterval is how often the retention job of the server applies the policies.
+const RetentionInterval = time.Minute
+
+// RetentionPolicies stores the retention policies per aggregate type.
+type RetentionPolicies struct {
+	store *sql.DB
+}
+
+// NewRetentionPolicies creates a new RetentionPolicies.
+func NewRetentionPolicies(db *sql.DB) *RetentionPolicies {
+	return &RetentionPolicies{store: db}
+}
+
+// SetPolicy stores the retention policy of an aggregate type, replacing an existing one.
+func (r *RetentionPolicies) SetPolicy(policy models.RetentionPolicy) error {
+	if policy.MaxAgeSeconds < 0 || policy.MaxCount < 0 || policy.TruncateBeforeVersion < 0 {
+		return errors.New("retention limits must not be negative")
+	}
+	v0, v1, err := helper.SplitInt62(policy.TruncateBeforeVersion)
+	if err != nil {
+		return err
+	}
+	_, err = r.store.Exec(`
+		INSERT INTO retention_policies (aggregateType, maxAgeSeconds, maxCount, truncateBefore_0, truncateBefore_1) VALUES (?,?,?,?,?)
+		ON CONFLICT(aggregateType) DO UPDATE SET
+			maxAgeSeconds = excluded.maxAgeSeconds,
+			maxCount = excluded.maxCount,
+			truncateBefore_0 = excluded.truncateBefore_0,
+			truncateBefore_1 = excluded.truncateBefore_1
+	`, policy.AggregateType, policy.MaxAgeSeconds, policy.MaxCount, v0, v1)
+	if err != nil {
+		log.Info().Err(err).Msg("Error storing retention policy")
+		return errors.New("could not store retention policy")
+	}
+	return nil
+}
+
+// GetPolicy retrieves the retention policy of an aggregate type. It returns a
+// RetentionPolicyNotFoundError if there is none.
+func (r *RetentionPolicies) GetPolicy(aggregateType string) (*models.RetentionPolicy, error) {
+	rows, err := r.store.Query(`
+		SELECT aggregateType, maxAgeSeconds, maxCount, truncateBefore_0, truncateBefore_1
+		FROM retention_policies WHERE aggregateType = ?`, aggregateType)
+	if err != nil {
+		log.Info().Err(err).Msg("Error running query statement")
+		return nil, errors.New("could not query retention policy")
+	}
+	defer rows.Close()
+	policies, err := scanRetentionPolicies(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(policies) == 0 {
+		return nil, &customerrors.RetentionPolicyNotFoundError{}
+	}
+	return &policies[0], nil
+}
+
+// ListPolicies retrieves all retention policies ordered by aggregate type.
+func (r *RetentionPolicies) ListPolicies() ([]models.RetentionPolicy, error) {
+	rows, err := r.store.Query(`
+		SELECT aggregateType, maxAgeSeconds, maxCount, truncateBefore_0, truncateBefore_1
+		FROM retention_policies ORDER BY aggregateType`)
+	if err != nil {
+		log.Info().Err(err).Msg("Error running query statement")
+		return nil, errors.New("could not query retention policies")
+	}
+	defer rows.Close()
+	return scanRetentionPolicies(rows)
+}
+
+// DeletePolicy removes the retention policy of an aggregate type. Removed events
+// stay removed. It returns a RetentionPolicyNotFoundError if there is none.
+func (r *RetentionPolicies) DeletePolicy(aggregateType string) error {
+	result, err := r.store.Exec("DELETE FROM retention_policies WHERE aggregateType = ?", aggregateType)
+	if err != nil {
+		log.Info().Err(err).Msg("Error deleting retention policy")
+		return errors.New("could not delete retention policy")
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return &customerrors.RetentionPolicyNotFoundError{}
+	}
+	return nil
+}
+
+func scanRetentionPolicies(rows *sql.Rows) ([]models.RetentionPolicy, error) {
+	policies := []models.RetentionPolicy{}
+	for rows.Next() {
+		var policy models.RetentionPolicy
+		var v0, v1 int32
+		err := rows.Scan(&policy.AggregateType, &policy.MaxAgeSeconds, &policy.MaxCount, &v0, &v1)
+		if err != nil {
+			log.Info().Err(err).Msg("Error scanning rows")
+			return nil, errors.New("could not retrieve retention policy")
+		}
+		policy.TruncateBeforeVersion, err = helper.MergeInt62(v0, v1)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	if err := rows.Err(); err != nil {
+		log.Info().Err(err).Msg("Error checking row errors")
+		return nil, errors.New("could not retrieve all retention policies")
+	}
+	return policies, nil
+}
+
+// retentionRun removes the events exceeding the retention policies instead of
+// appending events. removed is set by the writer.
+type retentionRun struct {
+	policies []models.RetentionPolicy
+	now      time.Time
+	removed  int64
+}
+
+// writeRetention removes the events of every policy and updates the event count
+// of the touched aggregates. Aggregates keep their version, so appends continue
+// after the removed events.
+func (w *eventWriter) writeRetention(tx *sql.Tx, run *retentionRun) error {
+	for _, policy := range run.policies {
+		conditions := []string{}
+		args := []any{policy.AggregateType}
+		if policy.MaxAgeSeconds > 0 {
+			t0, t1, err := helper.SplitInt62(run.now.Add(-time.Duration(policy.MaxAgeSeconds) * time.Second).UnixMicro())
+			if err != nil {
+				return err
+			}
+			conditions = append(conditions, "(timestamp_0, timestamp_1) < (?, ?)")
+			args = append(args, t0, t1)
+		}
+		if policy.TruncateBeforeVersion > 0 {
+			v0, v1, err := helper.SplitInt62(policy.TruncateBeforeVersion)
+			if err != nil {
+				return err
+			}
+			conditions = append(conditions, "(version_0, version_1) < (?, ?)")
+			args = append(args, v0, v1)
+		}
+		if policy.MaxCount > 0 {
+			conditions = append(conditions, `id IN (
+				SELECT id FROM (
+					SELECT id, ROW_NUMBER() OVER (PARTITION BY aggregateId ORDER BY version_0 DESC, version_1 DESC) AS position
+					FROM events WHERE aggregateType = ?
+				) WHERE position > ?)`)
+			args = append(args, policy.AggregateType, policy.MaxCount)
+		}
+		if len(conditions) == 0 {
+			continue
+		}
+		where := "aggregateType = ? AND (" + strings.Join(conditions, " OR ") + ")"
+
+		// the removed events are the oldest of their aggregates, the first remaining
+		// event links to the newest of them
+		_, err := tx.Exec(`
+			UPDATE aggregate_state SET truncatedHash = (
+				SELECT hash FROM events WHERE events.aggregateId = aggregate_state.id AND `+where+`
+				ORDER BY timestamp_0 DESC, timestamp_1 DESC LIMIT 1)
+			WHERE id IN (SELECT aggregateId FROM events WHERE `+where+`)`, append(slices.Clone(args), args...)...)
+		if err != nil {
+			log.Info().Err(err).Msg("Error recording truncation of aggregates")
+			return errors.New("could not apply retention policy")
+		}
+		if err = recordRemovedEvents(tx, where, args...); err != nil {
+			return errors.New("could not apply retention policy")
+		}
+		_, err = tx.Exec("DELETE FROM event_tags WHERE eventId IN (SELECT id FROM events WHERE "+where+")", args...)
+		if err != nil {
+			log.Info().Err(err).Msg("Error removing tags of expired events")
+			return errors.New("could not apply retention policy")
+		}
+		result, err := tx.Exec("DELETE FROM events WHERE "+where, args...)
+		if err != nil {
+			log.Info().Err(err).Msg("Error removing expired events")
+			return errors.New("could not apply retention policy")
+		}
+		removed, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if removed == 0 {
+			continue
+		}
+		_, err = tx.Exec(`
+			UPDATE aggregate_state SET event_count = (SELECT COUNT(*) FROM events WHERE events.aggregateId = aggregate_state.id)
+			WHERE type = ?`, policy.AggregateType)
+		if err != nil {
+			log.Info().Err(err).Msg("Error updating event count")
+			return errors.New("could not apply retention policy")
+		}
+		run.removed += removed
+		log.Debug().Str("aggregateType", policy.AggregateType).Int64("removed", removed).Msg("Applied retention policy")
+	}
+	return nil
+}
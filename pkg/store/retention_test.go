@@ -0,0 +1,132 @@
+package store_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func addStream(t *testing.T, r *store.EventRepository, aggregateId string, aggregateType string, count int) {
+	events := []models.Event{}
+	for i := 1; i <= count; i++ {
+		events = append(events, models.Event{Version: int64(i), Name: "ticked", Data: []byte(fmt.Sprint(i)), AggregateId: aggregateId, AggregateType: aggregateType, Tags: []string{aggregateType}})
+	}
+	assert.NoError(t, r.AddEvents(events))
+}
+
+func TestRetentionPolicies(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	policies := store.NewRetentionPolicies(conn)
+
+	_, err = policies.GetPolicy("session")
+	assert.IsType(t, &customerrors.RetentionPolicyNotFoundError{}, err)
+	assert.IsType(t, &customerrors.RetentionPolicyNotFoundError{}, policies.DeletePolicy("session"))
+	assert.Error(t, policies.SetPolicy(models.RetentionPolicy{AggregateType: "session", MaxCount: -1}))
+
+	assert.NoError(t, policies.SetPolicy(models.RetentionPolicy{AggregateType: "session", MaxCount: 10}))
+	assert.NoError(t, policies.SetPolicy(models.RetentionPolicy{AggregateType: "session", MaxAgeSeconds: 60, TruncateBeforeVersion: 3}))
+	assert.NoError(t, policies.SetPolicy(models.RetentionPolicy{AggregateType: "telemetry", MaxCount: 5}))
+	policy, err := policies.GetPolicy("session")
+	assert.NoError(t, err)
+	assert.Equal(t, models.RetentionPolicy{AggregateType: "session", MaxAgeSeconds: 60, TruncateBeforeVersion: 3}, *policy)
+	list, err := policies.ListPolicies()
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+	assert.NoError(t, policies.DeletePolicy("telemetry"))
+	list, err = policies.ListPolicies()
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+}
+
+func TestRetentionMaxCountAndTruncation(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "telemetry1", "telemetry", 5)
+	addStream(t, r, "telemetry2", "telemetry", 2)
+	addStream(t, r, "session1", "session", 4)
+	addStream(t, r, "order1", "order", 3)
+
+	removed, err := r.ApplyRetention()
+	assert.NoError(t, err)
+	assert.Zero(t, removed)
+	first, err := r.GetEventsSinceEvent(store.FeedStart, 1)
+	assert.NoError(t, err)
+
+	assert.NoError(t, r.RetentionPolicies().SetPolicy(models.RetentionPolicy{AggregateType: "telemetry", MaxCount: 2}))
+	assert.NoError(t, r.RetentionPolicies().SetPolicy(models.RetentionPolicy{AggregateType: "session", TruncateBeforeVersion: 3}))
+	removed, err = r.ApplyRetention()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), removed)
+
+	events, err := r.GetEventsForAggregate("telemetry1")
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, int64(4), events[0].Version)
+	events, err = r.GetEventsForAggregate("telemetry2")
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	events, err = r.GetEventsForAggregate("session1")
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, int64(3), events[0].Version)
+	events, err = r.GetEventsForAggregate("order1")
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+
+	events, err = r.GetEventsSinceEvent("", 100)
+	assert.NoError(t, err)
+	assert.Len(t, events, 9)
+	events, err = r.GetEventsSinceEvent(first[0].Id, 100)
+	assert.NoError(t, err)
+	assert.Len(t, events, 9)
+	events, err = r.GetEventsBeforeEvent(first[0].Id, 100)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+	_, err = r.GetEventsSinceEvent("unknown", 100)
+	assert.IsType(t, &customerrors.EventNotFoundError{}, err)
+	var tags int
+	assert.NoError(t, conn.QueryRow("SELECT COUNT(*) FROM event_tags").Scan(&tags))
+	assert.Equal(t, 9, tags)
+
+	aggregate, err := r.GetAggregate("telemetry1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), aggregate.Version)
+	assert.Equal(t, int64(2), aggregate.EventCount)
+	assert.NoError(t, r.AddEvents([]models.Event{{Version: 6, Name: "ticked", Data: []byte("6"), AggregateId: "telemetry1", AggregateType: "telemetry"}}))
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	addStream(t, r, "session1", "session", 3)
+	addStream(t, r, "session2", "session", 1)
+	// the first two events of session1 were appended long ago
+	_, err = conn.Exec("UPDATE events SET timestamp_0 = 0, timestamp_1 = version_1 WHERE aggregateId = 'session1' AND version_1 < 3")
+	assert.NoError(t, err)
+
+	assert.NoError(t, r.RetentionPolicies().SetPolicy(models.RetentionPolicy{AggregateType: "session", MaxAgeSeconds: 3600}))
+	removed, err := r.ApplyRetention()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), removed)
+
+	events, err := r.GetEventsForAggregate("session1")
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, int64(3), events[0].Version)
+	events, err = r.GetEventsForAggregate("session2")
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+}
@@ -0,0 +1,259 @@
+package store
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/rs/zerolog/log"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// schemaKey identifies the schema of an event.
+type schemaKey struct {
+	aggregateType string
+	name          string
+	version       int
+}
+
+// newSchemaKey returns the key of a schema. Versions below 1 are version 1, like
+// the schema version of events written without one.
+func newSchemaKey(aggregateType string, name string, version int) schemaKey {
+	return schemaKey{aggregateType, name, max(version, 1)}
+}
+
+// SchemaRegistry stores JSON Schemas per aggregate type, event name and schema
+// version and validates event payloads against them.
+type SchemaRegistry struct {
+	store *sql.DB
+	// changes is held for reading by appends from validating their events until
+	// they are committed, and for writing while a schema changes, so events are
+	// never committed after a schema change they were not validated against
+	changes  sync.RWMutex
+	mu       sync.RWMutex
+	compiled map[schemaKey]*jsonschema.Schema
+}
+
+// NewSchemaRegistry creates a new SchemaRegistry.
+func NewSchemaRegistry(db *sql.DB) *SchemaRegistry {
+	return &SchemaRegistry{
+		store:    db,
+		compiled: map[schemaKey]*jsonschema.Schema{},
+	}
+}
+
+// RegisterSchema stores the schema for events with the given aggregate type, name
+// and schema version, replacing an existing one. Each schema version of an event
+// has its own schema, so producers still writing an older version keep being
+// validated against the schema of that version. It returns an InvalidSchemaError
+// if the schema cannot be compiled.
+func (r *SchemaRegistry) RegisterSchema(aggregateType string, name string, version int, schema []byte) error {
+	key := newSchemaKey(aggregateType, name, version)
+	compiled, err := compileSchema(key, schema)
+	if err != nil {
+		return err
+	}
+
+	r.changes.Lock()
+	defer r.changes.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.store.Exec(`
+		INSERT INTO event_schemas (aggregateType, name, version, schema) VALUES (?,?,?,?)
+		ON CONFLICT(aggregateType, name, version) DO UPDATE SET schema = excluded.schema
+	`, key.aggregateType, key.name, key.version, string(schema))
+	if err != nil {
+		log.Info().Err(err).Msg("Error storing schema")
+		return errors.New("could not store schema")
+	}
+	r.compiled[key] = compiled
+	return nil
+}
+
+// GetSchema retrieves the schema for events with the given aggregate type, name
+// and schema version. It returns a SchemaNotFoundError if there is none.
+func (r *SchemaRegistry) GetSchema(aggregateType string, name string, version int) (*models.EventSchema, error) {
+	key := newSchemaKey(aggregateType, name, version)
+	var schema string
+	err := r.store.QueryRow("SELECT schema FROM event_schemas WHERE aggregateType = ? AND name = ? AND version = ?", key.aggregateType, key.name, key.version).Scan(&schema)
+	if err == sql.ErrNoRows {
+		return nil, &customerrors.SchemaNotFoundError{}
+	}
+	if err != nil {
+		log.Info().Err(err).Msg("Error querying schema")
+		return nil, errors.New("could not query schema")
+	}
+	return &models.EventSchema{AggregateType: key.aggregateType, Name: key.name, Version: key.version, Schema: json.RawMessage(schema)}, nil
+}
+
+// ListSchemas retrieves all registered schemas ordered by aggregate type, name and version.
+func (r *SchemaRegistry) ListSchemas() ([]models.EventSchema, error) {
+	rows, err := r.store.Query("SELECT aggregateType, name, version, schema FROM event_schemas ORDER BY aggregateType, name, version")
+	if err != nil {
+		log.Info().Err(err).Msg("Error running query statement")
+		return nil, errors.New("could not query schemas")
+	}
+	defer rows.Close()
+
+	schemas := []models.EventSchema{}
+	for rows.Next() {
+		var schema models.EventSchema
+		var raw string
+		if err = rows.Scan(&schema.AggregateType, &schema.Name, &schema.Version, &raw); err != nil {
+			log.Info().Err(err).Msg("Error scanning rows")
+			return nil, errors.New("could not retrieve schema")
+		}
+		schema.Schema = json.RawMessage(raw)
+		schemas = append(schemas, schema)
+	}
+	if err = rows.Err(); err != nil {
+		log.Info().Err(err).Msg("Error checking row errors")
+		return nil, errors.New("could not retrieve all schemas")
+	}
+	return schemas, nil
+}
+
+// DeleteSchema removes the schema for events with the given aggregate type, name
+// and schema version. It returns a SchemaNotFoundError if there is none.
+func (r *SchemaRegistry) DeleteSchema(aggregateType string, name string, version int) error {
+	key := newSchemaKey(aggregateType, name, version)
+	r.changes.Lock()
+	defer r.changes.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result, err := r.store.Exec("DELETE FROM event_schemas WHERE aggregateType = ? AND name = ? AND version = ?", key.aggregateType, key.name, key.version)
+	if err != nil {
+		log.Info().Err(err).Msg("Error deleting schema")
+		return errors.New("could not delete schema")
+	}
+	r.compiled[key] = nil
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return &customerrors.SchemaNotFoundError{}
+	}
+	return nil
+}
+
+// Validate checks the payloads of all events against the schemas of their
+// schema version. Events without a registered schema are accepted. It returns a
+// SchemaValidationError listing every violation. The schemas may change right
+// after Validate returns; EventRepository keeps them from changing until the
+// validated events are committed.
+func (r *SchemaRegistry) Validate(events []models.Event) error {
+	violations := []models.SchemaViolation{}
+	for i, event := range events {
+		schema, err := r.lookup(newSchemaKey(event.AggregateType, event.Name, event.SchemaVersion))
+		if err != nil {
+			return err
+		}
+		if schema == nil {
+			continue
+		}
+		violations = append(violations, validatePayload(schema, i, event)...)
+	}
+	if len(violations) > 0 {
+		return &customerrors.SchemaValidationError{Violations: violations}
+	}
+	return nil
+}
+
+// lookup returns the compiled schema for the key, loading it on first use.
+// It returns nil if no schema is registered.
+func (r *SchemaRegistry) lookup(key schemaKey) (*jsonschema.Schema, error) {
+	r.mu.RLock()
+	compiled, ok := r.compiled[key]
+	r.mu.RUnlock()
+	if ok {
+		return compiled, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if compiled, ok = r.compiled[key]; ok {
+		return compiled, nil
+	}
+	var schema string
+	err := r.store.QueryRow("SELECT schema FROM event_schemas WHERE aggregateType = ? AND name = ? AND version = ?", key.aggregateType, key.name, key.version).Scan(&schema)
+	if err != nil && err != sql.ErrNoRows {
+		log.Info().Err(err).Msg("Error querying schema")
+		return nil, errors.New("could not query schema")
+	}
+	if err == nil {
+		compiled, err = compileSchema(key, []byte(schema))
+		if err != nil {
+			log.Info().Err(err).Msg("Error compiling stored schema")
+			return nil, err
+		}
+	}
+	r.compiled[key] = compiled
+	return compiled, nil
+}
+
+// compileSchema compiles a JSON Schema. References to external documents are not resolved.
+func compileSchema(key schemaKey, schema []byte) (*jsonschema.Schema, error) {
+	url := fmt.Sprintf("evtsrc:///schemas/%s/%s/%d.json", key.aggregateType, key.name, key.version)
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("loading external schema %s is not supported", s)
+	}
+	err := compiler.AddResource(url, bytes.NewReader(schema))
+	if err != nil {
+		return nil, &customerrors.InvalidSchemaError{Reason: err.Error()}
+	}
+	compiled, err := compiler.Compile(url)
+	if err != nil {
+		return nil, &customerrors.InvalidSchemaError{Reason: err.Error()}
+	}
+	return compiled, nil
+}
+
+// validatePayload validates the payload of a single event.
+func validatePayload(schema *jsonschema.Schema, index int, event models.Event) []models.SchemaViolation {
+	violation := models.SchemaViolation{
+		EventIndex:    index,
+		AggregateType: event.AggregateType,
+		Name:          event.Name,
+	}
+	decoder := json.NewDecoder(bytes.NewReader(event.Data))
+	decoder.UseNumber()
+	var payload any
+	if err := decoder.Decode(&payload); err != nil {
+		violation.Message = "payload is not valid JSON"
+		return []models.SchemaViolation{violation}
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		violation.Message = "payload is not valid JSON"
+		return []models.SchemaViolation{violation}
+	}
+
+	err := schema.Validate(payload)
+	if err == nil {
+		return nil
+	}
+	var validationError *jsonschema.ValidationError
+	if !errors.As(err, &validationError) {
+		violation.Message = err.Error()
+		return []models.SchemaViolation{violation}
+	}
+	violations := []models.SchemaViolation{}
+	var collect func(*jsonschema.ValidationError)
+	collect = func(ve *jsonschema.ValidationError) {
+		if len(ve.Causes) == 0 {
+			violation.InstanceLocation = ve.InstanceLocation
+			violation.KeywordLocation = ve.KeywordLocation
+			violation.Message = ve.Message
+			violations = append(violations, violation)
+			return
+		}
+		for _, cause := range ve.Causes {
+			collect(cause)
+		}
+	}
+	collect(validationError)
+	return violations
+}
@@ -0,0 +1,160 @@
+package store_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+const orderPlacedSchema = `{
+	"type": "object",
+	"properties": {
+		"orderId": {"type": "string"},
+		"amount": {"type": "number", "minimum": 0}
+	},
+	"required": ["orderId", "amount"]
+}`
+
+func placedOrder(version int64, data string) models.Event {
+	return models.Event{
+		Version:       version,
+		Name:          "OrderPlaced",
+		Data:          []byte(data),
+		AggregateId:   "order1",
+		AggregateType: "order",
+	}
+}
+
+func TestAddEventsValidatesAgainstSchema(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	err = r.Schemas().RegisterSchema("order", "OrderPlaced", 1, []byte(orderPlacedSchema))
+	assert.NoError(t, err)
+
+	err = r.AddEvents([]models.Event{placedOrder(1, `{"orderId":"o1","amount":-5}`)})
+	validationError, ok := err.(*customerrors.SchemaValidationError)
+	assert.True(t, ok)
+	assert.Len(t, validationError.Violations, 1)
+	assert.Equal(t, "/amount", validationError.Violations[0].InstanceLocation)
+
+	err = r.AddEvents([]models.Event{placedOrder(1, "not json")})
+	assert.IsType(t, &customerrors.SchemaValidationError{}, err)
+
+	err = r.AddEvents([]models.Event{placedOrder(1, `{"orderId":"o1","amount":5}`)})
+	assert.NoError(t, err)
+
+	// Events without a schema are not validated.
+	err = r.AddEvents([]models.Event{{Version: 2, Name: "OrderShipped", Data: []byte{1, 2, 3}, AggregateId: "order1", AggregateType: "order"}})
+	assert.NoError(t, err)
+}
+
+func TestAppendToAggregatesValidatesAgainstSchema(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	assert.NoError(t, r.Schemas().RegisterSchema("order", "OrderPlaced", 1, []byte(orderPlacedSchema)))
+	err = r.AppendToAggregates([]models.StreamAppend{
+		{AggregateId: "order1", Events: []models.Event{placedOrder(1, `{"orderId":"o1","amount":5}`)}},
+		{AggregateId: "order2", Events: []models.Event{placedOrder(1, `{"amount":5}`)}},
+	})
+	assert.IsType(t, &customerrors.SchemaValidationError{}, err)
+
+	_, _, err = r.GetCurrentVersion("order1")
+	assert.IsType(t, &customerrors.AggregateNotFoundError{}, err)
+}
+
+func TestSchemaRegistryLifecycle(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	schemas := r.Schemas()
+
+	err = schemas.RegisterSchema("order", "OrderPlaced", 1, []byte(`{"type": 5}`))
+	assert.IsType(t, &customerrors.InvalidSchemaError{}, err)
+
+	assert.NoError(t, schemas.RegisterSchema("order", "OrderPlaced", 1, []byte(orderPlacedSchema)))
+	schema, err := schemas.GetSchema("order", "OrderPlaced", 1)
+	assert.NoError(t, err)
+	assert.JSONEq(t, orderPlacedSchema, string(schema.Schema))
+
+	list, err := schemas.ListSchemas()
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	// A fresh registry loads stored schemas lazily.
+	reopened := store.NewSchemaRegistry(conn)
+	err = reopened.Validate([]models.Event{placedOrder(1, `{}`)})
+	assert.IsType(t, &customerrors.SchemaValidationError{}, err)
+
+	assert.NoError(t, schemas.DeleteSchema("order", "OrderPlaced", 1))
+	assert.IsType(t, &customerrors.SchemaNotFoundError{}, schemas.DeleteSchema("order", "OrderPlaced", 1))
+	_, err = schemas.GetSchema("order", "OrderPlaced", 1)
+	assert.IsType(t, &customerrors.SchemaNotFoundError{}, err)
+	assert.NoError(t, r.AddEvents([]models.Event{placedOrder(1, `{}`)}))
+}
+
+func TestSchemasAreKeyedByVersion(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	schemas := r.Schemas()
+
+	assert.NoError(t, schemas.RegisterSchema("order", "OrderPlaced", 1, []byte(orderPlacedSchema)))
+	assert.NoError(t, schemas.RegisterSchema("order", "OrderPlaced", 2, []byte(`{"type": "object", "required": ["orderId", "total"]}`)))
+
+	// events without a schema version are validated with version 1
+	assert.NoError(t, r.AddEvents([]models.Event{placedOrder(1, `{"orderId":"o1","amount":5}`)}))
+	upgraded := placedOrder(2, `{"orderId":"o1","amount":5}`)
+	upgraded.SchemaVersion = 2
+	assert.IsType(t, &customerrors.SchemaValidationError{}, r.AddEvents([]models.Event{upgraded}))
+	upgraded.Data = []byte(`{"orderId":"o1","total":5}`)
+	assert.NoError(t, r.AddEvents([]models.Event{upgraded}))
+
+	schema, err := schemas.GetSchema("order", "OrderPlaced", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, schema.Version)
+	list, err := schemas.ListSchemas()
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+	assert.Equal(t, 2, list[1].Version)
+	_, err = schemas.GetSchema("order", "OrderPlaced", 3)
+	assert.IsType(t, &customerrors.SchemaNotFoundError{}, err)
+}
+
+func TestSetUpMigratesUnversionedSchemas(t *testing.T) {
+	db := setup()
+	teardown(db)
+
+	legacy, err := sql.Open("sqlite3", store.GetDbFileLocation())
+	assert.NoError(t, err)
+	_, err = legacy.Exec("CREATE TABLE event_schemas (aggregateType TEXT, name TEXT, schema TEXT, PRIMARY KEY(aggregateType, name))")
+	assert.NoError(t, err)
+	_, err = legacy.Exec("INSERT INTO event_schemas VALUES (?, ?, ?)", "order", "OrderPlaced", orderPlacedSchema)
+	assert.NoError(t, err)
+	legacy.Close()
+
+	db = &store.DatabaseConnection{}
+	db.SetUp()
+	defer teardown(db)
+	assert.True(t, db.IsInitialized())
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	schema, err := store.NewSchemaRegistry(conn).GetSchema("order", "OrderPlaced", 1)
+	assert.NoError(t, err)
+	assert.JSONEq(t, orderPlacedSchema, string(schema.Schema))
+}
@@ -0,0 +1,281 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+)
+
+// A segment file holds the stored data of archived events. Its layout is
+//
+//	magic | block ... | index | footer
+//
+// Every block is a zstd frame of records, each record the uvarint length of the
+// data followed by the data. The index lists the blocks (offset and length)
+// followed by the events (id, block, offset and length of the record data within
+// the decompressed block). The footer is the offset of the index and the magic.
+// Segment files are never changed once written.
+var segmentMagic = []byte("EVTSEG1\n")
+
+const (
+	// segmentBlockSize is the decompressed size after which a block is closed.
+	segmentBlockSize = 128 << 10
+	// segmentBlockCache is the number of decompressed blocks kept per segment.
+	segmentBlockCache = 8
+)
+
+// segmentRecord is the stored data of an event written to a segment.
+type segmentRecord struct {
+	id   uuid.UUID
+	data []byte
+}
+
+type segmentBlock struct {
+	offset uint64
+	length uint32
+}
+
+type segmentEntry struct {
+	block  uint32
+	offset uint32
+	length uint32
+}
+
+// writeSegment writes the records to a new segment file. The file is written
+// under a temporary name and renamed once it is complete and synced.
+func writeSegment(path string, records []segmentRecord) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = writeSegmentContent(file, records)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func writeSegmentContent(file io.Writer, records []segmentRecord) error {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return err
+	}
+	defer encoder.Close()
+	out := bufio.NewWriter(file)
+	if _, err = out.Write(segmentMagic); err != nil {
+		return err
+	}
+	offset := uint64(len(segmentMagic))
+	blocks := []segmentBlock{}
+	entries := make([]segmentEntry, 0, len(records))
+	var block bytes.Buffer
+	flush := func() error {
+		if block.Len() == 0 {
+			return nil
+		}
+		compressed := encoder.EncodeAll(block.Bytes(), nil)
+		if _, err := out.Write(compressed); err != nil {
+			return err
+		}
+		blocks = append(blocks, segmentBlock{offset: offset, length: uint32(len(compressed))})
+		offset += uint64(len(compressed))
+		block.Reset()
+		return nil
+	}
+	for _, record := range records {
+		block.Write(binary.AppendUvarint(nil, uint64(len(record.data))))
+		entries = append(entries, segmentEntry{block: uint32(len(blocks)), offset: uint32(block.Len()), length: uint32(len(record.data))})
+		block.Write(record.data)
+		if block.Len() >= segmentBlockSize {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err = flush(); err != nil {
+		return err
+	}
+
+	index := binary.BigEndian.AppendUint32(nil, uint32(len(blocks)))
+	for _, b := range blocks {
+		index = binary.BigEndian.AppendUint64(index, b.offset)
+		index = binary.BigEndian.AppendUint32(index, b.length)
+	}
+	index = binary.BigEndian.AppendUint32(index, uint32(len(records)))
+	for i, record := range records {
+		index = append(index, record.id[:]...)
+		index = binary.BigEndian.AppendUint32(index, entries[i].block)
+		index = binary.BigEndian.AppendUint32(index, entries[i].offset)
+		index = binary.BigEndian.AppendUint32(index, entries[i].length)
+	}
+	footer := binary.BigEndian.AppendUint64(nil, offset)
+	footer = append(footer, segmentMagic...)
+	if _, err = out.Write(index); err != nil {
+		return err
+	}
+	if _, err = out.Write(footer); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// segmentReader reads the data of events from a segment file.
+type segmentReader struct {
+	file    *os.File
+	decoder *zstd.Decoder
+	blocks  []segmentBlock
+	entries map[uuid.UUID]segmentEntry
+	mu      sync.Mutex
+	cache   map[uint32][]byte
+	order   []uint32
+}
+
+// openSegment opens a segment file and reads its index.
+func openSegment(path string) (*segmentReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := readSegmentIndex(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+func readSegmentIndex(file *os.File) (*segmentReader, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	footerSize := int64(8 + len(segmentMagic))
+	if info.Size() < int64(len(segmentMagic))+footerSize {
+		return nil, errors.New("segment file too short")
+	}
+	footer := make([]byte, footerSize)
+	if _, err = file.ReadAt(footer, info.Size()-footerSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[8:], segmentMagic) {
+		return nil, errors.New("not a segment file")
+	}
+	indexOffset := int64(binary.BigEndian.Uint64(footer))
+	if indexOffset < int64(len(segmentMagic)) || indexOffset > info.Size()-footerSize {
+		return nil, errors.New("invalid segment index offset")
+	}
+	index := make([]byte, info.Size()-footerSize-indexOffset)
+	if _, err = file.ReadAt(index, indexOffset); err != nil {
+		return nil, err
+	}
+
+	next := func(n int) ([]byte, error) {
+		if len(index) < n {
+			return nil, errors.New("segment index truncated")
+		}
+		value := index[:n]
+		index = index[n:]
+		return value, nil
+	}
+	count, err := next(4)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([]segmentBlock, binary.BigEndian.Uint32(count))
+	for i := range blocks {
+		value, err := next(12)
+		if err != nil {
+			return nil, err
+		}
+		blocks[i] = segmentBlock{offset: binary.BigEndian.Uint64(value), length: binary.BigEndian.Uint32(value[8:])}
+	}
+	count, err = next(4)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[uuid.UUID]segmentEntry, binary.BigEndian.Uint32(count))
+	for i := uint32(0); i < binary.BigEndian.Uint32(count); i++ {
+		value, err := next(28)
+		if err != nil {
+			return nil, err
+		}
+		entry := segmentEntry{block: binary.BigEndian.Uint32(value[16:]), offset: binary.BigEndian.Uint32(value[20:]), length: binary.BigEndian.Uint32(value[24:])}
+		if int(entry.block) >= len(blocks) {
+			return nil, errors.New("segment index references unknown block")
+		}
+		entries[uuid.UUID(value[:16])] = entry
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentReader{file: file, decoder: decoder, blocks: blocks, entries: entries, cache: map[uint32][]byte{}}, nil
+}
+
+// read returns the data of an event. The second result is false if the segment
+// does not contain the event.
+func (r *segmentReader) read(id uuid.UUID) ([]byte, bool, error) {
+	entry, ok := r.entries[id]
+	if !ok {
+		return nil, false, nil
+	}
+	block, err := r.block(entry.block)
+	if err != nil {
+		return nil, false, err
+	}
+	end := uint64(entry.offset) + uint64(entry.length)
+	if end > uint64(len(block)) {
+		return nil, false, errors.New("segment record out of bounds")
+	}
+	data := make([]byte, entry.length)
+	copy(data, block[entry.offset:end])
+	return data, true, nil
+}
+
+// block returns a decompressed block, keeping the recently used ones.
+func (r *segmentReader) block(index uint32) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if block, ok := r.cache[index]; ok {
+		return block, nil
+	}
+	location := r.blocks[index]
+	compressed := make([]byte, location.length)
+	if _, err := r.file.ReadAt(compressed, int64(location.offset)); err != nil {
+		return nil, err
+	}
+	block, err := r.decoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.order) >= segmentBlockCache {
+		delete(r.cache, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.cache[index] = block
+	r.order = append(r.order, index)
+	return block, nil
+}
+
+func (r *segmentReader) close() error {
+	r.decoder.Close()
+	return r.file.Close()
+}
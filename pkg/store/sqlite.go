@@ -17,14 +17,36 @@ type DatabaseConnection struct {
 
 var _DBFILE = "./db_files/eventstore.db"
 
+// _DBOPTIONS enables the write-ahead log so readers do not block the writer, and
+// secure delete so removed content like destroyed subject keys is overwritten
+// instead of staying in free pages.
+var _DBOPTIONS = "?_journal_mode=WAL&_busy_timeout=5000&_secure_delete=on"
+
 func GetDbFileLocation() string {
 	return _DBFILE
 }
 
+// SetDbFileLocation changes the database file used by SetUp. It has to be called before SetUp.
+func SetDbFileLocation(path string) {
+	_DBFILE = path
+}
+
 func (d *DatabaseConnection) Teardown() error {
 	if d.db != nil {
 		d.db.Close()
 	}
+	for _, dir := range []string{GetSegmentDirectory(), GetSegmentDirectory() + preRestoreSuffix} {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+	}
+	for _, suffix := range []string{"-wal", "-shm", preRestoreSuffix, preRestoreSuffix + "-wal", preRestoreSuffix + "-shm"} {
+		err := os.Remove(_DBFILE + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return os.Remove(_DBFILE)
 }
 
@@ -37,7 +59,7 @@ func (d *DatabaseConnection) SetUp() {
 			return
 		}
 	}
-	db, err := sql.Open("sqlite3", _DBFILE)
+	db, err := sql.Open("sqlite3", _DBFILE+_DBOPTIONS)
 	if err != nil {
 
 		log.Info().Err(err).Msg("Opening sqlite connection")
@@ -46,18 +68,107 @@ func (d *DatabaseConnection) SetUp() {
 	if createEventTable(db) != nil {
 		return
 	}
+	if migrateLegacyAggregateState(db) != nil {
+		return
+	}
+	if addColumnIfMissing(db, "events", "tags", "TEXT") != nil {
+		return
+	}
+	if addColumnIfMissing(db, "events", "schemaVersion", "INTEGER NOT NULL DEFAULT 0") != nil {
+		return
+	}
+	if addColumnIfMissing(db, "events", "contentType", "TEXT NOT NULL DEFAULT ''") != nil {
+		return
+	}
+	if addColumnIfMissing(db, "events", "subject", "TEXT NOT NULL DEFAULT ''") != nil {
+		return
+	}
+	if addColumnIfMissing(db, "events", "dataKey", "INTEGER NOT NULL DEFAULT 0") != nil {
+		return
+	}
+	if addColumnIfMissing(db, "events", "codec", "TEXT NOT NULL DEFAULT ''") != nil {
+		return
+	}
+	if addColumnIfMissing(db, "events", "dictionary", "INTEGER NOT NULL DEFAULT 0") != nil {
+		return
+	}
+	if addColumnIfMissing(db, "events", "segment", "INTEGER NOT NULL DEFAULT 0") != nil {
+		return
+	}
+	for _, column := range []string{"hash", "prevHash", "dataHash"} {
+		if addColumnIfMissing(db, "events", column, "BLOB") != nil {
+			return
+		}
+	}
+	if addColumnIfMissing(db, "events", "signingKeyId", "TEXT NOT NULL DEFAULT ''") != nil {
+		return
+	}
+	if addColumnIfMissing(db, "events", "signature", "BLOB") != nil {
+		return
+	}
+	if addColumnIfMissing(db, "events", "appendId", "INTEGER NOT NULL DEFAULT 0") != nil {
+		return
+	}
 	if createEventTableIndex(db) != nil {
 		return
 	}
+	if createEventTableTypeIndex(db) != nil {
+		return
+	}
 	if createAggregateStateTable(db) != nil {
 		return
 	}
-	if createAggregateTableIdIndex(db) != nil {
+	if addColumnIfMissing(db, "aggregate_state", "deleted", "TEXT NOT NULL DEFAULT ''") != nil {
+		return
+	}
+	if addColumnIfMissing(db, "aggregate_state", "hash", "BLOB") != nil {
+		return
+	}
+	if addColumnIfMissing(db, "aggregate_state", "truncatedHash", "BLOB") != nil {
 		return
 	}
 	if createAggregateTableTypeIndex(db) != nil {
 		return
 	}
+	if createEventTagTable(db) != nil {
+		return
+	}
+	if createRemovedEventTable(db) != nil {
+		return
+	}
+	if migrateUnversionedSchemas(db) != nil {
+		return
+	}
+	if createEventSchemaTable(db) != nil {
+		return
+	}
+	if createSubjectKeyTable(db) != nil {
+		return
+	}
+	if createDataKeyTable(db) != nil {
+		return
+	}
+	if createCompressionDictionaryTable(db) != nil {
+		return
+	}
+	if addColumnIfMissing(db, "compression_dictionaries", "dataKey", "INTEGER NOT NULL DEFAULT 0") != nil {
+		return
+	}
+	if createRetentionPolicyTable(db) != nil {
+		return
+	}
+	if createSegmentTable(db) != nil {
+		return
+	}
+	if createProducerKeyTable(db) != nil {
+		return
+	}
+	if createAPIKeyTable(db) != nil {
+		return
+	}
+	if createAccessRuleTable(db) != nil {
+		return
+	}
 	d.db = db
 	d.initialized = true
 }
@@ -66,9 +177,14 @@ func (d *DatabaseConnection) IsInitialized() bool {
 	return d.initialized
 }
 
+// preparer is implemented by *sql.DB and *sql.Tx.
+type preparer interface {
+	Prepare(query string) (*sql.Stmt, error)
+}
+
 func createEventTable(db *sql.DB) error {
 	//name = name of the event
-	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS events (id TEXT PRIMARY KEY, aggregateId TEXT, timestamp_0 INTEGER,timestamp_1 INTEGER,Name TEXT, version_0 INTEGER,version_1 INTEGER,data BLOB,UNIQUE(aggregateId,version_0, version_1) ON CONFLICT FAIL)")
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS events (id TEXT PRIMARY KEY, aggregateId TEXT, aggregateType TEXT, timestamp_0 INTEGER,timestamp_1 INTEGER,Name TEXT, version_0 INTEGER,version_1 INTEGER,data BLOB,tags TEXT,schemaVersion INTEGER NOT NULL DEFAULT 0,contentType TEXT NOT NULL DEFAULT '',subject TEXT NOT NULL DEFAULT '',dataKey INTEGER NOT NULL DEFAULT 0,codec TEXT NOT NULL DEFAULT '',dictionary INTEGER NOT NULL DEFAULT 0,segment INTEGER NOT NULL DEFAULT 0,hash BLOB,prevHash BLOB,dataHash BLOB,signingKeyId TEXT NOT NULL DEFAULT '',signature BLOB,appendId INTEGER NOT NULL DEFAULT 0,UNIQUE(aggregateId,version_0, version_1) ON CONFLICT FAIL)")
 	if err != nil {
 
 		log.Info().Err(err).Msg("Preparing statement for events table")
@@ -100,9 +216,26 @@ func createEventTableIndex(db *sql.DB) error {
 	return nil
 }
 
-func createAggregateStateTable(db *sql.DB) error {
-	//type = name of the aggregate
-	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS aggregate_state (id TEXT,type TEXT,version_0 INTEGER,version_1 INTEGER,UNIQUE(id,version_0, version_1) ON CONFLICT FAIL )")
+func createEventTableTypeIndex(db *sql.DB) error {
+
+	stmt, err := db.Prepare("CREATE INDEX IF NOT EXISTS IX_event__aggregateType ON events(aggregateType)")
+	if err != nil {
+
+		log.Info().Err(err).Msg("Preparing statement for events table")
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+
+		log.Info().Err(err).Msg("Creating index on events table")
+		return err
+	}
+	return nil
+}
+
+func createAggregateStateTable(db preparer) error {
+	//one row per aggregate: type = name of the aggregate, version = current (highest) version
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS aggregate_state (id TEXT PRIMARY KEY,type TEXT,version_0 INTEGER,version_1 INTEGER,event_count INTEGER,created_0 INTEGER,created_1 INTEGER,updated_0 INTEGER,updated_1 INTEGER,deleted TEXT NOT NULL DEFAULT '',hash BLOB,truncatedHash BLOB)")
 	if err != nil {
 
 		log.Info().Err(err).Msg("Preparing statement for aggregate_state table")
@@ -117,9 +250,9 @@ func createAggregateStateTable(db *sql.DB) error {
 	return nil
 }
 
-func createAggregateTableIdIndex(db *sql.DB) error {
+func createAggregateTableTypeIndex(db *sql.DB) error {
 
-	stmt, err := db.Prepare("CREATE INDEX IF NOT EXISTS IX_aggregate_state__id ON aggregate_state(id);")
+	stmt, err := db.Prepare("CREATE INDEX IF NOT EXISTS IX_aggregate_state__type ON aggregate_state(type);")
 	if err != nil {
 
 		log.Info().Err(err).Msg("Preparing statement for aggregate_state table")
@@ -133,18 +266,189 @@ func createAggregateTableIdIndex(db *sql.DB) error {
 	}
 	return nil
 }
-func createAggregateTableTypeIndex(db *sql.DB) error {
 
-	stmt, err := db.Prepare("CREATE INDEX IF NOT EXISTS IX_aggregate_state__typr ON aggregate_state(type);")
+func createEventTagTable(db *sql.DB) error {
+	//one row per tag of an event, keyed by tag to find tagged events quickly
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS event_tags (tag TEXT, eventId TEXT, PRIMARY KEY(tag, eventId)) WITHOUT ROWID")
 	if err != nil {
 
-		log.Info().Err(err).Msg("Preparing statement for aggregate_state table")
+		log.Info().Err(err).Msg("Preparing statement for event_tags table")
 		return err
 	}
 	_, err = stmt.Exec()
 	if err != nil {
 
-		log.Info().Err(err).Msg("Creating index on aggregate_state table")
+		log.Info().Err(err).Msg("Creating event_tags table")
+		return err
+	}
+	return nil
+}
+
+func createRemovedEventTable(db *sql.DB) error {
+	//position of events removed by retention or hard deletion, so they stay usable as feed cursors
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS removed_events (id TEXT PRIMARY KEY, timestamp_0 INTEGER, timestamp_1 INTEGER) WITHOUT ROWID")
+	if err != nil {
+
+		log.Info().Err(err).Msg("Preparing statement for removed_events table")
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+
+		log.Info().Err(err).Msg("Creating removed_events table")
+		return err
+	}
+	return nil
+}
+
+func createEventSchemaTable(db preparer) error {
+	//schema = JSON Schema for the data of events with this aggregate type, name and schema version
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS event_schemas (aggregateType TEXT, name TEXT, version INTEGER NOT NULL DEFAULT 1, schema TEXT, PRIMARY KEY(aggregateType, name, version))")
+	if err != nil {
+
+		log.Info().Err(err).Msg("Preparing statement for event_schemas table")
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+
+		log.Info().Err(err).Msg("Creating event_schemas table")
+		return err
+	}
+	return nil
+}
+
+func createSubjectKeyTable(db *sql.DB) error {
+	//key = data encryption key of the subject, NULL once destroyed
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS subject_keys (subject TEXT PRIMARY KEY, key BLOB, destroyed INTEGER NOT NULL DEFAULT 0)")
+	if err != nil {
+
+		log.Info().Err(err).Msg("Preparing statement for subject_keys table")
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+
+		log.Info().Err(err).Msg("Creating subject_keys table")
+		return err
+	}
+	return nil
+}
+
+func createDataKeyTable(db *sql.DB) error {
+	//key = data key wrapped with the master key identified by masterKey
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS data_keys (id INTEGER PRIMARY KEY AUTOINCREMENT, key BLOB NOT NULL, masterKey TEXT NOT NULL, active INTEGER NOT NULL DEFAULT 0)")
+	if err != nil {
+
+		log.Info().Err(err).Msg("Preparing statement for data_keys table")
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+
+		log.Info().Err(err).Msg("Creating data_keys table")
+		return err
+	}
+	return nil
+}
+
+func createCompressionDictionaryTable(db *sql.DB) error {
+	//dictionary = zstd dictionary, only the active one of an aggregate type is used for new events
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS compression_dictionaries (id INTEGER PRIMARY KEY AUTOINCREMENT, aggregateType TEXT NOT NULL, dictionary BLOB NOT NULL, active INTEGER NOT NULL DEFAULT 0, dataKey INTEGER NOT NULL DEFAULT 0)")
+	if err != nil {
+
+		log.Info().Err(err).Msg("Preparing statement for compression_dictionaries table")
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+
+		log.Info().Err(err).Msg("Creating compression_dictionaries table")
+		return err
+	}
+	return nil
+}
+
+func createRetentionPolicyTable(db *sql.DB) error {
+	//truncateBefore = version before which the events of the aggregates of the type are removed, 0 if unused
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS retention_policies (aggregateType TEXT PRIMARY KEY, maxAgeSeconds INTEGER NOT NULL DEFAULT 0, maxCount INTEGER NOT NULL DEFAULT 0, truncateBefore_0 INTEGER NOT NULL DEFAULT 0, truncateBefore_1 INTEGER NOT NULL DEFAULT 0)")
+	if err != nil {
+
+		log.Info().Err(err).Msg("Preparing statement for retention_policies table")
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+
+		log.Info().Err(err).Msg("Creating retention_policies table")
+		return err
+	}
+	return nil
+}
+
+func createSegmentTable(db *sql.DB) error {
+	//file = name of the segment file in the segment directory
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS segments (id INTEGER PRIMARY KEY AUTOINCREMENT, file TEXT NOT NULL, eventCount INTEGER NOT NULL, first_0 INTEGER, first_1 INTEGER, last_0 INTEGER, last_1 INTEGER)")
+	if err != nil {
+
+		log.Info().Err(err).Msg("Preparing statement for segments table")
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+
+		log.Info().Err(err).Msg("Creating segments table")
+		return err
+	}
+	return nil
+}
+
+func createProducerKeyTable(db *sql.DB) error {
+	//registeredAt, revokedAt = unix microseconds, revokedAt 0 while the key is in use
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS producer_keys (id TEXT PRIMARY KEY, producer TEXT NOT NULL DEFAULT '', publicKey BLOB NOT NULL, registeredAt INTEGER NOT NULL, revokedAt INTEGER NOT NULL DEFAULT 0)")
+	if err != nil {
+
+		log.Info().Err(err).Msg("Preparing statement for producer_keys table")
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+
+		log.Info().Err(err).Msg("Creating producer_keys table")
+		return err
+	}
+	return nil
+}
+
+func createAPIKeyTable(db *sql.DB) error {
+	//secretHash = sha256 of the secret, roles = JSON array
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS api_keys (id TEXT PRIMARY KEY, subject TEXT NOT NULL, roles TEXT, secretHash BLOB NOT NULL, createdAt INTEGER NOT NULL, revokedAt INTEGER NOT NULL DEFAULT 0)")
+	if err != nil {
+
+		log.Info().Err(err).Msg("Preparing statement for api_keys table")
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+
+		log.Info().Err(err).Msg("Creating api_keys table")
+		return err
+	}
+	return nil
+}
+
+func createAccessRuleTable(db *sql.DB) error {
+	//operations = JSON array, empty aggregateType / aggregateIdPrefix match every aggregate
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS access_rules (id TEXT PRIMARY KEY, role TEXT NOT NULL, aggregateType TEXT NOT NULL DEFAULT '', aggregateIdPrefix TEXT NOT NULL DEFAULT '', operations TEXT NOT NULL)")
+	if err != nil {
+
+		log.Info().Err(err).Msg("Preparing statement for access_rules table")
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+
+		log.Info().Err(err).Msg("Creating access_rules table")
 		return err
 	}
 	return nil
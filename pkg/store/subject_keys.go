@@ -0,0 +1,165 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"sync"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// subjectKey is the data encryption key of a subject. A destroyed key has no aead.
+type subjectKey struct {
+	key       []byte
+	aead      cipher.AEAD
+	destroyed bool
+}
+
+// subjectKeys encrypts the data of events with a key per subject (crypto-shredding).
+// Destroying the key of a subject makes the data of its events unreadable.
+type subjectKeys struct {
+	store *sql.DB
+	mu    sync.Mutex
+	keys  map[string]*subjectKey
+}
+
+func newSubjectKeys(db *sql.DB) *subjectKeys {
+	return &subjectKeys{
+		store: db,
+		keys:  map[string]*subjectKey{},
+	}
+}
+
+// seal encrypts data of an event with the key of its subject, creating the key
+// on first use. The nonce is derived from the key, the event id and the data, so
+// a replayed event is encrypted to the same bytes.
+func (s *subjectKeys) seal(subject string, eventId uuid.UUID, data []byte) ([]byte, error) {
+	key, err := s.get(subject, true)
+	if err != nil {
+		return nil, err
+	}
+	if key.destroyed {
+		return nil, &customerrors.SubjectKeyDestroyedError{Subject: subject}
+	}
+	mac := hmac.New(sha256.New, key.key)
+	mac.Write(eventId[:])
+	mac.Write(data)
+	nonce := mac.Sum(nil)[:key.aead.NonceSize()]
+	return key.aead.Seal(nonce, nonce, data, []byte(subject)), nil
+}
+
+// digestLabel separates the key of the digests from the key sealing the data.
+var digestLabel = []byte("evtsrc data digest")
+
+// digest returns the digest of data of an event of a subject, keyed with the key
+// of the subject. Once the key is destroyed, the digest cannot be used to confirm
+// a guessed plaintext; nil is returned then.
+func (s *subjectKeys) digest(subject string, data []byte) ([]byte, error) {
+	key, err := s.get(subject, false)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil || key.destroyed {
+		return nil, nil
+	}
+	derive := hmac.New(sha256.New, key.key)
+	derive.Write(digestLabel)
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// open decrypts data sealed with the key of a subject. Nil is returned if the
+// key was destroyed.
+func (s *subjectKeys) open(subject string, data []byte) ([]byte, error) {
+	key, err := s.get(subject, false)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil || key.destroyed {
+		return nil, nil
+	}
+	nonceSize := key.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("could not decrypt event")
+	}
+	plain, err := key.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(subject))
+	if err != nil {
+		log.Info().Err(err).Msg("Error decrypting event data")
+		return nil, errors.New("could not decrypt event")
+	}
+	return plain, nil
+}
+
+// get returns the key of a subject from the cache or the subject_keys table.
+// With create, a missing key is generated; otherwise nil is returned for it.
+func (s *subjectKeys) get(subject string, create bool) (*subjectKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.keys[subject]; ok {
+		return key, nil
+	}
+	if create {
+		generated := make([]byte, 32)
+		if _, err := rand.Read(generated); err != nil {
+			return nil, err
+		}
+		_, err := s.store.Exec("INSERT OR IGNORE INTO subject_keys (subject, key) VALUES (?,?)", subject, generated)
+		if err != nil {
+			log.Info().Err(err).Msg("Error storing subject key")
+			return nil, errors.New("could not store subject key")
+		}
+	}
+	var stored []byte
+	var destroyed bool
+	err := s.store.QueryRow("SELECT key, destroyed FROM subject_keys WHERE subject = ?", subject).Scan(&stored, &destroyed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Info().Err(err).Msg("Error querying subject key")
+		return nil, errors.New("could not query subject key")
+	}
+	key := &subjectKey{key: stored, destroyed: destroyed}
+	if !destroyed {
+		block, err := aes.NewCipher(stored)
+		if err != nil {
+			return nil, err
+		}
+		key.aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.keys[subject] = key
+	return key, nil
+}
+
+// destroy removes the key of a subject. The write-ahead log is checkpointed
+// afterwards, so the key does not outlive the update in it. It returns a
+// SubjectNotFoundError if the subject has no key.
+func (s *subjectKeys) destroy(subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, err := s.store.Exec("UPDATE subject_keys SET key = NULL, destroyed = 1 WHERE subject = ?", subject)
+	if err != nil {
+		log.Info().Err(err).Msg("Error destroying subject key")
+		return errors.New("could not destroy subject key")
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return &customerrors.SubjectNotFoundError{}
+	}
+	s.keys[subject] = &subjectKey{destroyed: true}
+	// a failed checkpoint is repeated by the next one, the key is destroyed either way
+	if _, err = s.store.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		log.Info().Err(err).Msg("Error checkpointing after destroying subject key")
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package store_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/models/customerrors"
+	"github.com/L4B0MB4/EVTSRC/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubjectDataIsEncryptedAtRest(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	event := models.Event{Id: "5b0e7a4c-3f7e-4c2a-9d51-2f1a8c6e0b17", Version: 1, Name: "registered", Data: []byte("alice@example.com"), AggregateId: "user1", AggregateType: "user", Subject: "alice"}
+	assert.NoError(t, r.AddEvents([]models.Event{event}))
+	// replaying the same event is still recognized as a replay
+	assert.NoError(t, r.AddEvents([]models.Event{event}))
+
+	var raw []byte
+	err = conn.QueryRow("SELECT data FROM events WHERE aggregateId = ?", "user1").Scan(&raw)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(raw), "alice@example.com")
+
+	events, err := r.GetEventsForAggregate("user1")
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, []byte("alice@example.com"), events[0].Data)
+	assert.Equal(t, "alice", events[0].Subject)
+}
+
+func TestDestroySubjectKeyShredsData(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+
+	err = r.AddEvents([]models.Event{
+		{Version: 1, Name: "registered", Data: []byte("alice"), AggregateId: "user2", AggregateType: "user", Subject: "alice"},
+		{Version: 2, Name: "renamed", Data: []byte("public"), AggregateId: "user2", AggregateType: "user"},
+	})
+	assert.NoError(t, err)
+
+	assert.IsType(t, &customerrors.SubjectNotFoundError{}, r.DestroySubjectKey("bob"))
+	assert.NoError(t, r.DestroySubjectKey("alice"))
+
+	events, err := r.GetEventsForAggregate("user2")
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Nil(t, events[0].Data)
+	assert.Equal(t, []byte("public"), events[1].Data)
+
+	err = r.AddEvents([]models.Event{{Version: 3, Name: "renamed", Data: []byte("again"), AggregateId: "user2", AggregateType: "user", Subject: "alice"}})
+	assert.IsType(t, &customerrors.SubjectKeyDestroyedError{}, err)
+}
+
+func TestDestroySubjectKeyLeavesNoKeyOnDisk(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	conn, err := db.GetDbConnection()
+	assert.NoError(t, err)
+	r := store.NewEventRepository(conn)
+	assert.NoError(t, r.AddEvents([]models.Event{{Version: 1, Name: "registered", Data: []byte("carol"), AggregateId: "user3", AggregateType: "user", Subject: "carol"}}))
+	var key []byte
+	assert.NoError(t, conn.QueryRow("SELECT key FROM subject_keys WHERE subject = ?", "carol").Scan(&key))
+	assert.NotEmpty(t, key)
+
+	assert.NoError(t, r.DestroySubjectKey("carol"))
+
+	for _, file := range []string{store.GetDbFileLocation(), store.GetDbFileLocation() + "-wal"} {
+		content, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		assert.NoError(t, err)
+		assert.False(t, bytes.Contains(content, key), file)
+	}
+}
@@ -0,0 +1,92 @@
+// Package upcaster brings event data written with older schema versions to the
+// latest version when events are read. Upcasting happens in clients only, see
+// EventSourcingHttpClient.Upcasters; the server returns events as stored.
+package upcaster
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+)
+
+// Upcaster transforms the data of an event from one schema version to the next.
+type Upcaster func(data []byte) ([]byte, error)
+
+type upcasterKey struct {
+	name    string
+	version int
+}
+
+// Registry holds upcasters keyed by event name and the schema version they
+// upgrade from. Events without a schema version are treated as version 1.
+type Registry struct {
+	mu        sync.RWMutex
+	upcasters map[upcasterKey]Upcaster
+}
+
+// NewRegistry creates a new empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		upcasters: map[upcasterKey]Upcaster{},
+	}
+}
+
+// Register adds the upcaster that turns data of the named event from
+// fromVersion into fromVersion+1, replacing an existing one.
+func (r *Registry) Register(name string, fromVersion int, upcaster Upcaster) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.upcasters[upcasterKey{name, fromVersion}] = upcaster
+}
+
+// LatestVersion returns the schema version events with the given name are upcast to.
+func (r *Registry) LatestVersion(name string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	version := 1
+	for {
+		if _, ok := r.upcasters[upcasterKey{name, version}]; !ok {
+			return version
+		}
+		version++
+	}
+}
+
+// Upcast applies upcasters to the event until no upcaster for its name and
+// current schema version is registered.
+func (r *Registry) Upcast(event *models.Event) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.upcasters) == 0 {
+		return nil
+	}
+	version := event.SchemaVersion
+	if version < 1 {
+		version = 1
+	}
+	for {
+		upcaster, ok := r.upcasters[upcasterKey{event.Name, version}]
+		if !ok {
+			return nil
+		}
+		data, err := upcaster(event.Data)
+		if err != nil {
+			return fmt.Errorf("upcasting event %s from schema version %d: %w", event.Id, version, err)
+		}
+		version++
+		event.Data = data
+		event.SchemaVersion = version
+	}
+}
+
+// UpcastAll upcasts every event of the list in place.
+func (r *Registry) UpcastAll(events []models.Event) error {
+	for i := range events {
+		err := r.Upcast(&events[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
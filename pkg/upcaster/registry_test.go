@@ -0,0 +1,48 @@
+package upcaster_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/L4B0MB4/EVTSRC/pkg/models"
+	"github.com/L4B0MB4/EVTSRC/pkg/upcaster"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpcastAppliesChain(t *testing.T) {
+	r := upcaster.NewRegistry()
+	r.Register("renamed", 1, func(data []byte) ([]byte, error) {
+		return append(data, '2'), nil
+	})
+	r.Register("renamed", 2, func(data []byte) ([]byte, error) {
+		return append(data, '3'), nil
+	})
+	assert.Equal(t, 3, r.LatestVersion("renamed"))
+	assert.Equal(t, 1, r.LatestVersion("other"))
+
+	events := []models.Event{
+		{Name: "renamed", Data: []byte("1")},
+		{Name: "renamed", Data: []byte("2"), SchemaVersion: 2},
+		{Name: "renamed", Data: []byte("3"), SchemaVersion: 3},
+		{Name: "other", Data: []byte("x")},
+	}
+	err := r.UpcastAll(events)
+	assert.NoError(t, err)
+	assert.Equal(t, "123", string(events[0].Data))
+	assert.Equal(t, 3, events[0].SchemaVersion)
+	assert.Equal(t, "23", string(events[1].Data))
+	assert.Equal(t, "3", string(events[2].Data))
+	assert.Equal(t, "x", string(events[3].Data))
+	assert.Equal(t, 0, events[3].SchemaVersion)
+}
+
+func TestUpcastReturnsUpcasterError(t *testing.T) {
+	r := upcaster.NewRegistry()
+	r.Register("broken", 1, func(data []byte) ([]byte, error) {
+		return nil, errors.New("cannot parse")
+	})
+	event := models.Event{Name: "broken", Data: []byte("1")}
+	err := r.Upcast(&event)
+	assert.Error(t, err)
+	assert.Equal(t, "1", string(event.Data))
+}